@@ -0,0 +1,104 @@
+// bftverify checks an archived bftcosi signature without a running conode:
+//
+//	bftverify -roster group.toml -msg block.bin -sig block.sig
+//
+// The signature file holds the binary or the JSON encoding of a BFTSignature,
+// see BFTSignature.Encode and BFTSignature.EncodeJSON. The roster file is the
+// group TOML of the conodes that made the signature, in the order of the
+// roster of the round.
+//
+// The count of cosigners is an upper bound: a cosigner can except itself and
+// make a valid signature alone, so the signature only proves that the
+// cosigners not excepted signed if at least one of them is honest.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"bls-ftcosi/bftcosi/protocol"
+
+	"github.com/dedis/cothority"
+	"github.com/dedis/onet"
+	"github.com/dedis/onet/app"
+)
+
+func main() {
+	rosterFile := flag.String("roster", "group.toml", "group TOML of the roster that signed")
+	msgFile := flag.String("msg", "", "file with the signed message")
+	sigFile := flag.String("sig", "", "file with the binary or JSON signature")
+	flag.Parse()
+	if *msgFile == "" || *sigFile == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := verify(*rosterFile, *msgFile, *sigFile); err != nil {
+		fmt.Fprintln(os.Stderr, "invalid signature:", err)
+		os.Exit(1)
+	}
+}
+
+// verify checks the signature of the message against the roster, and prints
+// the cosigners that are exceptions of the signature.
+func verify(rosterFile, msgFile, sigFile string) error {
+	roster, err := readRoster(rosterFile)
+	if err != nil {
+		return err
+	}
+	msg, err := ioutil.ReadFile(msgFile)
+	if err != nil {
+		return err
+	}
+	sig, err := readSignature(sigFile)
+	if err != nil {
+		return err
+	}
+	if sig.Msg != nil && !bytes.Equal(sig.Msg, msg) {
+		return errors.New("the signature is on another message")
+	}
+	sig.Msg = msg
+
+	if err := sig.Verify(cothority.Suite, roster.Publics()); err != nil {
+		return err
+	}
+	fmt.Printf("valid signature by at most %d of %d cosigners, "+
+		"proven if at least one of them is honest\n",
+		len(roster.List)-len(sig.Exceptions), len(roster.List))
+	for _, ex := range sig.Exceptions {
+		fmt.Printf("excepted: %d %s\n", ex.Index, roster.List[ex.Index])
+	}
+	return nil
+}
+
+func readRoster(file string) (*onet.Roster, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	group, err := app.ReadGroupDescToml(f)
+	if err != nil {
+		return nil, err
+	}
+	if group.Roster == nil || len(group.Roster.List) == 0 {
+		return nil, errors.New("empty roster in " + file)
+	}
+	return group.Roster, nil
+}
+
+// readSignature decodes the signature of the file, in JSON if it starts like
+// a JSON object, in binary otherwise.
+func readSignature(file string) (*protocol.BFTSignature, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if trimmed := bytes.TrimSpace(buf); len(trimmed) > 0 && trimmed[0] == '{' {
+		return protocol.DecodeBFTSignatureJSON(cothority.Suite, trimmed)
+	}
+	return protocol.DecodeBFTSignature(cothority.Suite, buf)
+}
@@ -46,25 +46,32 @@ import (
 	"errors"
 	"fmt"
 
-	"gopkg.in/dedis/crypto.v0/abstract"
-	"gopkg.in/dedis/crypto.v0/random"
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/sign/schnorr"
 )
 
+// Suite is the cryptographic suite CoSi works with: a group to sign with, and
+// a source of randomness for the commitments.
+type Suite interface {
+	kyber.Group
+	kyber.Random
+}
+
 // Commit returns a random scalar v, generated from the given cipher stream,
 // and a corresponding commitment V = [v]G. If the given cipher stream is nil,
-// a random stream is used.
-func Commit(suite abstract.Suite, s cipher.Stream) (abstract.Scalar, abstract.Point) {
+// the random stream of the suite is used.
+func Commit(suite Suite, s cipher.Stream) (kyber.Scalar, kyber.Point) {
 	if s == nil {
-		s = random.Stream
+		s = suite.RandomStream()
 	}
 	random := suite.Scalar().Pick(s)
-	commitment := suite.Point().Mul(nil, random)
+	commitment := suite.Point().Mul(random, nil)
 	return random, commitment
 }
 
 // AggregateCommitments returns the sum of the given commitments and the
 // bitwise OR of the corresponding masks.
-func AggregateCommitments(suite abstract.Suite, commitments []abstract.Point, masks [][]byte) (abstract.Point, []byte, error) {
+func AggregateCommitments(suite Suite, commitments []kyber.Point, masks [][]byte) (kyber.Point, []byte, error) {
 	if len(commitments) != len(masks) {
 		return nil, nil, errors.New("mismatching lengths of commitment and mask slices")
 	}
@@ -84,7 +91,7 @@ func AggregateCommitments(suite abstract.Suite, commitments []abstract.Point, ma
 // Challenge creates the collective challenge from the given aggregate
 // commitment V, aggregate public key A, and message M, i.e., it returns
 // c = H(V || A || M).
-func Challenge(suite abstract.Suite, commitment, public abstract.Point, message []byte) (abstract.Scalar, error) {
+func Challenge(suite Suite, commitment, public kyber.Point, message []byte) (kyber.Scalar, error) {
 	if commitment == nil {
 		return nil, errors.New("no commitment provided")
 	}
@@ -104,7 +111,7 @@ func Challenge(suite abstract.Suite, commitment, public abstract.Point, message
 
 // Response creates the response from the given random scalar v, (collective)
 // challenge c, and private key a, i.e., it returns r = v + c*a.
-func Response(suite abstract.Suite, private, random, challenge abstract.Scalar) (abstract.Scalar, error) {
+func Response(suite Suite, private, random, challenge kyber.Scalar) (kyber.Scalar, error) {
 	if private == nil {
 		return nil, errors.New("no private key provided")
 	}
@@ -119,7 +126,7 @@ func Response(suite abstract.Suite, private, random, challenge abstract.Scalar)
 }
 
 // AggregateResponses returns the sum of given responses.
-func AggregateResponses(suite abstract.Suite, responses []abstract.Scalar) (abstract.Scalar, error) {
+func AggregateResponses(suite Suite, responses []kyber.Scalar) (kyber.Scalar, error) {
 	if responses == nil {
 		return nil, errors.New("no responses provided")
 	}
@@ -133,7 +140,7 @@ func AggregateResponses(suite abstract.Suite, responses []abstract.Scalar) (abst
 // Sign returns the collective signature from the given (aggregate) commitment
 // V, (aggregate) response r, and participation bitmask Z using the EdDSA
 // format, i.e., the signature is V || r || Z.
-func Sign(suite abstract.Suite, commitment abstract.Point, response abstract.Scalar, mask *Mask) ([]byte, error) {
+func Sign(suite Suite, commitment kyber.Point, response kyber.Scalar, mask *Mask) ([]byte, error) {
 	if commitment == nil {
 		return nil, errors.New("no commitment provided")
 	}
@@ -162,7 +169,7 @@ func Sign(suite abstract.Suite, commitment abstract.Point, response abstract.Sca
 
 // Verify checks the given cosignature on the provided message using the list
 // of public keys and cosigning policy.
-func Verify(suite abstract.Suite, publics []abstract.Point, message, sig []byte, policy Policy) error {
+func Verify(suite Suite, publics []kyber.Point, message, sig []byte, policy Policy) error {
 	if publics == nil {
 		return errors.New("no public keys provided")
 	}
@@ -176,55 +183,175 @@ func Verify(suite abstract.Suite, publics []abstract.Point, message, sig []byte,
 		policy = CompletePolicy{}
 	}
 
-	lenCom := suite.PointLen()
-	VBuff := sig[:lenCom]
-	V := suite.Point()
-	if err := V.UnmarshalBinary(VBuff); err != nil {
-		return errors.New("unmarshalling of commitment failed")
+	V, r, err := unpack(suite, sig)
+	if err != nil {
+		return err
 	}
 
-	// Unpack the aggregate response
-	lenRes := lenCom + suite.ScalarLen()
-	rBuff := sig[lenCom:lenRes]
-	r := suite.Scalar().SetBytes(rBuff)
-
 	// Unpack the participation mask and get the aggregate public key
 	mask, err := NewMask(suite, publics, nil)
 	if err != nil {
 		return err
 	}
-	mask.SetMask(sig[lenRes:])
+	lenRes := suite.PointLen() + suite.ScalarLen()
+	if err := mask.SetMask(sig[lenRes:]); err != nil {
+		return err
+	}
 	A := mask.AggregatePublic
-	ABuff, err := A.MarshalBinary()
+	if err := verify(suite, V, r, A, A, suite.Point().Null(), message); err != nil {
+		return err
+	}
+	if !policy.Check(mask) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// Exception is a cosigner that sent a commitment but no response, as
+// reported by the bftcosi protocol. Its commitment stays in the aggregate
+// commitment V of the signature. Sig is the signature of the cosigner on
+// CommitmentPayload(Commitment), nil for a null commitment.
+type Exception struct {
+	Index      int
+	Commitment kyber.Point
+	Sig        []byte
+}
+
+// CommitmentPayload returns what a cosigner signs along with its commitment,
+// so that its commitment can be taken out of a signature as an exception. It
+// can't hold the message, which the cosigners only learn with the challenge.
+func CommitmentPayload(commitment kyber.Point) ([]byte, error) {
+	h := sha512.New()
+	h.Write([]byte("commitment"))
+	if _, err := commitment.MarshalTo(h); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// VerifyWithExceptions checks a signature where the challenge was computed
+// over the aggregate public key of all cosigners, but the given exceptions
+// did not contribute a response, i.e., the format of the signatures produced
+// by ProtocolBFTCoSi. The trailing participation mask of the signature is
+// ignored; the policy is checked against a mask where every cosigner except
+// the exceptions is enabled.
+//
+// The challenge doesn't bind the commitments of the exceptions, so each one
+// must be signed by its cosigner. A cosigner can still except itself with a
+// commitment of its choosing and make the signature alone: the policy only
+// holds if at least one of the cosigners not excepted is honest.
+func VerifyWithExceptions(suite Suite, publics []kyber.Point, message, sig []byte, exceptions []Exception, policy Policy) error {
+	if publics == nil {
+		return errors.New("no public keys provided")
+	}
+	if message == nil {
+		return errors.New("no message provided")
+	}
+	if sig == nil {
+		return errors.New("no signature provided")
+	}
+	if policy == nil {
+		policy = CompletePolicy{}
+	}
+
+	V, r, err := unpack(suite, sig)
 	if err != nil {
-		return errors.New("marshalling of aggregate public key failed")
+		return err
 	}
 
-	// Recompute the challenge
-	hash := sha512.New()
-	hash.Write(VBuff)
-	hash.Write(ABuff)
-	hash.Write(message)
-	buff := hash.Sum(nil)
-	k := suite.Scalar().SetBytes(buff)
+	mask, err := NewMask(suite, publics, nil)
+	if err != nil {
+		return err
+	}
+	for i := range publics {
+		mask.SetBit(i, true)
+	}
+	A := mask.AggregatePublic.Clone()
+
+	// The exceptions committed, so V contains their commitments, but they
+	// did not respond, so r lacks their share: remove both sides.
+	exCommit := suite.Point().Null()
+	for _, ex := range exceptions {
+		if ex.Index < 0 || ex.Index >= len(publics) || ex.Commitment == nil {
+			return errors.New("invalid exception")
+		}
+		if enabled, _ := mask.IndexEnabled(ex.Index); !enabled {
+			return errors.New("duplicate exception")
+		}
+		if err := verifyException(suite, publics[ex.Index], ex); err != nil {
+			return fmt.Errorf("exception %d: %s", ex.Index, err)
+		}
+		mask.SetBit(ex.Index, false)
+		exCommit.Add(exCommit, ex.Commitment)
+	}
+	if err := verify(suite, V, r, A, mask.AggregatePublic, exCommit, message); err != nil {
+		return err
+	}
+	if !policy.Check(mask) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// verifyException returns an error unless the commitment of the exception is
+// null or signed by the given public key.
+func verifyException(suite Suite, public kyber.Point, ex Exception) error {
+	if ex.Commitment.Equal(suite.Point().Null()) {
+		return nil
+	}
+	if ex.Sig == nil {
+		return errors.New("unsigned commitment")
+	}
+	msg, err := CommitmentPayload(ex.Commitment)
+	if err != nil {
+		return err
+	}
+	return schnorr.Verify(suite, public, msg, ex.Sig)
+}
+
+// unpack returns the aggregate commitment V and the aggregate response r of
+// the given signature.
+func unpack(suite Suite, sig []byte) (kyber.Point, kyber.Scalar, error) {
+	lenCom := suite.PointLen()
+	lenRes := lenCom + suite.ScalarLen()
+	if len(sig) < lenRes {
+		return nil, nil, errors.New("signature too short")
+	}
+	V := suite.Point()
+	if err := V.UnmarshalBinary(sig[:lenCom]); err != nil {
+		return nil, nil, errors.New("unmarshalling of commitment failed")
+	}
+	r := suite.Scalar().SetBytes(sig[lenCom:lenRes])
+	return V, r, nil
+}
+
+// verify checks that [r]G - [c]A' == V - E, where c = H(V || A || M) is the
+// challenge, A' the aggregate public key of the cosigners that responded and
+// E the aggregate commitment of the ones that did not.
+func verify(suite Suite, V kyber.Point, r kyber.Scalar, A, reduced, exCommit kyber.Point, message []byte) error {
+	k, err := Challenge(suite, V, A, message)
+	if err != nil {
+		return err
+	}
 
 	// k * -aggPublic + s * B = k*-A + s*B
 	// from s = k * a + r => s * B = k * a * B + r * B <=> s*B = k*A + r*B
 	// <=> s*B + k*-A = r*B
-	minusPublic := suite.Point().Neg(A)
-	kA := suite.Point().Mul(minusPublic, k)
-	sB := suite.Point().Mul(nil, r)
+	minusPublic := suite.Point().Neg(reduced)
+	kA := suite.Point().Mul(k, minusPublic)
+	sB := suite.Point().Mul(r, nil)
 	left := suite.Point().Add(kA, sB)
+	right := suite.Point().Sub(V, exCommit)
 
 	x, err := left.MarshalBinary()
 	if err != nil {
 		return err
 	}
-	y, err := V.MarshalBinary()
+	y, err := right.MarshalBinary()
 	if err != nil {
 		return err
 	}
-	if subtle.ConstantTimeCompare(x, y) == 0 || !policy.Check(mask) {
+	if subtle.ConstantTimeCompare(x, y) == 0 {
 		return errors.New("invalid signature")
 	}
 	return nil
@@ -233,15 +360,15 @@ func Verify(suite abstract.Suite, publics []abstract.Point, message, sig []byte,
 // Mask represents a cosigning participation bitmask.
 type Mask struct {
 	mask            []byte
-	publics         []abstract.Point
-	AggregatePublic abstract.Point
+	publics         []kyber.Point
+	AggregatePublic kyber.Point
 }
 
 // NewMask returns a new participation bitmask for cosigning where all
 // cosigners are disabled by default. If a public key is given it verifies that
 // it is present in the list of keys and sets the corresponding index in the
 // bitmask to 1 (enabled).
-func NewMask(suite abstract.Suite, publics []abstract.Point, myKey abstract.Point) (*Mask, error) {
+func NewMask(suite Suite, publics []kyber.Point, myKey kyber.Point) (*Mask, error) {
 	m := &Mask{
 		publics: publics,
 	}
@@ -328,7 +455,7 @@ func (m *Mask) IndexEnabled(i int) (bool, error) {
 
 // KeyEnabled checks whether the index, corresponding to the given key, is
 // enabled in the mask or not.
-func (m *Mask) KeyEnabled(public abstract.Point) (bool, error) {
+func (m *Mask) KeyEnabled(public kyber.Point) (bool, error) {
 	for i, key := range m.publics {
 		if key.Equal(public) {
 			return m.IndexEnabled(i)
@@ -402,3 +529,32 @@ type ThresholdPolicy struct {
 func (p ThresholdPolicy) Check(m *Mask) bool {
 	return m.CountEnabled() >= p.T
 }
+
+// WeightedPolicy requires that the cosigners of a collective signature hold
+// together at least the given threshold of weight. Weights[i] is the weight of
+// the cosigner at index i; cosigners without a weight count for nothing.
+type WeightedPolicy struct {
+	Weights   []int
+	Threshold int
+}
+
+// Check verifies that the participants that contributed to a collective
+// signature hold at least the threshold of weight.
+func (p WeightedPolicy) Check(m *Mask) bool {
+	w := 0
+	for i := range p.Weights {
+		if enabled, err := m.IndexEnabled(i); err == nil && enabled {
+			w += p.Weights[i]
+		}
+	}
+	return w >= p.Threshold
+}
+
+// PolicyFunc is an adapter to use an ordinary function as a cosigning
+// policy, for custom rules that none of the policies above cover.
+type PolicyFunc func(m *Mask) bool
+
+// Check calls f(m).
+func (f PolicyFunc) Check(m *Mask) bool {
+	return f(m)
+}
@@ -3,25 +3,26 @@ package cosi
 import (
 	"testing"
 
-	"gopkg.in/dedis/crypto.v0/ed25519"
-	"gopkg.in/dedis/crypto.v0/config"
-	"gopkg.in/dedis/crypto.v0/abstract"
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/group/edwards25519"
+	"github.com/dedis/kyber/sign/schnorr"
+	"github.com/dedis/kyber/util/key"
 )
 
-var testSuite = ed25519.NewAES128SHA256Ed25519(false)
+var testSuite = edwards25519.NewBlakeSHA256Ed25519()
 
 func TestCoSi(t *testing.T) {
 	n := 5
 	message := []byte("Hello World Cosi")
 
 	// Generate key pairs
-	var kps []*config.KeyPair
-	var privates []abstract.Scalar
-	var publics []abstract.Point
+	var kps []*key.Pair
+	var privates []kyber.Scalar
+	var publics []kyber.Point
 	for i := 0; i < n; i++ {
-		kp := config.NewKeyPair(testSuite)
+		kp := key.NewKeyPair(testSuite)
 		kps = append(kps, kp)
-		privates = append(privates, kp.Secret)
+		privates = append(privates, kp.Private)
 		publics = append(publics, kp.Public)
 	}
 
@@ -38,8 +39,8 @@ func TestCoSi(t *testing.T) {
 	}
 
 	// Compute commitments
-	var v []abstract.Scalar // random
-	var V []abstract.Point  // commitment
+	var v []kyber.Scalar // random
+	var V []kyber.Point  // commitment
 	for i := 0; i < n; i++ {
 		x, X := Commit(testSuite, nil)
 		v = append(v, x)
@@ -58,7 +59,7 @@ func TestCoSi(t *testing.T) {
 	}
 
 	// Compute challenge
-	var c []abstract.Scalar
+	var c []kyber.Scalar
 	for i := 0; i < n; i++ {
 		ci, err := Challenge(testSuite, aggV, masks[i].AggregatePublic, message)
 		if err != nil {
@@ -68,7 +69,7 @@ func TestCoSi(t *testing.T) {
 	}
 
 	// Compute responses
-	var r []abstract.Scalar
+	var r []kyber.Scalar
 	for i := 0; i < n; i++ {
 		ri, _ := Response(testSuite, privates[i], v[i], c[i])
 		r = append(r, ri)
@@ -99,13 +100,13 @@ func TestCoSiThreshold(t *testing.T) {
 	message := []byte("Hello World Cosi")
 
 	// Generate key pairs
-	var kps []*config.KeyPair
-	var privates []abstract.Scalar
-	var publics []abstract.Point
+	var kps []*key.Pair
+	var privates []kyber.Scalar
+	var publics []kyber.Point
 	for i := 0; i < n; i++ {
-		kp := config.NewKeyPair(testSuite)
+		kp := key.NewKeyPair(testSuite)
 		kps = append(kps, kp)
-		privates = append(privates, kp.Secret)
+		privates = append(privates, kp.Private)
 		publics = append(publics, kp.Public)
 	}
 
@@ -122,8 +123,8 @@ func TestCoSiThreshold(t *testing.T) {
 	}
 
 	// Compute commitments
-	var v []abstract.Scalar // random
-	var V []abstract.Point  // commitment
+	var v []kyber.Scalar // random
+	var V []kyber.Point  // commitment
 	for i := 0; i < n-f; i++ {
 		x, X := Commit(testSuite, nil)
 		v = append(v, x)
@@ -142,7 +143,7 @@ func TestCoSiThreshold(t *testing.T) {
 	}
 
 	// Compute challenge
-	var c []abstract.Scalar
+	var c []kyber.Scalar
 	for i := 0; i < n-f; i++ {
 		ci, err := Challenge(testSuite, aggV, masks[i].AggregatePublic, message)
 		if err != nil {
@@ -152,7 +153,7 @@ func TestCoSiThreshold(t *testing.T) {
 	}
 
 	// Compute responses
-	var r []abstract.Scalar
+	var r []kyber.Scalar
 	for i := 0; i < n-f; i++ {
 		ri, _ := Response(testSuite, privates[i], v[i], c[i])
 		r = append(r, ri)
@@ -176,3 +177,170 @@ func TestCoSiThreshold(t *testing.T) {
 		}
 	}
 }
+
+// genKeys returns n fresh key pairs and their public keys.
+func genKeys(n int) ([]*key.Pair, []kyber.Point) {
+	var kps []*key.Pair
+	var publics []kyber.Point
+	for i := 0; i < n; i++ {
+		kp := key.NewKeyPair(testSuite)
+		kps = append(kps, kp)
+		publics = append(publics, kp.Public)
+	}
+	return kps, publics
+}
+
+// cosign runs a star CoSi round where only the given indices participate
+// and returns the resulting signature.
+func cosign(t *testing.T, kps []*key.Pair, publics []kyber.Point, message []byte, signers []int) []byte {
+	mask, err := NewMask(testSuite, publics, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v []kyber.Scalar
+	var V []kyber.Point
+	for _, i := range signers {
+		mask.SetBit(i, true)
+		x, X := Commit(testSuite, nil)
+		v = append(v, x)
+		V = append(V, X)
+	}
+	aggV, _, err := AggregateCommitments(testSuite, V, make([][]byte, len(V)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := Challenge(testSuite, aggV, mask.AggregatePublic, message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r []kyber.Scalar
+	for j, i := range signers {
+		ri, err := Response(testSuite, kps[i].Private, v[j], c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = append(r, ri)
+	}
+	aggr, err := AggregateResponses(testSuite, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := Sign(testSuite, aggV, aggr, mask)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+func TestCoSiWeighted(t *testing.T) {
+	message := []byte("Hello World Cosi")
+	kps, publics := genKeys(4)
+	sig := cosign(t, kps, publics, message, []int{0, 2})
+
+	policy := WeightedPolicy{Weights: []int{3, 1, 2, 1}, Threshold: 5}
+	if err := Verify(testSuite, publics, message, sig, policy); err != nil {
+		t.Fatal(err)
+	}
+	policy.Threshold = 6
+	if err := Verify(testSuite, publics, message, sig, policy); err == nil {
+		t.Fatal("verification should fail below the weight threshold")
+	}
+	// cosigners without a weight do not count
+	policy = WeightedPolicy{Weights: []int{0, 1}, Threshold: 1}
+	if err := Verify(testSuite, publics, message, sig, policy); err == nil {
+		t.Fatal("verification should fail without weighted cosigners")
+	}
+}
+
+func TestCoSiPolicyFunc(t *testing.T) {
+	message := []byte("Hello World Cosi")
+	kps, publics := genKeys(5)
+	sig := cosign(t, kps, publics, message, []int{0, 1, 3})
+
+	leaderSigned := PolicyFunc(func(m *Mask) bool {
+		enabled, err := m.IndexEnabled(0)
+		return err == nil && enabled
+	})
+	if err := Verify(testSuite, publics, message, sig, leaderSigned); err != nil {
+		t.Fatal(err)
+	}
+	sig = cosign(t, kps, publics, message, []int{1, 2, 3, 4})
+	if err := Verify(testSuite, publics, message, sig, leaderSigned); err == nil {
+		t.Fatal("verification should fail without the leader")
+	}
+}
+
+func TestCoSiExceptions(t *testing.T) {
+	n := 5
+	message := []byte("Hello World Cosi")
+	kps, publics := genKeys(n)
+
+	// Everybody commits and the challenge covers all of them, but the last
+	// two do not respond.
+	all, err := NewMask(testSuite, publics, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v []kyber.Scalar
+	var V []kyber.Point
+	for i := 0; i < n; i++ {
+		all.SetBit(i, true)
+		x, X := Commit(testSuite, nil)
+		v = append(v, x)
+		V = append(V, X)
+	}
+	aggV, _, err := AggregateCommitments(testSuite, V, make([][]byte, n))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := Challenge(testSuite, aggV, all.AggregatePublic, message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r []kyber.Scalar
+	for i := 0; i < n-2; i++ {
+		ri, _ := Response(testSuite, kps[i].Private, v[i], c)
+		r = append(r, ri)
+	}
+	aggr, err := AggregateResponses(testSuite, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := Sign(testSuite, aggV, aggr, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exceptions := []Exception{{n - 2, V[n-2], nil}, {n - 1, V[n-1], nil}}
+	if err := VerifyWithExceptions(testSuite, publics, message, sig, exceptions, &ThresholdPolicy{n - 2}); err == nil {
+		t.Fatal("verification should fail with unsigned exception commitments")
+	}
+	for i := range exceptions {
+		payload, err := CommitmentPayload(exceptions[i].Commitment)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exceptions[i].Sig, err = schnorr.Sign(testSuite, kps[exceptions[i].Index].Private, payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := Verify(testSuite, publics, message, sig, nil); err == nil {
+		t.Fatal("verification should fail when ignoring exceptions")
+	}
+	if err := VerifyWithExceptions(testSuite, publics, message, sig, exceptions, &ThresholdPolicy{n - 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyWithExceptions(testSuite, publics, message, sig, exceptions, nil); err == nil {
+		t.Fatal("complete policy should not accept exceptions")
+	}
+	if err := VerifyWithExceptions(testSuite, publics, message, sig, exceptions[:1], &ThresholdPolicy{1}); err == nil {
+		t.Fatal("verification should fail with a missing exception")
+	}
+	if err := VerifyWithExceptions(testSuite, publics, message, sig, append(exceptions, exceptions[0]), &ThresholdPolicy{1}); err == nil {
+		t.Fatal("verification should fail with a duplicate exception")
+	}
+	exceptions[0].Commitment = V[0]
+	if err := VerifyWithExceptions(testSuite, publics, message, sig, exceptions, &ThresholdPolicy{1}); err == nil {
+		t.Fatal("verification should fail with a wrong exception commitment")
+	}
+}
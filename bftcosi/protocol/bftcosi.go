@@ -23,6 +23,7 @@ import (
 
 	"github.com/dedis/cothority/cosi/crypto"
 	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/sign/schnorr"
 	"github.com/dedis/onet"
 	"github.com/dedis/onet/log"
 )
@@ -49,8 +50,12 @@ type ProtocolBFTCoSi struct {
 	Msg []byte
 	// Data going along the msg to the verification
 	Data []byte
-	// Timeout is how long to wait while gathering commits.
+	// Timeout is how long to wait while gathering commits. It is the default
+	// for the phases that have no timeout in Timeouts.
 	Timeout time.Duration
+	// Timeouts are how long to wait in each phase of the round. They are set
+	// on the root and sent down the tree in the announcement.
+	Timeouts Timeouts
 	// last block computed
 	lastBlock string
 	// refusal to sign for the commit phase or not. This flag is set during the
@@ -62,6 +67,9 @@ type ProtocolBFTCoSi struct {
 	allowedExceptions int
 	// our index in the Roster list
 	index int
+	// blameProofs are the proofs against the nodes that refused to sign in
+	// the commit round after signing the prepare round, set on the root
+	blameProofs []*BlameProof
 
 	// onet-channels used to communicate the protocol
 	// channel for announcement
@@ -90,6 +98,13 @@ type ProtocolBFTCoSi struct {
 	// onSignatureDone is the callback that will be called when a signature has
 	// been generated ( at the end of the response phase of the commit round)
 	onSignatureDone func(*BFTSignature)
+	// onTimeout is called when the node gives up on the round because
+	// its parent didn't send the announcement or the challenge in time.
+	onTimeout func(*TimeoutError)
+	// onCommitmentMissing is called on the root with its children that
+	// didn't send their "prepare" commitment in time. If it is set, the
+	// round is stopped on all the nodes instead of going on without them.
+	onCommitmentMissing func([]*onet.TreeNode)
 	// VerificationFunction will be called
 	// during the (start/handle) challenge prepare phase of the protocol
 	VerificationFunction VerificationFunction
@@ -116,29 +131,43 @@ type collectStructs struct {
 	tmpMutex sync.Mutex
 	// exceptions given during the rounds that is used in the signature
 	tempExceptions []Exception
+	// exceptions given during the "commit" round, that end up in the final
+	// signature
+	tempCommitExceptions []Exception
 	// temporary buffer of "prepare" commitments
 	tempPrepareCommit []kyber.Point
 	// temporary buffer of "commit" commitments
 	tempCommitCommit []kyber.Point
+	// "prepare" commitments by the child that sent them
+	tempPrepareCommitChildren map[onet.TreeNodeID]Commitment
+	// "commit" commitments by the child that sent them
+	tempCommitCommitChildren map[onet.TreeNodeID]Commitment
 	// temporary buffer of "prepare" responses
 	tempPrepareResponse []kyber.Scalar
 	// temporary buffer of the public keys for nodes that responded
 	tempPrepareResponsePublics []kyber.Point
 	// temporary buffer of "commit" responses
 	tempCommitResponse []kyber.Scalar
+	// temporary buffer of the public keys for nodes that responded in the
+	// "commit" round
+	tempCommitResponsePublics []kyber.Point
 }
 
 
 
 // NewBFTCoSiProtocol returns a new bftcosi struct
 func NewBFTCoSiProtocol(n *onet.TreeNodeInstance, verify VerificationFunction) (*ProtocolBFTCoSi, error) {
-	// initialize the bftcosi node/protocol-instance
-	nodes := len(n.Tree().List())
+	// initialize the bftcosi node/protocol-instance: the nodes of the roster
+	// that are not part of the tree count as exceptions
+	nodes := len(n.Roster().List)
 	bft := &ProtocolBFTCoSi{
 		TreeNodeInstance: n,
 		collectStructs: collectStructs{
 			prepare: crypto.NewCosi(n.Suite(), n.Private(), n.Roster().Publics()),
 			commit:  crypto.NewCosi(n.Suite(), n.Private(), n.Roster().Publics()),
+
+			tempPrepareCommitChildren: make(map[onet.TreeNodeID]Commitment),
+			tempCommitCommitChildren:  make(map[onet.TreeNodeID]Commitment),
 		},
 		verifyChan:           make(chan bool),
 		VerificationFunction: verify,
@@ -158,6 +187,9 @@ func NewBFTCoSiProtocol(n *onet.TreeNodeInstance, verify VerificationFunction) (
 	if err != nil {
 		return nil, err
 	}
+	if err := bft.RegisterHandler(bft.handleStop); err != nil {
+		return nil, err
+	}
 
 	n.OnDoneCallback(bft.nodeDone)
 
@@ -200,7 +232,13 @@ func (bft *ProtocolBFTCoSi) Dispatch() error {
 
 
 	// Start prepare round
-	if err := bft.handleAnnouncement(<-bft.announceChan); err != nil {
+	var ann announceChan
+	select {
+	case ann = <-bft.announceChan:
+	case <-bft.waitParent(PhaseAnnouncement):
+		return bft.timeout(RoundPrepare, PhaseAnnouncement)
+	}
+	if err := bft.handleAnnouncement(ann); err != nil {
 		return err
 	}
 	if !bft.IsLeaf() {
@@ -208,9 +246,18 @@ func (bft *ProtocolBFTCoSi) Dispatch() error {
 			return err
 		}
 	}
+	if bft.isClosing() {
+		// the round has been stopped by the root
+		return nil
+	}
 
 	// Start commit round
-	if err := bft.handleAnnouncement(<-bft.announceChan); err != nil {
+	select {
+	case ann = <-bft.announceChan:
+	case <-bft.waitParent(PhaseAnnouncement):
+		return bft.timeout(RoundCommit, PhaseAnnouncement)
+	}
+	if err := bft.handleAnnouncement(ann); err != nil {
 		return err
 	}
 	if !bft.IsLeaf() {
@@ -218,9 +265,18 @@ func (bft *ProtocolBFTCoSi) Dispatch() error {
 			return err
 		}
 	}
+	if bft.isClosing() {
+		return nil
+	}
 
 	// Finish the prepare round
-	if err := bft.handleChallengePrepare(<-bft.challengePrepareChan); err != nil {
+	var chPrepare challengePrepareChan
+	select {
+	case chPrepare = <-bft.challengePrepareChan:
+	case <-bft.waitParent(PhaseChallenge):
+		return bft.timeout(RoundPrepare, PhaseChallenge)
+	}
+	if err := bft.handleChallengePrepare(chPrepare); err != nil {
 		return err
 	}
 	if !bft.IsLeaf() {
@@ -230,7 +286,13 @@ func (bft *ProtocolBFTCoSi) Dispatch() error {
 	}
 
 	// Finish the commit round
-	if err := bft.handleChallengeCommit(<-bft.challengeCommitChan); err != nil {
+	var chCommit challengeCommitChan
+	select {
+	case chCommit = <-bft.challengeCommitChan:
+	case <-bft.waitParent(PhaseChallenge):
+		return bft.timeout(RoundCommit, PhaseChallenge)
+	}
+	if err := bft.handleChallengeCommit(chCommit); err != nil {
 		return err
 	}
 	if !bft.IsLeaf() {
@@ -243,7 +305,9 @@ func (bft *ProtocolBFTCoSi) Dispatch() error {
 
 // Signature will generate the final signature, the output of the BFTCoSi
 // protocol.
-// The signature contains the commit round signature, with the message.
+// The signature contains the commit round signature, with the message, and
+// the exceptions of the nodes missing from it: the nodes that were offline,
+// that failed after making their commitment, or that refused to sign.
 // If the prepare phase failed, the signature will be nil and the Exceptions
 // will contain the exception from the prepare phase. It can be useful to see
 // which cosigners refused to sign (each exceptions contains the index of a
@@ -254,32 +318,40 @@ func (bft *ProtocolBFTCoSi) Signature() *BFTSignature {
 	bftSig := &BFTSignature{
 		Sig:        bft.commit.Signature(),
 		Msg:        bft.Msg,
-		Exceptions: nil,
+		Exceptions: bft.tempCommitExceptions,
 	}
 	if bft.signRefusal {
 		bftSig.Sig = nil
 		bftSig.Exceptions = bft.tempExceptions
 	}
-
-	// This is a hack to include exceptions which are the result of offline
-	// nodes rather than nodes that refused to sign.
-	if bftSig.Exceptions == nil {
-		for _, ex := range bft.tempExceptions {
-			if ex.Commitment.Equal(bft.Suite().Point().Null()) {
-				bftSig.Exceptions = append(bftSig.Exceptions, ex)
-			}
-		}
-	}
-
 	return bftSig
 }
 
+// BlameProofs returns a proof against each node that signed the prepare round
+// and then refused to sign the commit round, once the root has the signature.
+func (bft *ProtocolBFTCoSi) BlameProofs() []*BlameProof {
+	return bft.blameProofs
+}
+
 // RegisterOnDone registers a callback to call when the bftcosi protocols has
 // really finished
 func (bft *ProtocolBFTCoSi) RegisterOnDone(fn func()) {
 	bft.onDone = fn
 }
 
+// registerOnCommitmentMissing registers a callback to call on the root when
+// some of its children didn't send their "prepare" commitment in time. The
+// round is then stopped.
+func (bft *ProtocolBFTCoSi) registerOnCommitmentMissing(fn func([]*onet.TreeNode)) {
+	bft.onCommitmentMissing = fn
+}
+
+// RegisterOnTimeout registers a callback to call when the node gives up on
+// the round because a message of its parent didn't arrive in time.
+func (bft *ProtocolBFTCoSi) RegisterOnTimeout(fn func(*TimeoutError)) {
+	bft.onTimeout = fn
+}
+
 // RegisterOnSignatureDone register a callback to call when the bftcosi
 // protocol reached a signature on the block
 func (bft *ProtocolBFTCoSi) RegisterOnSignatureDone(fn func(*BFTSignature)) {
@@ -310,13 +382,57 @@ func (bft *ProtocolBFTCoSi) handleAnnouncement(msg announceChan) error {
 		log.Lvl3("Closing")
 		return nil
 	}
+	if !bft.IsRoot() {
+		bft.Timeouts = ann.Timeouts
+	}
 	if bft.IsLeaf() {
-		bft.Timeout = ann.Timeout
 		return bft.startCommitment(ann.TYPE)
 	}
+	// our children give up on their own children before we give up on
+	// them
+	ann.Timeouts.Commitment /= 2
+	ann.Timeouts.Response /= 2
 	return bft.sendToChildren(&ann)
 }
 
+// handleStop stops the node when the root aborts the round.
+func (bft *ProtocolBFTCoSi) handleStop(msg stopChan) error {
+	if !msg.TreeNode.ID.Equal(bft.Root().ID) {
+		return nil
+	}
+	log.Lvl3(bft.Name(), "stopped by the root")
+	bft.setClosing()
+	bft.Done()
+	return nil
+}
+
+// stop aborts the round on all the nodes.
+func (bft *ProtocolBFTCoSi) stop() {
+	bft.setClosing()
+	go func() {
+		if errs := bft.Broadcast(&Stop{}); len(errs) > 0 {
+			log.Lvl3(bft.Name(), "couldn't stop all the nodes:", errs)
+		}
+	}()
+	bft.Done()
+}
+
+// missingCommitments returns the children that didn't send their commitment
+// for round t.
+func (bft *ProtocolBFTCoSi) missingCommitments(t RoundType) []*onet.TreeNode {
+	commitments := bft.tempPrepareCommitChildren
+	if t == RoundCommit {
+		commitments = bft.tempCommitCommitChildren
+	}
+	var missing []*onet.TreeNode
+	for _, tn := range bft.Children() {
+		if _, ok := commitments[tn.ID]; !ok {
+			missing = append(missing, tn)
+		}
+	}
+	return missing
+}
+
 // handleCommitmentPrepare handles incoming commit messages in the prepare phase
 // and then computes the aggregate commit when enough messages arrive.
 // The aggregate is sent to the parent if the node is not a root otherwise it
@@ -330,6 +446,9 @@ func (bft *ProtocolBFTCoSi) handleCommitmentPrepare(c chan commitChan) error {
 	if err := bft.readCommitChan(c, RoundPrepare); err != nil {
 		return err
 	}
+	if bft.isClosing() {
+		return nil
+	}
 
 	// TODO this will not always work for non-star graphs
 	if len(bft.tempPrepareCommit) < len(bft.Children())-bft.allowedExceptions {
@@ -339,12 +458,15 @@ func (bft *ProtocolBFTCoSi) handleCommitmentPrepare(c chan commitChan) error {
 
 	commitment := bft.prepare.Commit(bft.Suite().RandomStream(), bft.tempPrepareCommit)
 	if bft.IsRoot() {
+		if missing := bft.missingCommitments(RoundPrepare); len(missing) > 0 && bft.onCommitmentMissing != nil {
+			log.Lvl2(bft.Name(), len(missing), "children didn't commit, stopping the round")
+			bft.stop()
+			bft.onCommitmentMissing(missing)
+			return nil
+		}
 		return bft.startChallenge(RoundPrepare)
 	}
-	return bft.SendToParent(&Commitment{
-		TYPE:       RoundPrepare,
-		Commitment: commitment,
-	})
+	return bft.sendCommitment(RoundPrepare, commitment)
 }
 
 // handleCommitmentCommit is similar to handleCommitmentPrepare except it is for
@@ -356,6 +478,9 @@ func (bft *ProtocolBFTCoSi) handleCommitmentCommit(c chan commitChan) error {
 	// wait until we have enough RoundCommit commitments or timeout
 	// should do nothing if `c` is closed
 	bft.readCommitChan(c, RoundCommit)
+	if bft.isClosing() {
+		return nil
+	}
 
 	// TODO this will not always work for non-star graphs
 	if len(bft.tempCommitCommit) < len(bft.Children())-bft.allowedExceptions {
@@ -370,10 +495,7 @@ func (bft *ProtocolBFTCoSi) handleCommitmentCommit(c chan commitChan) error {
 		// the "prepare" round: calls startChallengeCommit
 		return nil
 	}
-	return bft.SendToParent(&Commitment{
-		TYPE:       RoundCommit,
-		Commitment: commitment,
-	})
+	return bft.sendCommitment(RoundCommit, commitment)
 }
 
 // handleChallengePrepare collects the challenge-messages
@@ -542,10 +664,33 @@ func (bft *ProtocolBFTCoSi) handleResponseCommit(c chan responseChan) error {
 		return err
 	}
 
+	// the children that failed after making their commitment are missing
+	// from the aggregate response
+	bft.tempCommitExceptions = append(bft.tempCommitExceptions,
+		bft.missingExceptions(bft.tempCommitResponsePublics, bft.tempCommitCommitChildren)...)
+	if bft.IsRoot() {
+		bft.tempCommitExceptions = append(bft.tempCommitExceptions, bft.outsideExceptions()...)
+	}
+	r.Exceptions = append(r.Exceptions, bft.tempCommitExceptions...)
 	if bft.signRefusal {
+		// sign the refusal, so that we can be blamed for it
+		refusal, err := refusalPayload(bft.Msg, bft.commit.GetCommitment())
+		if err != nil {
+			return err
+		}
+		sig, err := schnorr.Sign(bft.Suite(), bft.Private(), refusal)
+		if err != nil {
+			return err
+		}
+		commitmentSig, err := bft.signCommitment(bft.commit.GetCommitment())
+		if err != nil {
+			return err
+		}
 		r.Exceptions = append(r.Exceptions, Exception{
 			Index:      bft.index,
 			Commitment: bft.commit.GetCommitment(),
+			Sig:        commitmentSig,
+			Refusal:    sig,
 		})
 		// don't include our own!
 		r.Response.Sub(r.Response, bft.commit.GetResponse())
@@ -556,6 +701,7 @@ func (bft *ProtocolBFTCoSi) handleResponseCommit(c chan responseChan) error {
 	// if root we have finished
 	if bft.IsRoot() {
 		sig := bft.Signature()
+		bft.blameProofs = bft.blame(sig)
 		if bft.onSignatureDone != nil {
 			bft.onSignatureDone(sig)
 		}
@@ -568,7 +714,7 @@ func (bft *ProtocolBFTCoSi) handleResponseCommit(c chan responseChan) error {
 
 // readCommitChan reads until all commit messages are received or a timeout for message type `t`
 func (bft *ProtocolBFTCoSi) readCommitChan(c chan commitChan, t RoundType) error {
-	timeout := time.After(bft.Timeout)
+	timeout := time.After(bft.phaseTimeouts().Commitment)
 	for {
 		if bft.isClosing() {
 			return errors.New("Closing")
@@ -586,11 +732,13 @@ func (bft *ProtocolBFTCoSi) readCommitChan(c chan commitChan, t RoundType) error
 			switch comm.TYPE {
 			case RoundPrepare:
 				bft.tempPrepareCommit = append(bft.tempPrepareCommit, comm.Commitment)
+				bft.tempPrepareCommitChildren[msg.TreeNode.ID] = comm
 				if t == RoundPrepare && len(bft.tempPrepareCommit) == len(bft.Children()) {
 					return nil
 				}
 			case RoundCommit:
 				bft.tempCommitCommit = append(bft.tempCommitCommit, comm.Commitment)
+				bft.tempCommitCommitChildren[msg.TreeNode.ID] = comm
 				// In case the prepare round had some exceptions, we
 				// will not wait for more commits from the commit
 				// round. The possibility of having a different set
@@ -603,7 +751,8 @@ func (bft *ProtocolBFTCoSi) readCommitChan(c chan commitChan, t RoundType) error
 		case <-timeout:
 			// in some cases this might be ok because we accept a certain number of faults
 			// the caller is responsible for checking if enough messages are received
-			log.Lvl1("timeout while trying to read commit message")
+			log.Lvl1(bft.Name(), "timeout in the commitment phase of the", t,
+				"round, missing", treeNodeNames(bft.missingCommitments(t)))
 			return nil
 		}
 	}
@@ -611,7 +760,7 @@ func (bft *ProtocolBFTCoSi) readCommitChan(c chan commitChan, t RoundType) error
 
 // should do nothing if the channel is closed
 func (bft *ProtocolBFTCoSi) readResponseChan(c chan responseChan, t RoundType) error {
-	timeout := time.After(bft.Timeout)
+	timeout := time.After(bft.phaseTimeouts().Response)
 	for {
 		if bft.isClosing() {
 			return errors.New("Closing")
@@ -640,13 +789,16 @@ func (bft *ProtocolBFTCoSi) readResponseChan(c chan responseChan, t RoundType) e
 				}
 			case RoundCommit:
 				bft.tempCommitResponse = append(bft.tempCommitResponse, r.Response)
+				bft.tempCommitExceptions = append(bft.tempCommitExceptions, r.Exceptions...)
+				bft.tempCommitResponsePublics = append(bft.tempCommitResponsePublics, from)
 				// Same reasoning as in RoundPrepare.
 				if t == RoundCommit && len(bft.tempCommitResponse) == len(bft.tempCommitCommit) {
 					return nil
 				}
 			}
 		case <-timeout:
-			log.Lvl1("timeout while trying to read response messages")
+			log.Lvl1(bft.Name(), "timeout in the response phase of the", t,
+				"round, missing", treeNodeNames(bft.missingResponses(t)))
 			return nil
 		}
 	}
@@ -655,14 +807,34 @@ func (bft *ProtocolBFTCoSi) readResponseChan(c chan responseChan, t RoundType) e
 // startAnnouncementPrepare create its announcement for the prepare round and
 // sends it down the tree.
 func (bft *ProtocolBFTCoSi) startAnnouncement(t RoundType) error {
-	bft.announceChan <- announceChan{Announce: Announce{TYPE: t, Timeout: bft.Timeout}}
+	bft.announceChan <- announceChan{Announce: Announce{TYPE: t, Timeouts: bft.phaseTimeouts()}}
 	return nil
 }
 
 // startCommitment sends the first commitment to the parent node
 func (bft *ProtocolBFTCoSi) startCommitment(t RoundType) error {
 	cm := bft.getCosi(t).CreateCommitment(bft.Suite().RandomStream())
-	return bft.SendToParent(&Commitment{TYPE: t, Commitment: cm})
+	return bft.sendCommitment(t, cm)
+}
+
+// sendCommitment sends the commitment to the parent, along with our signature
+// on it, which the parent puts in our exception if we fail later on.
+func (bft *ProtocolBFTCoSi) sendCommitment(t RoundType, commitment kyber.Point) error {
+	sig, err := bft.signCommitment(commitment)
+	if err != nil {
+		return err
+	}
+	return bft.SendToParent(&Commitment{TYPE: t, Commitment: commitment, Sig: sig})
+}
+
+// signCommitment returns our signature on the commitment, see
+// commitmentPayload.
+func (bft *ProtocolBFTCoSi) signCommitment(commitment kyber.Point) ([]byte, error) {
+	msg, err := commitmentPayload(commitment)
+	if err != nil {
+		return nil, err
+	}
+	return schnorr.Sign(bft.Suite(), bft.Private(), msg)
 }
 
 // startChallenge creates the challenge and sends it to its children
@@ -739,9 +911,14 @@ func (bft *ProtocolBFTCoSi) waitResponseVerification() (*Response, bool) {
 
 	if !verified {
 		// Add our exception
+		sig, err := bft.signCommitment(bft.prepare.GetCommitment())
+		if err != nil {
+			return nil, false
+		}
 		bft.tempExceptions = append(bft.tempExceptions, Exception{
 			Index:      bft.index,
 			Commitment: bft.prepare.GetCommitment(),
+			Sig:        sig,
 		})
 		// Don't include our response!
 		resp = bft.Suite().Scalar().Set(resp).Sub(resp, bft.prepare.GetResponse())
@@ -749,23 +926,10 @@ func (bft *ProtocolBFTCoSi) waitResponseVerification() (*Response, bool) {
 	}
 
 	// if we didn't get all the responses, add them to the exception
-	// 1, find children that are not in tempPrepareResponsePublics
-	// 2, for the missing ones, find the global index and then add it to the exception
-	publicsMap := make(map[kyber.Point]bool)
-	for _, p := range bft.tempPrepareResponsePublics {
-		publicsMap[p] = true
-	}
-	for _, tn := range bft.Children() {
-		if !publicsMap[tn.ServerIdentity.Public] {
-			// We assume the server was also not available for the commitment
-			// so no need to subtract the commitment.
-			// Conversely, we cannot handle nodes which fail right
-			// after making a commitment at the moment.
-			bft.tempExceptions = append(bft.tempExceptions, Exception{
-				Index:      tn.RosterIndex,
-				Commitment: bft.Suite().Point().Null(),
-			})
-		}
+	bft.tempExceptions = append(bft.tempExceptions,
+		bft.missingExceptions(bft.tempPrepareResponsePublics, bft.tempPrepareCommitChildren)...)
+	if bft.IsRoot() {
+		bft.tempExceptions = append(bft.tempExceptions, bft.outsideExceptions()...)
 	}
 
 	r := &Response{
@@ -778,6 +942,75 @@ func (bft *ProtocolBFTCoSi) waitResponseVerification() (*Response, bool) {
 	return r, verified
 }
 
+// missingExceptions returns the exceptions of the children that didn't
+// respond, given the public keys of the children that did and the commitments
+// received from the children. A child that failed after making its commitment
+// carries it in its exception, along with its signature on it, so that the
+// aggregate commitment matches the responses without it. Its subtree is
+// excepted as well, as the responses of the subtree went through it; their
+// commitments are already part of the one of the child.
+func (bft *ProtocolBFTCoSi) missingExceptions(responded []kyber.Point, commitments map[onet.TreeNodeID]Commitment) []Exception {
+	respondedMap := make(map[string]bool)
+	for _, p := range responded {
+		respondedMap[p.String()] = true
+	}
+	var exceptions []Exception
+	for _, tn := range bft.Children() {
+		if respondedMap[tn.ServerIdentity.Public.String()] {
+			continue
+		}
+		commitment, ok := commitments[tn.ID]
+		if !ok {
+			// the child was not available for the commitment
+			commitment.Commitment = bft.Suite().Point().Null()
+		}
+		log.Lvl2(bft.Name(), "missing response of", tn.ServerIdentity, "committed:", ok)
+		exceptions = append(exceptions, Exception{
+			Index:      tn.RosterIndex,
+			Commitment: commitment.Commitment,
+			Sig:        commitment.Sig,
+		})
+		for _, d := range descendants(tn) {
+			exceptions = append(exceptions, Exception{
+				Index:      d.RosterIndex,
+				Commitment: bft.Suite().Point().Null(),
+			})
+		}
+	}
+	return exceptions
+}
+
+// outsideExceptions returns the exceptions of the nodes of the roster that are
+// not part of the tree, like the nodes of a subtree left out by
+// SubtreesBFTCoSi: the signature is over the whole roster, but they neither
+// commit nor respond.
+func (bft *ProtocolBFTCoSi) outsideExceptions() []Exception {
+	inTree := make(map[int]bool)
+	for _, tn := range bft.Tree().List() {
+		inTree[tn.RosterIndex] = true
+	}
+	var exceptions []Exception
+	for i := range bft.Roster().List {
+		if !inTree[i] {
+			exceptions = append(exceptions, Exception{
+				Index:      i,
+				Commitment: bft.Suite().Point().Null(),
+			})
+		}
+	}
+	return exceptions
+}
+
+// descendants returns all the nodes below the given node.
+func descendants(tn *onet.TreeNode) []*onet.TreeNode {
+	var nodes []*onet.TreeNode
+	for _, c := range tn.Children {
+		nodes = append(nodes, c)
+		nodes = append(nodes, descendants(c)...)
+	}
+	return nodes
+}
+
 // nodeDone is either called by the end of EndProtocol or by the end of the
 // response phase of the commit round.
 func (bft *ProtocolBFTCoSi) nodeDone() bool {
@@ -788,6 +1021,84 @@ func (bft *ProtocolBFTCoSi) nodeDone() bool {
 	return true
 }
 
+// phaseTimeouts returns the timeouts of the round, where the phases without
+// a timeout wait Timeout while gathering messages from the children, and
+// twice as long on the parent, which has to gather the messages of the
+// whole tree first.
+func (bft *ProtocolBFTCoSi) phaseTimeouts() Timeouts {
+	t := bft.Timeouts
+	if t.Announcement == 0 {
+		t.Announcement = 2 * bft.Timeout
+	}
+	if t.Commitment == 0 {
+		t.Commitment = bft.Timeout
+	}
+	if t.Challenge == 0 {
+		t.Challenge = 2 * bft.Timeout
+	}
+	if t.Response == 0 {
+		t.Response = bft.Timeout
+	}
+	return t
+}
+
+// waitParent returns a channel that fires once the node waited too long on
+// its parent in phase p. The root doesn't wait on anybody, so it never fires.
+func (bft *ProtocolBFTCoSi) waitParent(p Phase) <-chan time.Time {
+	if bft.IsRoot() {
+		return nil
+	}
+	if p == PhaseAnnouncement {
+		return time.After(bft.phaseTimeouts().Announcement)
+	}
+	return time.After(bft.phaseTimeouts().Challenge)
+}
+
+// timeout cancels the round on this node after its parent didn't send the
+// message of phase p of round t in time, and reports it.
+func (bft *ProtocolBFTCoSi) timeout(t RoundType, p Phase) error {
+	err := &TimeoutError{Round: t, Phase: p, Peer: bft.Parent().ServerIdentity}
+	log.Error(bft.Name(), err)
+	if bft.onTimeout != nil {
+		bft.onTimeout(err)
+	}
+	bft.setClosing()
+	bft.Done()
+	return err
+}
+
+// missingResponses returns the children that didn't send their response for
+// round t.
+func (bft *ProtocolBFTCoSi) missingResponses(t RoundType) []*onet.TreeNode {
+	responded := bft.tempPrepareResponsePublics
+	if t == RoundCommit {
+		responded = bft.tempCommitResponsePublics
+	}
+	var missing []*onet.TreeNode
+	for _, tn := range bft.Children() {
+		found := false
+		for _, p := range responded {
+			if p.Equal(tn.ServerIdentity.Public) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, tn)
+		}
+	}
+	return missing
+}
+
+// treeNodeNames returns the addresses of the given nodes, for logging.
+func treeNodeNames(tns []*onet.TreeNode) []string {
+	var names []string
+	for _, tn := range tns {
+		names = append(names, tn.ServerIdentity.Address.String())
+	}
+	return names
+}
+
 func (bft *ProtocolBFTCoSi) getCosi(t RoundType) *crypto.CoSi {
 	if t == RoundPrepare {
 		return bft.prepare
@@ -1,6 +1,7 @@
 package protocol
 
 import (
+	"crypto/sha512"
 	"errors"
 	"fmt"
 	"strconv"
@@ -8,9 +9,14 @@ import (
 	"testing"
 	"time"
 
+	"bls-ftcosi/bftcosi/cosi"
 	"github.com/dedis/cothority"
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/sign/schnorr"
+	"github.com/dedis/kyber/util/key"
 	"github.com/dedis/onet"
 	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/network"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -201,6 +207,405 @@ func TestNodeFailure(t *testing.T) {
 	log.AfterTest(t)
 }
 
+// crashingBFTCoSi makes its commitments for both rounds like any node, then
+// fails before sending its response in the round `crash`. With `refuse`, it
+// refuses to sign the "commit" round instead.
+type crashingBFTCoSi struct {
+	*ProtocolBFTCoSi
+	crash  RoundType
+	refuse bool
+}
+
+func (c *crashingBFTCoSi) Dispatch() error {
+	if c.IsLeaf() {
+		close(c.commitChan)
+		close(c.responseChan)
+	}
+	for _, t := range []RoundType{RoundPrepare, RoundCommit} {
+		if err := c.handleAnnouncement(<-c.announceChan); err != nil {
+			return err
+		}
+		if c.IsLeaf() {
+			continue
+		}
+		if t == RoundPrepare {
+			if err := c.handleCommitmentPrepare(c.commitChan); err != nil {
+				return err
+			}
+		} else if err := c.handleCommitmentCommit(c.commitChan); err != nil {
+			return err
+		}
+	}
+	if c.crash == RoundCommit {
+		if err := c.handleChallengePrepare(<-c.challengePrepareChan); err != nil {
+			return err
+		}
+		if !c.IsLeaf() {
+			if err := c.handleResponsePrepare(c.responseChan); err != nil {
+				return err
+			}
+		}
+	}
+	if c.refuse {
+		ch := <-c.challengeCommitChan
+		c.signRefusal = true
+		if err := c.handleChallengeCommit(ch); err != nil {
+			return err
+		}
+		if !c.IsLeaf() {
+			return c.handleResponseCommit(c.responseChan)
+		}
+		return nil
+	}
+	log.Lvl2(c.Name(), "failing after its commitment in round", c.crash)
+	return nil
+}
+
+func TestNodeFailureAfterCommit(t *testing.T) {
+	const TestProtocolName = "DummyBFTCoSiFailureAfterCommit"
+	oldTimeout := defaultTimeout
+	defaultTimeout = 500 * time.Millisecond
+	defer func() { defaultTimeout = oldTimeout }()
+
+	var crashMutex sync.Mutex
+	crashes := make(map[network.ServerIdentityID]RoundType)
+	refuse := false
+	onet.GlobalProtocolRegister(TestProtocolName, func(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+		bft, err := NewBFTCoSiProtocol(n, func(m, d []byte) bool { return true })
+		if err != nil {
+			return nil, err
+		}
+		crashMutex.Lock()
+		defer crashMutex.Unlock()
+		if round, ok := crashes[n.ServerIdentity().ID]; ok {
+			return &crashingBFTCoSi{ProtocolBFTCoSi: bft, crash: round, refuse: refuse}, nil
+		}
+		return bft, nil
+	})
+
+	tests := []struct {
+		hosts, bf int
+		subleader bool
+		round     RoundType
+		refuse    bool
+	}{
+		{5, 4, false, RoundPrepare, false},
+		{5, 4, false, RoundCommit, false},
+		{5, 4, false, RoundCommit, true},
+		{13, 3, true, RoundPrepare, false},
+		{13, 3, true, RoundCommit, false},
+		{13, 3, true, RoundCommit, true},
+	}
+	for _, test := range tests {
+		local := onet.NewLocalTest(tSuite)
+		local.Check = onet.CheckNone
+		_, _, tree := local.GenBigTree(test.hosts, test.hosts, test.bf, true)
+
+		crashed := tree.List()[len(tree.List())-1]
+		if test.subleader {
+			crashed = tree.Root.Children[0]
+		}
+		crashMutex.Lock()
+		crashes = map[network.ServerIdentityID]RoundType{crashed.ServerIdentity.ID: test.round}
+		refuse = test.refuse
+		crashMutex.Unlock()
+
+		node, err := local.CreateProtocol(TestProtocolName, tree)
+		if err != nil {
+			local.CloseAll()
+			t.Fatal("Couldn't create new node:", err)
+		}
+		root := node.(*ProtocolBFTCoSi)
+		root.Msg = []byte("Hello BFTCoSi")
+		done := make(chan bool, 1)
+		root.RegisterOnDone(func() {
+			done <- true
+		})
+		go root.Start()
+
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			local.CloseAll()
+			t.Fatalf("%d hosts, failure in round %d: timeout", test.hosts, test.round)
+		}
+		sig := root.Signature()
+		if err := sig.Verify(root.Suite(), root.Roster().Publics()); err != nil {
+			local.CloseAll()
+			t.Fatalf("%d hosts, failure in round %d: %s", test.hosts, test.round, err)
+		}
+		// the exception of the failed node carries its commitment
+		found := false
+		for _, ex := range sig.Exceptions {
+			if ex.Index == crashed.RosterIndex {
+				found = !ex.Commitment.Equal(tSuite.Point().Null())
+			}
+		}
+		if !found {
+			local.CloseAll()
+			t.Fatalf("%d hosts, failure in round %d: no exception with the commitment of the failed node", test.hosts, test.round)
+		}
+		want := 1 + len(descendants(crashed))
+		if test.refuse {
+			// the responses of its subtree still go through it
+			want = 1
+		}
+		if len(sig.Exceptions) != want {
+			local.CloseAll()
+			t.Fatalf("%d hosts, failure in round %d: %d exceptions instead of %d", test.hosts, test.round, len(sig.Exceptions), want)
+		}
+		// only the node that refused to sign after signing the prepare
+		// round is blamed, not the ones that failed
+		proofs := root.BlameProofs()
+		if !test.refuse {
+			if len(proofs) != 0 {
+				local.CloseAll()
+				t.Fatalf("%d hosts: blamed a node that failed in the %s round", test.hosts, test.round)
+			}
+		} else {
+			if len(proofs) != 1 || proofs[0].Index != crashed.RosterIndex {
+				local.CloseAll()
+				t.Fatalf("%d hosts: %d blame proofs", test.hosts, len(proofs))
+			}
+			if err := VerifyBlameProof(root.Suite(), root.Roster().Publics(), proofs[0]); err != nil {
+				local.CloseAll()
+				t.Fatalf("%d hosts: invalid blame proof: %s", test.hosts, err)
+			}
+			wrong := *proofs[0]
+			wrong.Index = tree.Root.RosterIndex
+			if err := VerifyBlameProof(root.Suite(), root.Roster().Publics(), &wrong); err == nil {
+				local.CloseAll()
+				t.Fatalf("%d hosts: blamed the root", test.hosts)
+			}
+			// an exception can't be added to a valid signature without
+			// the key of the node
+			wrong.Commit = forgeException(proofs[0].Commit, root.Roster().Publics(), wrong.Index)
+			if err := wrong.Commit.Verify(root.Suite(), root.Roster().Publics()); err == nil {
+				local.CloseAll()
+				t.Fatalf("%d hosts: verified a forged exception", test.hosts)
+			}
+			if err := VerifyBlameProof(root.Suite(), root.Roster().Publics(), &wrong); err == nil {
+				local.CloseAll()
+				t.Fatalf("%d hosts: blamed the root with a forged exception", test.hosts)
+			}
+		}
+		local.CloseAll()
+	}
+	// Do it manually because we set CheckNone in local
+	log.AfterTest(t)
+}
+
+func TestSubtreesSubleaderFailure(t *testing.T) {
+	const TestProtocolName = "DummyBFTCoSiSubtrees"
+	const TestSubProtocolName = "DummyBFTCoSiSubtreesRound"
+	oldTimeout := defaultTimeout
+	defaultTimeout = 500 * time.Millisecond
+	defer func() { defaultTimeout = oldTimeout }()
+
+	onet.GlobalProtocolRegister(TestProtocolName, func(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+		return NewSubtreesBFTCoSi(n, TestSubProtocolName)
+	})
+	onet.GlobalProtocolRegister(TestSubProtocolName, func(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+		return NewBFTCoSiProtocol(n, func(m, d []byte) bool { return true })
+	})
+
+	// with 4 failing nodes, the whole first subtree is down
+	for _, failing := range []int{0, 1, 2, 4} {
+		local := onet.NewLocalTest(tSuite)
+		local.Check = onet.CheckNone
+		servers, roster, tree := local.GenTree(13, true)
+
+		// the first subleaders of the first subtree all fail
+		trees, err := GenTrees(roster, 13, 3)
+		if err != nil {
+			local.CloseAll()
+			t.Fatal(err)
+		}
+		for i := 1; i <= failing; i++ {
+			index, _ := roster.Search(trees[0].Roster.List[i].ID)
+			if err := servers[index].Close(); err != nil {
+				local.CloseAll()
+				t.Fatal(err)
+			}
+		}
+
+		node, err := local.CreateProtocol(TestProtocolName, tree)
+		if err != nil {
+			local.CloseAll()
+			t.Fatal("Couldn't create new node:", err)
+		}
+		root := node.(*SubtreesBFTCoSi)
+		root.Msg = []byte("Hello BFTCoSi")
+		root.NSubtrees = 3
+		root.CreateProtocol = func(name string, t *onet.Tree, sid onet.ServiceID) (onet.ProtocolInstance, error) {
+			return local.CreateProtocol(name, t)
+		}
+		done := make(chan bool, 1)
+		root.RegisterOnDone(func() {
+			done <- true
+		})
+		if err := root.Start(); err != nil {
+			local.CloseAll()
+			t.Fatal(err)
+		}
+
+		select {
+		case <-done:
+		case <-time.After(20 * time.Second):
+			local.CloseAll()
+			t.Fatalf("%d failing subleaders: timeout", failing)
+		}
+		sig := root.Signature()
+		if err := sig.Verify(root.Suite(), roster.Publics()); err != nil {
+			local.CloseAll()
+			t.Fatalf("%d failing subleaders: %s", failing, err)
+		}
+		// only the failed nodes are missing from the signature
+		if len(sig.Exceptions) != failing {
+			local.CloseAll()
+			t.Fatalf("%d failing subleaders: %d exceptions", failing, len(sig.Exceptions))
+		}
+		local.CloseAll()
+	}
+	// Do it manually because we set CheckNone in local
+	log.AfterTest(t)
+}
+
+func TestMergeTrees(t *testing.T) {
+	local := onet.NewLocalTest(tSuite)
+	defer local.CloseAll()
+	_, roster, _ := local.GenTree(10, false)
+
+	trees, err := GenTrees(roster, 10, 3)
+	assert.Nil(t, err)
+	trees, err = replaceSubleaders(trees, []*onet.TreeNode{trees[1].Root.Children[0]})
+	assert.Nil(t, err)
+	tree, err := mergeTrees(roster, trees)
+	assert.Nil(t, err)
+
+	assert.Equal(t, 10, tree.Size())
+	assert.Equal(t, 3, len(tree.Root.Children))
+	for _, tn := range tree.List() {
+		assert.Equal(t, roster.List[tn.RosterIndex].ID, tn.ServerIdentity.ID)
+	}
+	// the second node of the subtree is its new subleader
+	assert.Equal(t, trees[1].Roster.List[2].ID, tree.Root.Children[1].ServerIdentity.ID)
+	assert.Equal(t, 2, len(tree.Root.Children[1].Children))
+}
+
+// TestPhaseTimeout checks that a node whose parent never sends the challenge
+// of the commit round gives up on the round and reports it.
+func TestPhaseTimeout(t *testing.T) {
+	const TestProtocolName = "DummyBFTCoSiPhaseTimeout"
+	oldTimeout := defaultTimeout
+	defaultTimeout = 500 * time.Millisecond
+	defer func() { defaultTimeout = oldTimeout }()
+
+	timeouts := make(chan *TimeoutError, 5)
+	onet.GlobalProtocolRegister(TestProtocolName, func(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+		bft, err := NewBFTCoSiProtocol(n, verify)
+		if err != nil {
+			return nil, err
+		}
+		bft.RegisterOnTimeout(func(e *TimeoutError) {
+			timeouts <- e
+		})
+		return bft, nil
+	})
+
+	local := onet.NewLocalTest(tSuite)
+	local.Check = onet.CheckNone
+	defer local.CloseAll()
+	servers, _, tree := local.GenBigTree(5, 5, 4, true)
+
+	failing := servers[len(servers)-1]
+	interceptor := &Interceptor{
+		Interception: InterceptDrop,
+		Messages:     []network.MessageTypeID{network.MessageType(ChallengeCommit{})},
+		Suite:        tSuite,
+	}
+	interceptor.Register(failing, local.Overlays[failing.ServerIdentity.ID])
+
+	node, err := local.CreateProtocol(TestProtocolName, tree)
+	log.ErrFatal(err)
+	root := node.(*ProtocolBFTCoSi)
+	root.Msg = []byte("Hello BFTCoSi")
+	cMux.Lock()
+	counters.add(&Counter{})
+	root.Data = []byte(strconv.Itoa(counters.size() - 1))
+	cMux.Unlock()
+	go root.Start()
+
+	select {
+	case e := <-timeouts:
+		assert.Equal(t, RoundCommit, e.Round)
+		assert.Equal(t, PhaseChallenge, e.Phase)
+		assert.True(t, e.Peer.ID.Equal(tree.Root.ServerIdentity.ID))
+	case <-time.After(10 * time.Second):
+		t.Fatal("the node didn't give up on the round")
+	}
+	// Do it manually because we set CheckNone in local
+	log.AfterTest(t)
+}
+
+// TestCosiSignature checks that a signature made with the standalone cosi
+// primitives is accepted by BFTSignature.Verify.
+func TestCosiSignature(t *testing.T) {
+	n := 5
+	msg := []byte("Hello BFTCoSi")
+	var privates []kyber.Scalar
+	var publics []kyber.Point
+	for i := 0; i < n; i++ {
+		kp := key.NewKeyPair(tSuite)
+		privates = append(privates, kp.Private)
+		publics = append(publics, kp.Public)
+	}
+
+	mask, err := cosi.NewMask(tSuite, publics, nil)
+	log.ErrFatal(err)
+	var v []kyber.Scalar
+	var V []kyber.Point
+	for i := 0; i < n; i++ {
+		mask.SetBit(i, true)
+		x, X := cosi.Commit(tSuite, nil)
+		v = append(v, x)
+		V = append(V, X)
+	}
+	aggV, _, err := cosi.AggregateCommitments(tSuite, V, make([][]byte, n))
+	log.ErrFatal(err)
+	c, err := cosi.Challenge(tSuite, aggV, mask.AggregatePublic, msg)
+	log.ErrFatal(err)
+
+	// the last node commits but does not respond
+	var r []kyber.Scalar
+	for i := 0; i < n-1; i++ {
+		ri, err := cosi.Response(tSuite, privates[i], v[i], c)
+		log.ErrFatal(err)
+		r = append(r, ri)
+	}
+	aggr, err := cosi.AggregateResponses(tSuite, r)
+	log.ErrFatal(err)
+	sig, err := cosi.Sign(tSuite, aggV, aggr, mask)
+	log.ErrFatal(err)
+
+	bftSig := &BFTSignature{Sig: sig, Msg: msg}
+	assert.NotNil(t, bftSig.Verify(tSuite, publics))
+	bftSig.Exceptions = []Exception{{Index: n - 1, Commitment: V[n-1]}}
+	assert.NotNil(t, bftSig.Verify(tSuite, publics))
+	payload, err := commitmentPayload(V[n-1])
+	log.ErrFatal(err)
+	bftSig.Exceptions[0].Sig, err = schnorr.Sign(tSuite, privates[n-1], payload)
+	log.ErrFatal(err)
+	assert.Nil(t, bftSig.Verify(tSuite, publics))
+	assert.Nil(t, cosi.VerifyWithExceptions(tSuite, publics, msg, sig, cosiExceptions(bftSig),
+		&cosi.ThresholdPolicy{T: n - 1}))
+
+	bftSig.Exceptions = append(bftSig.Exceptions, bftSig.Exceptions[0])
+	assert.NotNil(t, bftSig.Verify(tSuite, publics))
+	assert.NotNil(t, cosi.VerifyWithExceptions(tSuite, publics, msg, sig, cosiExceptions(bftSig),
+		&cosi.ThresholdPolicy{T: n - 2}))
+}
+
 func runProtocol(t *testing.T, name string, refuseCount int) {
 	for _, nbrHosts := range []int{3, 4, 13} {
 		runProtocolOnce(t, nbrHosts, name, refuseCount, true)
@@ -279,6 +684,13 @@ func runProtocolOnceGo(nbrHosts int, name string, refuseCount int, succeed bool,
 			return fmt.Errorf("%s: Shouldn't have succeeded for %d hosts, but signed for count: %d",
 				root.Name(), nbrHosts, refuseCount)
 		}
+		// the standalone cosi package must agree with BFTSignature.Verify
+		publics := root.Roster().Publics()
+		cosiErr := cosi.VerifyWithExceptions(tSuite, publics, sig.Msg, sig.Sig, cosiExceptions(sig),
+			&cosi.ThresholdPolicy{T: len(publics) - len(sig.Exceptions)})
+		if (err == nil) != (cosiErr == nil) {
+			return fmt.Errorf("%s: cosi and BFTSignature disagree: %v / %v", root.Name(), cosiErr, err)
+		}
 	case <-time.After(wait):
 		log.Lvl1("Going to break because of timeout")
 		return errors.New("Waited " + wait.String() + " for BFTCoSi to finish ...")
@@ -378,3 +790,36 @@ func min(a, b int) int {
 	}
 	return b
 }
+
+// cosiExceptions converts the exceptions of a BFTSignature for the cosi
+// package.
+func cosiExceptions(sig *BFTSignature) []cosi.Exception {
+	var exs []cosi.Exception
+	for _, ex := range sig.Exceptions {
+		exs = append(exs, cosi.Exception{Index: ex.Index, Commitment: ex.Commitment, Sig: ex.Sig})
+	}
+	return exs
+}
+
+// forgeException returns a copy of the signature with an exception for the
+// node of the given index, whose commitment cancels out the public key of the
+// node, -k*P. It only lacks the signature of the node on that commitment.
+func forgeException(sig *BFTSignature, publics []kyber.Point, index int) *BFTSignature {
+	aggPublic := tSuite.Point().Null()
+	for _, p := range publics {
+		aggPublic.Add(aggPublic, p)
+	}
+	h := sha512.New()
+	h.Write(sig.Sig[:tSuite.PointLen()])
+	_, err := aggPublic.MarshalTo(h)
+	log.ErrFatal(err)
+	h.Write(sig.Msg)
+	k := tSuite.Scalar().SetBytes(h.Sum(nil))
+	commitment := tSuite.Point().Mul(k, publics[index])
+	forged := *sig
+	forged.Exceptions = append(append([]Exception{}, sig.Exceptions...), Exception{
+		Index:      index,
+		Commitment: commitment.Neg(commitment),
+	})
+	return &forged
+}
@@ -0,0 +1,132 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/sign/schnorr"
+	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/network"
+)
+
+// BlameProof shows that a node agreed to sign in the "prepare" round, and then
+// refused to sign in the "commit" round: the node is not an exception of the
+// signature of the "prepare" round, but it is an exception of the final
+// signature, along with the commitment it made for the "commit" round.
+// The exception carries the signature of the node on its refusal, so that
+// nobody else can make it: the nodes excepted by their parent are not blamed,
+// as they might only have failed or been cut off by the failure of their
+// parent.
+type BlameProof struct {
+	// Index is the index of the blamed node in the roster.
+	Index int
+	// Prepare is the signature of the "prepare" round, on the hash of the
+	// message.
+	Prepare *BFTSignature
+	// Commit is the final signature, on the message.
+	Commit *BFTSignature
+}
+
+// VerifyBlameProof returns an error unless the proof shows that the node of
+// its index took part in the "prepare" round and refused to sign in the
+// "commit" round. publics are the public keys of the roster.
+func VerifyBlameProof(s network.Suite, publics []kyber.Point, bp *BlameProof) error {
+	if bp == nil || bp.Prepare == nil || bp.Commit == nil {
+		return errors.New("incomplete blame proof")
+	}
+	if bp.Index < 0 || bp.Index >= len(publics) {
+		return fmt.Errorf("invalid index %d", bp.Index)
+	}
+	data := sha512.Sum512(bp.Commit.Msg)
+	if !bytes.Equal(data[:], bp.Prepare.Msg) {
+		return errors.New("the signatures of the rounds are not on the same message")
+	}
+	if err := bp.Prepare.Verify(s, publics); err != nil {
+		return fmt.Errorf("invalid prepare signature: %s", err)
+	}
+	if err := bp.Commit.Verify(s, publics); err != nil {
+		return fmt.Errorf("invalid commit signature: %s", err)
+	}
+	if findException(bp.Prepare.Exceptions, bp.Index) != nil {
+		return errors.New("the node did not sign the prepare round")
+	}
+	ex := findException(bp.Commit.Exceptions, bp.Index)
+	if ex == nil {
+		return errors.New("the node signed the commit round")
+	}
+	if err := verifyRefusal(s, publics, bp.Commit.Msg, ex); err != nil {
+		return fmt.Errorf("the node did not refuse to sign the commit round: %s", err)
+	}
+	return nil
+}
+
+// blame returns the proofs against the nodes that are exceptions of the final
+// signature with their signed refusal, but not of the signature of the
+// "prepare" round.
+func (bft *ProtocolBFTCoSi) blame(sig *BFTSignature) []*BlameProof {
+	if sig.Sig == nil {
+		return nil
+	}
+	data := sha512.Sum512(bft.Msg)
+	prepare := &BFTSignature{
+		Sig:        bft.prepareSignature,
+		Msg:        data[:],
+		Exceptions: bft.tempExceptions,
+	}
+	var proofs []*BlameProof
+	publics := bft.Roster().Publics()
+	for i, ex := range sig.Exceptions {
+		if ex.Refusal == nil || findException(prepare.Exceptions, ex.Index) != nil {
+			continue
+		}
+		if err := verifyRefusal(bft.Suite(), publics, sig.Msg, &sig.Exceptions[i]); err != nil {
+			log.Error(bft.Name(), "invalid refusal of node", ex.Index, ":", err)
+			continue
+		}
+		proofs = append(proofs, &BlameProof{
+			Index:   ex.Index,
+			Prepare: prepare,
+			Commit:  sig,
+		})
+	}
+	return proofs
+}
+
+// refusalPayload returns what a node signs when it refuses to sign the
+// "commit" round on msg, after having made the given commitment.
+func refusalPayload(msg []byte, commitment kyber.Point) ([]byte, error) {
+	h := sha512.New()
+	h.Write([]byte("refusal"))
+	if _, err := commitment.MarshalTo(h); err != nil {
+		return nil, err
+	}
+	h.Write(msg)
+	return h.Sum(nil), nil
+}
+
+// verifyRefusal returns an error unless the exception carries the signature
+// of the node of its index on its refusal to sign msg.
+func verifyRefusal(s network.Suite, publics []kyber.Point, msg []byte, ex *Exception) error {
+	if ex.Refusal == nil {
+		return errors.New("no refusal")
+	}
+	refusal, err := refusalPayload(msg, ex.Commitment)
+	if err != nil {
+		return err
+	}
+	return schnorr.Verify(s, publics[ex.Index], refusal, ex.Refusal)
+}
+
+// findException returns the exception of the node with the given index, or
+// nil.
+func findException(exceptions []Exception, index int) *Exception {
+	for i := range exceptions {
+		if exceptions[i].Index == index {
+			return &exceptions[i]
+		}
+	}
+	return nil
+}
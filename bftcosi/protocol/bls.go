@@ -0,0 +1,444 @@
+package protocol
+
+import (
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	blscosi "bls-ftcosi/blsftcosi/protocol"
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/pairing"
+	"github.com/dedis/kyber/sign/bls"
+	"github.com/dedis/onet"
+	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/network"
+)
+
+func init() {
+	for _, i := range []interface{}{
+		BLSBFTSignature{},
+		BLSAnnounce{},
+		BLSResponse{},
+	} {
+		network.RegisterMessage(i)
+	}
+}
+
+// BLSBFTSignature is what the BLS variant of bftcosi outputs. It contains the
+// aggregate BLS signatures of both rounds, each followed by its participation
+// mask, and the roster indexes of the nodes missing from them.
+type BLSBFTSignature struct {
+	Msg []byte
+	// Prepare is the signature of the "prepare" round, on the hash of the
+	// message.
+	Prepare []byte
+	// Sig is the signature of the "commit" round, on the message. It is nil
+	// if too many nodes refused to sign.
+	Sig []byte
+	// PrepareExceptions are the nodes missing from the "prepare" signature.
+	PrepareExceptions []int
+	// Exceptions are the nodes missing from the "commit" signature.
+	Exceptions []int
+}
+
+// Verify returns whether the signatures of both rounds are valid for the
+// public keys, with only the nodes of the exceptions missing.
+func (bs *BLSBFTSignature) Verify(ps pairing.Suite, publics []kyber.Point) error {
+	if bs == nil || bs.Sig == nil || bs.Prepare == nil || bs.Msg == nil {
+		return errors.New("Invalid signature")
+	}
+	data := sha512.Sum512(bs.Msg)
+	if err := verifyBLS(ps, publics, data[:], bs.Prepare, bs.PrepareExceptions); err != nil {
+		return fmt.Errorf("prepare signature: %s", err)
+	}
+	if err := verifyBLS(ps, publics, bs.Msg, bs.Sig, bs.Exceptions); err != nil {
+		return fmt.Errorf("commit signature: %s", err)
+	}
+	return nil
+}
+
+// verifyBLS checks the signature followed by its mask, and that the nodes
+// missing from the mask are the exceptions.
+func verifyBLS(ps pairing.Suite, publics []kyber.Point, msg, sig []byte, exceptions []int) error {
+	pointLen := ps.G1().PointLen()
+	if len(sig) < pointLen {
+		return errors.New("signature too short")
+	}
+	missing, err := maskExceptions(ps, publics, sig[pointLen:])
+	if err != nil {
+		return err
+	}
+	if len(missing) != len(exceptions) {
+		return errors.New("the exceptions don't match the mask")
+	}
+	for i := range missing {
+		if missing[i] != exceptions[i] {
+			return errors.New("the exceptions don't match the mask")
+		}
+	}
+	policy := blscosi.NewThresholdPolicy(len(publics) - len(exceptions))
+	return blscosi.Verify(ps, publics, msg, sig, policy)
+}
+
+// maskExceptions returns the indexes of the nodes disabled in the mask.
+func maskExceptions(ps pairing.Suite, publics []kyber.Point, mask []byte) ([]int, error) {
+	m, err := blscosi.NewMask(ps, publics, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.SetMask(mask); err != nil {
+		return nil, err
+	}
+	var missing []int
+	for i := range publics {
+		if enabled, _ := m.IndexEnabled(i); !enabled {
+			missing = append(missing, i)
+		}
+	}
+	return missing, nil
+}
+
+// BLSAnnounce starts a round of the BLS variant. In the "commit" round, it
+// carries the signature of the "prepare" round, which the nodes check before
+// signing.
+type BLSAnnounce struct {
+	TYPE    RoundType
+	Msg     []byte
+	Data    []byte
+	Timeout time.Duration
+	Prepare []byte
+}
+
+// blsAnnounceChan is the type of the channel that will be used to catch the
+// announcements of the BLS variant.
+type blsAnnounceChan struct {
+	*onet.TreeNode
+	BLSAnnounce
+}
+
+// BLSResponse is the aggregate signature of a subtree, along with its mask.
+type BLSResponse struct {
+	TYPE RoundType
+	Sig  []byte
+	Mask []byte
+}
+
+// blsResponseChan is the type of the channel that will be used to catch the
+// responses of the BLS variant.
+type blsResponseChan struct {
+	*onet.TreeNode
+	BLSResponse
+}
+
+// ProtocolBLSBFTCoSi is the BLS variant of bftcosi. The "prepare" and the
+// "commit" rounds are each a single pass down and up the tree: the nodes sign
+// with BLS as soon as they get the announcement, and aggregate the signatures
+// and masks of their children, like blsftcosi. A node only signs the "commit"
+// round if the "prepare" signature is signed by enough nodes.
+// The roster must have keys of the G2 group of PairingSuite.
+type ProtocolBLSBFTCoSi struct {
+	*onet.TreeNodeInstance
+
+	// The message that will be signed
+	Msg []byte
+	// Data going along the msg to the verification
+	Data []byte
+	// Timeout is how long to wait for the responses of the children.
+	Timeout time.Duration
+	// VerificationFunction is called in the "prepare" round.
+	VerificationFunction VerificationFunction
+	// PairingSuite is the suite of the BLS signatures.
+	PairingSuite pairing.Suite
+
+	// allowedExceptions is how many nodes can refuse to sign
+	allowedExceptions int
+	// our index in the Roster list
+	index int
+	// prepare signature and its exceptions, on the root
+	prepare           []byte
+	prepareExceptions []int
+	signature         *BLSBFTSignature
+
+	announceChan chan blsAnnounceChan
+	responseChan chan blsResponseChan
+
+	onDone          func()
+	onSignatureDone func(*BLSBFTSignature)
+	closeOnce       sync.Once
+}
+
+// NewBLSBFTCoSiProtocol returns a new instance of the BLS variant of bftcosi.
+func NewBLSBFTCoSiProtocol(n *onet.TreeNodeInstance, verify VerificationFunction, ps pairing.Suite) (*ProtocolBLSBFTCoSi, error) {
+	nodes := len(n.Tree().List())
+	bft := &ProtocolBLSBFTCoSi{
+		TreeNodeInstance:     n,
+		Msg:                  make([]byte, 0),
+		Data:                 make([]byte, 0),
+		Timeout:              defaultTimeout,
+		VerificationFunction: verify,
+		PairingSuite:         ps,
+		allowedExceptions:    nodes - (nodes+1)*2/3,
+	}
+	bft.index, _ = n.Roster().Search(n.ServerIdentity().ID)
+	if err := bft.RegisterChannels(&bft.announceChan, &bft.responseChan); err != nil {
+		return nil, err
+	}
+	n.OnDoneCallback(bft.nodeDone)
+	return bft, nil
+}
+
+// Start starts the "prepare" round, the root starts the "commit" round once it
+// has the "prepare" signature.
+func (bft *ProtocolBLSBFTCoSi) Start() error {
+	bft.announceChan <- blsAnnounceChan{BLSAnnounce: BLSAnnounce{
+		TYPE:    RoundPrepare,
+		Msg:     bft.Msg,
+		Data:    bft.Data,
+		Timeout: bft.Timeout,
+	}}
+	return nil
+}
+
+// Dispatch runs both rounds.
+func (bft *ProtocolBLSBFTCoSi) Dispatch() error {
+	defer bft.Done()
+	for range []RoundType{RoundPrepare, RoundCommit} {
+		msg, ok := <-bft.announceChan
+		if !ok {
+			return nil
+		}
+		if err := bft.handleAnnouncement(msg.BLSAnnounce); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Signature returns the signature, once the root has finished.
+func (bft *ProtocolBLSBFTCoSi) Signature() *BLSBFTSignature {
+	return bft.signature
+}
+
+// RegisterOnDone registers a callback to call when the protocol has finished.
+func (bft *ProtocolBLSBFTCoSi) RegisterOnDone(fn func()) {
+	bft.onDone = fn
+}
+
+// RegisterOnSignatureDone registers a callback to call when the root has the
+// signature.
+func (bft *ProtocolBLSBFTCoSi) RegisterOnSignatureDone(fn func(*BLSBFTSignature)) {
+	bft.onSignatureDone = fn
+}
+
+// Shutdown closes the channels.
+func (bft *ProtocolBLSBFTCoSi) Shutdown() error {
+	bft.closeOnce.Do(func() {
+		close(bft.announceChan)
+		close(bft.responseChan)
+	})
+	return nil
+}
+
+// handleAnnouncement sends the announcement down the tree, signs, and sends
+// the aggregate signature of the subtree up once the children responded.
+func (bft *ProtocolBLSBFTCoSi) handleAnnouncement(ann BLSAnnounce) error {
+	if !bft.IsRoot() {
+		bft.Msg = ann.Msg
+		bft.Data = ann.Data
+		bft.Timeout = ann.Timeout
+	}
+	if !bft.IsLeaf() {
+		// our children give up on their own children before we give up
+		// on them
+		down := ann
+		down.Timeout /= 2
+		go func() {
+			if errs := bft.SendToChildrenInParallel(&down); len(errs) > 0 {
+				log.Lvl2(bft.Name(), "couldn't send the announcement to all the children:", errs)
+			}
+		}()
+	}
+
+	verified := make(chan bool, 1)
+	go func() {
+		verified <- bft.verify(ann)
+	}()
+	responses := bft.collectResponses(ann.TYPE)
+
+	msg := bft.Msg
+	if ann.TYPE == RoundPrepare {
+		data := sha512.Sum512(bft.Msg)
+		msg = data[:]
+	}
+	r, err := bft.aggregate(ann.TYPE, msg, <-verified, responses)
+	if err != nil {
+		return err
+	}
+	if !bft.IsRoot() {
+		return bft.SendToParent(r)
+	}
+	return bft.finishRound(ann.TYPE, r)
+}
+
+// verify returns whether the node signs the round: the verification function
+// decides in the "prepare" round, and the "prepare" signature in the "commit"
+// round.
+func (bft *ProtocolBLSBFTCoSi) verify(ann BLSAnnounce) bool {
+	if ann.TYPE == RoundPrepare {
+		return bft.VerificationFunction(bft.Msg, bft.Data)
+	}
+	publics := bft.Roster().Publics()
+	data := sha512.Sum512(bft.Msg)
+	policy := blscosi.NewThresholdPolicy(len(publics) - bft.allowedExceptions)
+	if err := blscosi.Verify(bft.PairingSuite, publics, data[:], ann.Prepare, policy); err != nil {
+		log.Lvl2(bft.Name(), "refusing to sign the commit round:", err)
+		return false
+	}
+	return true
+}
+
+// collectResponses returns the responses of the children for the round,
+// received before the timeout.
+func (bft *ProtocolBLSBFTCoSi) collectResponses(t RoundType) []BLSResponse {
+	var responses []BLSResponse
+	timeout := time.After(bft.Timeout)
+	for len(responses) < len(bft.Children()) {
+		select {
+		case msg, ok := <-bft.responseChan:
+			if !ok {
+				return responses
+			}
+			if msg.TYPE == t {
+				responses = append(responses, msg.BLSResponse)
+			}
+		case <-timeout:
+			log.Lvl1("timeout while trying to read response messages")
+			return responses
+		}
+	}
+	return responses
+}
+
+// aggregate returns the aggregate signature and mask of the valid responses,
+// along with our own signature if we sign.
+func (bft *ProtocolBLSBFTCoSi) aggregate(t RoundType, msg []byte, sign bool, responses []BLSResponse) (*BLSResponse, error) {
+	ps := bft.PairingSuite
+	mask, err := blscosi.NewMask(ps, bft.Roster().Publics(), nil)
+	if err != nil {
+		return nil, err
+	}
+	sig := ps.G1().Point().Null()
+	if sign {
+		buf, err := bls.Sign(ps, bft.Private(), msg)
+		if err != nil {
+			return nil, err
+		}
+		own := ps.G1().Point()
+		if err := own.UnmarshalBinary(buf); err != nil {
+			return nil, err
+		}
+		sig.Add(sig, own)
+		mask.SetBit(bft.index, true)
+	}
+	for _, r := range responses {
+		// a child with an invalid aggregate is left out, instead of
+		// invalidating the signature of the whole round
+		s, err := bft.childSignature(msg, mask.Mask(), r)
+		if err != nil {
+			log.Lvl2(bft.Name(), "invalid signature of a child:", err)
+			continue
+		}
+		m, err := blscosi.AggregateMasks(mask.Mask(), r.Mask)
+		if err != nil {
+			log.Lvl2(bft.Name(), "invalid mask of a child:", err)
+			continue
+		}
+		sig.Add(sig, s)
+		mask.SetMask(m)
+	}
+	buf, err := sig.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return &BLSResponse{TYPE: t, Sig: buf, Mask: mask.Mask()}, nil
+}
+
+// childSignature returns the aggregate signature of the response of a child,
+// once checked to be the one of the nodes of its mask on msg. None of them may
+// be in the mask of the signatures aggregated so far, or they would count
+// twice.
+func (bft *ProtocolBLSBFTCoSi) childSignature(msg, aggregated []byte, r BLSResponse) (kyber.Point, error) {
+	ps := bft.PairingSuite
+	if len(r.Mask) != len(aggregated) {
+		return nil, errors.New("mask of the wrong length")
+	}
+	for i := range r.Mask {
+		if r.Mask[i]&aggregated[i] != 0 {
+			return nil, errors.New("the mask overlaps the one of another subtree")
+		}
+	}
+	mask, err := blscosi.NewMask(ps, bft.Roster().Publics(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := mask.SetMask(r.Mask); err != nil {
+		return nil, err
+	}
+	if err := bls.Verify(ps, mask.AggregatePublic, msg, r.Sig); err != nil {
+		return nil, err
+	}
+	s := ps.G1().Point()
+	if err := s.UnmarshalBinary(r.Sig); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// finishRound makes the signature of the round on the root. After the
+// "prepare" round, it starts the "commit" round.
+func (bft *ProtocolBLSBFTCoSi) finishRound(t RoundType, r *BLSResponse) error {
+	exceptions, err := maskExceptions(bft.PairingSuite, bft.Roster().Publics(), r.Mask)
+	if err != nil {
+		return err
+	}
+	sig := append(r.Sig, r.Mask...)
+	if t == RoundPrepare {
+		bft.prepare = sig
+		bft.prepareExceptions = exceptions
+		bft.announceChan <- blsAnnounceChan{BLSAnnounce: BLSAnnounce{
+			TYPE:    RoundCommit,
+			Msg:     bft.Msg,
+			Data:    bft.Data,
+			Timeout: bft.Timeout,
+			Prepare: sig,
+		}}
+		return nil
+	}
+
+	bft.signature = &BLSBFTSignature{
+		Msg:               bft.Msg,
+		Prepare:           bft.prepare,
+		Sig:               sig,
+		PrepareExceptions: bft.prepareExceptions,
+		Exceptions:        exceptions,
+	}
+	if len(bft.prepareExceptions) > bft.allowedExceptions || len(exceptions) > bft.allowedExceptions {
+		log.Errorf("%s: More than threshold (%d/%d) refused to sign - aborting.",
+			bft.Roster(), len(exceptions), len(bft.Roster().List))
+		bft.signature.Sig = nil
+	}
+	if bft.onSignatureDone != nil {
+		bft.onSignatureDone(bft.signature)
+	}
+	return nil
+}
+
+func (bft *ProtocolBLSBFTCoSi) nodeDone() bool {
+	if bft.onDone != nil {
+		// only true for the root
+		bft.onDone()
+	}
+	return true
+}
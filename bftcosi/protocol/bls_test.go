@@ -0,0 +1,163 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/pairing"
+	"github.com/dedis/kyber/pairing/bn256"
+	"github.com/dedis/onet"
+	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/network"
+)
+
+// blsSuite gives the servers keys of the G2 group of the pairing suite.
+var blsSuite = struct {
+	kyber.Group
+	pairing.Suite
+}{
+	Group: bn256.NewSuiteG2(),
+	Suite: bn256.NewSuite(),
+}
+
+func TestBLSBftCoSi(t *testing.T) {
+	const TestProtocolName = "DummyBLSBFTCoSi"
+	const TestRefuseProtocolName = "DummyBLSBFTCoSiRefuse"
+	oldTimeout := defaultTimeout
+	defaultTimeout = 500 * time.Millisecond
+	defer func() { defaultTimeout = oldTimeout }()
+
+	onet.GlobalProtocolRegister(TestProtocolName, func(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+		return NewBLSBFTCoSiProtocol(n, func(m, d []byte) bool { return true }, blsSuite.Suite)
+	})
+	// the last node of the roster refuses the message
+	onet.GlobalProtocolRegister(TestRefuseProtocolName, func(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+		last := n.Roster().List[len(n.Roster().List)-1]
+		refuse := n.ServerIdentity().ID.Equal(last.ID)
+		return NewBLSBFTCoSiProtocol(n, func(m, d []byte) bool { return !refuse }, blsSuite.Suite)
+	})
+
+	tests := []struct {
+		name            string
+		hosts, bf       int
+		killed          int
+		prepare, commit int
+	}{
+		{TestProtocolName, 5, 4, 0, 0, 0},
+		{TestProtocolName, 13, 3, 0, 0, 0},
+		{TestProtocolName, 13, 3, 1, 1, 1},
+		{TestRefuseProtocolName, 5, 4, 0, 1, 0},
+	}
+	for _, test := range tests {
+		local := onet.NewLocalTest(blsSuite)
+		local.Check = onet.CheckNone
+		servers, roster, tree := local.GenBigTree(test.hosts, test.hosts, test.bf, true)
+		for _, s := range servers[len(servers)-test.killed:] {
+			if err := s.Close(); err != nil {
+				local.CloseAll()
+				t.Fatal(err)
+			}
+		}
+
+		node, err := local.CreateProtocol(test.name, tree)
+		if err != nil {
+			local.CloseAll()
+			t.Fatal("Couldn't create new node:", err)
+		}
+		root := node.(*ProtocolBLSBFTCoSi)
+		root.Msg = []byte("Hello BFTCoSi")
+		done := make(chan bool, 1)
+		root.RegisterOnDone(func() {
+			done <- true
+		})
+		go root.Start()
+
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			local.CloseAll()
+			t.Fatalf("%s with %d hosts: timeout", test.name, test.hosts)
+		}
+		sig := root.Signature()
+		if err := sig.Verify(blsSuite.Suite, roster.Publics()); err != nil {
+			local.CloseAll()
+			t.Fatalf("%s with %d hosts: %s", test.name, test.hosts, err)
+		}
+		if len(sig.PrepareExceptions) != test.prepare || len(sig.Exceptions) != test.commit {
+			local.CloseAll()
+			t.Fatalf("%s with %d hosts: exceptions %v and %v", test.name, test.hosts, sig.PrepareExceptions, sig.Exceptions)
+		}
+		// the exceptions must match the masks
+		sig.Exceptions = append(sig.Exceptions, 0)
+		if err := sig.Verify(blsSuite.Suite, roster.Publics()); err == nil {
+			local.CloseAll()
+			t.Fatalf("%s with %d hosts: verified with a wrong exception", test.name, test.hosts)
+		}
+		local.CloseAll()
+	}
+	// Do it manually because we set CheckNone in local
+	log.AfterTest(t)
+}
+
+func TestBLSBftCoSiInvalidResponse(t *testing.T) {
+	const TestProtocolName = "DummyBLSBFTCoSiInvalid"
+	oldTimeout := defaultTimeout
+	defaultTimeout = 500 * time.Millisecond
+	defer func() { defaultTimeout = oldTimeout }()
+
+	onet.GlobalProtocolRegister(TestProtocolName, func(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+		return NewBLSBFTCoSiProtocol(n, func(m, d []byte) bool { return true }, blsSuite.Suite)
+	})
+
+	local := onet.NewLocalTest(blsSuite)
+	local.Check = onet.CheckNone
+	servers, roster, tree := local.GenBigTree(5, 5, 4, true)
+
+	// the root gets a random signature from the last node in both rounds
+	invalid := servers[len(servers)-1].ServerIdentity
+	overlay := local.Overlays[servers[0].ServerIdentity.ID]
+	servers[0].RegisterProcessorFunc(onet.ProtocolMsgID, func(e *network.Envelope) {
+		pm := e.Msg.(*onet.ProtocolMsg)
+		_, msg, err := network.Unmarshal(pm.MsgSlice, blsSuite)
+		if r, ok := msg.(*BLSResponse); err == nil && ok && e.ServerIdentity.ID.Equal(invalid.ID) {
+			r.Sig, _ = blsSuite.G1().Point().Pick(blsSuite.RandomStream()).MarshalBinary()
+			pm.MsgSlice, _ = network.Marshal(r)
+		}
+		overlay.Process(e)
+	})
+
+	node, err := local.CreateProtocol(TestProtocolName, tree)
+	if err != nil {
+		local.CloseAll()
+		t.Fatal("Couldn't create new node:", err)
+	}
+	root := node.(*ProtocolBLSBFTCoSi)
+	root.Msg = []byte("Hello BFTCoSi")
+	done := make(chan bool, 1)
+	root.RegisterOnDone(func() {
+		done <- true
+	})
+	go root.Start()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		local.CloseAll()
+		t.Fatal("timeout")
+	}
+	sig := root.Signature()
+	if err := sig.Verify(blsSuite.Suite, roster.Publics()); err != nil {
+		local.CloseAll()
+		t.Fatal(err)
+	}
+	index, _ := roster.Search(invalid.ID)
+	if len(sig.PrepareExceptions) != 1 || sig.PrepareExceptions[0] != index ||
+		len(sig.Exceptions) != 1 || sig.Exceptions[0] != index {
+		local.CloseAll()
+		t.Fatalf("exceptions %v and %v", sig.PrepareExceptions, sig.Exceptions)
+	}
+	local.CloseAll()
+	// Do it manually because we set CheckNone in local
+	log.AfterTest(t)
+}
@@ -1,10 +1,11 @@
 package protocol
 
 import (
-	"gopkg.in/dedis/onet.v1"
 	"errors"
 	"fmt"
-	"gopkg.in/dedis/onet.v1/network"
+
+	"github.com/dedis/onet"
+	"github.com/dedis/onet/network"
 )
 
 // GenTree will create a given number of subtrees of the same number of nodes.
@@ -1,12 +1,10 @@
 package protocol
 
 import (
-	//"bls-ftcosi/bftcosi/cosi"
-	//"gopkg.in/dedis/crypto.v0/abstract"
-	"gopkg.in/dedis/onet.v1"
-	//"gopkg.in/dedis/onet.v1/log"
 	"fmt"
-	"gopkg.in/dedis/onet.v1/network"
+
+	"github.com/dedis/onet"
+	"github.com/dedis/onet/network"
 )
 
 
@@ -0,0 +1,170 @@
+package protocol
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dedis/onet"
+	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/network"
+)
+
+// Interception is what a server does with the bftcosi messages it intercepts.
+type Interception int
+
+const (
+	// InterceptNone passes the messages on to the protocol.
+	InterceptNone Interception = iota
+	// InterceptDrop drops the messages.
+	InterceptDrop
+	// InterceptDelay passes the messages on after a delay.
+	InterceptDelay
+	// InterceptCorrupt replaces the commitment, challenge or response of the
+	// messages with a random one, and swaps the round of the announcements.
+	InterceptCorrupt
+)
+
+var interceptionNames = map[string]Interception{
+	"":        InterceptNone,
+	"none":    InterceptNone,
+	"drop":    InterceptDrop,
+	"delay":   InterceptDelay,
+	"corrupt": InterceptCorrupt,
+}
+
+// ParseInterception returns the interception with the given name: none, drop,
+// delay or corrupt.
+func ParseInterception(name string) (Interception, error) {
+	i, ok := interceptionNames[strings.ToLower(name)]
+	if !ok {
+		return InterceptNone, fmt.Errorf("unknown interception %q", name)
+	}
+	return i, nil
+}
+
+var messageTypes = map[string]network.MessageTypeID{
+	"Announce":         network.MessageType(Announce{}),
+	"Commitment":       network.MessageType(Commitment{}),
+	"ChallengePrepare": network.MessageType(ChallengePrepare{}),
+	"ChallengeCommit":  network.MessageType(ChallengeCommit{}),
+	"Response":         network.MessageType(Response{}),
+	"BLSAnnounce":      network.MessageType(BLSAnnounce{}),
+	"BLSResponse":      network.MessageType(BLSResponse{}),
+}
+
+// ParseMessageTypes returns the types of the bftcosi messages whose names are
+// given separated by commas, e.g. "Announce,Response".
+func ParseMessageTypes(names string) ([]network.MessageTypeID, error) {
+	var types []network.MessageTypeID
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		t, ok := messageTypes[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown message type %q", name)
+		}
+		types = append(types, t)
+	}
+	return types, nil
+}
+
+// Interceptor makes a server drop, delay or corrupt some types of the bftcosi
+// messages it receives, before they reach the protocol, to inject faults.
+type Interceptor struct {
+	// Interception is what happens to the intercepted messages.
+	Interception Interception
+	// Messages are the types of the intercepted messages.
+	Messages []network.MessageTypeID
+	// Delay is how long the messages are delayed with InterceptDelay.
+	Delay time.Duration
+	// Suite is used to decode the messages and to corrupt them.
+	Suite network.Suite
+}
+
+// Register makes the server intercept the messages of all its protocols, and
+// pass the other ones on to the overlay.
+func (i *Interceptor) Register(server *onet.Server, overlay *onet.Overlay) {
+	server.RegisterProcessorFunc(onet.ProtocolMsgID, func(e *network.Envelope) {
+		if i.intercept(e, overlay.Process) {
+			overlay.Process(e)
+		}
+	})
+}
+
+// intercept applies the interception to the message of the envelope if it
+// is one of the intercepted types, and returns whether to pass it on. A
+// delayed message is passed on to process later instead, without holding up
+// the messages received in the meantime.
+func (i *Interceptor) intercept(e *network.Envelope, process func(*network.Envelope)) bool {
+	pm, ok := e.Msg.(*onet.ProtocolMsg)
+	if !ok || i.Interception == InterceptNone {
+		return true
+	}
+	typ, msg, err := network.Unmarshal(pm.MsgSlice, i.Suite)
+	if err != nil || !i.intercepted(typ) {
+		return true
+	}
+	switch i.Interception {
+	case InterceptDrop:
+		log.Lvl3("dropping", typ)
+		return false
+	case InterceptDelay:
+		log.Lvl3("delaying", typ)
+		time.AfterFunc(i.Delay, func() {
+			process(e)
+		})
+		return false
+	case InterceptCorrupt:
+		log.Lvl3("corrupting", typ)
+		buf, err := network.Marshal(i.corrupt(msg))
+		if err != nil {
+			log.Error("couldn't corrupt the message:", err)
+			return true
+		}
+		pm.MsgSlice = buf
+	}
+	return true
+}
+
+func (i *Interceptor) intercepted(typ network.MessageTypeID) bool {
+	for _, t := range i.Messages {
+		if t.Equal(typ) {
+			return true
+		}
+	}
+	return false
+}
+
+// corrupt returns the message with a random commitment, challenge or response,
+// with a damaged BLS signature, or with the other round for an announcement.
+func (i *Interceptor) corrupt(msg network.Message) network.Message {
+	switch m := msg.(type) {
+	case *Announce:
+		m.TYPE = otherRound(m.TYPE)
+	case *BLSAnnounce:
+		m.TYPE = otherRound(m.TYPE)
+	case *BLSResponse:
+		if len(m.Sig) > 0 {
+			m.Sig[0] ^= 0xff
+		}
+	case *Commitment:
+		m.Commitment = i.Suite.Point().Pick(i.Suite.RandomStream())
+	case *ChallengePrepare:
+		m.Challenge = i.Suite.Scalar().Pick(i.Suite.RandomStream())
+	case *ChallengeCommit:
+		m.Challenge = i.Suite.Scalar().Pick(i.Suite.RandomStream())
+	case *Response:
+		m.Response = i.Suite.Scalar().Pick(i.Suite.RandomStream())
+	}
+	return msg
+}
+
+func otherRound(t RoundType) RoundType {
+	if t == RoundPrepare {
+		return RoundCommit
+	}
+	return RoundPrepare
+}
@@ -0,0 +1,140 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dedis/onet"
+	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/network"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseInterception(t *testing.T) {
+	i, err := ParseInterception("Delay")
+	assert.Nil(t, err)
+	assert.Equal(t, InterceptDelay, i)
+	_, err = ParseInterception("crash")
+	assert.NotNil(t, err)
+
+	types, err := ParseMessageTypes("Announce, Response")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(types))
+	types, err = ParseMessageTypes("BLSAnnounce,BLSResponse")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(types))
+	_, err = ParseMessageTypes("Announce,Stop")
+	assert.NotNil(t, err)
+}
+
+func TestInterceptorCorrupt(t *testing.T) {
+	i := &Interceptor{Interception: InterceptCorrupt, Suite: tSuite}
+	commitment := tSuite.Point().Pick(tSuite.RandomStream())
+	c := i.corrupt(&Commitment{Commitment: commitment.Clone()}).(*Commitment)
+	assert.False(t, c.Commitment.Equal(commitment))
+	a := i.corrupt(&Announce{TYPE: RoundPrepare}).(*Announce)
+	assert.Equal(t, RoundCommit, a.TYPE)
+	ba := i.corrupt(&BLSAnnounce{TYPE: RoundCommit}).(*BLSAnnounce)
+	assert.Equal(t, RoundPrepare, ba.TYPE)
+	br := i.corrupt(&BLSResponse{Sig: []byte{1, 2}}).(*BLSResponse)
+	assert.Equal(t, []byte{0xfe, 2}, br.Sig)
+}
+
+func TestInterceptorDelay(t *testing.T) {
+	messages, err := ParseMessageTypes("Announce")
+	assert.Nil(t, err)
+	i := &Interceptor{
+		Interception: InterceptDelay,
+		Messages:     messages,
+		Delay:        100 * time.Millisecond,
+		Suite:        tSuite,
+	}
+	buf, err := network.Marshal(&Announce{TYPE: RoundPrepare})
+	assert.Nil(t, err)
+	e := &network.Envelope{Msg: &onet.ProtocolMsg{MsgSlice: buf}}
+
+	// the delayed message doesn't hold up the next ones
+	processed := make(chan *network.Envelope, 1)
+	start := time.Now()
+	assert.False(t, i.intercept(e, func(e *network.Envelope) {
+		processed <- e
+	}))
+	assert.True(t, time.Since(start) < i.Delay)
+	select {
+	case p := <-processed:
+		assert.Equal(t, e, p)
+		assert.True(t, time.Since(start) >= i.Delay)
+	case <-time.After(10 * i.Delay):
+		t.Fatal("the delayed message was never passed on")
+	}
+}
+
+func TestInterceptor(t *testing.T) {
+	const TestProtocolName = "DummyBFTCoSiIntercept"
+	oldTimeout := defaultTimeout
+	defaultTimeout = 500 * time.Millisecond
+	defer func() { defaultTimeout = oldTimeout }()
+
+	onet.GlobalProtocolRegister(TestProtocolName, func(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+		return NewBFTCoSiProtocol(n, func(m, d []byte) bool { return true })
+	})
+
+	tests := []struct {
+		interception Interception
+		messages     string
+	}{
+		{InterceptDrop, "Announce"},
+		{InterceptDrop, "ChallengePrepare"},
+		{InterceptDelay, "Announce"},
+	}
+	for _, test := range tests {
+		local := onet.NewLocalTest(tSuite)
+		local.Check = onet.CheckNone
+		servers, roster, tree := local.GenBigTree(5, 5, 4, true)
+
+		// the last leaf doesn't take part in the rounds
+		messages, err := ParseMessageTypes(test.messages)
+		assert.Nil(t, err)
+		failing := servers[len(servers)-1]
+		interceptor := &Interceptor{
+			Interception: test.interception,
+			Messages:     messages,
+			Delay:        2 * defaultTimeout,
+			Suite:        tSuite,
+		}
+		interceptor.Register(failing, local.Overlays[failing.ServerIdentity.ID])
+
+		node, err := local.CreateProtocol(TestProtocolName, tree)
+		if err != nil {
+			local.CloseAll()
+			t.Fatal("Couldn't create new node:", err)
+		}
+		root := node.(*ProtocolBFTCoSi)
+		root.Msg = []byte("Hello BFTCoSi")
+		done := make(chan bool, 1)
+		root.RegisterOnDone(func() {
+			done <- true
+		})
+		go root.Start()
+
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			local.CloseAll()
+			t.Fatalf("%s intercepted: timeout", test.messages)
+		}
+		sig := root.Signature()
+		if err := sig.Verify(root.Suite(), roster.Publics()); err != nil {
+			local.CloseAll()
+			t.Fatalf("%s intercepted: %s", test.messages, err)
+		}
+		index, _ := roster.Search(failing.ServerIdentity.ID)
+		if len(sig.Exceptions) != 1 || sig.Exceptions[0].Index != index {
+			local.CloseAll()
+			t.Fatalf("%s intercepted: exceptions %v", test.messages, sig.Exceptions)
+		}
+		local.CloseAll()
+	}
+	// Do it manually because we set CheckNone in local
+	log.AfterTest(t)
+}
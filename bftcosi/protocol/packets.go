@@ -3,9 +3,12 @@ package protocol
 import (
 	"crypto/sha512"
 	"errors"
+	"fmt"
 	"time"
 
+	"bls-ftcosi/bftcosi/cosi"
 	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/sign/schnorr"
 	"github.com/dedis/onet"
 
 	"github.com/dedis/onet/network"
@@ -14,11 +17,13 @@ import (
 func init() {
 	for _, i := range []interface{}{
 		BFTSignature{},
+		BlameProof{},
 		Announce{},
 		Commitment{},
 		ChallengePrepare{},
 		ChallengeCommit{},
 		Response{},
+		Stop{},
 	} {
 		network.RegisterMessage(i)
 	}
@@ -50,6 +55,11 @@ type BFTSignature struct {
 // signature, so it can be verified by dedis/crypto/cosi.
 // publics is a slice of all public signatures, and the msg is the msg
 // being signed.
+// The commitment of an exception is not bound by the challenge, so every
+// exception with a commitment must carry the signature of its node on it.
+// Still, a node can except itself with a commitment of its choosing, so a
+// valid signature only proves that the nodes not excepted signed msg if at
+// least one of them is honest, not that all of them did.
 func (bs *BFTSignature) Verify(s network.Suite, publics []kyber.Point) error {
 	if bs == nil || bs.Sig == nil || bs.Msg == nil {
 		return errors.New("Invalid signature")
@@ -64,7 +74,18 @@ func (bs *BFTSignature) Verify(s network.Suite, publics []kyber.Point) error {
 
 	// compute the aggregate commit of exception
 	aggExCommit := s.Point().Null()
+	excepted := make(map[int]bool)
 	for _, ex := range bs.Exceptions {
+		if ex.Index < 0 || ex.Index >= len(publics) || ex.Commitment == nil {
+			return errors.New("Invalid exception")
+		}
+		if excepted[ex.Index] {
+			return errors.New("duplicate exception")
+		}
+		excepted[ex.Index] = true
+		if err := verifyCommitment(s, publics, &ex); err != nil {
+			return fmt.Errorf("exception %d: %s", ex.Index, err)
+		}
 		aggExCommit = aggExCommit.Add(aggExCommit, ex.Commitment)
 		aggReducedPublic.Sub(aggReducedPublic, publics[ex.Index])
 	}
@@ -110,11 +131,76 @@ func (bs *BFTSignature) Verify(s network.Suite, publics []kyber.Point) error {
 	return nil
 }
 
+// String returns the name of the round.
+func (t RoundType) String() string {
+	if t == RoundPrepare {
+		return "prepare"
+	}
+	return "commit"
+}
+
+// Phase is one of the four phases of a round.
+type Phase int32
+
+const (
+	// PhaseAnnouncement is when a node waits for the announcement of its
+	// parent.
+	PhaseAnnouncement Phase = iota
+	// PhaseCommitment is when a node gathers the commitments of its
+	// children.
+	PhaseCommitment
+	// PhaseChallenge is when a node waits for the challenge of its parent.
+	PhaseChallenge
+	// PhaseResponse is when a node gathers the responses of its children.
+	PhaseResponse
+)
+
+// String returns the name of the phase.
+func (p Phase) String() string {
+	switch p {
+	case PhaseAnnouncement:
+		return "announcement"
+	case PhaseCommitment:
+		return "commitment"
+	case PhaseChallenge:
+		return "challenge"
+	default:
+		return "response"
+	}
+}
+
+// Timeouts are how long a node waits in each phase of a round. The root
+// sends them down the tree in the announcement. The commitment and response
+// timeouts are halved at each level, so that children give up on their own
+// children before their parent gives up on them. The announcement and
+// challenge timeouts are how long a node waits on its parent, and stay the
+// same down the tree.
+type Timeouts struct {
+	Announcement time.Duration
+	Commitment   time.Duration
+	Challenge    time.Duration
+	Response     time.Duration
+}
+
+// TimeoutError is returned by a node that gave up on the round because a
+// message didn't arrive in time.
+type TimeoutError struct {
+	Round RoundType
+	Phase Phase
+	// Peer is the node whose message was missing.
+	Peer *network.ServerIdentity
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("timeout in the %s phase of the %s round waiting for %s",
+		e.Phase, e.Round, e.Peer)
+}
+
 // Announce is the struct used during the announcement phase (of both
 // rounds)
 type Announce struct {
-	TYPE    RoundType
-	Timeout time.Duration
+	TYPE     RoundType
+	Timeouts Timeouts
 }
 
 // announceChan is the type of the channel that will be used to catch
@@ -125,9 +211,12 @@ type announceChan struct {
 }
 
 // Commitment is the commitment packets that is sent for both rounds
+// The signature is the one of the sender on its commitment, see
+// commitmentPayload.
 type Commitment struct {
 	TYPE       RoundType
 	Commitment kyber.Point
+	Sig        []byte
 }
 
 // commitChan is the type of the channel that will be used to catch commitment
@@ -188,13 +277,52 @@ type responseChan struct {
 	Response
 }
 
+// Stop is sent by the root to all the nodes to abort the round, when it
+// restarts it over another tree.
+type Stop struct{}
+
+// stopChan is the type used to handle the stop messages.
+type stopChan struct {
+	*onet.TreeNode
+	Stop
+}
+
 // Exception represents the exception mechanism used in BFTCosi to indicate a
 // signer did not want to sign.
 // The index is the index of the public key of the cosigner that do not want to
 // sign.
 // The commit is needed in order to be able to
 // correctly verify the signature
+// The sig is the signature of the cosigner on its commitment, see
+// commitmentPayload. It is nil for a null commitment.
+// The refusal is the signature of the cosigner on its refusal to sign the
+// "commit" round, see refusalPayload. It is nil for the cosigners excepted by
+// their parent because they failed or could not be reached.
 type Exception struct {
 	Index      int
 	Commitment kyber.Point
+	Sig        []byte
+	Refusal    []byte
+}
+
+// commitmentPayload returns what a node signs along with its commitment, the
+// same as the cosi package checks in VerifyWithExceptions.
+func commitmentPayload(commitment kyber.Point) ([]byte, error) {
+	return cosi.CommitmentPayload(commitment)
+}
+
+// verifyCommitment returns an error unless the commitment of the exception is
+// null or carries the signature of the node of its index.
+func verifyCommitment(s network.Suite, publics []kyber.Point, ex *Exception) error {
+	if ex.Commitment.Equal(s.Point().Null()) {
+		return nil
+	}
+	if ex.Sig == nil {
+		return errors.New("unsigned commitment")
+	}
+	msg, err := commitmentPayload(ex.Commitment)
+	if err != nil {
+		return err
+	}
+	return schnorr.Verify(s, publics[ex.Index], msg, ex.Sig)
 }
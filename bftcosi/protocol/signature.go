@@ -0,0 +1,167 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/dedis/onet/network"
+)
+
+// signatureVersion is the first byte of the binary encoding of a
+// BFTSignature, to be able to change the encoding without breaking the
+// signatures already archived.
+const signatureVersion = 1
+
+// The encodings below are not MarshalBinary and MarshalJSON on purpose:
+// BFTSignature is sent in the protocol messages, and the network library
+// would pick up a MarshalBinary method instead of its own encoding.
+
+// Encode returns the binary encoding of the signature:
+//
+//	version (1 byte) || len(Msg) || Msg || len(Sig) || Sig ||
+//	len(Exceptions) ||
+//	(Index || Commitment || len(Sig) || Sig || len(Refusal) || Refusal)...
+//
+// where the lengths and the indexes are big-endian uint32.
+func (bs *BFTSignature) Encode() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(signatureVersion)
+	writeBytes(&buf, bs.Msg)
+	writeBytes(&buf, bs.Sig)
+	binary.Write(&buf, binary.BigEndian, uint32(len(bs.Exceptions)))
+	for _, ex := range bs.Exceptions {
+		if ex.Index < 0 || ex.Commitment == nil {
+			return nil, errors.New("invalid exception")
+		}
+		binary.Write(&buf, binary.BigEndian, uint32(ex.Index))
+		if _, err := ex.Commitment.MarshalTo(&buf); err != nil {
+			return nil, err
+		}
+		writeBytes(&buf, ex.Sig)
+		writeBytes(&buf, ex.Refusal)
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeBFTSignature returns the signature of the given binary encoding, see
+// BFTSignature.Encode. s is the suite of the roster that made the signature.
+func DecodeBFTSignature(s network.Suite, data []byte) (*BFTSignature, error) {
+	buf := bytes.NewReader(data)
+	version, err := buf.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if version != signatureVersion {
+		return nil, fmt.Errorf("unknown signature version %d", version)
+	}
+	bs := &BFTSignature{}
+	if bs.Msg, err = readBytes(buf); err != nil {
+		return nil, err
+	}
+	if bs.Sig, err = readBytes(buf); err != nil {
+		return nil, err
+	}
+	var n uint32
+	if err := binary.Read(buf, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	for i := uint32(0); i < n; i++ {
+		var index uint32
+		if err := binary.Read(buf, binary.BigEndian, &index); err != nil {
+			return nil, err
+		}
+		commitment := s.Point()
+		if _, err := commitment.UnmarshalFrom(buf); err != nil {
+			return nil, err
+		}
+		ex := Exception{Index: int(index), Commitment: commitment}
+		if ex.Sig, err = readBytes(buf); err != nil {
+			return nil, err
+		}
+		if ex.Refusal, err = readBytes(buf); err != nil {
+			return nil, err
+		}
+		bs.Exceptions = append(bs.Exceptions, ex)
+	}
+	if buf.Len() != 0 {
+		return nil, errors.New("trailing bytes after the signature")
+	}
+	return bs, nil
+}
+
+// signatureJSON is the JSON encoding of a BFTSignature, where the byte
+// slices and the commitments are base64 strings.
+type signatureJSON struct {
+	Msg        []byte
+	Sig        []byte
+	Exceptions []exceptionJSON
+}
+
+type exceptionJSON struct {
+	Index      int
+	Commitment []byte
+	Sig        []byte
+	Refusal    []byte
+}
+
+// EncodeJSON returns the JSON encoding of the signature.
+func (bs *BFTSignature) EncodeJSON() ([]byte, error) {
+	sj := signatureJSON{Msg: bs.Msg, Sig: bs.Sig, Exceptions: []exceptionJSON{}}
+	for _, ex := range bs.Exceptions {
+		if ex.Commitment == nil {
+			return nil, errors.New("invalid exception")
+		}
+		c, err := ex.Commitment.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		sj.Exceptions = append(sj.Exceptions, exceptionJSON{Index: ex.Index, Commitment: c,
+			Sig: ex.Sig, Refusal: ex.Refusal})
+	}
+	return json.MarshalIndent(sj, "", "  ")
+}
+
+// DecodeBFTSignatureJSON returns the signature of the given JSON encoding,
+// see BFTSignature.EncodeJSON.
+func DecodeBFTSignatureJSON(s network.Suite, data []byte) (*BFTSignature, error) {
+	var sj signatureJSON
+	if err := json.Unmarshal(data, &sj); err != nil {
+		return nil, err
+	}
+	bs := &BFTSignature{Msg: sj.Msg, Sig: sj.Sig}
+	for _, ex := range sj.Exceptions {
+		commitment := s.Point()
+		if err := commitment.UnmarshalBinary(ex.Commitment); err != nil {
+			return nil, err
+		}
+		bs.Exceptions = append(bs.Exceptions, Exception{Index: ex.Index, Commitment: commitment,
+			Sig: ex.Sig, Refusal: ex.Refusal})
+	}
+	return bs, nil
+}
+
+func writeBytes(buf *bytes.Buffer, b []byte) {
+	binary.Write(buf, binary.BigEndian, uint32(len(b)))
+	buf.Write(b)
+}
+
+func readBytes(buf *bytes.Reader) ([]byte, error) {
+	var n uint32
+	if err := binary.Read(buf, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	if int64(n) > int64(buf.Len()) {
+		return nil, errors.New("length exceeds the signature")
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	b := make([]byte, n)
+	if _, err := buf.Read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
@@ -0,0 +1,56 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBFTSignatureEncoding(t *testing.T) {
+	sig := &BFTSignature{
+		Msg: []byte("Hello BFTCoSi"),
+		Sig: []byte{1, 2, 3, 4},
+		Exceptions: []Exception{
+			{Index: 2, Commitment: tSuite.Point().Pick(tSuite.RandomStream()),
+				Sig: []byte{7, 8, 9}, Refusal: []byte{5, 6}},
+			{Index: 5, Commitment: tSuite.Point().Null()},
+		},
+	}
+	refused := &BFTSignature{Msg: []byte("Hello BFTCoSi")}
+
+	for _, s := range []*BFTSignature{sig, refused} {
+		buf, err := s.Encode()
+		assert.Nil(t, err)
+		decoded, err := DecodeBFTSignature(tSuite, buf)
+		assert.Nil(t, err)
+		assertSignatureEqual(t, s, decoded)
+
+		buf, err = s.EncodeJSON()
+		assert.Nil(t, err)
+		decoded, err = DecodeBFTSignatureJSON(tSuite, buf)
+		assert.Nil(t, err)
+		assertSignatureEqual(t, s, decoded)
+	}
+
+	buf, err := sig.Encode()
+	assert.Nil(t, err)
+	_, err = DecodeBFTSignature(tSuite, buf[:len(buf)-1])
+	assert.NotNil(t, err)
+	_, err = DecodeBFTSignature(tSuite, append(buf, 0))
+	assert.NotNil(t, err)
+	buf[0] = signatureVersion + 1
+	_, err = DecodeBFTSignature(tSuite, buf)
+	assert.NotNil(t, err)
+}
+
+func assertSignatureEqual(t *testing.T, expected, actual *BFTSignature) {
+	assert.Equal(t, expected.Msg, actual.Msg)
+	assert.Equal(t, expected.Sig, actual.Sig)
+	assert.Equal(t, len(expected.Exceptions), len(actual.Exceptions))
+	for i := range expected.Exceptions {
+		assert.Equal(t, expected.Exceptions[i].Index, actual.Exceptions[i].Index)
+		assert.True(t, expected.Exceptions[i].Commitment.Equal(actual.Exceptions[i].Commitment))
+		assert.Equal(t, expected.Exceptions[i].Sig, actual.Exceptions[i].Sig)
+		assert.Equal(t, expected.Exceptions[i].Refusal, actual.Exceptions[i].Refusal)
+	}
+}
@@ -0,0 +1,264 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dedis/onet"
+	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/simul/monitor"
+)
+
+// MeasureRestarts is the name of the measure of the number of times a round
+// has been restarted with new subleaders.
+const MeasureRestarts = "restarts"
+
+// CreateProtocolFunction is the function used by SubtreesBFTCoSi to create
+// the protocol instances running the rounds.
+type CreateProtocolFunction func(name string, t *onet.Tree, sid onet.ServiceID) (onet.ProtocolInstance, error)
+
+// SubtreesBFTCoSi runs the rounds of bftcosi over the subtree layout of
+// GenTrees: the subleaders are the children of the root, and the other nodes
+// of each subtree are the children of its subleader. It only runs on the
+// root, which starts a ProtocolBFTCoSi over that tree. If subleaders don't
+// send their "prepare" commitment in time, the root stops the round and
+// restarts it with the next node of their subtree as subleader, like
+// blsftcosi. A subtree that failed with every subleader is left out, its nodes
+// end up in the exceptions. A subleader that fails once it committed can't be
+// replaced, as the challenge depends on its commitment: it is excepted along
+// with its subtree.
+type SubtreesBFTCoSi struct {
+	*onet.TreeNodeInstance
+	// NSubtrees is the number of subtrees of the layout.
+	NSubtrees int
+	// Msg is the message to sign.
+	Msg []byte
+	// Data goes along the message to the verification.
+	Data []byte
+	// Timeout is the timeout of the rounds, see ProtocolBFTCoSi.
+	Timeout time.Duration
+	// CreateProtocol creates the instances of the rounds.
+	CreateProtocol CreateProtocolFunction
+
+	subProtocolName string
+	signature       *BFTSignature
+	blameProofs     []*BlameProof
+	startChan       chan bool
+	onDone          func()
+}
+
+// NewSubtreesBFTCoSi returns the protocol instance running the rounds of the
+// protocol registered under subProtocolName, which must create a
+// ProtocolBFTCoSi.
+func NewSubtreesBFTCoSi(n *onet.TreeNodeInstance, subProtocolName string) (*SubtreesBFTCoSi, error) {
+	p := &SubtreesBFTCoSi{
+		TreeNodeInstance: n,
+		NSubtrees:        1,
+		Msg:              make([]byte, 0),
+		Data:             make([]byte, 0),
+		Timeout:          defaultTimeout,
+		subProtocolName:  subProtocolName,
+		startChan:        make(chan bool, 1),
+	}
+	n.OnDoneCallback(p.nodeDone)
+	return p, nil
+}
+
+// Start starts the rounds, it is only called on the root.
+func (p *SubtreesBFTCoSi) Start() error {
+	if p.CreateProtocol == nil {
+		return errors.New("no CreateProtocol function set")
+	}
+	if p.NSubtrees < 1 {
+		return fmt.Errorf("invalid number of subtrees: %d", p.NSubtrees)
+	}
+	p.startChan <- true
+	return nil
+}
+
+// Dispatch runs the rounds on the root until they produce a signature. The
+// other nodes only take part in the rounds.
+func (p *SubtreesBFTCoSi) Dispatch() error {
+	defer p.Done()
+	if !p.IsRoot() {
+		return nil
+	}
+	if _, ok := <-p.startChan; !ok {
+		return nil
+	}
+
+	roster := p.Roster()
+	if !roster.List[0].ID.Equal(p.ServerIdentity().ID) {
+		return errors.New("the root must be the first node of the roster")
+	}
+	trees, err := GenTrees(roster, p.Tree().Size(), p.NSubtrees)
+	if err != nil {
+		return fmt.Errorf("error in tree generation: %s", err)
+	}
+
+	restarts := 0
+	defer func() {
+		monitor.RecordSingleMeasure(MeasureRestarts, float64(restarts))
+	}()
+	for {
+		tree, err := mergeTrees(roster, trees)
+		if err != nil {
+			return err
+		}
+		missing := make(chan []*onet.TreeNode, 1)
+		signature := make(chan *BFTSignature, 1)
+		if err := p.startRound(tree, missing, signature); err != nil {
+			return err
+		}
+
+		// each phase of the round times out after Timeout
+		select {
+		case sig := <-signature:
+			p.signature = sig
+			return nil
+		case failed := <-missing:
+			restarts++
+			if trees, err = replaceSubleaders(trees, failed); err != nil {
+				return err
+			}
+		case <-time.After(5 * p.Timeout):
+			return errors.New("the round timed out")
+		}
+	}
+}
+
+// startRound starts a round over the tree, which reports the subleaders that
+// didn't commit, or the signature.
+func (p *SubtreesBFTCoSi) startRound(tree *onet.Tree, missing chan []*onet.TreeNode, signature chan *BFTSignature) error {
+	pi, err := p.CreateProtocol(p.subProtocolName, tree, onet.NilServiceID)
+	if err != nil {
+		return err
+	}
+	bft, ok := pi.(*ProtocolBFTCoSi)
+	if !ok {
+		return fmt.Errorf("protocol %s is not bftcosi", p.subProtocolName)
+	}
+	bft.Msg = p.Msg
+	bft.Data = p.Data
+	bft.Timeout = p.Timeout
+	bft.registerOnCommitmentMissing(func(failed []*onet.TreeNode) {
+		missing <- failed
+	})
+	bft.RegisterOnSignatureDone(func(sig *BFTSignature) {
+		p.blameProofs = bft.BlameProofs()
+		signature <- sig
+	})
+	return bft.Start()
+}
+
+// Signature returns the signature of the last round.
+func (p *SubtreesBFTCoSi) Signature() *BFTSignature {
+	return p.signature
+}
+
+// BlameProofs returns the blame proofs of the last round, see
+// ProtocolBFTCoSi.BlameProofs.
+func (p *SubtreesBFTCoSi) BlameProofs() []*BlameProof {
+	return p.blameProofs
+}
+
+// RegisterOnDone registers a callback to call once the signature is done.
+func (p *SubtreesBFTCoSi) RegisterOnDone(fn func()) {
+	p.onDone = fn
+}
+
+// Shutdown implements onet.ProtocolInstance.
+func (p *SubtreesBFTCoSi) Shutdown() error {
+	return nil
+}
+
+func (p *SubtreesBFTCoSi) nodeDone() bool {
+	if p.onDone != nil {
+		// only true for the root
+		p.onDone()
+	}
+	return true
+}
+
+// replaceSubleaders makes the next node of its subtree the subleader of each
+// subtree whose subleader failed. The subtrees which failed with every
+// subleader are removed: the roster of the rounds stays the same, so their
+// nodes are excepted from the signature, see outsideExceptions.
+func replaceSubleaders(trees []*onet.Tree, failed []*onet.TreeNode) ([]*onet.Tree, error) {
+	var replaced []*onet.Tree
+	for _, tree := range trees {
+		if len(tree.Root.Children) == 0 || !contains(failed, tree.Root.Children[0]) {
+			replaced = append(replaced, tree)
+			continue
+		}
+		subleaderID := tree.Root.Children[0].RosterIndex
+		log.Lvlf2("subleader %d of a subtree failed, restarting", subleaderID)
+		if subleaderID+1 >= len(tree.Roster.List) {
+			log.Lvl2("subtree failed with every subleader, ignoring it")
+			continue
+		}
+		newTree, err := GenSubtree(tree.Roster, subleaderID+1)
+		if err != nil {
+			return nil, err
+		}
+		replaced = append(replaced, newTree)
+	}
+	return replaced, nil
+}
+
+// contains returns whether a node of the list has the server identity of tn.
+func contains(list []*onet.TreeNode, tn *onet.TreeNode) bool {
+	for _, n := range list {
+		if n.ServerIdentity.ID.Equal(tn.ServerIdentity.ID) {
+			return true
+		}
+	}
+	return false
+}
+
+// SubtreesTree returns the tree of the subtree layout of GenTrees over the
+// roster, as run by SubtreesBFTCoSi before any subleader fails.
+func SubtreesTree(roster *onet.Roster, nNodes, nSubtrees int) (*onet.Tree, error) {
+	trees, err := GenTrees(roster, nNodes, nSubtrees)
+	if err != nil {
+		return nil, err
+	}
+	return mergeTrees(roster, trees)
+}
+
+// mergeTrees returns the tree over the whole roster where the subleaders of
+// the subtrees are the children of the root, so that the roster indexes of the
+// nodes, used in the exceptions, are the ones of the roster.
+func mergeTrees(roster *onet.Roster, trees []*onet.Tree) (*onet.Tree, error) {
+	root := onet.NewTreeNode(0, roster.List[0])
+	for _, tree := range trees {
+		for _, subleader := range tree.Root.Children {
+			tn, err := copyTreeNode(roster, root, subleader)
+			if err != nil {
+				return nil, err
+			}
+			root.Children = append(root.Children, tn)
+		}
+	}
+	return onet.NewTree(roster, root), nil
+}
+
+// copyTreeNode copies the node and its children below parent, with their
+// indexes in the roster.
+func copyTreeNode(roster *onet.Roster, parent, tn *onet.TreeNode) (*onet.TreeNode, error) {
+	index, _ := roster.Search(tn.ServerIdentity.ID)
+	if index < 0 {
+		return nil, fmt.Errorf("%s is not part of the roster", tn.ServerIdentity)
+	}
+	c := onet.NewTreeNode(index, tn.ServerIdentity)
+	c.Parent = parent
+	for _, child := range tn.Children {
+		cc, err := copyTreeNode(roster, c, child)
+		if err != nil {
+			return nil, err
+		}
+		c.Children = append(c.Children, cc)
+	}
+	return c, nil
+}
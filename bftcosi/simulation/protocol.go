@@ -21,6 +21,7 @@ In the Node-method you can read the files that have been created by the
 
 import (
 	"errors"
+	"strings"
 	//"strconv"
 
 	"github.com/BurntSushi/toml"
@@ -33,28 +34,50 @@ import (
 	"fmt"
 	"time"
 
-	"bls-ftcosi/cothority/protocols/byzcoin/blockchain"
-	"bls-ftcosi/cothority/protocols/byzcoin/blockchain/blkparser"
+	"bls-ftcosi/blocks"
+	"github.com/dedis/kyber/pairing/bn256"
 )
 
-var magicNum = [4]byte{0xF9, 0xBE, 0xB4, 0xD9}
-var blocksPath = "/users/csbenz/blocks" // "/home/christo/.bitcoin/blocks"
-const ReadFirstNBlocks = 66000
-var wantednTxs = 10000
-
 func init() {
 	onet.SimulationRegister("BFTCosiSimul", NewSimulationProtocol)
 	onet.GlobalProtocolRegister("BFTCosiSimul", func (n* onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+			return protocol.NewSubtreesBFTCoSi(n, "BFTCosiSimulRound")
+		})
+	onet.GlobalProtocolRegister("BFTCosiSimulRound", func (n* onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
 			return protocol.NewBFTCoSiProtocol(n,  func(msg []byte, data []byte) bool { return true })
 		})
+	onet.GlobalProtocolRegister("BFTCosiSimulBLS", func (n* onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+			return protocol.NewBLSBFTCoSiProtocol(n, func(msg []byte, data []byte) bool { return true }, pairingSuite)
+		})
 }
 
+var pairingSuite = bn256.NewSuite()
+
 // SimulationProtocol implements onet.Simulation.
 type SimulationProtocol struct {
 	onet.SimulationBFTree
+	// Config selects the transactions of the blocks, see blocks.Config
+	blocks.Config
 	NSubtrees int
 	FailingSubleaders int
 	FailingLeafs int
+	// Interception is what the failing nodes do with the InterceptedMessages
+	// they receive: drop (default), delay or corrupt.
+	Interception string
+	// InterceptedMessages are the names of the intercepted bftcosi messages,
+	// separated by commas, Announce by default, or BLSAnnounce with BLS.
+	InterceptedMessages string
+	// InterceptionDelay is the delay of the delayed messages, in
+	// milliseconds.
+	InterceptionDelay int
+	// Timeout is the timeout of each phase of a round, in milliseconds,
+	// defaultTimeout if zero. A failing subleader is only replaced once the
+	// commitment phase times out.
+	Timeout int
+	// BLS runs the BLS variant of bftcosi, over the same subtrees, with
+	// keys of the G2 group of bn256: Suite = "bn256.g2" in the row of the
+	// run.
+	BLS bool
 }
 
 // NewSimulationProtocol is used internally to register the simulation (see the init()
@@ -65,6 +88,9 @@ func NewSimulationProtocol(config string) (onet.Simulation, error) {
 	if err != nil {
 		return nil, err
 	}
+	if es.BLS && !strings.EqualFold(es.Suite, "bn256.g2") {
+		return nil, fmt.Errorf("the BLS runs need Suite = \"bn256.g2\", not %q", es.Suite)
+	}
 	return es, nil
 }
 
@@ -88,9 +114,20 @@ func (s *SimulationProtocol) Node(config *onet.SimulationConfig) error {
 	if index < 0 {
 		log.Fatal("Didn't find this node in roster")
 	}
+	if err := s.intercept(config); err != nil {
+		return err
+	}
+	log.Lvl3("Initializing node-index", index)
+	return s.SimulationBFTree.Node(config)
+}
 
-/*
-	//get subleader ids
+// intercept makes the node intercept its messages if it is one of the first
+// FailingSubleaders subleaders or of the first FailingLeafs leafs of the
+// subtrees.
+func (s *SimulationProtocol) intercept(config *onet.SimulationConfig) error {
+	if s.FailingSubleaders == 0 && s.FailingLeafs == 0 {
+		return nil
+	}
 	subleadersIds, err := protocol.GetSubleaderIDs(config.Tree, s.Hosts, s.NSubtrees)
 	if err != nil {
 		return err
@@ -98,8 +135,6 @@ func (s *SimulationProtocol) Node(config *onet.SimulationConfig) error {
 	if len(subleadersIds) > s.FailingSubleaders {
 		subleadersIds = subleadersIds[:s.FailingSubleaders]
 	}
-
-	//get leafs ids
 	leafsIds, err := protocol.GetLeafsIDs(config.Tree, s.Hosts, s.NSubtrees)
 	if err != nil {
 		return err
@@ -108,47 +143,69 @@ func (s *SimulationProtocol) Node(config *onet.SimulationConfig) error {
 		leafsIds = leafsIds[:s.FailingLeafs]
 	}
 
-	to_intercept := append(leafsIds, subleadersIds...)
-
-	//intercept announcements on some nodes
-	for _, id := range to_intercept {
-		if id == config.Server.ServerIdentity.ID {
-			config.Server.RegisterProcessorFunc(onet.ProtocolMsgID, func(e *network.Envelope) {
-				//get message
-				_, msg, err := network.Unmarshal(e.Msg.(*onet.ProtocolMsg).MsgSlice)
-				if err != nil {
-					log.Fatal("error while unmarshaling a message:", err)
-					return
-				}
-
-				switch msg.(type) { //ignore announcements
-				case *protocol.Announcement:
-					break
-				default:
-					config.Overlay.Process(e)
-				}
-			})
-		break //this node has been found
+	interception, err := protocol.ParseInterception(s.Interception)
+	if err != nil {
+		return err
+	}
+	if s.Interception == "" {
+		interception = protocol.InterceptDrop
+	}
+	names := s.InterceptedMessages
+	if names == "" {
+		names = "Announce"
+		if s.BLS {
+			names = "BLSAnnounce"
 		}
 	}
-	*/
-	log.Lvl3("Initializing node-index", index)
-	return s.SimulationBFTree.Node(config)
+	// the BLS variant only sends its own messages, intercepting the other
+	// ones would silently leave the run without faults
+	for _, name := range strings.Split(names, ",") {
+		if bls := strings.HasPrefix(strings.TrimSpace(name), "BLS"); bls != s.BLS {
+			return fmt.Errorf("%s is not a message of the protocol of the run", name)
+		}
+	}
+	messages, err := protocol.ParseMessageTypes(names)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range append(leafsIds, subleadersIds...) {
+		if id.Equal(config.Server.ServerIdentity.ID) {
+			log.Lvl2(config.Server.ServerIdentity, "intercepts", names)
+			interceptor := &protocol.Interceptor{
+				Interception: interception,
+				Messages:     messages,
+				Delay:        time.Duration(s.InterceptionDelay) * time.Millisecond,
+				Suite:        config.Server.Suite(),
+			}
+			interceptor.Register(config.Server, config.Overlay)
+			break
+		}
+	}
+	return nil
 }
 
 var defaultTimeout = 120 * time.Second
 
+// timeout returns the timeout of the phases of the rounds.
+func (s *SimulationProtocol) timeout() time.Duration {
+	if s.Timeout > 0 {
+		return time.Duration(s.Timeout) * time.Millisecond
+	}
+	return defaultTimeout
+}
+
 // Run implements onet.Simulation.
 func (s *SimulationProtocol) Run(config *onet.SimulationConfig) error {
 
-	transactions, err := loadBlocks()
+	transactions, err := s.Load()
 	if err != nil {
 		return err
 	}
 
 	log.Lvl1("Run got", len(transactions), "transactions")
 
-	block, err := GetBlock(3000, transactions, "0", "0", 0)
+	block, err := blocks.GetBlock(3000, transactions, "0", "0", 0)
 	if err != nil {
 		return err
 	}
@@ -164,21 +221,30 @@ func (s *SimulationProtocol) Run(config *onet.SimulationConfig) error {
 	for round := 0; round < s.Rounds; round++ {
 		log.Lvl1("Starting round", round)
 		round := monitor.NewTimeMeasure("round")
+		if s.BLS {
+			if err := s.runBLS(config, binaryBlock); err != nil {
+				return err
+			}
+			round.Record()
+			continue
+		}
 
 		p, err := config.Overlay.CreateProtocol("BFTCosiSimul", config.Tree, onet.NilServiceID)
 		if err != nil {
 			return err
 		}
-		proto := p.(*protocol.ProtocolBFTCoSi)
-		//proto.NSubtrees = s.NSubtrees
+		proto := p.(*protocol.SubtreesBFTCoSi)
+		proto.NSubtrees = s.NSubtrees
+		proto.CreateProtocol = config.Overlay.CreateProtocol
 		proto.Msg = binaryBlock
-		proto.Timeout = defaultTimeout
+		proto.Timeout = s.timeout()
 		
 		go func() {
 			log.ErrFatal(p.Start())
 		}()
 		done := make(chan bool)
-		wait := time.Second * 80
+		// as long as SubtreesBFTCoSi waits for the round, restarts included
+		wait := 5 * proto.Timeout
 		proto.RegisterOnDone(func() {
 			done <- true
 		})
@@ -203,43 +269,35 @@ func (s *SimulationProtocol) Run(config *onet.SimulationConfig) error {
 	return nil
 }
 
-
-func loadBlocks() ([]blkparser.Tx, error) {
-	// Initialize blockchain parser
-	parser, err := blockchain.NewParser(blocksPath, magicNum)
-	_ = parser
+// runBLS runs a round of the BLS variant over the subtrees.
+func (s *SimulationProtocol) runBLS(config *onet.SimulationConfig, msg []byte) error {
+	tree, err := protocol.SubtreesTree(config.Roster, config.Tree.Size(), s.NSubtrees)
 	if err != nil {
-		return nil, err
-	}
-
-	transactions, err := parser.Parse(0, ReadFirstNBlocks)
-	if len(transactions) == 0 {
-		return nil, errors.New("Couldn't read any transactions.")
+		return err
 	}
+	p, err := config.Overlay.CreateProtocol("BFTCosiSimulBLS", tree, onet.NilServiceID)
 	if err != nil {
-		log.Error("Error: Couldn't parse blocks in", blocksPath,
-			".\nPlease download bitcoin blocks as .dat files first and place them in",
-			blocksPath, "Either run a bitcoin node (recommended) or using a torrent.")
-		return nil, err
+		return err
 	}
-	log.Lvl1("Got", len(transactions), "transactions")
-	if len(transactions) < wantednTxs {
-		log.Errorf("Read only %v but wanted %v", len(transactions), wantednTxs)
+	proto := p.(*protocol.ProtocolBLSBFTCoSi)
+	proto.Msg = msg
+	proto.Timeout = s.timeout()
+	done := make(chan bool, 1)
+	proto.RegisterOnDone(func() {
+		done <- true
+	})
+	if err := proto.Start(); err != nil {
+		return err
 	}
-
-	return transactions, nil
-}
-
-// GetBlock returns the next block available from the transaction pool.
-func GetBlock(size int, transactions []blkparser.Tx, lastBlock string, lastKeyBlock string, priority int) (*blockchain.TrBlock, error) {
-	log.Lvl1("GetBlock got", len(transactions), "transactions")
-
-	if len(transactions) < 1 {
-		return nil, errors.New("no transaction available")
+	wait := 5 * proto.Timeout
+	select {
+	case <-done:
+		if err := proto.Signature().Verify(pairingSuite, tree.Roster.Publics()); err != nil {
+			return fmt.Errorf("%s Verification of the signature refused: %s", proto.Name(), err)
+		}
+	case <-time.After(wait):
+		return errors.New("Waited " + wait.String() + " for BFTCoSi to finish ...")
 	}
-
-	trlist := blockchain.NewTransactionList(transactions, size)
-	header := blockchain.NewHeader(trlist, lastBlock, lastKeyBlock)
-	trblock := blockchain.NewTrBlock(trlist, header)
-	return trblock, nil
+	log.Lvl2("Signature correctly verified!")
+	return nil
 }
@@ -0,0 +1,233 @@
+// Package blocks gives the simulations the transactions of the blocks they
+// sign or order: either parsed from the Bitcoin .dat files of a directory, or
+// generated, so that the simulations run without downloading the blockchain.
+//
+// The generated transactions are real Bitcoin transactions with one input
+// and two pay-to-pubkey-hash outputs, filled with pseudo-random bytes drawn
+// from a seed, and parsed with blkparser like the ones of the .dat files.
+package blocks
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+
+	"bls-ftcosi/cothority/log"
+	"bls-ftcosi/cothority/protocols/byzcoin/blockchain"
+	"bls-ftcosi/cothority/protocols/byzcoin/blockchain/blkparser"
+)
+
+var magicNum = [4]byte{0xF9, 0xBE, 0xB4, 0xD9}
+
+// ReadFirstNBlocks is how many blocks are parsed in BlocksPath.
+const ReadFirstNBlocks = 66000
+
+// DefaultTransactions is how many transactions are read or generated when
+// Config.Transactions is 0.
+const DefaultTransactions = 10000
+
+// DefaultTxSize is the mean size in bytes of the generated transactions when
+// Config.TxSize is 0, about the one of the transactions of the blockchain.
+const DefaultTxSize = 250
+
+// The generated transactions are at least minTxSize bytes long, the size of
+// a transaction with an empty script in its input, and at most maxTxSize.
+const (
+	minTxSize = 119
+	maxTxSize = 100000
+)
+
+// Config selects the transactions of a simulation. It is embedded in the
+// SimulationProtocol of the simulations, so its fields are set in the run
+// TOML:
+//
+//	BlocksPath = "/home/user/.bitcoin/blocks"
+//
+// or, for generated transactions:
+//
+//	Transactions = 6000
+//	TxSize = 400
+//	TxSizeDistribution = "exponential"
+//	Seed = 42
+type Config struct {
+	// BlocksPath is a directory with the Bitcoin .dat files to read the
+	// transactions from. If it is empty, the transactions are generated.
+	BlocksPath string
+	// Transactions is how many transactions are generated, or wanted from
+	// BlocksPath, DefaultTransactions if it is 0.
+	Transactions int
+	// TxSize is the mean size of the generated transactions, in bytes,
+	// DefaultTxSize if it is 0.
+	TxSize int
+	// TxSizeDistribution is how the sizes of the generated transactions
+	// are drawn around TxSize: "fixed", "uniform" between minimal size and
+	// twice TxSize (default), or "exponential".
+	TxSizeDistribution string
+	// Seed makes the generated transactions the same over the runs.
+	Seed int64
+}
+
+// Load returns the transactions of the configuration: the ones of the
+// blocks in BlocksPath if it is set, generated ones otherwise.
+func (c Config) Load() ([]blkparser.Tx, error) {
+	if c.BlocksPath != "" {
+		return c.parse()
+	}
+	txs, err := c.Generate()
+	if err != nil {
+		return nil, err
+	}
+	log.Lvl1("Generated", len(txs), "transactions")
+	return txs, nil
+}
+
+func (c Config) parse() ([]blkparser.Tx, error) {
+	parser, err := blockchain.NewParser(c.BlocksPath, magicNum)
+	if err != nil {
+		return nil, err
+	}
+	transactions, err := parser.Parse(0, ReadFirstNBlocks)
+	if len(transactions) == 0 {
+		return nil, errors.New("Couldn't read any transactions.")
+	}
+	if err != nil {
+		log.Error("Error: Couldn't parse blocks in", c.BlocksPath,
+			".\nPlease download bitcoin blocks as .dat files first and place them in",
+			c.BlocksPath, "Either run a bitcoin node (recommended) or using a torrent.",
+			"Or leave BlocksPath empty to generate the transactions.")
+		return nil, err
+	}
+	log.Lvl1("Got", len(transactions), "transactions")
+	if len(transactions) < c.transactions() {
+		log.Errorf("Read only %v but wanted %v", len(transactions), c.transactions())
+	}
+	return transactions, nil
+}
+
+// Generate returns Transactions transactions generated from Seed.
+func (c Config) Generate() ([]blkparser.Tx, error) {
+	size, err := c.sizeFunc()
+	if err != nil {
+		return nil, err
+	}
+	rnd := rand.New(rand.NewSource(c.Seed))
+	txs := make([]blkparser.Tx, c.transactions())
+	for i := range txs {
+		raw := rawTx(rnd, size(rnd))
+		tx, n := blkparser.NewTx(raw)
+		tx.Hash = blkparser.GetShaString(raw[:n])
+		tx.Size = uint32(n)
+		txs[i] = *tx
+	}
+	return txs, nil
+}
+
+// GetBlock returns a block of the first size transactions, or of all of them
+// if there are fewer.
+func GetBlock(size int, transactions []blkparser.Tx, lastBlock string, lastKeyBlock string, priority int) (*blockchain.TrBlock, error) {
+	if len(transactions) < 1 {
+		return nil, errors.New("no transaction available")
+	}
+	trlist := blockchain.NewTransactionList(transactions, size)
+	header := blockchain.NewHeader(trlist, lastBlock, lastKeyBlock)
+	return blockchain.NewTrBlock(trlist, header), nil
+}
+
+func (c Config) transactions() int {
+	if c.Transactions == 0 {
+		return DefaultTransactions
+	}
+	return c.Transactions
+}
+
+// sizeFunc returns the function drawing the sizes of the transactions.
+func (c Config) sizeFunc() (func(*rand.Rand) int, error) {
+	mean := c.TxSize
+	if mean == 0 {
+		mean = DefaultTxSize
+	}
+	if mean < minTxSize || mean > maxTxSize {
+		return nil, fmt.Errorf("TxSize must be between %d and %d", minTxSize, maxTxSize)
+	}
+	switch c.TxSizeDistribution {
+	case "fixed":
+		return func(*rand.Rand) int { return mean }, nil
+	case "", "uniform":
+		return func(rnd *rand.Rand) int {
+			return clampSize(minTxSize + rnd.Intn(2*(mean-minTxSize)+1))
+		}, nil
+	case "exponential":
+		return func(rnd *rand.Rand) int {
+			return clampSize(minTxSize + int(math.Round(rnd.ExpFloat64()*float64(mean-minTxSize))))
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown TxSizeDistribution %q", c.TxSizeDistribution)
+}
+
+func clampSize(size int) int {
+	if size < minTxSize {
+		return minTxSize
+	}
+	if size > maxTxSize {
+		return maxTxSize
+	}
+	return size
+}
+
+// rawTx returns a serialized transaction of about the given size, with one input
+// whose script fills up the size, and two pay-to-pubkey-hash outputs.
+func rawTx(rnd *rand.Rand, size int) []byte {
+	script := size - minTxSize
+	// a script longer than 0xfc bytes takes 2 more bytes for its length,
+	// and 4 more if it is longer than 0xffff bytes
+	switch {
+	case script > 0xffff:
+		script -= 4
+	case script > 0xfc:
+		script -= 2
+	}
+	raw := make([]byte, 0, size)
+	raw = appendUint32(raw, 1) // version
+	raw = append(raw, 1)       // inputs
+	raw = append(raw, randBytes(rnd, 32)...)
+	raw = appendUint32(raw, uint32(rnd.Intn(4)))
+	raw = appendVarInt(raw, script)
+	raw = append(raw, randBytes(rnd, script)...)
+	raw = appendUint32(raw, 0xffffffff) // sequence
+	raw = append(raw, 2)                // outputs
+	for i := 0; i < 2; i++ {
+		value := make([]byte, 8)
+		binary.LittleEndian.PutUint64(value, uint64(rnd.Int63n(100000000)))
+		raw = append(raw, value...)
+		raw = append(raw, 25, 0x76, 0xa9, 20)
+		raw = append(raw, randBytes(rnd, 20)...)
+		raw = append(raw, 0x88, 0xac)
+	}
+	return appendUint32(raw, 0) // lock time
+}
+
+func randBytes(rnd *rand.Rand, n int) []byte {
+	b := make([]byte, n)
+	rnd.Read(b)
+	return b
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+// appendVarInt appends the variable length integer of the Bitcoin protocol,
+// for values up to 0xffffffff.
+func appendVarInt(b []byte, v int) []byte {
+	switch {
+	case v < 0xfd:
+		return append(b, byte(v))
+	case v <= 0xffff:
+		return append(b, 0xfd, byte(v), byte(v>>8))
+	}
+	return appendUint32(append(b, 0xfe), uint32(v))
+}
@@ -0,0 +1,58 @@
+package blocks
+
+import (
+	"testing"
+
+	"bls-ftcosi/cothority/protocols/byzcoin/blockchain"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerate(t *testing.T) {
+	c := Config{Transactions: 100, Seed: 1}
+	txs, err := c.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, 100, len(txs))
+	again, err := c.Generate()
+	assert.Nil(t, err)
+	assert.Equal(t, txs, again)
+
+	c.Seed = 2
+	other, err := c.Generate()
+	assert.Nil(t, err)
+	assert.NotEqual(t, txs[0].Hash, other[0].Hash)
+
+	for _, tx := range txs {
+		assert.Equal(t, uint32(1), tx.TxInCnt)
+		assert.Equal(t, uint32(2), tx.TxOutCnt)
+		assert.True(t, tx.Size >= minTxSize && tx.Size <= 2*DefaultTxSize)
+	}
+	list := blockchain.NewTransactionList(txs, 50)
+	block := blockchain.NewTrBlock(list, blockchain.NewHeader(list, "0", "0"))
+	_, err = block.MarshalBinary()
+	assert.Nil(t, err)
+}
+
+func TestGenerateSizes(t *testing.T) {
+	for _, size := range []int{minTxSize, 252 + minTxSize, 1000, 0xffff + minTxSize + 4, maxTxSize} {
+		txs, err := Config{Transactions: 10, TxSize: size, TxSizeDistribution: "fixed"}.Generate()
+		assert.Nil(t, err)
+		for _, tx := range txs {
+			assert.InDelta(t, size, int(tx.Size), 2)
+		}
+	}
+
+	txs, err := Config{Transactions: 1000, TxSize: 500, TxSizeDistribution: "exponential"}.Generate()
+	assert.Nil(t, err)
+	total := 0
+	for _, tx := range txs {
+		assert.True(t, tx.Size >= minTxSize && tx.Size <= maxTxSize)
+		total += int(tx.Size)
+	}
+	assert.InDelta(t, 500, total/len(txs), 50)
+
+	_, err = Config{TxSizeDistribution: "normal"}.Generate()
+	assert.NotNil(t, err)
+	_, err = Config{TxSize: 10}.Generate()
+	assert.NotNil(t, err)
+}
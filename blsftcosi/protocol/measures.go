@@ -0,0 +1,78 @@
+package protocol
+
+import (
+	"fmt"
+
+	"github.com/dedis/onet"
+	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/network"
+	"github.com/dedis/onet/simul/monitor"
+)
+
+// Names of the measures recorded by the protocol through the onet monitor.
+// When running a simulation they show up as columns of the CSV output, each
+// aggregated (min, max, avg, sum, dev) over all the nodes and rounds.
+const (
+	// time spent by a node in the verification function
+	MeasureVerification = "verification"
+	// time spent by a node waiting for the responses of its children
+	MeasureWaitChildren = "wait_children"
+	// time spent by a node aggregating its children signatures and masks
+	MeasureAggregation = "aggregation"
+	// time spent by the root sending the announcement to the subleaders
+	MeasureAnnouncement = "announcement"
+	// time spent by the root collecting the responses of all the subtrees
+	MeasureCollect = "collect"
+	// number of subleader restarts in a round
+	MeasureRestarts = "restarts"
+	// number of signers in the final signature of a round
+	MeasureSigners = "signers"
+)
+
+// measureSubtree returns the name of a measure for the given subtree, so that
+// the subtrees can be compared with each other.
+func measureSubtree(subtree int, measure string) string {
+	return fmt.Sprintf("subtree_%d_%s", subtree, measure)
+}
+
+// measureBytesLevel returns the name of the measure of the bytes sent by the
+// nodes at the given level of a subtree: 0 for the root, 1 for the subleader
+// and 2 for the leaves.
+func measureBytesLevel(level int) string {
+	return fmt.Sprintf("bytes_level_%d", level)
+}
+
+// treeLevel returns the depth of the given node in its tree.
+func treeLevel(tn *onet.TreeNode) int {
+	level := 0
+	for tn.Parent != nil {
+		tn = tn.Parent
+		level++
+	}
+	return level
+}
+
+// recordBytesSent records the size of a message that has been sent n times
+// by a node at the given level.
+func recordBytesSent(level int, msg interface{}, n int) {
+	if n < 1 {
+		return
+	}
+	b, err := network.Marshal(msg)
+	if err != nil {
+		log.Lvl3("couldn't measure message size:", err)
+		return
+	}
+	monitor.RecordSingleMeasure(measureBytesLevel(level), float64(len(b)*n))
+}
+
+// countSigners returns the number of bits set in a participation mask.
+func countSigners(mask []byte) int {
+	n := 0
+	for _, b := range mask {
+		for ; b != 0; b &= b - 1 {
+			n++
+		}
+	}
+	return n
+}
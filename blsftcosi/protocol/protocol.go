@@ -1,6 +1,7 @@
 package protocol
 
 import (
+	"context"
 	"fmt"
 	"sync"
 	"time"
@@ -10,6 +11,7 @@ import (
 	"github.com/dedis/onet"
 	"github.com/dedis/kyber"
 	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/simul/monitor"
 	"github.com/dedis/kyber/pairing"
 	"github.com/dedis/kyber/pairing/bn256"
 	
@@ -40,9 +42,13 @@ type BlsFtCosi struct {
 
 	Timeout        time.Duration // sub-protocol time out
 	FinalSignature chan []byte // final signature that is sent back to client
+	FinalError     chan error  // reason why the round failed, if it did
 
 	publics         []kyber.Point // list of public keys
 	stoppedOnce     sync.Once 
+	ctx             context.Context
+	subProtocols    []*SubBlsFtCosi // currently running sub-protocols
+	subProtocolsMut sync.Mutex
 	startChan       chan bool
 	subProtocolName string
 	verificationFn  VerificationFn
@@ -50,6 +56,16 @@ type BlsFtCosi struct {
 }
 
 
+// CancelledError is sent on FinalError when a round is cancelled through the
+// context given to StartContext. Err is the error of the context.
+type CancelledError struct {
+	Err error
+}
+
+func (e *CancelledError) Error() string {
+	return fmt.Sprintf("blsftcosi round cancelled: %s", e.Err)
+}
+
 // CreateProtocolFunction is a function type which creates a new protocol
 // used in FtCosi protocol for creating sub leader protocols.
 type CreateProtocolFunction func(name string, t *onet.Tree, sid onet.ServiceID) (onet.ProtocolInstance, error)
@@ -67,6 +83,7 @@ func NewBlsFtCosi(n *onet.TreeNodeInstance, vf VerificationFn, subProtocolName s
 	c := &BlsFtCosi{
 		TreeNodeInstance: n,
 		FinalSignature:   make(chan []byte, 1),
+		FinalError:       make(chan error, 1),
 		Data:             make([]byte, 0),
 		publics:          list,
 		startChan:        make(chan bool, 1),
@@ -115,8 +132,16 @@ func (p *BlsFtCosi) Shutdown() error {
 	return nil
 }
 
-func (p *BlsFtCosi) Dispatch() error {
+func (p *BlsFtCosi) Dispatch() (err error) {
 	defer p.Done()
+	defer func() {
+		if err != nil {
+			select {
+			case p.FinalError <- err:
+			default:
+			}
+		}
+	}()
 
 	// if node is not root, doesn't use protocol but sub-protocol
 	if !p.IsRoot() {
@@ -136,11 +161,25 @@ func (p *BlsFtCosi) Dispatch() error {
 
 	log.Lvl3("leader protocol started")
 
+	// stop every sub-protocol as soon as the context is cancelled
+	dispatchDone := make(chan struct{})
+	defer close(dispatchDone)
+	go func() {
+		select {
+		case <-p.ctx.Done():
+			p.stopSubProtocols()
+		case <-dispatchDone:
+		}
+	}()
+
 	// Verification of the data
 	verifyChan := make(chan bool, 1)
 	go func() {
 		log.Lvl3(p.ServerIdentity().Address, "starting verification")
-		verifyChan <- p.verificationFn(p.Msg, p.Data)
+		verification := monitor.NewTimeMeasure(MeasureVerification)
+		ok := p.verificationFn(p.Msg, p.Data)
+		verification.Record()
+		verifyChan <- ok
 	}()
 
 	// generate trees
@@ -157,10 +196,15 @@ func (p *BlsFtCosi) Dispatch() error {
 
 	// start all subprotocols
 	cosiSubProtocols := make([]*SubBlsFtCosi, len(trees))
+	p.subProtocolsMut.Lock()
+	p.subProtocols = cosiSubProtocols
+	p.subProtocolsMut.Unlock()
 	for i, tree := range trees {
-
-		cosiSubProtocols[i], err = p.startSubProtocol(tree)
+		_, err := p.startSubProtocol(i, tree)
 		if err != nil {
+			if _, ok := err.(*CancelledError); ok {
+				p.FinalSignature <- nil
+			}
 			return err
 		}
 	}
@@ -168,10 +212,15 @@ func (p *BlsFtCosi) Dispatch() error {
 	log.Lvl3(p.ServerIdentity().Address, "all protocols started")
 
 	// Wait and collect all the signature responses
+	collect := monitor.NewTimeMeasure(MeasureCollect)
 	responses, runningSubProtocols, err := p.collectSignatures(trees, cosiSubProtocols)
 	if err != nil {
+		if _, ok := err.(*CancelledError); ok {
+			p.FinalSignature <- nil
+		}
 		return err
 	}
+	collect.Record()
 	log.Lvl3(p.ServerIdentity().Address, "collected all signature responses")
 
 
@@ -179,7 +228,13 @@ func (p *BlsFtCosi) Dispatch() error {
 
 	// TODO
 	//ok := true
-	ok := <-verifyChan
+	var ok bool
+	select {
+	case ok = <-verifyChan:
+	case <-p.ctx.Done():
+		p.FinalSignature <- nil
+		return &CancelledError{p.ctx.Err()}
+	}
 	if !ok {
 		// root should not fail the verification otherwise it would not have
 		// started the protocol
@@ -191,10 +246,13 @@ func (p *BlsFtCosi) Dispatch() error {
 	}
 
 	// generate root signature
+	aggregation := monitor.NewTimeMeasure(MeasureAggregation)
 	signaturePoint, finalMask, err := generateSignature(p.PairingSuite, p.TreeNodeInstance, p.publics, responses, p.Msg, ok)
 	if err != nil {
 		return err
 	}
+	aggregation.Record()
+	monitor.RecordSingleMeasure(MeasureSigners, float64(finalMask.CountEnabled()))
 
 	signature, err := signaturePoint.MarshalBinary()
 	if err != nil {
@@ -222,6 +280,8 @@ func (p *BlsFtCosi) collectSignatures(trees []*onet.Tree, cosiSubProtocols []*Su
 
 	var mut sync.Mutex
 	var wg sync.WaitGroup
+	var cancelled error
+	restarts := 0
 	errChan := make(chan error, len(cosiSubProtocols))
 	responses := make([]StructResponse, 0)
 	runningSubProtocols := make([]*SubBlsFtCosi, 0)
@@ -231,12 +291,26 @@ func (p *BlsFtCosi) collectSignatures(trees []*onet.Tree, cosiSubProtocols []*Su
 		wg.Add(1)
 		go func(i int, subProtocol *SubBlsFtCosi) {
 			defer wg.Done()
+			subtreeCollect := monitor.NewTimeMeasure(measureSubtree(i, MeasureCollect))
+			subtreeRestarts := 0
+			defer func() {
+				monitor.RecordSingleMeasure(measureSubtree(i, MeasureRestarts), float64(subtreeRestarts))
+				mut.Lock()
+				restarts += subtreeRestarts
+				mut.Unlock()
+			}()
 			for {
 				select {
 				case <-subProtocol.subleaderNotResponding: // TODO need to modify not reponding step?
 
+					if p.ctx.Err() != nil {
+						// don't restart anything, the round is being cancelled
+						return
+					}
+
 					subleaderID := trees[i].Root.Children[0].RosterIndex
 					log.Lvlf2("subleader from tree %d (id %d) failed, restarting it", i, subleaderID)
+					subtreeRestarts++
 
 					// send stop signal
 					subProtocol.HandleStop(StructStop{subProtocol.TreeNode(), Stop{}})
@@ -255,16 +329,21 @@ func (p *BlsFtCosi) collectSignatures(trees []*onet.Tree, cosiSubProtocols []*Su
 					}
 
 					// restart subprotocol
-					subProtocol, err = p.startSubProtocol(trees[i])
+					subProtocol, err = p.startSubProtocol(i, trees[i])
+					if _, ok := err.(*CancelledError); ok {
+						mut.Lock()
+						cancelled = err
+						mut.Unlock()
+						return
+					}
 					if err != nil {
 						err = fmt.Errorf("(node %v) error in restarting of subprotocol: %s", i, err)
 						errChan <- err
 						return
 					}
-					mut.Lock()
-					cosiSubProtocols[i] = subProtocol
-					mut.Unlock()
 				case response := <-subProtocol.subResponse:
+					subtreeCollect.Record()
+					monitor.RecordSingleMeasure(measureSubtree(i, MeasureSigners), float64(countSigners(response.Mask)))
 					mut.Lock()
 					runningSubProtocols = append(runningSubProtocols, subProtocol)
 					responses = append(responses, response)
@@ -274,6 +353,11 @@ func (p *BlsFtCosi) collectSignatures(trees []*onet.Tree, cosiSubProtocols []*Su
 					err := fmt.Errorf("(node %v) didn't get response after timeout %v", i, p.Timeout)
 					errChan <- err
 					return
+				case <-p.ctx.Done():
+					mut.Lock()
+					cancelled = &CancelledError{p.ctx.Err()}
+					mut.Unlock()
+					return
 				}
 			}
 		}(i, subProtocol)
@@ -281,6 +365,10 @@ func (p *BlsFtCosi) collectSignatures(trees []*onet.Tree, cosiSubProtocols []*Su
 	wg.Wait()
 
 	close(errChan)
+	monitor.RecordSingleMeasure(MeasureRestarts, float64(restarts))
+	if cancelled != nil {
+		return nil, nil, cancelled
+	}
 	var errs []error
 	for err := range errChan {
 		errs = append(errs, err)
@@ -294,9 +382,33 @@ func (p *BlsFtCosi) collectSignatures(trees []*onet.Tree, cosiSubProtocols []*Su
 	return responses, runningSubProtocols, nil
 }
 
+// stopSubProtocols sends a Stop message into every sub-protocol currently
+// running, including the ones that have been restarted with a new subleader.
+func (p *BlsFtCosi) stopSubProtocols() {
+	p.subProtocolsMut.Lock()
+	defer p.subProtocolsMut.Unlock()
+	for _, subProtocol := range p.subProtocols {
+		if subProtocol != nil {
+			subProtocol.HandleStop(StructStop{subProtocol.TreeNode(), Stop{}})
+		}
+	}
+}
+
 // Start is done only by root and starts the protocol.
 // It also verifies that the protocol has been correctly parameterized.
 func (p *BlsFtCosi) Start() error {
+	return p.StartContext(context.Background())
+}
+
+// StartContext is like Start, but the round can be cancelled through the
+// given context. Cancelling it stops all the sub-protocols, and the round
+// ends with a nil FinalSignature and a *CancelledError on FinalError.
+func (p *BlsFtCosi) StartContext(ctx context.Context) error {
+	if ctx == nil {
+		close(p.startChan)
+		return fmt.Errorf("nil context")
+	}
+	p.ctx = ctx
 	if p.Msg == nil {
 		close(p.startChan)
 		return fmt.Errorf("no proposal msg specified")
@@ -327,9 +439,16 @@ func (p *BlsFtCosi) Start() error {
 	return nil
 }
 
-// startSubProtocol creates, parametrize and starts a subprotocol on a given tree
-// and returns the started protocol.
-func (p *BlsFtCosi) startSubProtocol(tree *onet.Tree) (*SubBlsFtCosi, error) {
+// startSubProtocol creates, parametrize and starts the i-th subprotocol on a
+// given tree and returns the started protocol. It fails with a *CancelledError
+// once the round is cancelled, so that no sub-protocol is started after
+// stopSubProtocols ran.
+func (p *BlsFtCosi) startSubProtocol(i int, tree *onet.Tree) (*SubBlsFtCosi, error) {
+	p.subProtocolsMut.Lock()
+	defer p.subProtocolsMut.Unlock()
+	if err := p.ctx.Err(); err != nil {
+		return nil, &CancelledError{err}
+	}
 
 	pi, err := p.CreateProtocol(p.subProtocolName, tree, onet.NilServiceID)
 	if err != nil {
@@ -347,5 +466,6 @@ func (p *BlsFtCosi) startSubProtocol(tree *onet.Tree) (*SubBlsFtCosi, error) {
 		return nil, err
 	}
 
+	p.subProtocols[i] = cosiSubProtocol
 	return cosiSubProtocol, err
 }
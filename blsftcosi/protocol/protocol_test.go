@@ -1,6 +1,7 @@
 package protocol
 
 import (
+	"context"
 	"fmt"
 	"sync"
 	"testing"
@@ -395,6 +396,75 @@ func TestProtocolRefusalAll(t *testing.T) {
 
 
 
+// Tests that cancelling the context stops a round that cannot finish
+func TestProtocolCancel(t *testing.T) {
+	nodes := []int{5, 13}
+	subtrees := []int{1, 2}
+	proposal := []byte{0xFF}
+
+	for _, nNodes := range nodes {
+		for _, nSubtrees := range subtrees {
+			log.Lvl2("test asking for", nNodes, "nodes and", nSubtrees, "subtrees")
+
+			local := onet.NewLocalTest(testSuite)
+			servers, _, tree := local.GenTree(nNodes, false)
+
+			pi, err := local.CreateProtocol(DefaultProtocolName, tree)
+			if err != nil {
+				local.CloseAll()
+				t.Fatal("Error in creation of protocol:", err)
+			}
+			cosiProtocol := pi.(*BlsFtCosi)
+			cosiProtocol.CreateProtocol = local.CreateProtocol
+			cosiProtocol.Msg = proposal
+			cosiProtocol.NSubtrees = nSubtrees
+			cosiProtocol.Timeout = defaultTimeout * 10
+
+			// pause every node but the root so that the round hangs
+			for _, s := range servers[1:] {
+				s.Pause()
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			err = cosiProtocol.StartContext(ctx)
+			if err != nil {
+				local.CloseAll()
+				t.Fatal(err)
+			}
+
+			time.Sleep(100 * time.Millisecond)
+			cancel()
+
+			select {
+			case signature := <-cosiProtocol.FinalSignature:
+				if signature != nil {
+					local.CloseAll()
+					t.Fatal("cancelled round should not produce a signature")
+				}
+			case <-time.After(defaultTimeout):
+				local.CloseAll()
+				t.Fatal("cancelled round didn't stop in time")
+			}
+
+			select {
+			case err := <-cosiProtocol.FinalError:
+				if _, ok := err.(*CancelledError); !ok {
+					local.CloseAll()
+					t.Fatal("expected a cancellation error, got", err)
+				}
+			case <-time.After(defaultTimeout):
+				local.CloseAll()
+				t.Fatal("no error after cancellation")
+			}
+
+			for _, s := range servers[1:] {
+				s.Unpause()
+			}
+			local.CloseAll()
+		}
+	}
+}
+
 func getAndVerifySignature(cosiProtocol *BlsFtCosi, publics []kyber.Point,
 	proposal []byte, policy Policy) error {
 	var signature []byte
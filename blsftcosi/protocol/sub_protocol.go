@@ -11,6 +11,7 @@ import (
 	"github.com/dedis/kyber"
 	"github.com/dedis/onet"
 	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/simul/monitor"
 	"github.com/dedis/kyber/pairing"
 	"github.com/dedis/kyber/pairing/bn256"
 
@@ -29,6 +30,7 @@ type SubBlsFtCosi struct {
 	
 	Timeout        time.Duration
 	stoppedOnce    sync.Once
+	stopOnce       sync.Once // the root and the restarts can both stop it
 	verificationFn VerificationFn
 	pairingSuite   pairing.Suite
 
@@ -74,8 +76,10 @@ func NewSubBlsFtCosi(n *onet.TreeNodeInstance, vf VerificationFn, pairingSuite p
 	}
 
 	if n.IsRoot() {
-		c.subleaderNotResponding = make(chan bool)
-		c.subResponse = make(chan StructResponse)
+		// buffered so that the sub-protocol never blocks on a main protocol
+		// that stopped listening, e.g. because the round was cancelled
+		c.subleaderNotResponding = make(chan bool, 1)
+		c.subResponse = make(chan StructResponse, 1)
 	}
 
 	for _, channel := range []interface{}{
@@ -130,14 +134,22 @@ func (p *SubBlsFtCosi) Dispatch() error {
 	if !p.IsRoot() {
 		go func() {
 			log.Lvl3(p.ServerIdentity(), "starting verification")
-			verifyChan <- p.verificationFn(p.Msg, p.Data)
+			verification := monitor.NewTimeMeasure(MeasureVerification)
+			ok := p.verificationFn(p.Msg, p.Data)
+			verification.Record()
+			verifyChan <- ok
 		}()
 	}
 
-
+	level := treeLevel(p.TreeNode())
+	sendAnnouncement := monitor.NewTimeMeasure(MeasureAnnouncement)
 	if errs := p.SendToChildrenInParallel(&announcement.Announcement); len(errs) > 0 {
 		log.Lvl3(p.ServerIdentity().Address, "failed to send announcement to all children")
 	}	
+	if p.IsRoot() {
+		sendAnnouncement.Record()
+	}
+	recordBytesSent(level, &announcement.Announcement, len(p.Children()))
 
 	// Collect all responses from children, store them and wait till all have responded or timed out.
 	responses := make([]StructResponse, 0)
@@ -155,7 +167,8 @@ func (p *SubBlsFtCosi) Dispatch() error {
 			p.subleaderNotResponding <- true
 			return nil
 		}
-	} else {
+	} else if !p.IsLeaf() {
+		waitChildren := monitor.NewTimeMeasure(MeasureWaitChildren)
 		t := time.After(p.Timeout / 2)
 loop:
 	// note that this section will not execute if it's on a leaf
@@ -170,6 +183,7 @@ loop:
 					break loop
 				}
 		}
+		waitChildren.Record()
 	}
 
 	var ok bool
@@ -192,11 +206,13 @@ loop:
 		// unset the mask if the verification failed and remove commitment
 		
 		// Generate own signature and aggregate with all children signatures
+		aggregation := monitor.NewTimeMeasure(MeasureAggregation)
 		signaturePoint, finalMask, err := generateSignature(p.pairingSuite, p.TreeNodeInstance, p.Publics, responses, p.Msg, ok)
 
 		if err != nil {
 			return err
 		}
+		aggregation.Record()
 
 		tmp, err := PointToByteSlice(p.pairingSuite, signaturePoint)
 
@@ -219,10 +235,12 @@ loop:
 		}
 
 
-		err = p.SendToParent(&Response{CoSiReponse:tmp, Mask:finalMask.mask})
+		response := &Response{CoSiReponse:tmp, Mask:finalMask.mask}
+		err = p.SendToParent(response)
 		if err != nil {
 			return err
 		}
+		recordBytesSent(level, response, 1)
 	}
 
 	return nil
@@ -258,11 +276,13 @@ func (p *SubBlsFtCosi) Start() error {
 
 // HandleStop is called when a Stop message is send to this node.
 // It broadcasts the message to all the nodes in tree and each node will stop
-// the protocol by calling p.Done.
+// the protocol by calling p.Done. Only the first Stop is handled.
 func (p *SubBlsFtCosi) HandleStop(stop StructStop) error {
-	defer p.Done()
-	if p.IsRoot() {
-		p.Broadcast(&stop.Stop)
-	}
+	p.stopOnce.Do(func() {
+		defer p.Done()
+		if p.IsRoot() {
+			p.Broadcast(&stop.Stop)
+		}
+	})
 	return nil
 }
\ No newline at end of file
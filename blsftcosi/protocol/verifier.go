@@ -0,0 +1,157 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/pairing"
+	"github.com/dedis/kyber/sign/bls"
+	"github.com/dedis/onet/simul/monitor"
+)
+
+// Verifier checks collective signatures produced by a fixed roster. Unlike
+// Verify, it does not rebuild the aggregate public key from scratch for every
+// signature: the aggregate of all keys is computed once, and the aggregate for
+// a given mask is derived either by subtracting the disabled keys from it or by
+// patching the aggregate of the previously verified mask, whichever needs
+// fewer point operations. Consecutive signatures with near-identical masks
+// therefore cost only a handful of point additions.
+// A Verifier is safe for concurrent use.
+type Verifier struct {
+	suite     pairing.Suite
+	publics   []kyber.Point
+	aggregate kyber.Point // aggregate of all the public keys
+
+	sync.Mutex
+	lastMask      []byte
+	lastAggregate kyber.Point
+}
+
+// NewVerifier returns a Verifier bound to the given list of public keys, in
+// the same order as the one used by the protocol to build the masks.
+func NewVerifier(suite pairing.Suite, publics []kyber.Point) (*Verifier, error) {
+	if suite == nil {
+		return nil, errors.New("no pairing suite provided")
+	}
+	if len(publics) == 0 {
+		return nil, errors.New("no public keys provided")
+	}
+
+	aggregate := suite.G2().Point().Null()
+	for _, p := range publics {
+		aggregate.Add(aggregate, p)
+	}
+
+	full := make([]byte, (len(publics)+7)>>3)
+	for i := range publics {
+		full[i>>3] |= byte(1) << uint(i&7)
+	}
+
+	return &Verifier{
+		suite:         suite,
+		publics:       publics,
+		aggregate:     aggregate,
+		lastMask:      full,
+		lastAggregate: aggregate.Clone(),
+	}, nil
+}
+
+// AggregatePublic returns the aggregate public key of the cosigners enabled
+// in the given participation mask.
+func (v *Verifier) AggregatePublic(mask []byte) (kyber.Point, error) {
+	if len(mask) != len(v.lastMask) {
+		return nil, fmt.Errorf("mismatching mask lengths")
+	}
+
+	v.Lock()
+	defer v.Unlock()
+
+	// count the number of point operations needed by each strategy
+	disabled, changed := 0, 0
+	for i := range v.publics {
+		byt := i >> 3
+		msk := byte(1) << uint(i&7)
+		if mask[byt]&msk == 0 {
+			disabled++
+		}
+		if (mask[byt]^v.lastMask[byt])&msk != 0 {
+			changed++
+		}
+	}
+
+	var agg kyber.Point
+	if changed <= disabled {
+		agg = v.lastAggregate.Clone()
+		for i := range v.publics {
+			byt := i >> 3
+			msk := byte(1) << uint(i&7)
+			if (mask[byt]^v.lastMask[byt])&msk == 0 {
+				continue
+			}
+			if mask[byt]&msk != 0 {
+				agg.Add(agg, v.publics[i])
+			} else {
+				agg.Sub(agg, v.publics[i])
+			}
+		}
+	} else {
+		agg = v.aggregate.Clone()
+		for i := range v.publics {
+			if mask[i>>3]&(byte(1)<<uint(i&7)) == 0 {
+				agg.Sub(agg, v.publics[i])
+			}
+		}
+	}
+
+	copy(v.lastMask, mask)
+	v.lastAggregate = agg.Clone()
+	return agg, nil
+}
+
+// Verify checks the given cosignature on the provided message using the
+// cosigning policy. The signature has the same format as the one accepted by
+// Verify, i.e. the aggregate signature followed by the participation mask.
+func (v *Verifier) Verify(message, sig []byte, policy Policy) error {
+	if message == nil {
+		return errors.New("no message provided")
+	}
+	if sig == nil {
+		return errors.New("no signature provided")
+	}
+	if policy == nil {
+		policy = CompletePolicy{}
+	}
+
+	lenCom := v.suite.G1().PointLen()
+	if len(sig) < lenCom {
+		return errors.New("signature too short")
+	}
+	signature, rawMask := sig[:lenCom], sig[lenCom:]
+
+	agg, err := v.AggregatePublic(rawMask)
+	if err != nil {
+		return err
+	}
+
+	if err := bls.Verify(v.suite, agg, message, signature); err != nil {
+		return fmt.Errorf("didn't get a valid signature: %s", err)
+	}
+
+	// the aggregate is already known, so the mask is built directly
+	// instead of through NewMask which would redo all the additions
+	mask := &Mask{
+		mask:            make([]byte, len(rawMask)),
+		publics:         v.publics,
+		AggregatePublic: agg,
+	}
+	copy(mask.mask, rawMask)
+
+	monitor.RecordSingleMeasure("correct_nodes", float64(mask.CountEnabled()))
+
+	if !policy.Check(mask) {
+		return errors.New("the policy is not fulfilled")
+	}
+	return nil
+}
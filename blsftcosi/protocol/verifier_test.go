@@ -0,0 +1,135 @@
+package protocol
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/sign/bls"
+	"github.com/dedis/kyber/util/random"
+)
+
+// genSignature returns a collective signature on msg by the signers whose
+// index is enabled in the mask, in the format produced by the protocol.
+func genSignature(t *testing.T, privates []kyber.Scalar, publics []kyber.Point, msg []byte, enabled []bool) []byte {
+	mask, err := NewMask(ThePairingSuite, publics, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	agg := ThePairingSuite.G1().Point().Null()
+	for i, on := range enabled {
+		if !on {
+			continue
+		}
+		sig, err := bls.Sign(ThePairingSuite, privates[i], msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		point, err := signedByteSliceToPoint(ThePairingSuite, sig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		agg.Add(agg, point)
+		mask.SetBit(i, true)
+	}
+	sig, err := agg.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return AppendSigAndMask(sig, mask)
+}
+
+func TestVerifier(t *testing.T) {
+	n := 13
+	msg := []byte("dedis")
+
+	privates := make([]kyber.Scalar, n)
+	publics := make([]kyber.Point, n)
+	for i := range publics {
+		privates[i], publics[i] = bls.NewKeyPair(ThePairingSuite, random.New())
+	}
+
+	verifier, err := NewVerifier(ThePairingSuite, publics)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// masks that exercise both the "subtract" and the "diff" strategies
+	cases := [][]int{
+		{},
+		{3},
+		{3, 4},
+		{0, 1, 2, 5, 6, 7, 8, 9, 10, 11},
+		{12},
+		{},
+	}
+	for _, disabled := range cases {
+		enabled := make([]bool, n)
+		for i := range enabled {
+			enabled[i] = true
+		}
+		for _, d := range disabled {
+			enabled[d] = false
+		}
+		sig := genSignature(t, privates, publics, msg, enabled)
+
+		if err := verifier.Verify(msg, sig, NewThresholdPolicy(n-len(disabled))); err != nil {
+			t.Fatal("disabled", disabled, ":", err)
+		}
+		if err := Verify(ThePairingSuite, publics, msg, sig, NewThresholdPolicy(n-len(disabled))); err != nil {
+			t.Fatal("disabled", disabled, ":", err)
+		}
+		if len(disabled) > 0 {
+			if err := verifier.Verify(msg, sig, CompletePolicy{}); err == nil {
+				t.Fatal("complete policy should fail with disabled", disabled)
+			}
+		}
+		if err := verifier.Verify([]byte("other"), sig, nil); err == nil {
+			t.Fatal("verification of wrong message should fail")
+		}
+	}
+}
+
+func TestVerifierConcurrent(t *testing.T) {
+	n := 8
+	msg := []byte("dedis")
+
+	privates := make([]kyber.Scalar, n)
+	publics := make([]kyber.Point, n)
+	for i := range publics {
+		privates[i], publics[i] = bls.NewKeyPair(ThePairingSuite, random.New())
+	}
+
+	verifier, err := NewVerifier(ThePairingSuite, publics)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sigs := make([][]byte, n)
+	for d := range sigs {
+		enabled := make([]bool, n)
+		for i := range enabled {
+			enabled[i] = i != d
+		}
+		sigs[d] = genSignature(t, privates, publics, msg, enabled)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, n*4)
+	for r := 0; r < 4; r++ {
+		for _, sig := range sigs {
+			wg.Add(1)
+			go func(sig []byte) {
+				defer wg.Done()
+				errs <- verifier.Verify(msg, sig, NewThresholdPolicy(n-1))
+			}(sig)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
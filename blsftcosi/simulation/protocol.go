@@ -4,7 +4,6 @@ package main
 import (
 	"time"
 	"fmt"
-	"errors"
 
 	"github.com/BurntSushi/toml"
 	"github.com/dedis/onet"
@@ -15,8 +14,7 @@ import (
 	"github.com/dedis/cothority"
 	"github.com/dedis/kyber/pairing"
 	"github.com/dedis/kyber/pairing/bn256"
-	"bls-ftcosi/cothority/protocols/byzcoin/blockchain"
-	"bls-ftcosi/cothority/protocols/byzcoin/blockchain/blkparser"
+	"bls-ftcosi/blocks"
 )
 
 func init() {
@@ -31,15 +29,11 @@ func init() {
 	}
 }
 
-
-var magicNum = [4]byte{0xF9, 0xBE, 0xB4, 0xD9}
-var blocksPath = "/users/csbenz/blocks" // "/home/christo/.bitcoin/blocks"
-const ReadFirstNBlocks = 66000
-var wantednTxs = 10000
-
 // SimulationProtocol implements onet.Simulation.
 type SimulationProtocol struct {
 	onet.SimulationBFTree
+	// Config selects the transactions of the blocks, see blocks.Config
+	blocks.Config
 	NNodes				int
 	NSubtrees			int
 	FailingSubleaders	int
@@ -68,32 +62,6 @@ func (s *SimulationProtocol) Setup(dir string, hosts []string) (*onet.Simulation
 	return sc, nil
 }
 
-func loadBlocks() ([]blkparser.Tx, error) {
-	// Initialize blockchain parser
-	parser, err := blockchain.NewParser(blocksPath, magicNum)
-	_ = parser
-	if err != nil {
-		return nil, err
-	}
-
-	transactions, err := parser.Parse(0, ReadFirstNBlocks)
-	if len(transactions) == 0 {
-		return nil, errors.New("Couldn't read any transactions.")
-	}
-	if err != nil {
-		log.Error("Error: Couldn't parse blocks in", blocksPath,
-			".\nPlease download bitcoin blocks as .dat files first and place them in",
-			blocksPath, "Either run a bitcoin node (recommended) or using a torrent.")
-		return nil, err
-	}
-	log.Lvl1("Got", len(transactions), "transactions")
-	if len(transactions) < wantednTxs {
-		log.Errorf("Read only %v but wanted %v", len(transactions), wantednTxs)
-	}
-
-	return transactions, nil
-}
-
 // Node can be used to initialize each node before it will be run
 // by the server. Here we call the 'Node'-method of the
 // SimulationBFTree structure which will load the roster- and the
@@ -112,14 +80,14 @@ var proposal = []byte("dedis")
 
 // Run implements onet.Simulation.
 func (s *SimulationProtocol) Run(config *onet.SimulationConfig) error {
-	transactions, err := loadBlocks()
+	transactions, err := s.Load()
 	if err != nil {
 		return err
 	}
 
 	log.Lvl1("Run got", len(transactions), "transactions")
 
-	block, err := GetBlock(6000, transactions, "0", "0", 0)
+	block, err := blocks.GetBlock(6000, transactions, "0", "0", 0)
 	if err != nil {
 		return err
 	}
@@ -132,17 +100,25 @@ func (s *SimulationProtocol) Run(config *onet.SimulationConfig) error {
 	thold := size * 2 / 3
 	log.Lvl1("Size is:", size, "rounds:", s.Rounds)
 	log.Lvl1("Simulating for", s.Hosts, "nodes and", s.NSubtrees, "subtrees in ", s.Rounds, "round")
+
+	// get public keys
+	publics := make([]kyber.Point, config.Tree.Size())
+	for i, node := range config.Tree.List() {
+		publics[i] = node.ServerIdentity.Public
+	}
+
+	// the verifier is kept across rounds so that consecutive signatures
+	// with similar masks are cheap to verify
+	verifier, err := protocol.NewVerifier(protocol.ThePairingSuite, publics)
+	if err != nil {
+		return err
+	}
+
 	for round := 0; round < s.Rounds; round++ {
 
 		roundNoVerify := monitor.NewTimeMeasure("roundNoVerify")
 		fullRound := monitor.NewTimeMeasure("fullRound")
 
-		// get public keys
-		publics := make([]kyber.Point, config.Tree.Size())
-		for i, node := range config.Tree.List() {
-			publics[i] = node.ServerIdentity.Public
-		}
-
 		pi, err := config.Overlay.CreateProtocol(protocol.DefaultProtocolName, config.Tree, onet.NilServiceID)
 		if err != nil {
 			return err
@@ -170,7 +146,7 @@ func (s *SimulationProtocol) Run(config *onet.SimulationConfig) error {
 
 		
 		verificationOnly := monitor.NewTimeMeasure("verificationOnly")
-		err = verifySignature(cosiProtocol.PairingSuite, signature, publics, binaryBlock, protocol.NewThresholdPolicy(thold))
+		err = verifier.Verify(binaryBlock, signature, protocol.NewThresholdPolicy(thold))
 		if err != nil {
 			return err
 		}
@@ -182,20 +158,6 @@ func (s *SimulationProtocol) Run(config *onet.SimulationConfig) error {
 	return nil
 }
 
-// GetBlock returns the next block available from the transaction pool.
-func GetBlock(size int, transactions []blkparser.Tx, lastBlock string, lastKeyBlock string, priority int) (*blockchain.TrBlock, error) {
-	log.Lvl1("GetBlock got", len(transactions), "transactions")
-
-	if len(transactions) < 1 {
-		return nil, errors.New("no transaction available")
-	}
-
-	trlist := blockchain.NewTransactionList(transactions, size)
-	header := blockchain.NewHeader(trlist, lastBlock, lastKeyBlock)
-	trblock := blockchain.NewTrBlock(trlist, header)
-	return trblock, nil
-}
-
 func getAndVerifySignature(cosiProtocol *protocol.BlsFtCosi, publics []kyber.Point,
 	proposal []byte, policy protocol.Policy) error {
 	var signature []byte
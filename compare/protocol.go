@@ -0,0 +1,213 @@
+package main
+
+/*
+The comparison simulation runs any of the protocols of this repository with
+the same blocks, failures and rounds, and records the same measures for all of
+them, so that their results can be compared directly. The protocol is chosen
+by the Protocol of the run TOML, which can be a column of the runs:
+
+	Protocol, Hosts, Failing
+	"blsftcosi", 16, 0
+	"bftcosi", 16, 0
+	"pbft", 16, 0
+	"hotstuff", 16, 0
+
+Every round records the same three measures through the monitor:
+roundNoVerify, until the root has the signature or the reply of the round,
+verificationOnly, the verification of that result by the root, and fullRound,
+both of them. The result of hotstuff, a committed block, carries nothing to
+verify, so its runs have no verificationOnly. The root also writes them in a
+CSV file per run, with a protocol column, see csvFile.
+*/
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"bls-ftcosi/blocks"
+	"github.com/BurntSushi/toml"
+	"github.com/dedis/cothority"
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/pairing"
+	"github.com/dedis/kyber/pairing/bn256"
+	"github.com/dedis/onet"
+	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/network"
+	"github.com/dedis/onet/simul/monitor"
+)
+
+func init() {
+	onet.SimulationRegister("Comparison", NewSimulationProtocol)
+
+	// blsftcosi needs a pairing suite, the other protocols run on its G2
+	// group: all the runs use Suite = "bn256.g2"
+	cothority.Suite = struct {
+		pairing.Suite
+		kyber.Group
+	}{
+		Suite: bn256.NewSuite(),
+		Group: bn256.NewSuiteG2(),
+	}
+}
+
+// defaultBlockSize is the number of transactions of the block when BlockSize
+// is not set.
+const defaultBlockSize = 3000
+
+var defaultTimeout = 120 * time.Second
+
+// SimulationProtocol implements onet.Simulation.
+type SimulationProtocol struct {
+	onet.SimulationBFTree
+	// Config selects the transactions of the blocks, see blocks.Config
+	blocks.Config
+	// Protocol is the protocol to run, one of the keys of runners.
+	Protocol string
+	// BlockSize is the number of transactions of the block of every round,
+	// defaultBlockSize if it is 0.
+	BlockSize int
+	// Failing is the number of nodes at the end of the roster that crash:
+	// they drop all the messages of the protocols.
+	Failing int
+	// NSubtrees is the number of subtrees of blsftcosi and bftcosi.
+	NSubtrees int
+	// CSVDir is the directory of the CSV files written by the root, the
+	// one it runs in by default.
+	CSVDir string
+}
+
+// NewSimulationProtocol is used internally to register the simulation (see the init()
+// function above).
+func NewSimulationProtocol(config string) (onet.Simulation, error) {
+	es := &SimulationProtocol{}
+	_, err := toml.Decode(config, es)
+	if err != nil {
+		return nil, err
+	}
+	if es.BlockSize == 0 {
+		es.BlockSize = defaultBlockSize
+	}
+	if es.NSubtrees == 0 {
+		es.NSubtrees = 1
+	}
+	return es, nil
+}
+
+// Setup implements onet.Simulation.
+func (s *SimulationProtocol) Setup(dir string, hosts []string) (*onet.SimulationConfig, error) {
+	if _, ok := runners[s.Protocol]; !ok {
+		return nil, fmt.Errorf("unknown Protocol %q", s.Protocol)
+	}
+	// all the protocols tolerate f faulty nodes out of 3f+1, and the root
+	// runs the rounds
+	if f := (s.Hosts - 1) / 3; s.Failing > f {
+		return nil, fmt.Errorf("%d failing nodes but the protocols tolerate only %d out of %d", s.Failing, f, s.Hosts)
+	}
+	sc := &onet.SimulationConfig{}
+	s.CreateRoster(sc, hosts, 2000)
+	err := s.CreateTree(sc)
+	if err != nil {
+		return nil, err
+	}
+	return sc, nil
+}
+
+// Node can be used to initialize each node before it will be run
+// by the server. Here we call the 'Node'-method of the
+// SimulationBFTree structure which will load the roster- and the
+// tree-structure to speed up the first round.
+func (s *SimulationProtocol) Node(config *onet.SimulationConfig) error {
+	index, _ := config.Roster.Search(config.Server.ServerIdentity.ID)
+	if index < 0 {
+		log.Fatal("Didn't find this node in roster")
+	}
+	if len(config.Roster.List)-index <= s.Failing {
+		log.Lvl2("node", index, "crashed")
+		config.Server.RegisterProcessorFunc(onet.ProtocolMsgID, func(e *network.Envelope) {})
+	}
+	log.Lvl3("Initializing node-index", index)
+	return s.SimulationBFTree.Node(config)
+}
+
+// Run implements onet.Simulation.
+func (s *SimulationProtocol) Run(config *onet.SimulationConfig) error {
+	transactions, err := s.Load()
+	if err != nil {
+		return err
+	}
+	block, err := blocks.GetBlock(s.BlockSize, transactions, "0", "0", 0)
+	if err != nil {
+		return err
+	}
+	binaryBlock, err := block.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	r, err := runners[s.Protocol](s, config)
+	if err != nil {
+		return err
+	}
+
+	out, err := s.csvFile()
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	w := csv.NewWriter(out)
+	w.Write([]string{"protocol", "hosts", "failing", "block_size", "round",
+		"round_no_verify", "verification_only", "full_round"})
+
+	log.Lvl1("Simulating", s.Protocol, "for", s.Hosts, "nodes with", s.Failing,
+		"failing in", s.Rounds, "rounds")
+	for round := 0; round < s.Rounds; round++ {
+		log.Lvl1("Starting round", round)
+		start := time.Now()
+		roundNoVerify := monitor.NewTimeMeasure("roundNoVerify")
+		fullRound := monitor.NewTimeMeasure("fullRound")
+
+		verify, err := r.Round(config, binaryBlock)
+		if err != nil {
+			return err
+		}
+		roundNoVerify.Record()
+		consensus := time.Since(start)
+
+		verification := ""
+		if verify != nil {
+			verificationOnly := monitor.NewTimeMeasure("verificationOnly")
+			if err := verify(); err != nil {
+				return fmt.Errorf("%s: invalid result: %s", s.Protocol, err)
+			}
+			verificationOnly.Record()
+			verification = seconds(time.Since(start) - consensus)
+		}
+		fullRound.Record()
+		total := time.Since(start)
+
+		w.Write([]string{s.Protocol, strconv.Itoa(s.Hosts), strconv.Itoa(s.Failing),
+			strconv.Itoa(s.BlockSize), strconv.Itoa(round), seconds(consensus),
+			verification, seconds(total)})
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// csvFile creates the CSV file of the run in CSVDir, named after the
+// protocol and the parameters of the run, e.g.
+// pbft_16_hosts_1_failing_3000_txs.csv.
+func (s *SimulationProtocol) csvFile() (*os.File, error) {
+	name := fmt.Sprintf("%s_%d_hosts_%d_failing_%d_txs.csv", s.Protocol, s.Hosts,
+		s.Failing, s.BlockSize)
+	return os.Create(filepath.Join(s.CSVDir, name))
+}
+
+func seconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 6, 64)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+
+	bftcosi "bls-ftcosi/bftcosi/protocol"
+	blsftcosi "bls-ftcosi/blsftcosi/protocol"
+	hotstuff "bls-ftcosi/hotstuff/protocol"
+	pbft "bls-ftcosi/pbft/protocol"
+	"github.com/dedis/kyber"
+	"github.com/dedis/onet"
+	"github.com/dedis/onet/log"
+)
+
+// runner runs the rounds of a protocol on the root.
+type runner interface {
+	// Round runs a round of the protocol on the block, and returns once the
+	// root has its result, with the function verifying that result, or nil
+	// if the result carries nothing to verify.
+	Round(config *onet.SimulationConfig, block []byte) (verify func() error, err error)
+}
+
+// runners are the protocols of the simulation by their Protocol name. A new
+// protocol only needs a runner here to be compared with the others.
+var runners = map[string]func(s *SimulationProtocol, config *onet.SimulationConfig) (runner, error){
+	"blsftcosi": newBlsFtCosiRunner,
+	"bftcosi":   newBFTCoSiRunner,
+	"pbft":      newPbftRunner,
+	"hotstuff":  newHotStuffRunner,
+}
+
+func init() {
+	onet.GlobalProtocolRegister("CompareBFTCoSi", func(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+		return bftcosi.NewSubtreesBFTCoSi(n, "CompareBFTCoSiRound")
+	})
+	onet.GlobalProtocolRegister("CompareBFTCoSiRound", func(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+		return bftcosi.NewBFTCoSiProtocol(n, func(msg []byte, data []byte) bool { return true })
+	})
+}
+
+type blsFtCosiRunner struct {
+	nSubtrees int
+	// the verifier is kept across rounds so that consecutive signatures
+	// with similar masks are cheap to verify
+	verifier *blsftcosi.Verifier
+	policy   blsftcosi.Policy
+}
+
+func newBlsFtCosiRunner(s *SimulationProtocol, config *onet.SimulationConfig) (runner, error) {
+	publics := make([]kyber.Point, config.Tree.Size())
+	for i, node := range config.Tree.List() {
+		publics[i] = node.ServerIdentity.Public
+	}
+	verifier, err := blsftcosi.NewVerifier(blsftcosi.ThePairingSuite, publics)
+	if err != nil {
+		return nil, err
+	}
+	return &blsFtCosiRunner{
+		nSubtrees: s.NSubtrees,
+		verifier:  verifier,
+		policy:    blsftcosi.NewThresholdPolicy(config.Tree.Size() * 2 / 3),
+	}, nil
+}
+
+func (r *blsFtCosiRunner) Round(config *onet.SimulationConfig, block []byte) (func() error, error) {
+	pi, err := config.Overlay.CreateProtocol(blsftcosi.DefaultProtocolName, config.Tree, onet.NilServiceID)
+	if err != nil {
+		return nil, err
+	}
+	cosiProtocol := pi.(*blsftcosi.BlsFtCosi)
+	cosiProtocol.CreateProtocol = config.Overlay.CreateProtocol
+	cosiProtocol.Msg = block
+	cosiProtocol.NSubtrees = r.nSubtrees
+	cosiProtocol.Timeout = defaultTimeout
+	if err := cosiProtocol.Start(); err != nil {
+		return nil, err
+	}
+
+	select {
+	case signature := <-cosiProtocol.FinalSignature:
+		return func() error {
+			return r.verifier.Verify(block, signature, r.policy)
+		}, nil
+	case <-time.After(defaultTimeout * 2):
+		// wait a bit longer than the protocol timeout
+		return nil, errors.New("didn't get the signature in time")
+	}
+}
+
+type bftCoSiRunner struct {
+	nSubtrees int
+}
+
+func newBFTCoSiRunner(s *SimulationProtocol, config *onet.SimulationConfig) (runner, error) {
+	return &bftCoSiRunner{nSubtrees: s.NSubtrees}, nil
+}
+
+func (r *bftCoSiRunner) Round(config *onet.SimulationConfig, block []byte) (func() error, error) {
+	pi, err := config.Overlay.CreateProtocol("CompareBFTCoSi", config.Tree, onet.NilServiceID)
+	if err != nil {
+		return nil, err
+	}
+	proto := pi.(*bftcosi.SubtreesBFTCoSi)
+	proto.NSubtrees = r.nSubtrees
+	proto.CreateProtocol = config.Overlay.CreateProtocol
+	proto.Msg = block
+	proto.Timeout = defaultTimeout
+	done := make(chan bool, 1)
+	proto.RegisterOnDone(func() {
+		done <- true
+	})
+	go func() {
+		log.ErrFatal(proto.Start())
+	}()
+
+	select {
+	case <-done:
+		return func() error {
+			return proto.Signature().Verify(proto.Suite(), proto.Roster().Publics())
+		}, nil
+	case <-time.After(defaultTimeout * 2):
+		return nil, errors.New("didn't get the signature in time")
+	}
+}
+
+// pbftRunner verifies the commit certificate of the reply of the root: the
+// signatures of a quorum of the replicas on the batch of the block.
+type pbftRunner struct{}
+
+func newPbftRunner(s *SimulationProtocol, config *onet.SimulationConfig) (runner, error) {
+	return pbftRunner{}, nil
+}
+
+func (pbftRunner) Round(config *onet.SimulationConfig, block []byte) (func() error, error) {
+	pi, err := config.Overlay.CreateProtocol(pbft.DefaultProtocolName, config.Tree, onet.NilServiceID)
+	if err != nil {
+		return nil, err
+	}
+	pbftProtocol := pi.(*pbft.PbftProtocol)
+	pbftProtocol.Timeout = defaultTimeout
+	pbftProtocol.Msg = block
+	// the block is the only request of the root
+	results := make(chan *pbft.Result, 1)
+	pbftProtocol.RegisterOnResult(func(r *pbft.Result) {
+		select {
+		case results <- r:
+		default:
+		}
+	})
+	if err := pbftProtocol.Start(); err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-pbftProtocol.FinalReply:
+		// the result is given before the final reply
+		var result *pbft.Result
+		select {
+		case result = <-results:
+		case <-time.After(defaultTimeout * 2):
+			return nil, errors.New("leader got the final reply but no result")
+		}
+		return func() error {
+			cert := result.Cert
+			if cert == nil {
+				return errors.New("no commit certificate")
+			}
+			if cert.Phase != "commit" || cert.Seq != result.Seq {
+				return fmt.Errorf("%s certificate of sequence number %d for the result of %d",
+					cert.Phase, cert.Seq, result.Seq)
+			}
+			return cert.Verify(pbftProtocol.Suite(), pbftProtocol.Roster())
+		}, nil
+	case <-time.After(defaultTimeout * 2):
+		// don't leave the replicas running into the next round
+		pbftProtocol.Stop()
+		return nil, errors.New("leader never got enough final replies, timed out")
+	}
+}
+
+// hotStuffRunner has nothing to verify: the block committed by the root comes
+// with the certificate of its parent only, the one of the block is in its
+// descendants.
+type hotStuffRunner struct{}
+
+func newHotStuffRunner(s *SimulationProtocol, config *onet.SimulationConfig) (runner, error) {
+	return hotStuffRunner{}, nil
+}
+
+func (hotStuffRunner) Round(config *onet.SimulationConfig, block []byte) (func() error, error) {
+	pi, err := config.Overlay.CreateProtocol(hotstuff.DefaultProtocolName, config.Tree, onet.NilServiceID)
+	if err != nil {
+		return nil, err
+	}
+	hotstuffProtocol := pi.(*hotstuff.HotStuffProtocol)
+	hotstuffProtocol.Msg = block
+	hotstuffProtocol.Timeout = defaultTimeout
+	if err := hotstuffProtocol.Start(); err != nil {
+		return nil, err
+	}
+
+	select {
+	case b := <-hotstuffProtocol.FinalBlock:
+		if !bytes.Equal(b.Payload, block) {
+			return nil, fmt.Errorf("committed the wrong block in view %d", b.View)
+		}
+		return nil, nil
+	case <-time.After(defaultTimeout * 2):
+		// don't leave the replicas running into the next round
+		hotstuffProtocol.Stop()
+		return nil, errors.New("root never committed the block, timed out")
+	}
+}
@@ -0,0 +1,9 @@
+package main
+
+import (
+	"github.com/dedis/onet/simul"
+)
+
+func main() {
+	simul.Start()
+}
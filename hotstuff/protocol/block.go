@@ -0,0 +1,82 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	blscosi "bls-ftcosi/blsftcosi/protocol"
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/pairing"
+	"github.com/dedis/kyber/sign/bls"
+)
+
+// Hash returns the hash identifying the block in the tree.
+func (b *Block) Hash() []byte {
+	h := sha512.New()
+	binary.Write(h, binary.LittleEndian, int64(b.View))
+	h.Write(b.Parent)
+	binary.Write(h, binary.LittleEndian, int64(b.Justify.View))
+	h.Write(b.Justify.Block)
+	h.Write([]byte(b.Proposer))
+	h.Write(b.Payload)
+	return h.Sum(nil)
+}
+
+// Genesis returns the root of the block tree, which every replica starts
+// from. It is certified by GenesisQC.
+func Genesis() *Block {
+	return &Block{}
+}
+
+// GenesisQC returns the certificate of the genesis block, which needs no
+// signature.
+func GenesisQC() *QC {
+	return &QC{View: 0, Block: Genesis().Hash()}
+}
+
+// Verify checks that the certificate holds the aggregate signature of a
+// quorum of the given public keys, in the order of the roster.
+func (qc *QC) Verify(suite pairing.Suite, publics []kyber.Point) error {
+	if qc.View == 0 {
+		if !bytes.Equal(qc.Block, Genesis().Hash()) {
+			return errors.New("certificate of view 0 for another block than the genesis")
+		}
+		return nil
+	}
+	mask, err := blscosi.NewMask(suite, publics, nil)
+	if err != nil {
+		return err
+	}
+	if err := mask.SetMask(qc.Mask); err != nil {
+		return err
+	}
+	if n := mask.CountEnabled(); n < quorumSize(len(publics)) {
+		return fmt.Errorf("only %d signers in the certificate", n)
+	}
+	return bls.Verify(suite, mask.AggregatePublic, votePayload(qc.View, qc.Block), qc.Sig)
+}
+
+// votePayload returns the bytes signed by a replica voting for a block, so
+// that votes cannot be replayed in another view.
+func votePayload(view int, block []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("vote")
+	binary.Write(&buf, binary.LittleEndian, int64(view))
+	buf.Write(block)
+	return buf.Bytes()
+}
+
+// quorumSize returns the number of replicas out of n whose votes form a
+// quorum: any two quorums intersect in at least one correct replica.
+func quorumSize(n int) int {
+	return (n+(n-1)/3)/2 + 1
+}
+
+// digest returns the digest identifying a payload.
+func digest(payload []byte) string {
+	d := sha512.Sum512(payload)
+	return string(d[:])
+}
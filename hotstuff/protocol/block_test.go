@@ -0,0 +1,68 @@
+package protocol
+
+import (
+	"testing"
+
+	blscosi "bls-ftcosi/blsftcosi/protocol"
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/pairing/bn256"
+	"github.com/dedis/kyber/sign/bls"
+	"github.com/dedis/kyber/util/key"
+)
+
+func TestQC(t *testing.T) {
+	suite := bn256.NewSuite()
+	keys := make([]*key.Pair, 4)
+	publics := make([]kyber.Point, len(keys))
+	for i := range keys {
+		keys[i] = key.NewKeyPair(bn256.NewSuiteG2())
+		publics[i] = keys[i].Public
+	}
+	block := (&Block{View: 1, Parent: Genesis().Hash(), Justify: *GenesisQC()}).Hash()
+
+	qc := func(view int, signers ...int) *QC {
+		mask, err := blscosi.NewMask(suite, publics, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sigs [][]byte
+		for _, i := range signers {
+			sig, err := bls.Sign(suite, keys[i].Private, votePayload(view, block))
+			if err != nil {
+				t.Fatal(err)
+			}
+			sigs = append(sigs, sig)
+			if err := mask.SetBit(i, true); err != nil {
+				t.Fatal(err)
+			}
+		}
+		sig, err := bls.AggregateSignatures(suite, sigs...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &QC{View: 1, Block: block, Sig: sig, Mask: mask.Mask()}
+	}
+
+	if err := qc(1, 0, 1, 3).Verify(suite, publics); err != nil {
+		t.Fatal("valid certificate rejected:", err)
+	}
+	if err := qc(1, 0, 1).Verify(suite, publics); err == nil {
+		t.Fatal("certificate without a quorum accepted")
+	}
+	if err := qc(2, 0, 1, 2).Verify(suite, publics); err == nil {
+		t.Fatal("votes of another view accepted")
+	}
+
+	wrongMask := qc(1, 0, 1, 2)
+	wrongMask.Mask = qc(1, 1, 2, 3).Mask
+	if err := wrongMask.Verify(suite, publics); err == nil {
+		t.Fatal("certificate with the wrong signers accepted")
+	}
+
+	if err := GenesisQC().Verify(suite, publics); err != nil {
+		t.Fatal("genesis certificate rejected:", err)
+	}
+	if err := (&QC{View: 0, Block: block}).Verify(suite, publics); err == nil {
+		t.Fatal("unsigned certificate accepted")
+	}
+}
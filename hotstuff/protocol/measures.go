@@ -0,0 +1,47 @@
+package protocol
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/dedis/onet"
+	"github.com/dedis/onet/simul/monitor"
+)
+
+// Names of the measures recorded by every replica through the onet monitor
+// when its protocol ends.
+const (
+	// time spent signing, aggregating and verifying votes
+	MeasureAuthentication = "authentication"
+	// number of messages sent to the other nodes
+	MeasureMessages = "messages"
+)
+
+// measureAuthentication adds the time elapsed since start to the time spent
+// authenticating messages.
+func (hs *HotStuffProtocol) measureAuthentication(start time.Time) {
+	hs.authTime += time.Since(start)
+}
+
+// recordMeasures records the measures of the replica.
+func (hs *HotStuffProtocol) recordMeasures() {
+	monitor.RecordSingleMeasure(MeasureAuthentication, hs.authTime.Seconds())
+	monitor.RecordSingleMeasure(MeasureMessages, float64(atomic.LoadInt64(&hs.messages)))
+}
+
+// broadcast sends the message to all the other nodes of the tree, counting
+// the messages sent.
+func (hs *HotStuffProtocol) broadcast(msg interface{}) []error {
+	errs := hs.Broadcast(msg)
+	atomic.AddInt64(&hs.messages, int64(len(hs.List())-1-len(errs)))
+	return errs
+}
+
+// sendTo sends the message to the node, counting the messages sent.
+func (hs *HotStuffProtocol) sendTo(to *onet.TreeNode, msg interface{}) error {
+	if err := hs.SendTo(to, msg); err != nil {
+		return err
+	}
+	atomic.AddInt64(&hs.messages, 1)
+	return nil
+}
@@ -0,0 +1,99 @@
+package protocol
+
+import (
+	"time"
+
+	"github.com/dedis/onet"
+	"github.com/dedis/onet/log"
+)
+
+// leader returns the leader of the given view.
+func (hs *HotStuffProtocol) leader(view int) *onet.TreeNode {
+	return hs.replicas[view%len(hs.replicas)]
+}
+
+// isLeader returns whether the replica with the given identifier leads the
+// view.
+func (hs *HotStuffProtocol) isLeader(view int, id string) bool {
+	return hs.leader(view).ServerIdentity.ID.String() == id
+}
+
+// updateHighQC keeps the certificate if it is the highest one, and moves the
+// replica to the view following the certified one. The certified block might
+// not have been received yet, in which case the leader waits for it before
+// proposing.
+func (hs *HotStuffProtocol) updateHighQC(qc *QC) {
+	if qc.View > hs.highQC.View {
+		hs.highQC = qc
+		// progress was made, so the leaders are given the initial
+		// timeout again
+		hs.viewTimeout = hs.Timeout
+	}
+	hs.advance(qc.View + 1)
+}
+
+// advance moves the replica to the view, restarting its timer.
+func (hs *HotStuffProtocol) advance(view int) {
+	if view <= hs.view {
+		return
+	}
+	log.Lvl3(hs.ServerIdentity(), "entering view", view)
+	hs.view = view
+	hs.viewTimer = nil
+	hs.startViewTimer()
+}
+
+// startViewTimer starts the timer after which the leader of the current view
+// is suspected to be faulty, unless it is already running or no payload is
+// waiting to be committed.
+func (hs *HotStuffProtocol) startViewTimer() {
+	if hs.viewTimer != nil || !hs.busy() {
+		return
+	}
+	if hs.viewTimeout == 0 {
+		hs.viewTimeout = hs.Timeout
+	}
+	hs.viewTimer = time.After(hs.viewTimeout)
+}
+
+// localTimeout moves the replica to the next view, doubling its timeout, and
+// sends its highest certificate to the leader of this view.
+func (hs *HotStuffProtocol) localTimeout() error {
+	if !hs.busy() {
+		return nil
+	}
+	log.Lvl2(hs.ServerIdentity(), "timed out in view", hs.view)
+	hs.viewTimeout *= 2
+	hs.advance(hs.view + 1)
+
+	nv := &NewView{View: hs.view, HighQC: *hs.highQC, Sender: hs.id()}
+	if hs.isLeader(nv.View, hs.id()) {
+		return hs.handleNewView(nv)
+	}
+	if err := hs.sendTo(hs.leader(nv.View), nv); err != nil {
+		log.Lvl2(hs.ServerIdentity(), "couldn't send new-view to the leader:", err)
+	}
+	return nil
+}
+
+// handleNewView makes the leader of a view propose once a quorum of replicas
+// timed out into it, extending the highest certificate they sent.
+func (hs *HotStuffProtocol) handleNewView(nv *NewView) error {
+	if err := hs.verifyQC(&nv.HighQC); err != nil {
+		log.Lvl2(hs.ServerIdentity(), "received new-view with invalid certificate:", err)
+		return nil
+	}
+	hs.updateHighQC(&nv.HighQC)
+	if nv.View < hs.view || !hs.isLeader(nv.View, hs.id()) {
+		return nil
+	}
+	if hs.newViews[nv.View] == nil {
+		hs.newViews[nv.View] = make(map[string]bool)
+	}
+	hs.newViews[nv.View][nv.Sender] = true
+	if len(hs.newViews[nv.View]) < hs.quorum() {
+		return nil
+	}
+	hs.advance(nv.View)
+	return hs.tryPropose()
+}
@@ -0,0 +1,644 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/pairing"
+	"github.com/dedis/kyber/pairing/bn256"
+	"github.com/dedis/onet"
+	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/network"
+)
+
+func init() {
+	network.RegisterMessages(Request{}, Proposal{}, Vote{}, NewView{}, Stop{})
+	onet.GlobalProtocolRegister(DefaultProtocolName, NewProtocol)
+}
+
+// VerificationFn validates a block proposed by a leader before the replica
+// votes for it.
+type VerificationFn func(block *Block) bool
+
+var defaultTimeout = 60 * time.Second
+
+// MinTimeout and MaxTimeout bound the timeout of the pacemaker of the
+// replicas, like the ones of pbft.
+const (
+	MinTimeout = 100 * time.Millisecond
+	MaxTimeout = 10 * time.Minute
+)
+
+// HotStuffProtocol is a chained HotStuff replica. Every node of the tree is a
+// replica, the leader of view v being the replica at index v modulo the size
+// of the roster. The leader of a view proposes a block extending the highest
+// certified block, and the replicas send their votes to the leader of the
+// next view, which aggregates them into the certificate justifying its own
+// proposal. A block is committed once it starts a chain of three blocks of
+// consecutive views, the last one being certified. If a leader fails, the
+// pacemaker of the replicas times out and moves them to the next view.
+//
+// The root of the tree submits the payloads. When Msg is set, the protocol
+// orders this single payload, sends its block on FinalBlock and stops.
+// Otherwise the replicas run until Stop is called on the root, and payloads
+// are submitted with Submit.
+type HotStuffProtocol struct {
+	*onet.TreeNodeInstance
+
+	Msg        []byte
+	FinalBlock chan *Block
+	Timeout    time.Duration
+	PubKeysMap map[string]kyber.Point
+
+	startChan      chan bool
+	submitChan     chan []byte
+	stopChan       chan bool
+	doneChan       chan bool
+	stoppedOnce    sync.Once
+	stopOnce       sync.Once
+	verificationFn VerificationFn
+	onCommit       func(*Block)
+	pairingSuite   pairing.Suite
+	authTime       time.Duration
+	messages       int64
+
+	// replicas sorted by roster index
+	replicas []*onet.TreeNode
+
+	// block tree, indexed by hash
+	blocks      map[string]*Block
+	payloads    map[string]string
+	verifying   map[string]bool
+	verifyChan  chan verification
+	verifiedQCs map[string]bool
+
+	// chained HotStuff
+	view      int
+	lastVoted int
+	locked    *Block
+	executed  *Block
+	highQC    *QC
+	proposed  map[int]bool
+	votes     map[int]map[string]*Vote
+	newViews  map[int]map[string]bool
+
+	// pacemaker
+	viewTimeout time.Duration
+	viewTimer   <-chan time.Time
+
+	// payloads waiting to be committed, in the order they were received
+	pending   []string
+	requests  map[string][]byte
+	committed map[string]bool
+	msgDigest string
+
+	ChannelRequest  chan StructRequest
+	ChannelProposal chan StructProposal
+	ChannelVote     chan StructVote
+	ChannelNewView  chan StructNewView
+	ChannelStop     chan StructStop
+}
+
+// verification is the result of the verification function on a block
+type verification struct {
+	hash string
+	ok   bool
+}
+
+// Check that *HotStuffProtocol implements onet.ProtocolInstance
+var _ onet.ProtocolInstance = (*HotStuffProtocol)(nil)
+
+// NewProtocol initialises the structure for use in one round
+func NewProtocol(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+	vf := func(b *Block) bool {
+		// Simulate verification function by sleeping
+		msg, _ := json.Marshal(b.Payload)
+		m := time.Duration(len(msg) / (500 * 1024)) //verification of 150ms per 500KB simulated
+		waitTime := 150 * time.Millisecond * m
+		log.Lvl3("Verifying for", waitTime)
+		time.Sleep(waitTime)
+
+		return true
+	}
+	return NewHotStuffProtocol(n, vf)
+}
+
+// NewHotStuffProtocol returns a replica voting for the blocks that passed the
+// verification function. The keys of the servers must be bn256 G2 keys, as
+// for blsftcosi.
+func NewHotStuffProtocol(n *onet.TreeNodeInstance, vf VerificationFn) (*HotStuffProtocol, error) {
+
+	pubKeysMap := make(map[string]kyber.Point)
+	for _, node := range n.Tree().List() {
+		pubKeysMap[node.ServerIdentity.ID.String()] = node.ServerIdentity.Public
+	}
+
+	replicas := n.Tree().List()
+	sort.Slice(replicas, func(i, j int) bool {
+		return replicas[i].RosterIndex < replicas[j].RosterIndex
+	})
+
+	genesis := Genesis()
+	t := &HotStuffProtocol{
+		TreeNodeInstance: n,
+		startChan:        make(chan bool, 1),
+		submitChan:       make(chan []byte),
+		stopChan:         make(chan bool),
+		doneChan:         make(chan bool),
+		FinalBlock:       make(chan *Block, 1),
+		PubKeysMap:       pubKeysMap,
+		verificationFn:   vf,
+		pairingSuite:     bn256.NewSuite(),
+		Timeout:          defaultTimeout,
+		replicas:         replicas,
+		blocks:           map[string]*Block{string(genesis.Hash()): genesis},
+		payloads:         make(map[string]string),
+		verifying:        make(map[string]bool),
+		verifyChan:       make(chan verification, 1),
+		verifiedQCs:      make(map[string]bool),
+		view:             1,
+		locked:           genesis,
+		executed:         genesis,
+		highQC:           GenesisQC(),
+		proposed:         make(map[int]bool),
+		votes:            make(map[int]map[string]*Vote),
+		newViews:         make(map[int]map[string]bool),
+		requests:         make(map[string][]byte),
+		committed:        make(map[string]bool),
+	}
+
+	for _, channel := range []interface{}{
+		&t.ChannelRequest,
+		&t.ChannelProposal,
+		&t.ChannelVote,
+		&t.ChannelNewView,
+		&t.ChannelStop,
+	} {
+		err := t.RegisterChannel(channel)
+		if err != nil {
+			return nil, errors.New("couldn't register channel: " + err.Error())
+		}
+	}
+
+	return t, nil
+}
+
+// Start is done only by the root and starts the protocol.
+func (hs *HotStuffProtocol) Start() error {
+	if err := CheckTimeout(hs.Timeout); err != nil {
+		close(hs.startChan)
+		return err
+	}
+
+	log.Lvl3("Starting HotStuffProtocol")
+	hs.startChan <- true
+	return nil
+}
+
+// Submit sends a payload to the replicas. It can only be called on the root,
+// after Start.
+func (hs *HotStuffProtocol) Submit(payload []byte) error {
+	if len(payload) == 0 {
+		return errors.New("cannot submit an empty payload")
+	}
+	select {
+	case hs.submitChan <- payload:
+		return nil
+	case <-hs.doneChan:
+		return errors.New("protocol is stopped")
+	}
+}
+
+// Stop stops the root and all the replicas. It can only be called on the
+// root.
+func (hs *HotStuffProtocol) Stop() {
+	hs.stopOnce.Do(func() {
+		close(hs.stopChan)
+	})
+}
+
+// RegisterOnCommit registers a callback called every time a block is
+// committed by this replica, in the order of the chain.
+func (hs *HotStuffProtocol) RegisterOnCommit(fn func(*Block)) {
+	hs.onCommit = fn
+}
+
+func (hs *HotStuffProtocol) Dispatch() error {
+	defer hs.Done()
+	defer close(hs.doneChan)
+	defer hs.recordMeasures()
+
+	log.Lvl3(hs.ServerIdentity(), "Started node")
+
+	if hs.IsRoot() {
+		select {
+		case _, ok := <-hs.startChan:
+			if !ok {
+				log.Lvl1("protocol finished prematurely")
+				return nil
+			}
+		case <-time.After(time.Second):
+			return fmt.Errorf("timeout, did you forget to call Start?")
+		}
+		if hs.Msg != nil {
+			hs.msgDigest = digest(hs.Msg)
+			if err := hs.submit(hs.Msg); err != nil {
+				return err
+			}
+		}
+	}
+
+	for {
+		var err error
+		select {
+		case payload := <-hs.submitChan:
+			err = hs.submit(payload)
+		case <-hs.stopChan:
+			hs.stop()
+			return nil
+		case msg, channelOpen := <-hs.ChannelStop:
+			if !channelOpen {
+				return nil
+			}
+			if msg.TreeNode.ID.Equal(hs.Root().ID) {
+				log.Lvl3(hs.ServerIdentity(), "stopped by the root")
+				return nil
+			}
+		case msg, channelOpen := <-hs.ChannelRequest:
+			if !channelOpen {
+				return nil
+			}
+			if hs.authentic(msg.TreeNode, msg.Sender) {
+				err = hs.handleRequest(&msg.Request)
+			}
+		case msg, channelOpen := <-hs.ChannelProposal:
+			if !channelOpen {
+				return nil
+			}
+			if hs.authentic(msg.TreeNode, msg.Sender) {
+				err = hs.handleProposal(&msg.Proposal)
+			}
+		case msg, channelOpen := <-hs.ChannelVote:
+			if !channelOpen {
+				return nil
+			}
+			if hs.authentic(msg.TreeNode, msg.Sender) {
+				err = hs.handleVote(&msg.Vote)
+			}
+		case msg, channelOpen := <-hs.ChannelNewView:
+			if !channelOpen {
+				return nil
+			}
+			if hs.authentic(msg.TreeNode, msg.Sender) {
+				err = hs.handleNewView(&msg.NewView)
+			}
+		case v := <-hs.verifyChan:
+			err = hs.handleVerification(v)
+		case <-hs.viewTimer:
+			hs.viewTimer = nil
+			err = hs.localTimeout()
+		}
+		if err != nil {
+			return err
+		}
+
+		// in single payload mode, the root stops everybody once the
+		// payload has been committed
+		if hs.IsRoot() && hs.Msg != nil && len(hs.FinalBlock) > 0 {
+			hs.stop()
+			return nil
+		}
+	}
+}
+
+// stop makes every replica stop its protocol.
+func (hs *HotStuffProtocol) stop() {
+	if errs := hs.broadcast(&Stop{}); len(errs) > 0 {
+		log.Lvl3(hs.ServerIdentity(), "failed to stop all replicas")
+	}
+}
+
+// submit sends the payload to every replica.
+func (hs *HotStuffProtocol) submit(payload []byte) error {
+	req := &Request{Payload: payload, Timeout: hs.Timeout, Sender: hs.id()}
+	go func() {
+		if errs := hs.broadcast(req); len(errs) > 0 {
+			log.Lvl3(hs.ServerIdentity(), "failed to send request to all replicas")
+		}
+	}()
+	return hs.handleRequest(req)
+}
+
+// handleRequest queues the payload until it is committed.
+func (hs *HotStuffProtocol) handleRequest(req *Request) error {
+	// the timeouts out of bounds are ignored, so that a request can't stall
+	// the pacemaker or make it time out all the time
+	if req.Sender == hs.Root().ServerIdentity.ID.String() && CheckTimeout(req.Timeout) == nil {
+		hs.Timeout = req.Timeout
+	}
+	hs.addPending(req.Payload)
+	hs.startViewTimer()
+	return hs.tryPropose()
+}
+
+// CheckTimeout returns an error if the timeout is out of the bounds
+// MinTimeout and MaxTimeout.
+func CheckTimeout(timeout time.Duration) error {
+	if timeout < MinTimeout || timeout > MaxTimeout {
+		return fmt.Errorf("timeout %s out of bounds [%s, %s]", timeout, MinTimeout, MaxTimeout)
+	}
+	return nil
+}
+
+// addPending queues the payload, unless it is empty, already queued or
+// committed.
+func (hs *HotStuffProtocol) addPending(payload []byte) {
+	d := digest(payload)
+	if len(payload) == 0 || hs.committed[d] {
+		return
+	}
+	if _, ok := hs.requests[d]; ok {
+		return
+	}
+	hs.requests[d] = payload
+	hs.pending = append(hs.pending, d)
+}
+
+// tryPropose makes the leader of the current view propose a block extending
+// the highest certified block, once it has the certificate of the previous
+// view or the new-view messages of a quorum of replicas. The leader doesn't
+// propose anything while there is no payload to commit.
+func (hs *HotStuffProtocol) tryPropose() error {
+	if !hs.isLeader(hs.view, hs.id()) || hs.proposed[hs.view] || !hs.busy() {
+		return nil
+	}
+	if hs.highQC.View != hs.view-1 && len(hs.newViews[hs.view]) < hs.quorum() {
+		return nil
+	}
+	parent, ok := hs.blocks[string(hs.highQC.Block)]
+	if !ok {
+		return nil
+	}
+	hs.proposed[hs.view] = true
+
+	b := Block{
+		View:     hs.view,
+		Parent:   hs.highQC.Block,
+		Justify:  *hs.highQC,
+		Proposer: hs.id(),
+		Payload:  hs.nextPayload(parent),
+	}
+	log.Lvl2(hs.ServerIdentity(), "proposing block for view", b.View, "with", len(b.Payload), "bytes")
+	p := &Proposal{Block: b, Sender: hs.id()}
+	go func() {
+		if errs := hs.broadcast(p); len(errs) > 0 {
+			log.Lvl3(hs.ServerIdentity(), "failed to send proposal to all replicas")
+		}
+	}()
+	return hs.handleProposal(p)
+}
+
+// nextPayload returns the oldest pending payload that is not already in the
+// uncommitted blocks of the branch ending with the parent, or nil if there is
+// none.
+func (hs *HotStuffProtocol) nextPayload(parent *Block) []byte {
+	inBranch := make(map[string]bool)
+	for b := parent; b != nil && b.View > hs.executed.View; b = hs.blocks[string(b.Parent)] {
+		inBranch[hs.payloads[string(b.Hash())]] = true
+	}
+	for _, d := range hs.pending {
+		if !inBranch[d] {
+			return hs.requests[d]
+		}
+	}
+	return nil
+}
+
+// handleProposal stores a valid block of the leader of its view, updates the
+// state of the replica with the certificate it carries and starts the
+// verification of the block.
+func (hs *HotStuffProtocol) handleProposal(p *Proposal) error {
+	b := &p.Block
+	if b.Proposer != p.Sender || !hs.isLeader(b.View, p.Sender) {
+		log.Lvl2(hs.ServerIdentity(), "received proposal for view", b.View, "from another replica than its leader")
+		return nil
+	}
+	hash := string(b.Hash())
+	if _, ok := hs.blocks[hash]; ok {
+		return nil
+	}
+	if !bytes.Equal(b.Parent, b.Justify.Block) || b.View <= b.Justify.View {
+		log.Lvl2(hs.ServerIdentity(), "received proposal not extending its certified block")
+		return nil
+	}
+	if _, ok := hs.blocks[string(b.Parent)]; !ok {
+		log.Lvl2(hs.ServerIdentity(), "received proposal for view", b.View, "with an unknown parent")
+		return nil
+	}
+	if err := hs.verifyQC(&b.Justify); err != nil {
+		log.Lvl2(hs.ServerIdentity(), "received proposal with invalid certificate:", err)
+		return nil
+	}
+
+	hs.blocks[hash] = b
+	hs.payloads[hash] = digest(b.Payload)
+	hs.addPending(b.Payload)
+	if err := hs.update(b); err != nil {
+		return err
+	}
+	// the certificate of the block might have been formed before it
+	// arrived
+	if err := hs.tryPropose(); err != nil {
+		return err
+	}
+
+	// the leader doesn't verify its own proposals, and empty blocks don't
+	// need to be verified
+	if b.Proposer == hs.id() || len(b.Payload) == 0 {
+		return hs.vote(b)
+	}
+	if hs.verifying[hash] {
+		return nil
+	}
+	log.Lvl3(hs.ServerIdentity(), "Received proposal. Verifying...")
+	hs.verifying[hash] = true
+	go func() {
+		v := verification{hash, hs.verificationFn(b)}
+		select {
+		case hs.verifyChan <- v:
+		case <-hs.doneChan:
+		}
+	}()
+	return nil
+}
+
+// handleVerification votes for a block once it has been verified.
+func (hs *HotStuffProtocol) handleVerification(v verification) error {
+	delete(hs.verifying, v.hash)
+	if !v.ok {
+		// don't vote for it: the view will time out
+		log.Lvl1(hs.ServerIdentity(), "verification failed on node")
+		return nil
+	}
+	b, ok := hs.blocks[v.hash]
+	if !ok {
+		return nil
+	}
+	return hs.vote(b)
+}
+
+// update applies the chained HotStuff rules to the chain ending with the
+// block: the certificate it carries may become the highest one, the
+// grandparent of the block is locked, and the great-grandparent is committed
+// if the three of them have consecutive views.
+func (hs *HotStuffProtocol) update(b *Block) error {
+	hs.updateHighQC(&b.Justify)
+	b2, ok := hs.blocks[string(b.Justify.Block)]
+	if !ok {
+		return nil
+	}
+	b1, ok := hs.blocks[string(b2.Justify.Block)]
+	if !ok {
+		return nil
+	}
+	if b1.View > hs.locked.View {
+		hs.locked = b1
+	}
+	b0, ok := hs.blocks[string(b1.Justify.Block)]
+	if !ok {
+		return nil
+	}
+	if b2.View == b1.View+1 && b1.View == b0.View+1 {
+		return hs.commit(b0)
+	}
+	return nil
+}
+
+// safeNode returns whether the replica can vote for the block: it must
+// extend the locked block, unless it carries a certificate newer than the
+// locked block.
+func (hs *HotStuffProtocol) safeNode(b *Block) bool {
+	return hs.extends(b, hs.locked) || b.Justify.View > hs.locked.View
+}
+
+// extends returns whether the block is a descendant of the ancestor.
+func (hs *HotStuffProtocol) extends(b, ancestor *Block) bool {
+	hash := ancestor.Hash()
+	for b != nil && b.View > ancestor.View {
+		b = hs.blocks[string(b.Parent)]
+	}
+	return b != nil && bytes.Equal(b.Hash(), hash)
+}
+
+// commit executes the block and its uncommitted ancestors, in the order of
+// the chain.
+func (hs *HotStuffProtocol) commit(b *Block) error {
+	if b.View <= hs.executed.View {
+		return nil
+	}
+	if parent, ok := hs.blocks[string(b.Parent)]; ok {
+		if err := hs.commit(parent); err != nil {
+			return err
+		}
+	}
+	hs.executed = b
+	log.Lvl2(hs.ServerIdentity(), "committed block of view", b.View)
+
+	if len(b.Payload) > 0 {
+		d := hs.payloads[string(b.Hash())]
+		hs.committed[d] = true
+		hs.removePending(d)
+		if hs.IsRoot() && hs.Msg != nil && d == hs.msgDigest {
+			hs.FinalBlock <- b
+		}
+	}
+	if hs.onCommit != nil {
+		hs.onCommit(b)
+	}
+	hs.prune()
+
+	// stop the pacemaker once there is nothing left to commit
+	hs.viewTimer = nil
+	hs.startViewTimer()
+	return nil
+}
+
+// removePending removes a committed payload from the queue.
+func (hs *HotStuffProtocol) removePending(d string) {
+	delete(hs.requests, d)
+	for i, p := range hs.pending {
+		if p == d {
+			hs.pending = append(hs.pending[:i], hs.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+// prune forgets the blocks and messages older than the last committed block.
+func (hs *HotStuffProtocol) prune() {
+	for hash, b := range hs.blocks {
+		if b.View < hs.executed.View {
+			delete(hs.blocks, hash)
+			delete(hs.payloads, hash)
+		}
+	}
+	for view := range hs.votes {
+		if view < hs.executed.View {
+			delete(hs.votes, view)
+		}
+	}
+	for view := range hs.newViews {
+		if view < hs.executed.View {
+			delete(hs.newViews, view)
+		}
+	}
+	for view := range hs.proposed {
+		if view < hs.executed.View {
+			delete(hs.proposed, view)
+		}
+	}
+}
+
+// busy returns whether there is a payload waiting to be committed.
+func (hs *HotStuffProtocol) busy() bool {
+	return len(hs.pending) > 0
+}
+
+// Shutdown stops the protocol
+func (hs *HotStuffProtocol) Shutdown() error {
+	hs.stoppedOnce.Do(func() {
+		close(hs.ChannelRequest)
+		close(hs.ChannelProposal)
+		close(hs.ChannelVote)
+		close(hs.ChannelNewView)
+		close(hs.ChannelStop)
+	})
+	return nil
+}
+
+// authentic returns whether the message declaring the given sender has
+// really been sent by it, so that a replica cannot speak for another one.
+func (hs *HotStuffProtocol) authentic(tn *onet.TreeNode, sender string) bool {
+	if tn == nil || tn.ServerIdentity.ID.String() != sender {
+		log.Lvl2(hs.ServerIdentity(), "dropping message of", sender, "sent by another node")
+		return false
+	}
+	return true
+}
+
+// id returns the identifier used as Sender in the messages of this node.
+func (hs *HotStuffProtocol) id() string {
+	return hs.ServerIdentity().ID.String()
+}
+
+// quorum returns the number of votes from distinct replicas needed to
+// certify a block.
+func (hs *HotStuffProtocol) quorum() int {
+	return quorumSize(len(hs.replicas))
+}
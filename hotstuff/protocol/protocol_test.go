@@ -0,0 +1,164 @@
+package protocol
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/dedis/kyber/pairing/bn256"
+	"github.com/dedis/onet"
+)
+
+var tSuite = bn256.NewSuiteG2()
+
+func TestNode(t *testing.T) {
+
+	proposal := []byte("dedis")
+	timeout := 5 * time.Second
+	nodes := []int{4, 7, 10}
+
+	for _, nbrNodes := range nodes {
+		local := onet.NewLocalTest(tSuite)
+		_, _, tree := local.GenTree(nbrNodes, true)
+
+		pi, err := local.CreateProtocol(DefaultProtocolName, tree)
+		if err != nil {
+			local.CloseAll()
+			t.Fatal("Error in creation of protocol:", err)
+		}
+
+		protocol := pi.(*HotStuffProtocol)
+		protocol.Msg = proposal
+		protocol.Timeout = timeout
+
+		err = protocol.Start()
+		if err != nil {
+			local.CloseAll()
+			t.Fatal(err)
+		}
+
+		select {
+		case b := <-protocol.FinalBlock:
+			if !bytes.Equal(b.Payload, proposal) {
+				local.CloseAll()
+				t.Fatal("committed the wrong payload")
+			}
+		case <-time.After(timeout * 2):
+			local.CloseAll()
+			t.Fatal("Root never committed the block, timed out")
+		}
+
+		local.CloseAll()
+	}
+}
+
+func TestLeaderFailure(t *testing.T) {
+
+	proposal := []byte("dedis")
+	timeout := 2 * time.Second
+
+	// with round-robin leaders, a commit needs four consecutive correct
+	// leaders, so a single failure needs at least 7 replicas
+	local := onet.NewLocalTest(tSuite)
+	defer local.CloseAll()
+	local.Check = onet.CheckNone
+	servers, _, tree := local.GenTree(7, true)
+
+	pi, err := local.CreateProtocol(DefaultProtocolName, tree)
+	if err != nil {
+		t.Fatal("Error in creation of protocol:", err)
+	}
+
+	protocol := pi.(*HotStuffProtocol)
+	protocol.Msg = proposal
+	protocol.Timeout = timeout
+
+	// kill the leader of the first view
+	if err := servers[1].Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := protocol.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case b := <-protocol.FinalBlock:
+		if !bytes.Equal(b.Payload, proposal) {
+			t.Fatal("committed the wrong payload")
+		}
+		if b.View == 1 {
+			t.Fatal("committed a block of the failed leader")
+		}
+	case <-time.After(timeout * 10):
+		t.Fatal("Replicas didn't move to the next leader in time")
+	}
+}
+
+func TestChain(t *testing.T) {
+
+	timeout := 5 * time.Second
+	nbrPayloads := 20
+
+	local := onet.NewLocalTest(tSuite)
+	defer local.CloseAll()
+	_, _, tree := local.GenTree(4, true)
+
+	pi, err := local.CreateProtocol(DefaultProtocolName, tree)
+	if err != nil {
+		t.Fatal("Error in creation of protocol:", err)
+	}
+	protocol := pi.(*HotStuffProtocol)
+	protocol.Timeout = timeout
+
+	commits := make(chan *Block, 10*nbrPayloads)
+	protocol.RegisterOnCommit(func(b *Block) {
+		commits <- b
+	})
+
+	if err := protocol.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer protocol.Stop()
+
+	for i := 0; i < nbrPayloads; i++ {
+		if err := protocol.Submit([]byte("payload " + strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	view := 0
+	committed := make(map[string]bool)
+	for len(committed) < nbrPayloads {
+		select {
+		case b := <-commits:
+			if b.View <= view {
+				t.Fatal("committed view", b.View, "after view", view)
+			}
+			view = b.View
+			if len(b.Payload) == 0 {
+				continue
+			}
+			if committed[string(b.Payload)] {
+				t.Fatal("committed", string(b.Payload), "twice")
+			}
+			committed[string(b.Payload)] = true
+		case <-time.After(timeout):
+			t.Fatal("only", len(committed), "payloads committed")
+		}
+	}
+}
+
+func TestCheckTimeout(t *testing.T) {
+	for _, timeout := range []time.Duration{0, MinTimeout / 2, 2 * MaxTimeout} {
+		if CheckTimeout(timeout) == nil {
+			t.Fatal("accepted timeout", timeout)
+		}
+	}
+	for _, timeout := range []time.Duration{MinTimeout, time.Second, MaxTimeout} {
+		if err := CheckTimeout(timeout); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package protocol
+
+import (
+	"time"
+
+	"github.com/dedis/onet"
+)
+
+// DefaultProtocolName can be used from other packages to refer to this
+// protocol.
+const DefaultProtocolName = "HotStuff"
+
+// Block is a node of the block tree. It extends its parent, and Justify is
+// the quorum certificate of the parent, which the leader of View uses to
+// prove that its proposal extends the highest certified block it knows of.
+// A block without Payload is only proposed to drive the commit of its
+// ancestors.
+type Block struct {
+	View     int
+	Parent   []byte
+	Justify  QC
+	Proposer string
+	Payload  []byte
+}
+
+// QC is a quorum certificate: the aggregate BLS signature of a quorum of
+// replicas voting for the block with hash Block in View. Mask marks the
+// signers, in the order of the roster.
+type QC struct {
+	View  int
+	Block []byte
+	Sig   []byte
+	Mask  []byte
+}
+
+// Request asks the replicas to order a payload. The root sends it to every
+// replica, so that the backups can detect a leader ignoring it.
+type Request struct {
+	Payload []byte
+	Timeout time.Duration
+	Sender  string
+}
+
+type StructRequest struct {
+	*onet.TreeNode
+	Request
+}
+
+// Proposal is sent by the leader of the view of the block to every replica.
+type Proposal struct {
+	Block  Block
+	Sender string
+}
+
+type StructProposal struct {
+	*onet.TreeNode
+	Proposal
+}
+
+// Vote is the partial BLS signature of a replica on a block, sent to the
+// leader of the next view.
+type Vote struct {
+	View   int
+	Block  []byte
+	Sig    []byte
+	Sender string
+}
+
+type StructVote struct {
+	*onet.TreeNode
+	Vote
+}
+
+// NewView is sent by a replica timing out to the leader of the view it
+// enters, along with the highest quorum certificate it knows of.
+type NewView struct {
+	View   int
+	HighQC QC
+	Sender string
+}
+
+type StructNewView struct {
+	*onet.TreeNode
+	NewView
+}
+
+// Stop is sent by the root to stop the replicas.
+type Stop struct{}
+
+type StructStop struct {
+	*onet.TreeNode
+	Stop
+}
@@ -0,0 +1,137 @@
+package protocol
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	blscosi "bls-ftcosi/blsftcosi/protocol"
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/sign/bls"
+	"github.com/dedis/onet/log"
+)
+
+// vote sends the vote of the replica for the block to the leader of the next
+// view, if the block is of the current view and the safety rule allows it.
+func (hs *HotStuffProtocol) vote(b *Block) error {
+	if b.View <= hs.lastVoted || b.View < hs.view || !hs.safeNode(b) {
+		return nil
+	}
+	hs.lastVoted = b.View
+	hs.advance(b.View + 1)
+
+	hash := b.Hash()
+	sig, err := hs.signVote(votePayload(b.View, hash))
+	if err != nil {
+		return err
+	}
+	v := &Vote{View: b.View, Block: hash, Sig: sig, Sender: hs.id()}
+	if hs.isLeader(b.View+1, hs.id()) {
+		return hs.handleVote(v)
+	}
+	if err := hs.sendTo(hs.leader(b.View+1), v); err != nil {
+		log.Lvl2(hs.ServerIdentity(), "couldn't send vote to the next leader:", err)
+	}
+	return nil
+}
+
+// handleVote is run by the leader of the view following the one of the vote.
+// Once a quorum of replicas voted for the same block, it aggregates their
+// votes into a certificate and proposes a block extending it.
+func (hs *HotStuffProtocol) handleVote(v *Vote) error {
+	if !hs.isLeader(v.View+1, hs.id()) || v.View <= hs.highQC.View {
+		return nil
+	}
+	if v.Sender != hs.id() {
+		if err := hs.verifyPartial(v.Sender, votePayload(v.View, v.Block), v.Sig); err != nil {
+			log.Lvl2(hs.ServerIdentity(), "received vote with invalid signature:", err)
+			return nil
+		}
+	}
+	if hs.votes[v.View] == nil {
+		hs.votes[v.View] = make(map[string]*Vote)
+	}
+	hs.votes[v.View][v.Sender] = v
+
+	sigs := make(map[string][]byte)
+	for sender, vote := range hs.votes[v.View] {
+		if bytes.Equal(vote.Block, v.Block) {
+			sigs[sender] = vote.Sig
+		}
+	}
+	qc, err := hs.aggregate(v.View, v.Block, sigs)
+	if err != nil || qc == nil {
+		return err
+	}
+	log.Lvl2(hs.ServerIdentity(), "aggregated", len(sigs), "votes for view", v.View)
+	hs.updateHighQC(qc)
+	return hs.tryPropose()
+}
+
+// aggregate returns the certificate aggregating the votes, or nil if they
+// are not a quorum.
+func (hs *HotStuffProtocol) aggregate(view int, block []byte, sigs map[string][]byte) (*QC, error) {
+	if len(sigs) < hs.quorum() {
+		return nil, nil
+	}
+	defer hs.measureAuthentication(time.Now())
+	mask, err := blscosi.NewMask(hs.pairingSuite, hs.publics(), nil)
+	if err != nil {
+		return nil, err
+	}
+	var partials [][]byte
+	for i, r := range hs.replicas {
+		if sig, ok := sigs[r.ServerIdentity.ID.String()]; ok {
+			partials = append(partials, sig)
+			if err := mask.SetBit(i, true); err != nil {
+				return nil, err
+			}
+		}
+	}
+	sig, err := bls.AggregateSignatures(hs.pairingSuite, partials...)
+	if err != nil {
+		return nil, err
+	}
+	return &QC{View: view, Block: block, Sig: sig, Mask: mask.Mask()}, nil
+}
+
+// verifyQC checks a certificate against the keys of the replicas,
+// remembering the certificates already verified.
+func (hs *HotStuffProtocol) verifyQC(qc *QC) error {
+	key := string(votePayload(qc.View, qc.Block)) + string(qc.Sig) + string(qc.Mask)
+	if hs.verifiedQCs[key] {
+		return nil
+	}
+	defer hs.measureAuthentication(time.Now())
+	if err := qc.Verify(hs.pairingSuite, hs.publics()); err != nil {
+		return err
+	}
+	hs.verifiedQCs[key] = true
+	return nil
+}
+
+// signVote returns the BLS signature of the message.
+func (hs *HotStuffProtocol) signVote(msg []byte) ([]byte, error) {
+	defer hs.measureAuthentication(time.Now())
+	return bls.Sign(hs.pairingSuite, hs.Private(), msg)
+}
+
+// verifyPartial checks the BLS signature of a replica.
+func (hs *HotStuffProtocol) verifyPartial(sender string, msg, sig []byte) error {
+	defer hs.measureAuthentication(time.Now())
+	public, ok := hs.PubKeysMap[sender]
+	if !ok {
+		return fmt.Errorf("unknown sender %s", sender)
+	}
+	return bls.Verify(hs.pairingSuite, public, msg, sig)
+}
+
+// publics returns the public keys of the replicas, in the order of the
+// roster.
+func (hs *HotStuffProtocol) publics() []kyber.Point {
+	publics := make([]kyber.Point, len(hs.replicas))
+	for i, r := range hs.replicas {
+		publics[i] = r.ServerIdentity.Public
+	}
+	return publics
+}
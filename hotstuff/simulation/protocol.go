@@ -0,0 +1,143 @@
+package main
+
+/*
+The simulation-file can be used with the `cothority/simul` and be run either
+locally or on deterlab. Contrary to the `test` of the protocol, the simulation
+is much more realistic, as it tests the protocol on different nodes, and not
+only in a test-environment.
+
+The Setup-method is run once on the client and will create all structures
+and slices necessary to the simulation. It also receives a 'dir' argument
+of a directory where it can write files. These files will be copied over to
+the simulation so that they are available.
+
+The Run-method is called only once by the root-node of the tree defined in
+Setup. It should run the simulation in different rounds. It can also
+measure the time each run takes.
+
+In the Node-method you can read the files that have been created by the
+'Setup'-method.
+*/
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+
+	"bls-ftcosi/blocks"
+	"bls-ftcosi/hotstuff/protocol"
+	"github.com/BurntSushi/toml"
+	"github.com/dedis/onet"
+	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/simul/monitor"
+)
+
+func init() {
+	onet.SimulationRegister("HotStuffProtocol", NewSimulationProtocol)
+}
+
+// SimulationProtocol implements onet.Simulation.
+type SimulationProtocol struct {
+	onet.SimulationBFTree
+	// Config selects the transactions of the blocks, see blocks.Config
+	blocks.Config
+	NNodes int
+}
+
+// NewSimulationProtocol is used internally to register the simulation (see the init()
+// function above).
+func NewSimulationProtocol(config string) (onet.Simulation, error) {
+	es := &SimulationProtocol{}
+	_, err := toml.Decode(config, es)
+	if err != nil {
+		return nil, err
+	}
+	return es, nil
+}
+
+// Setup implements onet.Simulation.
+func (s *SimulationProtocol) Setup(dir string, hosts []string) (
+	*onet.SimulationConfig, error) {
+	sc := &onet.SimulationConfig{}
+	s.CreateRoster(sc, hosts, 2000)
+	err := s.CreateTree(sc)
+	if err != nil {
+		return nil, err
+	}
+	return sc, nil
+}
+
+// Node can be used to initialize each node before it will be run
+// by the server. Here we call the 'Node'-method of the
+// SimulationBFTree structure which will load the roster- and the
+// tree-structure to speed up the first round.
+func (s *SimulationProtocol) Node(config *onet.SimulationConfig) error {
+	index, _ := config.Roster.Search(config.Server.ServerIdentity.ID)
+	if index < 0 {
+		log.Fatal("Didn't find this node in roster")
+	}
+	log.Lvl3("Initializing node-index", index)
+	return s.SimulationBFTree.Node(config)
+}
+
+var defaultTimeout = 120 * time.Second
+
+// Run implements onet.Simulation.
+func (s *SimulationProtocol) Run(config *onet.SimulationConfig) error {
+	log.SetDebugVisible(1)
+
+	transactions, err := s.Load()
+	if err != nil {
+		return err
+	}
+
+	log.Lvl1("Run got", len(transactions), "transactions")
+
+	block, err := blocks.GetBlock(3000, transactions, "0", "0", 0)
+	if err != nil {
+		return err
+	}
+	binaryBlock, err := block.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	size := config.Tree.Size()
+	log.Lvl1("Size is:", size, "rounds:", s.Rounds)
+	log.Lvl1("Simulating for", s.Hosts, "nodes in ", s.Rounds, "round")
+
+	for round := 0; round < s.Rounds; round++ {
+		log.Lvl1("Starting round", round)
+		fullRound := monitor.NewTimeMeasure("fullRound")
+
+		pi, err := config.Overlay.CreateProtocol(protocol.DefaultProtocolName, config.Tree, onet.NilServiceID)
+		if err != nil {
+			return err
+		}
+
+		hotstuffProtocol := pi.(*protocol.HotStuffProtocol)
+		hotstuffProtocol.Msg = binaryBlock
+		hotstuffProtocol.Timeout = defaultTimeout
+
+		err = hotstuffProtocol.Start()
+		if err != nil {
+			return err
+		}
+
+		select {
+		case b := <-hotstuffProtocol.FinalBlock:
+			log.Lvl1("Root committed the block of view", b.View)
+			if !bytes.Equal(b.Payload, binaryBlock) {
+				return errors.New("committed the wrong block")
+			}
+		case <-time.After(defaultTimeout * 2):
+			// don't leave the replicas running into the next round
+			hotstuffProtocol.Stop()
+			return fmt.Errorf("root never committed the block, timed out")
+		}
+
+		fullRound.Record()
+	}
+	return nil
+}
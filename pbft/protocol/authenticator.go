@@ -0,0 +1,132 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/sign/schnorr"
+	"github.com/dedis/onet"
+)
+
+// MACProtocolName is the name of the protocol authenticating the commits and
+// the replies with vectors of MACs instead of signatures.
+const MACProtocolName = "PBFTMAC"
+
+func init() {
+	onet.GlobalProtocolRegister(MACProtocolName, NewMACProtocol)
+}
+
+// NewMACProtocol returns a replica like NewProtocol, using MAC
+// authenticators.
+func NewMACProtocol(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+	pi, err := NewProtocol(n)
+	if err != nil {
+		return nil, err
+	}
+	pi.(*PbftProtocol).MACs = true
+	return pi, nil
+}
+
+// sessionKey derives the key shared by the owner of the private key and the
+// owner of the public key, through a Diffie-Hellman exchange.
+func sessionKey(suite kyber.Group, private kyber.Scalar, public kyber.Point) ([]byte, error) {
+	shared, err := suite.Point().Mul(private, public).MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	key := sha256.Sum256(shared)
+	return key[:], nil
+}
+
+// mac returns the MAC of the message under the key.
+func mac(key, msg []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(msg)
+	return h.Sum(nil)
+}
+
+// sessionKey returns the key shared with the owner of the public key,
+// deriving it on first use.
+func (pbft *PbftProtocol) sessionKey(public kyber.Point) ([]byte, error) {
+	id := public.String()
+	if key, ok := pbft.sessionKeys[id]; ok {
+		return key, nil
+	}
+	key, err := sessionKey(pbft.Suite(), pbft.Private(), public)
+	if err != nil {
+		return nil, err
+	}
+	pbft.sessionKeys[id] = key
+	return key, nil
+}
+
+// authenticator returns the vector of the MACs of the message for every
+// replica, in the order of the roster.
+func (pbft *PbftProtocol) authenticator(msg []byte) ([][]byte, error) {
+	defer pbft.measureAuthentication(time.Now())
+	auth := make([][]byte, len(pbft.replicas))
+	for i, r := range pbft.replicas {
+		key, err := pbft.sessionKey(r.ServerIdentity.Public)
+		if err != nil {
+			return nil, err
+		}
+		auth[i] = mac(key, msg)
+	}
+	return auth, nil
+}
+
+// verifyAuthenticator checks the MAC of the message for this replica in the
+// authenticator of the sender.
+func (pbft *PbftProtocol) verifyAuthenticator(sender string, msg []byte, auth [][]byte) error {
+	defer pbft.measureAuthentication(time.Now())
+	index := -1
+	for i, r := range pbft.replicas {
+		if r.ServerIdentity.ID.Equal(pbft.ServerIdentity().ID) {
+			index = i
+		}
+	}
+	if index < 0 || index >= len(auth) {
+		return errors.New("no MAC for this replica in the authenticator")
+	}
+	return pbft.verifyMAC(sender, msg, auth[index])
+}
+
+// verifyMAC checks a MAC of the message computed by the sender for this
+// replica.
+func (pbft *PbftProtocol) verifyMAC(sender string, msg, tag []byte) error {
+	public, ok := pbft.PubKeysMap[sender]
+	if !ok {
+		return fmt.Errorf("unknown sender %s", sender)
+	}
+	key, err := pbft.sessionKey(public)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(tag, mac(key, msg)) {
+		return errors.New("invalid MAC")
+	}
+	return nil
+}
+
+// sign signs the message with the key of the replica.
+func (pbft *PbftProtocol) sign(msg []byte) ([]byte, error) {
+	defer pbft.measureAuthentication(time.Now())
+	return schnorr.Sign(pbft.Suite(), pbft.Private(), msg)
+}
+
+// VerifyMAC checks the MAC of a reply of the replica whose public key is
+// given, for the client owning the private key.
+func (r *Reply) VerifyMAC(suite kyber.Group, private kyber.Scalar, public kyber.Point) error {
+	key, err := sessionKey(suite, private, public)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(r.MAC, mac(key, r.payload())) {
+		return errors.New("invalid MAC")
+	}
+	return nil
+}
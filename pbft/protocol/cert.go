@@ -0,0 +1,111 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/sign/schnorr"
+	"github.com/dedis/onet"
+	"github.com/dedis/onet/log"
+)
+
+// QuorumCert is a transferable proof that a quorum of distinct replicas of a
+// roster signed the same phase of a slot: anybody knowing the roster can
+// verify it, without trusting the replica that built it.
+type QuorumCert struct {
+	Phase string
+	View int
+	Seq int
+	Digest []byte
+	Sigs []CertSig
+}
+
+// CertSig is the signature of one replica in a QuorumCert.
+type CertSig struct {
+	Sender string
+	Sig []byte
+}
+
+// Verify checks that the certificate holds valid signatures of a quorum of
+// distinct members of the roster.
+func (qc *QuorumCert) Verify(suite kyber.Group, roster *onet.Roster) error {
+	publics := make(map[string]kyber.Point)
+	for _, si := range roster.List {
+		publics[si.ID.String()] = si.Public
+	}
+	msg := payload(qc.Phase, qc.View, qc.Seq, qc.Digest)
+	senders := make(map[string]bool)
+	for _, s := range qc.Sigs {
+		public, ok := publics[s.Sender]
+		if !ok {
+			return fmt.Errorf("signer %s is not in the roster", s.Sender)
+		}
+		if senders[s.Sender] {
+			return fmt.Errorf("signer %s signed twice", s.Sender)
+		}
+		if err := schnorr.Verify(suite, public, msg, s.Sig); err != nil {
+			return err
+		}
+		senders[s.Sender] = true
+	}
+	if len(senders) < quorumSize(len(roster.List)) {
+		return fmt.Errorf("only %d signers in the %s certificate", len(senders), qc.Phase)
+	}
+	return nil
+}
+
+// Matches returns an error if the certificate is not about the given phase
+// of the slot.
+func (qc *QuorumCert) Matches(phase string, view, seq int, digest []byte) error {
+	if qc.Phase != phase || qc.View != view || qc.Seq != seq || !bytes.Equal(qc.Digest, digest) {
+		return errors.New("certificate for another slot")
+	}
+	return nil
+}
+
+// quorumSize returns the number of replicas out of n whose signatures form a
+// quorum: any two quorums intersect in at least one correct replica.
+func quorumSize(n int) int {
+	return (n+(n-1)/3)/2 + 1
+}
+
+// quorumCert collects the signatures of the given messages matching the
+// phase, view, sequence number and digest, at most one per sender. It
+// returns nil until a quorum of them is reached.
+func (pbft *PbftProtocol) quorumCert(phase string, view, seq int, digest []byte, sigs map[string][]byte) *QuorumCert {
+	qc := &QuorumCert{Phase: phase, View: view, Seq: seq, Digest: digest}
+	for _, r := range pbft.replicas {
+		sender := r.ServerIdentity.ID.String()
+		if sig, ok := sigs[sender]; ok {
+			qc.Sigs = append(qc.Sigs, CertSig{Sender: sender, Sig: sig})
+		}
+	}
+	if len(qc.Sigs) < pbft.quorum() {
+		return nil
+	}
+	return qc
+}
+
+// verifySig checks the signature of a message of a replica, rejecting the
+// senders that are not part of the roster.
+func (pbft *PbftProtocol) verifySig(sender string, msg, sig []byte) error {
+	defer pbft.measureAuthentication(time.Now())
+	public, ok := pbft.PubKeysMap[sender]
+	if !ok {
+		return fmt.Errorf("unknown sender %s", sender)
+	}
+	return schnorr.Verify(pbft.Suite(), public, msg, sig)
+}
+
+// authentic returns whether the message declaring the given sender has
+// really been sent by it, so that a replica cannot speak for another one.
+func (pbft *PbftProtocol) authentic(tn *onet.TreeNode, sender string) bool {
+	if tn == nil || tn.ServerIdentity.ID.String() != sender {
+		log.Lvl2(pbft.ServerIdentity(), "dropping message of", sender, "sent by another node")
+		return false
+	}
+	return true
+}
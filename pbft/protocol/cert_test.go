@@ -0,0 +1,74 @@
+package protocol
+
+import (
+	"crypto/sha512"
+	"strconv"
+	"testing"
+
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/sign/schnorr"
+	"github.com/dedis/kyber/util/key"
+	"github.com/dedis/onet"
+	"github.com/dedis/onet/network"
+)
+
+func TestQuorumCert(t *testing.T) {
+	var list []*network.ServerIdentity
+	var privates []kyber.Scalar
+	for i := 0; i < 4; i++ {
+		kp := key.NewKeyPair(tSuite)
+		addr := network.NewAddress(network.Local, "127.0.0.1:"+strconv.Itoa(2000+i))
+		list = append(list, network.NewServerIdentity(kp.Public, addr))
+		privates = append(privates, kp.Private)
+	}
+	roster := onet.NewRoster(list)
+
+	digest := sha512.Sum512([]byte("dedis"))
+	qc := &QuorumCert{Phase: "commit", View: 1, Seq: 2, Digest: digest[:]}
+	sign := func(i int) CertSig {
+		sig, err := schnorr.Sign(tSuite, privates[i], payload(qc.Phase, qc.View, qc.Seq, qc.Digest))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return CertSig{Sender: list[i].ID.String(), Sig: sig}
+	}
+
+	// 3 out of 4 replicas is a quorum
+	qc.Sigs = []CertSig{sign(0), sign(1), sign(2)}
+	if err := qc.Verify(tSuite, roster); err != nil {
+		t.Fatal("valid certificate rejected:", err)
+	}
+	if err := qc.Matches("commit", 1, 2, digest[:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := qc.Matches("prepare", 1, 2, digest[:]); err == nil {
+		t.Fatal("certificate matched another phase")
+	}
+
+	// a replica replaying its signature doesn't make a quorum
+	qc.Sigs = []CertSig{sign(0), sign(1), sign(1)}
+	if err := qc.Verify(tSuite, roster); err == nil {
+		t.Fatal("certificate with a duplicate signer accepted")
+	}
+
+	// nor does a replica signing for another one
+	forged := sign(1)
+	forged.Sender = list[2].ID.String()
+	qc.Sigs = []CertSig{sign(0), sign(1), forged}
+	if err := qc.Verify(tSuite, roster); err == nil {
+		t.Fatal("certificate with a forged signature accepted")
+	}
+
+	// or a replica outside of the roster
+	qc.Sigs = []CertSig{sign(0), sign(1), {Sender: "unknown", Sig: sign(2).Sig}}
+	if err := qc.Verify(tSuite, roster); err == nil {
+		t.Fatal("certificate with an unknown signer accepted")
+	}
+
+	// and the certificate cannot be moved to another slot
+	qc.Sigs = []CertSig{sign(0), sign(1), sign(2)}
+	qc.Seq = 3
+	if err := qc.Verify(tSuite, roster); err == nil {
+		t.Fatal("certificate moved to another sequence number accepted")
+	}
+}
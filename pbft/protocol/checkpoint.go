@@ -0,0 +1,190 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/sign/schnorr"
+	"github.com/dedis/onet/log"
+)
+
+// sendCheckpoint broadcasts the digest of the state of the state machine and
+// of the configuration after executing the given sequence number. A replica
+// removed by a reconfiguration keeps its checkpoint for itself.
+func (pbft *PbftProtocol) sendCheckpoint(seq int) error {
+	snapshot := pbft.stateMachine.Snapshot()
+	config := pbft.configAfter(seq)
+	cp := &Checkpoint{Seq: seq, State: stateDigest(snapshot, config), Sender: pbft.id()}
+	// kept for the replicas fetching it once it is stable
+	pbft.snapshots[seq] = snapshot
+	pbft.configs[seq] = config
+	var err error
+	cp.Sig, err = pbft.sign(payload("checkpoint", 0, cp.Seq, cp.State))
+	if err != nil {
+		return err
+	}
+	log.Lvl3(pbft.ServerIdentity(), "checkpoint at sequence number", seq)
+	if err := pbft.persist(&Record{Type: recordCheckpoint, Seq: seq, Checkpoint: cp, Snapshot: snapshot, Config: config}); err != nil {
+		return err
+	}
+
+	if !pbft.isMember() {
+		return pbft.handleCheckpoint(cp)
+	}
+	if errs := pbft.broadcast(cp); len(errs) > 0 {
+		log.Lvl3(pbft.ServerIdentity(), "failed to send checkpoint to all replicas")
+	}
+	return pbft.handleCheckpoint(cp)
+}
+
+func (pbft *PbftProtocol) handleCheckpoint(cp *Checkpoint) error {
+	if cp.Seq <= pbft.stableSeq {
+		return nil
+	}
+	// a replica trusts its own checkpoint, even when it isn't a member
+	if cp.Sender != pbft.id() {
+		if err := pbft.verifyCheckpoint(cp); err != nil {
+			log.Lvl2(pbft.ServerIdentity(), "received invalid checkpoint:", err)
+			return nil
+		}
+	}
+	if pbft.checkpoints[cp.Seq] == nil {
+		pbft.checkpoints[cp.Seq] = make(map[string]*Checkpoint)
+	}
+	pbft.checkpoints[cp.Seq][cp.Sender] = cp
+	if pbft.lagging(cp) {
+		return pbft.fetchState(cp.Seq)
+	}
+
+	// the checkpoint is stable once a quorum of replicas agrees with our
+	// own state
+	own, ok := pbft.checkpoints[cp.Seq][pbft.id()]
+	if !ok {
+		return nil
+	}
+	var proof []Checkpoint
+	for sender, c := range pbft.checkpoints[cp.Seq] {
+		if _, member := pbft.PubKeysMap[sender]; member && bytes.Equal(c.State, own.State) {
+			proof = append(proof, *c)
+		}
+	}
+	if len(proof) < pbft.quorum() {
+		return nil
+	}
+	return pbft.stabilize(cp.Seq, proof)
+}
+
+// stabilize moves the low watermark to the given stable checkpoint and
+// discards the messages of the log it makes useless, as well as what the
+// replica remembers of the requests executed up to it: a retransmission of
+// one of them is older than the last request of its client. The replicas
+// switch to
+// the replica set of a pending reconfiguration at its checkpoint.
+func (pbft *PbftProtocol) stabilize(seq int, proof []Checkpoint) error {
+	log.Lvl2(pbft.ServerIdentity(), "stable checkpoint at sequence number", seq)
+	pbft.stableSeq = seq
+	pbft.stableProof = proof
+
+	for id := range pbft.log {
+		if id.seq <= seq {
+			delete(pbft.log, id)
+		}
+	}
+	for s, digest := range pbft.committed {
+		if s <= seq {
+			for _, d := range pbft.batches[string(digest)] {
+				if pbft.executed[d] {
+					delete(pbft.requests, d)
+					delete(pbft.executed, d)
+					delete(pbft.assigned, d)
+				}
+			}
+			delete(pbft.batches, string(digest))
+			delete(pbft.verified, string(digest))
+			delete(pbft.committed, s)
+			delete(pbft.commitCerts, s)
+		}
+	}
+	for s := range pbft.proposedAt {
+		if s <= seq {
+			delete(pbft.proposedAt, s)
+		}
+	}
+	for s := range pbft.prepared {
+		if s <= seq {
+			delete(pbft.prepared, s)
+		}
+	}
+	for s := range pbft.checkpoints {
+		if s <= seq {
+			delete(pbft.checkpoints, s)
+		}
+	}
+	for s := range pbft.snapshots {
+		if s < seq {
+			delete(pbft.snapshots, s)
+			delete(pbft.configs, s)
+		}
+	}
+	pbft.discardViews()
+	if pbft.nextSeq <= seq {
+		pbft.nextSeq = seq + 1
+	}
+	if pbft.config.Next != nil && seq >= pbft.config.Seq {
+		pbft.previous = pbft.replicas
+		pbft.switchedAt = seq
+		pbft.applyConfig(Configuration{Members: pbft.config.Next})
+	}
+	if err := pbft.compact(seq); err != nil {
+		return err
+	}
+
+	// the window moved, the primary can order more requests
+	if pbft.isPrimary(pbft.view) && !pbft.viewChanging {
+		return pbft.proposePending()
+	}
+	return nil
+}
+
+func (pbft *PbftProtocol) verifyCheckpoint(cp *Checkpoint) error {
+	return pbft.verifySig(cp.Sender, payload("checkpoint", 0, cp.Seq, cp.State), cp.Sig)
+}
+
+// verifyStableProof checks that the checkpoints are a quorum of matching
+// checkpoints from distinct replicas for the given sequence number. The
+// checkpoint at which the last reconfiguration switched is signed by the
+// replicas before it.
+func (pbft *PbftProtocol) verifyStableProof(seq int, proof []Checkpoint) error {
+	if seq == 0 {
+		return nil
+	}
+	signers := pbft.replicas
+	if seq == pbft.switchedAt && pbft.previous != nil {
+		signers = pbft.previous
+	}
+	publics := make(map[string]kyber.Point)
+	for _, r := range signers {
+		publics[r.ServerIdentity.ID.String()] = r.ServerIdentity.Public
+	}
+	senders := make(map[string]bool)
+	for i := range proof {
+		cp := &proof[i]
+		if cp.Seq != seq || !bytes.Equal(cp.State, proof[0].State) {
+			return errors.New("checkpoints don't match")
+		}
+		public, ok := publics[cp.Sender]
+		if !ok {
+			return fmt.Errorf("unknown sender %s", cp.Sender)
+		}
+		if err := schnorr.Verify(pbft.Suite(), public, payload("checkpoint", 0, cp.Seq, cp.State), cp.Sig); err != nil {
+			return err
+		}
+		senders[cp.Sender] = true
+	}
+	if len(senders) < quorumSize(len(signers)) {
+		return fmt.Errorf("only %d checkpoints in the proof", len(senders))
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/sign/schnorr"
+	"github.com/dedis/onet/log"
+)
+
+// clientRequest is a request received from an external client, along with
+// the channel on which its reply is sent once executed. A cancelled client
+// request stops waiting for the reply.
+type clientRequest struct {
+	req *Request
+	reply chan *Reply
+	cancel bool
+}
+
+// Digest returns the digest identifying the request: the client signs it,
+// and the replicas agree on it.
+func (r *Request) Digest() []byte {
+	h := sha512.New()
+	if r.Client != nil {
+		r.Client.MarshalTo(h)
+	}
+	binary.Write(h, binary.LittleEndian, r.Timestamp)
+	h.Write(r.Msg)
+	for _, m := range r.Members {
+		h.Write([]byte(m))
+	}
+	return h.Sum(nil)
+}
+
+// batchDigest returns the digest identifying a batch of requests, on which
+// the replicas agree.
+func batchDigest(reqs []Request) []byte {
+	digests := make([][]byte, len(reqs))
+	for i := range reqs {
+		digests[i] = reqs[i].Digest()
+	}
+	return hashDigests(digests)
+}
+
+// inBatch returns whether the digest is one of the digests of the batch.
+func inBatch(digest []byte, batch [][]byte) bool {
+	for _, d := range batch {
+		if bytes.Equal(d, digest) {
+			return true
+		}
+	}
+	return false
+}
+
+// hashDigests returns the digest of a batch from the digests of its requests,
+// in order.
+func hashDigests(digests [][]byte) []byte {
+	h := sha512.New()
+	h.Write([]byte("batch"))
+	for _, d := range digests {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+// Verify checks the signature of the replica whose public key is given.
+func (r *Reply) Verify(suite kyber.Group, public kyber.Point) error {
+	return schnorr.Verify(suite, public, r.payload(), r.Sig)
+}
+
+// HandleClientRequest orders the request of an external client, and returns
+// the reply of this replica once it has been executed, or fails after the
+// timeout of the request. A request older than the last one executed for the
+// same client is rejected, and the last one is answered again without being
+// executed twice.
+func (pbft *PbftProtocol) HandleClientRequest(req *Request) (*Reply, error) {
+	if err := pbft.verifyRequest(req); err != nil {
+		return nil, err
+	}
+	if err := CheckTimeout(req.Timeout); err != nil {
+		return nil, err
+	}
+	cr := clientRequest{req: req, reply: make(chan *Reply, 1)}
+	select {
+	case pbft.clientChan <- cr:
+	case <-pbft.doneChan:
+		return nil, errors.New("protocol is stopped")
+	}
+
+	select {
+	case reply := <-cr.reply:
+		if reply == nil || reply.Rejected {
+			return nil, errors.New("request older than the last one of the client")
+		}
+		return reply, nil
+	case <-time.After(req.Timeout):
+		cr.cancel = true
+		select {
+		case pbft.clientChan <- cr:
+		case <-pbft.doneChan:
+		}
+		return nil, errors.New("request timed out")
+	case <-pbft.doneChan:
+		return nil, errors.New("protocol is stopped")
+	}
+}
+
+// handleClientRequest registers the client waiting for the request. A backup
+// relays it to the primary and starts its view timer, so that the primary is
+// replaced if it ignores the request.
+func (pbft *PbftProtocol) handleClientRequest(cr clientRequest) error {
+	if cr.cancel {
+		pbft.removeWaiter(cr)
+		return nil
+	}
+	client := cr.req.Client.String()
+	switch last := pbft.lastTimestamp[client]; {
+	case cr.req.Timestamp < last:
+		cr.reply <- nil
+		return nil
+	case cr.req.Timestamp == last:
+		cr.reply <- pbft.lastReply[client]
+		return nil
+	}
+
+	d := string(cr.req.Digest())
+	pbft.waiters[d] = append(pbft.waiters[d], cr.reply)
+
+	req := *cr.req
+	req.Sender = pbft.id()
+	if !pbft.isPrimary(pbft.view) && !pbft.viewChanging {
+		primary := pbft.primary(pbft.view)
+		go func() {
+			if err := pbft.sendTo(primary, &req); err != nil {
+				log.Lvl3(pbft.ServerIdentity(), "failed to relay request to the primary:", err)
+			}
+		}()
+	}
+	return pbft.handleRequest(&req)
+}
+
+// removeWaiter forgets the client waiting for the reply of a cancelled
+// request.
+func (pbft *PbftProtocol) removeWaiter(cr clientRequest) {
+	d := string(cr.req.Digest())
+	waiters := pbft.waiters[d][:0]
+	for _, c := range pbft.waiters[d] {
+		if c != cr.reply {
+			waiters = append(waiters, c)
+		}
+	}
+	if len(waiters) == 0 {
+		delete(pbft.waiters, d)
+	} else {
+		pbft.waiters[d] = waiters
+	}
+}
+
+// deliver sends the reply of an executed request to the clients waiting for
+// it.
+func (pbft *PbftProtocol) deliver(req *Request, reply *Reply) {
+	d := string(reply.Digest)
+	for _, c := range pbft.waiters[d] {
+		c <- reply
+	}
+	delete(pbft.waiters, d)
+
+	// the root is the client of the requests it submitted itself
+	if !req.Client.Equal(pbft.Root().ServerIdentity.Public) {
+		return
+	}
+	if pbft.IsRoot() {
+		pbft.handleReply(reply)
+	} else if err := pbft.sendTo(pbft.Root(), reply); err != nil {
+		log.Lvl2(pbft.ServerIdentity(), "couldn't send reply:", err)
+	}
+}
+
+// verifyRequest checks the signature of the client on the request.
+func (pbft *PbftProtocol) verifyRequest(req *Request) error {
+	if req.Client == nil {
+		return errors.New("request without client")
+	}
+	return schnorr.Verify(pbft.Suite(), req.Client, req.Digest(), req.Sig)
+}
+
+// verifyBatch checks the signatures of the clients on the requests of a
+// batch.
+func (pbft *PbftProtocol) verifyBatch(batch []Request) error {
+	for i := range batch {
+		if err := pbft.verifyRequest(&batch[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
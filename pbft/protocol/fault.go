@@ -0,0 +1,139 @@
+package protocol
+
+import (
+	"crypto/sha512"
+	"fmt"
+
+	"github.com/dedis/onet"
+	"github.com/dedis/onet/log"
+)
+
+// Fault is a Byzantine behaviour injected in a replica, to measure the
+// protocol under attack in simulations.
+type Fault int
+
+const (
+	// Correct replicas follow the protocol.
+	Correct Fault = iota
+	// ConflictingDigests makes the replica send a different digest to
+	// every replica in its pre-prepares, prepares, commits and
+	// checkpoints, properly signed.
+	ConflictingDigests
+	// InvalidSignatures makes the replica send its pre-prepares,
+	// prepares, commits and checkpoints with invalid signatures.
+	InvalidSignatures
+	// Crash makes the replica stop sending messages as a replica. It still
+	// sends the requests of the client, so that the root can crash as the
+	// primary of the first view and still run the simulation.
+	Crash
+)
+
+// ParseFault returns the fault with the given name: "digest", "signature" or
+// "crash", or Correct for an empty name.
+func ParseFault(name string) (Fault, error) {
+	switch name {
+	case "":
+		return Correct, nil
+	case "digest":
+		return ConflictingDigests, nil
+	case "signature":
+		return InvalidSignatures, nil
+	case "crash":
+		return Crash, nil
+	}
+	return Correct, fmt.Errorf("unknown fault %q", name)
+}
+
+// tamper returns the message the faulty replica sends to the given node
+// instead of msg. The message itself is left untouched, as the replica
+// handles it as well.
+func (pbft *PbftProtocol) tamper(to *onet.TreeNode, msg interface{}) interface{} {
+	var err error
+	switch m := msg.(type) {
+	case *PrePrepare:
+		c := *m
+		if pbft.Fault == ConflictingDigests {
+			c.Digest = conflicting(c.Digest, to)
+			c.Sig, err = pbft.sign(payload("preprepare", c.View, c.Seq, c.Digest))
+		} else {
+			c.Sig = corrupt(c.Sig)
+		}
+		msg = &c
+	case *Prepare:
+		c := *m
+		if pbft.Fault == ConflictingDigests {
+			c.Digest = conflicting(c.Digest, to)
+			if pbft.Linear {
+				c.Sig, err = pbft.signPartial(payload("prepare", c.View, c.Seq, c.Digest))
+			} else {
+				c.Sig, err = pbft.sign(payload("prepare", c.View, c.Seq, c.Digest))
+			}
+		} else {
+			c.Sig = corrupt(c.Sig)
+		}
+		msg = &c
+	case *Commit:
+		c := *m
+		if pbft.Fault == ConflictingDigests {
+			c.Digest = conflicting(c.Digest, to)
+			switch {
+			case pbft.MACs:
+				c.Auth, err = pbft.authenticator(payload("commit", c.View, c.Seq, c.Digest))
+			case pbft.Linear:
+				c.Sig, err = pbft.signPartial(payload("commit", c.View, c.Seq, c.Digest))
+			default:
+				c.Sig, err = pbft.sign(payload("commit", c.View, c.Seq, c.Digest))
+			}
+		} else {
+			c.Sig = corrupt(c.Sig)
+			c.Auth = make([][]byte, len(m.Auth))
+			for i := range m.Auth {
+				c.Auth[i] = corrupt(m.Auth[i])
+			}
+		}
+		msg = &c
+	case *Checkpoint:
+		c := *m
+		if pbft.Fault == ConflictingDigests {
+			c.State = conflicting(c.State, to)
+			c.Sig, err = pbft.sign(payload("checkpoint", 0, c.Seq, c.State))
+		} else {
+			c.Sig = corrupt(c.Sig)
+		}
+		msg = &c
+	}
+	if err != nil {
+		log.Error(pbft.ServerIdentity(), "couldn't tamper with the message:", err)
+	}
+	return msg
+}
+
+// silenced returns whether the faulty replica doesn't send msg at all: a
+// crashed replica only sends the requests and the stop of the client.
+func (pbft *PbftProtocol) silenced(msg interface{}) bool {
+	if pbft.Fault != Crash {
+		return false
+	}
+	switch msg.(type) {
+	case *Request, *Stop:
+		return false
+	}
+	return true
+}
+
+// conflicting returns a digest specific to the destination.
+func conflicting(digest []byte, to *onet.TreeNode) []byte {
+	h := sha512.New()
+	h.Write(digest)
+	h.Write(to.ServerIdentity.ID[:])
+	return h.Sum(nil)
+}
+
+// corrupt returns a copy of the signature with its first byte flipped.
+func corrupt(sig []byte) []byte {
+	c := append([]byte{}, sig...)
+	if len(c) > 0 {
+		c[0] ^= 0xff
+	}
+	return c
+}
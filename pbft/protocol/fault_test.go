@@ -0,0 +1,130 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"testing"
+	"time"
+
+	"github.com/dedis/onet"
+)
+
+const byzantineTestProtocolName = "PBFTByzantineTest"
+const crashedPrimaryTestProtocolName = "PBFTCrashedPrimaryTest"
+
+// byzantineFault is the fault of the last replica of the roster.
+var byzantineFault = Correct
+
+func init() {
+	onet.GlobalProtocolRegister(byzantineTestProtocolName, func(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+		pi, err := NewProtocol(n)
+		if err != nil {
+			return nil, err
+		}
+		if n.TreeNode().RosterIndex == len(n.Roster().List)-1 {
+			pi.(*PbftProtocol).Fault = byzantineFault
+		}
+		return pi, nil
+	})
+	onet.GlobalProtocolRegister(crashedPrimaryTestProtocolName, func(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+		pi, err := NewProtocol(n)
+		if err != nil {
+			return nil, err
+		}
+		if n.IsRoot() {
+			pi.(*PbftProtocol).Fault = Crash
+		}
+		return pi, nil
+	})
+}
+
+func TestParseFault(t *testing.T) {
+	for name, fault := range map[string]Fault{"": Correct, "digest": ConflictingDigests,
+		"signature": InvalidSignatures, "crash": Crash} {
+		f, err := ParseFault(name)
+		if err != nil || f != fault {
+			t.Fatal("wrong fault for", name)
+		}
+	}
+	if _, err := ParseFault("slow"); err == nil {
+		t.Fatal("unknown fault accepted")
+	}
+}
+
+func TestByzantine(t *testing.T) {
+
+	proposal := []byte("dedis")
+	timeout := 5 * time.Second
+
+	for _, fault := range []Fault{ConflictingDigests, InvalidSignatures} {
+		byzantineFault = fault
+		local := onet.NewLocalTest(tSuite)
+		_, _, tree := local.GenTree(4, true)
+
+		pi, err := local.CreateProtocol(byzantineTestProtocolName, tree)
+		if err != nil {
+			local.CloseAll()
+			t.Fatal("Error in creation of protocol:", err)
+		}
+		protocol := pi.(*PbftProtocol)
+		protocol.Msg = proposal
+		protocol.Timeout = timeout
+
+		if err := protocol.Start(); err != nil {
+			local.CloseAll()
+			t.Fatal(err)
+		}
+
+		select {
+		case finalReply := <-protocol.FinalReply:
+			digest := sha512.Sum512(proposal)
+			if !bytes.Equal(finalReply, digest[:]) {
+				local.CloseAll()
+				t.Fatal("committed the wrong request")
+			}
+		case <-time.After(timeout * 2):
+			local.CloseAll()
+			t.Fatal("the correct replicas didn't commit with fault", fault)
+		}
+
+		local.CloseAll()
+	}
+	byzantineFault = Correct
+}
+
+func TestCrashedPrimary(t *testing.T) {
+	proposal := []byte("dedis")
+	timeout := time.Second
+
+	local := onet.NewLocalTest(tSuite)
+	_, _, tree := local.GenTree(4, true)
+
+	// the root is the primary of the first view, and stays the client
+	pi, err := local.CreateProtocol(crashedPrimaryTestProtocolName, tree)
+	if err != nil {
+		local.CloseAll()
+		t.Fatal("Error in creation of protocol:", err)
+	}
+	protocol := pi.(*PbftProtocol)
+	protocol.Msg = proposal
+	protocol.Timeout = timeout
+
+	if err := protocol.Start(); err != nil {
+		local.CloseAll()
+		t.Fatal(err)
+	}
+
+	select {
+	case finalReply := <-protocol.FinalReply:
+		digest := sha512.Sum512(proposal)
+		if !bytes.Equal(finalReply, digest[:]) {
+			local.CloseAll()
+			t.Fatal("committed the wrong request")
+		}
+	case <-time.After(timeout * 10):
+		local.CloseAll()
+		t.Fatal("the replicas didn't change the crashed primary")
+	}
+
+	local.CloseAll()
+}
@@ -0,0 +1,299 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+
+	blscosi "bls-ftcosi/blsftcosi/protocol"
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/pairing"
+	"github.com/dedis/kyber/pairing/bn256"
+	"github.com/dedis/kyber/sign/bls"
+	"github.com/dedis/onet"
+	"github.com/dedis/onet/log"
+)
+
+// LinearProtocolName is the name of the linear variant of the protocol: the
+// backups send their prepares and commits to the primary only, which
+// aggregates a quorum of their BLS signatures into a certificate and
+// broadcasts it once, so that every phase costs O(n) messages instead of
+// O(n²). The keys of the servers must be bn256 G2 keys, as for blsftcosi.
+const LinearProtocolName = "PBFTLinear"
+
+func init() {
+	onet.GlobalProtocolRegister(LinearProtocolName, NewLinearProtocol)
+}
+
+// NewLinearProtocol returns a replica like NewProtocol, running the linear
+// variant.
+func NewLinearProtocol(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+	pi, err := NewProtocol(n)
+	if err != nil {
+		return nil, err
+	}
+	pbft := pi.(*PbftProtocol)
+	pbft.Linear = true
+	pbft.pairingSuite = bn256.NewSuite()
+	return pbft, nil
+}
+
+// Verify checks that the certificate holds the aggregate signature of a
+// quorum of the given public keys, in the order of the roster.
+func (ac *AggregateCert) Verify(suite pairing.Suite, publics []kyber.Point) error {
+	mask, err := blscosi.NewMask(suite, publics, nil)
+	if err != nil {
+		return err
+	}
+	if err := mask.SetMask(ac.Mask); err != nil {
+		return err
+	}
+	if n := mask.CountEnabled(); n < quorumSize(len(publics)) {
+		return fmt.Errorf("only %d signers in the %s certificate", n, ac.Phase)
+	}
+	return bls.Verify(suite, mask.AggregatePublic, payload(ac.Phase, ac.View, ac.Seq, ac.Digest), ac.Sig)
+}
+
+// Matches returns an error if the certificate is not about the given phase
+// of the slot.
+func (ac *AggregateCert) Matches(phase string, view, seq int, digest []byte) error {
+	if ac.Phase != phase || ac.View != view || ac.Seq != seq || !bytes.Equal(ac.Digest, digest) {
+		return errors.New("certificate for another slot")
+	}
+	return nil
+}
+
+// sendLinearPrepare sends the partial signature of the prepare to the
+// primary.
+func (pbft *PbftProtocol) sendLinearPrepare(view, seq int, digest []byte) error {
+	sig, err := pbft.signPartial(payload("prepare", view, seq, digest))
+	if err != nil {
+		return err
+	}
+	prepare := &Prepare{View: view, Seq: seq, Digest: digest, Sig: sig, Sender: pbft.id()}
+	if err := pbft.toCollector(view, prepare, func() error {
+		return pbft.handlePrepare(prepare)
+	}); err != nil {
+		return err
+	}
+	// the prepare certificate might have arrived before the pre-prepare
+	return pbft.checkPrepared(view, seq)
+}
+
+// handleLinearPrepare is run by the primary to collect the prepares.
+func (pbft *PbftProtocol) handleLinearPrepare(prepare *Prepare) error {
+	if !pbft.isPrimary(prepare.View) {
+		return nil
+	}
+	err := pbft.verifyPartial(prepare.Sender, payload("prepare", prepare.View, prepare.Seq, prepare.Digest), prepare.Sig)
+	if err != nil {
+		log.Lvl2(pbft.ServerIdentity(), "received prepare with invalid signature:", err)
+		return nil
+	}
+	pbft.entry(prepare.View, prepare.Seq).prepares[prepare.Sender] = prepare
+	return pbft.checkPrepared(prepare.View, prepare.Seq)
+}
+
+// checkLinearPrepared makes the primary broadcast the prepare certificate
+// once it has a quorum of prepares, and every replica send its commit once
+// it received the certificate.
+func (pbft *PbftProtocol) checkLinearPrepared(view, seq int) error {
+	e := pbft.entry(view, seq)
+	if e.prePrepare == nil || view != pbft.view || pbft.viewChanging {
+		return nil
+	}
+
+	if pbft.isPrimary(view) && e.prepareAgg == nil {
+		sigs := make(map[string][]byte)
+		for sender, prepare := range e.prepares {
+			if bytes.Equal(prepare.Digest, e.prePrepare.Digest) {
+				sigs[sender] = prepare.Sig
+			}
+		}
+		ac, err := pbft.aggregate("prepare", view, seq, e.prePrepare.Digest, sigs)
+		if err != nil {
+			return err
+		}
+		if ac != nil {
+			log.Lvl2(pbft.ServerIdentity(), "aggregated", len(sigs), "prepares for", seq)
+			e.prepareAgg = ac
+			go func() {
+				if errs := pbft.broadcast(ac); len(errs) > 0 {
+					log.Lvl3(pbft.ServerIdentity(), "failed to send prepare certificate to all replicas")
+				}
+			}()
+		}
+	}
+
+	if e.prepareAgg == nil || e.sentCommit || !e.sentPrepare || !bytes.Equal(e.prepareAgg.Digest, e.prePrepare.Digest) {
+		return nil
+	}
+	prepared := &PreparedCert{PrePrepare: *e.prePrepare, Aggregate: *e.prepareAgg}
+	if err := pbft.persist(&Record{Type: recordCommit, View: view, Seq: seq, Prepared: prepared}); err != nil {
+		return err
+	}
+	pbft.prepared[seq] = prepared
+	e.sentCommit = true
+
+	sig, err := pbft.signPartial(payload("commit", view, seq, e.prePrepare.Digest))
+	if err != nil {
+		return err
+	}
+	commit := &Commit{View: view, Seq: seq, Digest: e.prePrepare.Digest, Sig: sig, Sender: pbft.id()}
+	if err := pbft.toCollector(view, commit, func() error {
+		return pbft.handleCommit(commit)
+	}); err != nil {
+		return err
+	}
+	// the commit certificate might have arrived before the prepare one
+	return pbft.checkCommitted(view, seq)
+}
+
+// handleLinearCommit is run by the primary to collect the commits.
+func (pbft *PbftProtocol) handleLinearCommit(commit *Commit) error {
+	if !pbft.isPrimary(commit.View) {
+		return nil
+	}
+	err := pbft.verifyPartial(commit.Sender, payload("commit", commit.View, commit.Seq, commit.Digest), commit.Sig)
+	if err != nil {
+		log.Lvl2(pbft.ServerIdentity(), "received commit with invalid signature:", err)
+		return nil
+	}
+	pbft.entry(commit.View, commit.Seq).commits[commit.Sender] = commit
+	return pbft.checkCommitted(commit.View, commit.Seq)
+}
+
+// checkLinearCommitted makes the primary broadcast the commit certificate
+// once it has a quorum of commits, and every replica execute the request
+// once it received the certificate.
+func (pbft *PbftProtocol) checkLinearCommitted(view, seq int) error {
+	e := pbft.entry(view, seq)
+	if e.committed || e.prePrepare == nil {
+		return nil
+	}
+
+	if pbft.isPrimary(view) && e.commitAgg == nil {
+		sigs := make(map[string][]byte)
+		for sender, commit := range e.commits {
+			if bytes.Equal(commit.Digest, e.prePrepare.Digest) {
+				sigs[sender] = commit.Sig
+			}
+		}
+		ac, err := pbft.aggregate("commit", view, seq, e.prePrepare.Digest, sigs)
+		if err != nil {
+			return err
+		}
+		if ac != nil {
+			log.Lvl2(pbft.ServerIdentity(), "aggregated", len(sigs), "commits for", seq)
+			e.commitAgg = ac
+			go func() {
+				if errs := pbft.broadcast(ac); len(errs) > 0 {
+					log.Lvl3(pbft.ServerIdentity(), "failed to send commit certificate to all replicas")
+				}
+			}()
+		}
+	}
+
+	if e.commitAgg == nil || !bytes.Equal(e.commitAgg.Digest, e.prePrepare.Digest) {
+		return nil
+	}
+	if err := pbft.persist(&Record{Type: recordCommitted, View: view, Seq: seq, Digest: e.prePrepare.Digest}); err != nil {
+		return err
+	}
+	e.committed = true
+	pbft.committed[seq] = e.prePrepare.Digest
+	return pbft.execute()
+}
+
+// handleAggregate stores a certificate broadcast by the primary.
+func (pbft *PbftProtocol) handleAggregate(ac *AggregateCert) error {
+	if !pbft.Linear || ac.View < pbft.view || !pbft.inWindow(ac.Seq) {
+		return nil
+	}
+	if err := pbft.verifyAggregate(ac); err != nil {
+		log.Lvl2(pbft.ServerIdentity(), "received invalid certificate:", err)
+		return nil
+	}
+	e := pbft.entry(ac.View, ac.Seq)
+	switch ac.Phase {
+	case "prepare":
+		e.prepareAgg = ac
+		return pbft.checkPrepared(ac.View, ac.Seq)
+	case "commit":
+		e.commitAgg = ac
+		return pbft.checkCommitted(ac.View, ac.Seq)
+	}
+	return nil
+}
+
+// toCollector sends the message to the primary of the view, or handles it
+// locally if this replica is the primary.
+func (pbft *PbftProtocol) toCollector(view int, msg interface{}, local func() error) error {
+	if pbft.isPrimary(view) {
+		return local()
+	}
+	if err := pbft.sendTo(pbft.primary(view), msg); err != nil {
+		log.Lvl2(pbft.ServerIdentity(), "couldn't send to the primary:", err)
+	}
+	return nil
+}
+
+// aggregate returns the certificate aggregating the signatures, or nil if
+// they are not a quorum.
+func (pbft *PbftProtocol) aggregate(phase string, view, seq int, digest []byte, sigs map[string][]byte) (*AggregateCert, error) {
+	if len(sigs) < pbft.quorum() {
+		return nil, nil
+	}
+	defer pbft.measureAuthentication(time.Now())
+	mask, err := blscosi.NewMask(pbft.pairingSuite, pbft.publics(), nil)
+	if err != nil {
+		return nil, err
+	}
+	var partials [][]byte
+	for i, r := range pbft.replicas {
+		if sig, ok := sigs[r.ServerIdentity.ID.String()]; ok {
+			partials = append(partials, sig)
+			if err := mask.SetBit(i, true); err != nil {
+				return nil, err
+			}
+		}
+	}
+	sig, err := bls.AggregateSignatures(pbft.pairingSuite, partials...)
+	if err != nil {
+		return nil, err
+	}
+	return &AggregateCert{Phase: phase, View: view, Seq: seq, Digest: digest, Sig: sig, Mask: mask.Mask()}, nil
+}
+
+// verifyAggregate checks a certificate against the keys of the replicas.
+func (pbft *PbftProtocol) verifyAggregate(ac *AggregateCert) error {
+	defer pbft.measureAuthentication(time.Now())
+	return ac.Verify(pbft.pairingSuite, pbft.publics())
+}
+
+// signPartial returns the BLS signature of the message.
+func (pbft *PbftProtocol) signPartial(msg []byte) ([]byte, error) {
+	defer pbft.measureAuthentication(time.Now())
+	return bls.Sign(pbft.pairingSuite, pbft.Private(), msg)
+}
+
+// verifyPartial checks the BLS signature of a replica.
+func (pbft *PbftProtocol) verifyPartial(sender string, msg, sig []byte) error {
+	defer pbft.measureAuthentication(time.Now())
+	public, ok := pbft.PubKeysMap[sender]
+	if !ok {
+		return fmt.Errorf("unknown sender %s", sender)
+	}
+	return bls.Verify(pbft.pairingSuite, public, msg, sig)
+}
+
+// publics returns the public keys of the replicas, in the order of the
+// roster.
+func (pbft *PbftProtocol) publics() []kyber.Point {
+	publics := make([]kyber.Point, len(pbft.replicas))
+	for i, r := range pbft.replicas {
+		publics[i] = r.ServerIdentity.Public
+	}
+	return publics
+}
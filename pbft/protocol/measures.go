@@ -0,0 +1,87 @@
+package protocol
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/dedis/onet"
+	"github.com/dedis/onet/simul/monitor"
+)
+
+// Names of the measures recorded by every replica through the onet monitor
+// when its protocol ends.
+const (
+	// time spent signing, authenticating and verifying messages
+	MeasureAuthentication = "authentication"
+	// number of messages sent to the other nodes
+	MeasureMessages = "messages"
+	// number of requests of a batch, recorded by the primary once the
+	// batch has been executed
+	MeasureBatchSize = "batch_size"
+	// time between the proposal of a batch and its execution
+	MeasureBatchLatency = "batch_latency"
+	// requests executed per second in a batch
+	MeasureBatchThroughput = "batch_throughput"
+)
+
+// measureAuthentication adds the time elapsed since start to the time spent
+// authenticating messages.
+func (pbft *PbftProtocol) measureAuthentication(start time.Time) {
+	pbft.authTime += time.Since(start)
+}
+
+// measureBatch records the measures of a batch executed by the primary that
+// proposed it.
+func (pbft *PbftProtocol) measureBatch(seq, size int) {
+	proposed, ok := pbft.proposedAt[seq]
+	if !ok {
+		return
+	}
+	delete(pbft.proposedAt, seq)
+	latency := time.Since(proposed).Seconds()
+	monitor.RecordSingleMeasure(MeasureBatchSize, float64(size))
+	monitor.RecordSingleMeasure(MeasureBatchLatency, latency)
+	monitor.RecordSingleMeasure(MeasureBatchThroughput, float64(size)/latency)
+}
+
+// recordMeasures records the measures of the replica.
+func (pbft *PbftProtocol) recordMeasures() {
+	monitor.RecordSingleMeasure(MeasureAuthentication, pbft.authTime.Seconds())
+	monitor.RecordSingleMeasure(MeasureMessages, float64(atomic.LoadInt64(&pbft.messages)))
+}
+
+// broadcast sends the message to all the other nodes of the tree, counting
+// the messages sent.
+func (pbft *PbftProtocol) broadcast(msg interface{}) []error {
+	if pbft.Fault != Correct {
+		// a faulty replica tampers with the message of every node
+		var errs []error
+		for _, tn := range pbft.List() {
+			if tn.ID.Equal(pbft.TreeNode().ID) {
+				continue
+			}
+			if err := pbft.sendTo(tn, msg); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		return errs
+	}
+	errs := pbft.Broadcast(msg)
+	atomic.AddInt64(&pbft.messages, int64(len(pbft.List())-1-len(errs)))
+	return errs
+}
+
+// sendTo sends the message to the node, counting the messages sent.
+func (pbft *PbftProtocol) sendTo(to *onet.TreeNode, msg interface{}) error {
+	if pbft.silenced(msg) {
+		return nil
+	}
+	if pbft.Fault != Correct {
+		msg = pbft.tamper(to, msg)
+	}
+	if err := pbft.SendTo(to, msg); err != nil {
+		return err
+	}
+	atomic.AddInt64(&pbft.messages, 1)
+	return nil
+}
@@ -2,19 +2,21 @@ package protocol
 
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
 	"sync"
 	"time"
-	"bytes"
-	"math"
-	"fmt"
-	"encoding/json"
 
 	"github.com/dedis/onet"
 	"github.com/dedis/onet/log"
 	"github.com/dedis/onet/network"
 	"github.com/dedis/kyber"
-	"github.com/dedis/kyber/sign/schnorr"
+	"github.com/dedis/kyber/pairing"
 
 
 	"crypto/sha512"
@@ -22,7 +24,7 @@ import (
 
 func init() {
 	log.SetDebugVisible(1)
-	network.RegisterMessages(PrePrepare{}, Prepare{}, Commit{}, Reply{})
+	network.RegisterMessages(Request{}, PrePrepare{}, Prepare{}, Commit{}, Reply{}, Checkpoint{}, ViewChange{}, NewView{}, AggregateCert{}, StateRequest{}, StateReply{}, Stop{}, Record{})
 	onet.GlobalProtocolRegister(DefaultProtocolName, NewProtocol)
 }
 
@@ -31,6 +33,46 @@ type VerificationFn func(msg []byte, data []byte) bool
 
 var defaultTimeout = 60 * time.Second
 
+// MinTimeout and MaxTimeout bound the timeout of the replicas, after which a
+// backup suspects the primary.
+const (
+	MinTimeout = 100 * time.Millisecond
+	MaxTimeout = 10 * time.Minute
+)
+
+// checkpointInterval is the number of sequence numbers between two
+// checkpoints, and logSize the number of sequence numbers above the last
+// stable checkpoint that can be in progress at the same time (the distance
+// between the low and the high watermarks). Every replica must use the same
+// values.
+var checkpointInterval = 64
+var logSize = 2 * checkpointInterval
+
+// defaultBatchSize is the maximum number of requests ordered in a single
+// pre-prepare, and defaultBatchTimeout how long the primary waits for a batch
+// to fill up before proposing it anyway.
+var defaultBatchSize = 1
+var defaultBatchTimeout = 10 * time.Millisecond
+
+// PbftProtocol is a PBFT replica. The root of the tree acts as the client: it
+// submits requests to the replicas and waits for their replies. Every node of
+// the roster is a replica, the primary of view v being the replica at index v
+// modulo the size of the roster. The primary assigns sequence numbers to the
+// requests, which are executed on the state machine of every replica once
+// committed. If the primary fails, the backups time out and elect the next
+// one through a view change.
+//
+// When Msg is set, the protocol orders this single request, sends its digest
+// on FinalReply and stops. Otherwise the replicas run until Stop is called on
+// the root, and requests are submitted with Submit.
+//
+// The primary orders the requests in batches of up to BatchSize requests,
+// and proposes a batch that isn't full after BatchTimeout. All the batches
+// between the low and the high watermarks can be in flight at the same time.
+//
+// The root can replace the replicas with Reconfigure. The reconfiguration is
+// ordered like any request, and the replicas switch to the new replica set at
+// a checkpoint, the quorums being computed over the new replicas from there.
 type PbftProtocol struct {
 	*onet.TreeNodeInstance
 
@@ -40,16 +82,170 @@ type PbftProtocol struct {
 
 	FinalReply 			chan []byte
 	startChan       	chan bool
+	submitChan			chan *Request
+	clientChan			chan clientRequest
+	stopChan			chan bool
+	doneChan			chan bool
 	stoppedOnce    		sync.Once
+	stopOnce			sync.Once
 	verificationFn  	VerificationFn
+	stateMachine		StateMachine
+	onResult			func(*Result)
+
+	// Timeout is how long a backup waits for the primary to make progress
+	// before suspecting it. It is set on the root, between MinTimeout and
+	// MaxTimeout, and sent to the replicas along its requests.
 	Timeout 			time.Duration
 	PubKeysMap			map[string]kyber.Point
+	BatchSize			int
+	BatchTimeout		time.Duration
+
+	// MACs makes the replicas authenticate the commits and the replies
+	// with MACs rather than signatures. It must be the same for all the
+	// replicas, so it is set by the constructor of the protocol. The
+	// prepares stay signed: a PreparedCert is sent along a view change
+	// and must convince replicas that didn't receive the prepares, which
+	// a MAC for another replica can't do.
+	MACs				bool
+	sessionKeys			map[string][]byte
+
+	// Linear makes the replicas send their prepares and commits to the
+	// primary only, which broadcasts their BLS aggregate. Like MACs, it
+	// is set by the constructor of the protocol.
+	Linear				bool
+	pairingSuite		pairing.Suite
+
+	// Fault makes the replica Byzantine in simulations.
+	Fault				Fault
+
+	authTime			time.Duration
+	messages			int64
+
+	// replicas in the order of the configuration, initially sorted by
+	// roster index
+	replicas			[]*onet.TreeNode
+	config				Configuration
+	configs				map[int]*Configuration
+
+	// replicas before the last reconfiguration, which signed the
+	// checkpoint at which it switched
+	previous			[]*onet.TreeNode
+	switchedAt			int
+
+	// view
+	view				int
+	viewChanging		bool
+	viewTimeout			time.Duration
+	viewTimer			<-chan time.Time
+	viewChanges			map[int]map[string]*ViewChange
+	sentNewView			map[int]bool
+
+	// requests
+	requests			map[string]*Request
+	outstanding			map[string]bool
+	executed			map[string]bool
+	verified			map[string]bool
+	verifying			map[string]bool
+	verifyChan			chan verification
+
+	// clients
+	waiters				map[string][]chan *Reply
+	lastTimestamp		map[string]int64
+	lastReply			map[string]*Reply
+
+	// primary
+	nextSeq				int
+	pending				[]string
+	assigned			map[string]bool
+	batchTimer			<-chan time.Time
+	batchDue			bool
+	proposedAt			map[int]time.Time
+
+	// batches maps the digest of a batch to the digests of its requests
+	batches				map[string][]string
 
+	// log
+	log					map[entryID]*entry
+	prepared			map[int]*PreparedCert
+	committed			map[int][]byte
+	commitCerts			map[int]*QuorumCert
+	lastExecuted		int
+	checkpoints			map[int]map[string]*Checkpoint
+	stableSeq			int
+	stableProof			[]Checkpoint
+	snapshots			map[int][]byte
+
+	// write-ahead log
+	wal					WAL
+	walRecords			[]*Record
+	replaying			bool
+
+	// state transfer
+	fetching			int
+	transfer			map[string]*StateReply
+
+	// client
+	timestamp			int64
+	// sent is closed once the last submitted request has been broadcast, so
+	// that the requests reach the replicas in the order of their timestamps
+	sent				chan bool
+	msgDigest			string
+	submitted			map[string]bool
+	replies				map[string]map[string]*Reply
+
+	ChannelRequest		chan StructRequest
 	ChannelPrePrepare   chan StructPrePrepare
 	ChannelPrepare 		chan StructPrepare
 	ChannelCommit		chan StructCommit
 	ChannelReply		chan StructReply
+	ChannelCheckpoint	chan StructCheckpoint
+	ChannelViewChange	chan StructViewChange
+	ChannelNewView		chan StructNewView
+	ChannelAggregate	chan StructAggregateCert
+	ChannelStateRequest	chan StructStateRequest
+	ChannelStateReply	chan StructStateReply
+	ChannelStop			chan StructStop
+
+}
+
+// Result is the outcome of a request, as agreed on by the replicas.
+type Result struct {
+	Seq int
+	Digest []byte
+	Result []byte
+	// Rejected is set if the request was older than the last one of the
+	// client when it was ordered, in which case it has not been executed.
+	Rejected bool
+	// Batch holds the digests of the requests committed along with this
+	// one, in order.
+	Batch [][]byte
+	// Cert proves to anybody knowing the roster that the batch has been
+	// committed with sequence number Seq.
+	Cert *QuorumCert
+}
+
+// entryID identifies a slot of the log
+type entryID struct {
+	view int
+	seq int
+}
+
+// entry holds the messages received for a slot of the log
+type entry struct {
+	prePrepare			*PrePrepare
+	prepares			map[string]*Prepare
+	commits				map[string]*Commit
+	prepareAgg			*AggregateCert
+	commitAgg			*AggregateCert
+	sentPrepare			bool
+	sentCommit			bool
+	committed			bool
+}
 
+// verification is the result of the verification function on a request
+type verification struct {
+	digest string
+	ok bool
 }
 
 // Check that *PbftProtocol implements onet.ProtocolInstance
@@ -57,39 +253,106 @@ var _ onet.ProtocolInstance = (*PbftProtocol)(nil)
 
 // NewProtocol initialises the structure for use in one round
 func NewProtocol(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
-
-	pubKeysMap := make(map[string]kyber.Point)
-	for _, node := range n.Tree().List() {
-		//fmt.Println(node.ServerIdentity, node.ServerIdentity.Public, node.ServerIdentity.ID.String())
-		pubKeysMap[node.ServerIdentity.ID.String()] = node.ServerIdentity.Public
-	}
-
 	vf := func(msg, data []byte) bool {
 		// Simulate verification function by sleeping
 		b, _ := json.Marshal(msg)
 		m := time.Duration(len(b) / (500 * 1024))  //verification of 150ms per 500KB simulated
 		waitTime := 150 * time.Millisecond * m
 		log.Lvl3("Verifying for", waitTime)
-		time.Sleep(waitTime)  
+		time.Sleep(waitTime)
 
-		return true 
+		return true
+	}
+	// a replica restarted after a crash finds the log of its round
+	path := filepath.Join(WALDir, fmt.Sprintf("%s-%s.wal", n.ServerIdentity().ID, n.Token().RoundID))
+	wal, err := NewFileWAL(path, n.Suite())
+	if err != nil {
+		return nil, err
+	}
+	return NewPbftProtocol(n, vf, NewHashChain(), wal)
+}
+
+// NewPbftProtocol returns a replica executing the committed requests on the
+// given state machine, once they passed the verification function. The
+// replica records its decisions in the write-ahead log, and replays it when
+// it starts.
+func NewPbftProtocol(n *onet.TreeNodeInstance, vf VerificationFn, sm StateMachine, wal WAL) (*PbftProtocol, error) {
+
+	pubKeysMap := make(map[string]kyber.Point)
+	for _, node := range n.Tree().List() {
+		//fmt.Println(node.ServerIdentity, node.ServerIdentity.Public, node.ServerIdentity.ID.String())
+		pubKeysMap[node.ServerIdentity.ID.String()] = node.ServerIdentity.Public
+	}
+
+	replicas := n.Tree().List()
+	sort.Slice(replicas, func(i, j int) bool {
+		return replicas[i].RosterIndex < replicas[j].RosterIndex
+	})
+	members := make([]string, len(replicas))
+	for i, r := range replicas {
+		members[i] = r.ServerIdentity.ID.String()
 	}
 
 	t := &PbftProtocol{
 		TreeNodeInstance: 	n,
 		nNodes: 			n.Tree().Size(),
 		startChan:       	make(chan bool, 1),
+		submitChan:			make(chan *Request),
+		clientChan:			make(chan clientRequest),
+		stopChan:			make(chan bool),
+		doneChan:			make(chan bool),
 		FinalReply:   		make(chan []byte, 1),
 		PubKeysMap:			pubKeysMap,
+		sessionKeys:		make(map[string][]byte),
 		Data:            	make([]byte, 0),
 		verificationFn:		vf,
+		stateMachine:		sm,
+		wal:				wal,
+		Timeout:			defaultTimeout,
+		BatchSize:			defaultBatchSize,
+		BatchTimeout:		defaultBatchTimeout,
+		replicas:			replicas,
+		config:				Configuration{Members: members},
+		configs:			make(map[int]*Configuration),
+		viewChanges:		make(map[int]map[string]*ViewChange),
+		sentNewView:		make(map[int]bool),
+		requests:			make(map[string]*Request),
+		outstanding:		make(map[string]bool),
+		executed:			make(map[string]bool),
+		verified:			make(map[string]bool),
+		verifying:			make(map[string]bool),
+		verifyChan:			make(chan verification, 1),
+		waiters:			make(map[string][]chan *Reply),
+		lastTimestamp:		make(map[string]int64),
+		lastReply:			make(map[string]*Reply),
+		nextSeq:			1,
+		assigned:			make(map[string]bool),
+		proposedAt:			make(map[int]time.Time),
+		batches:			make(map[string][]string),
+		log:				make(map[entryID]*entry),
+		prepared:			make(map[int]*PreparedCert),
+		committed:			make(map[int][]byte),
+		commitCerts:		make(map[int]*QuorumCert),
+		checkpoints:		make(map[int]map[string]*Checkpoint),
+		snapshots:			make(map[int][]byte),
+		transfer:			make(map[string]*StateReply),
+		submitted:			make(map[string]bool),
+		replies:			make(map[string]map[string]*Reply),
 	}
 
 	for _, channel := range []interface{}{
+		&t.ChannelRequest,
 		&t.ChannelPrePrepare,
 		&t.ChannelPrepare,
 		&t.ChannelCommit,
 		&t.ChannelReply,
+		&t.ChannelCheckpoint,
+		&t.ChannelViewChange,
+		&t.ChannelNewView,
+		&t.ChannelAggregate,
+		&t.ChannelStateRequest,
+		&t.ChannelStateReply,
+		&t.ChannelStop,
 	} {
 		err := t.RegisterChannel(channel)
 		if err != nil {
@@ -100,212 +363,925 @@ func NewProtocol(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
 	return t, nil
 }
 
-// Start sends the Announce-message to all children
+// Start is done only by the root and starts the protocol.
 func (pbft *PbftProtocol) Start() error {
-	// TODO verify args not null
+	if err := CheckTimeout(pbft.Timeout); err != nil {
+		close(pbft.startChan)
+		return err
+	}
 
 	log.Lvl3("Starting PbftProtocol")
-	
+	pbft.startChan <- true
 	return nil
 }
 
-func (pbft *PbftProtocol) Dispatch() error {
+// Submit sends a request to the replicas. It can only be called on the root,
+// after Start.
+func (pbft *PbftProtocol) Submit(msg []byte) error {
+	if msg == nil {
+		return errors.New("cannot submit an empty request")
+	}
+	select {
+	case pbft.submitChan <- &Request{Msg: msg}:
+		return nil
+	case <-pbft.doneChan:
+		return errors.New("protocol is stopped")
+	}
+}
 
-	log.Lvl3(pbft.ServerIdentity(), "Started node")
+// Stop stops the root and all the replicas. It can only be called on the
+// root.
+func (pbft *PbftProtocol) Stop() {
+	pbft.stopOnce.Do(func() {
+		close(pbft.stopChan)
+	})
+}
 
-	nRepliesThreshold := int(math.Ceil(float64(pbft.nNodes - 1 ) * (float64(2)/float64(3)))) + 1
-	nRepliesThreshold = min(nRepliesThreshold, pbft.nNodes - 1)
+// RegisterOnResult registers a callback called on the root every time a
+// request submitted by it got f+1 matching replies, including the ones of
+// the requests rejected because a newer one of the root was executed first.
+func (pbft *PbftProtocol) RegisterOnResult(fn func(*Result)) {
+	pbft.onResult = fn
+}
 
-	// Verification of the data
-	verifyChan := make(chan bool, 1)
+func (pbft *PbftProtocol) Dispatch() error {
+	defer pbft.Done()
+	defer close(pbft.doneChan)
+	defer pbft.recordMeasures()
+	defer pbft.closeWAL()
 
-	var futureDigest []byte
-	if pbft.IsRoot() {
+	log.Lvl3(pbft.ServerIdentity(), "Started node")
+	if err := pbft.replay(); err != nil {
+		return err
+	}
 
-		// send pre-prepare phase
-		digest := sha512.Sum512(pbft.Msg) // TODO digest is correct?
+	if pbft.IsRoot() {
+		select {
+		case _, ok := <-pbft.startChan:
+			if !ok {
+				log.Lvl1("protocol finished prematurely")
+				return nil
+			}
+		case <-time.After(time.Second):
+			return fmt.Errorf("timeout, did you forget to call Start?")
+		}
+		if pbft.Msg != nil {
+			if err := pbft.submit(&Request{Msg: pbft.Msg}); err != nil {
+				return err
+			}
+		} else if err := pbft.sendCheckpoint(0); err != nil {
+			// the genesis checkpoint makes every node start its replica,
+			// so that clients can reach any of them
+			return err
+		}
+	}
 
-		sig, err := schnorr.Sign(pbft.Suite(), pbft.Private(), pbft.Msg)
+	for {
+		var err error
+		select {
+		case req := <-pbft.submitChan:
+			err = pbft.submit(req)
+		case cr := <-pbft.clientChan:
+			err = pbft.handleClientRequest(cr)
+		case <-pbft.stopChan:
+			pbft.stop()
+			pbft.discardWAL()
+			return nil
+		case msg, channelOpen := <-pbft.ChannelStop:
+			if !channelOpen {
+				return nil
+			}
+			if msg.TreeNode.ID.Equal(pbft.Root().ID) {
+				log.Lvl3(pbft.ServerIdentity(), "stopped by the client")
+				pbft.discardWAL()
+				return nil
+			}
+		case msg, channelOpen := <-pbft.ChannelRequest:
+			if !channelOpen {
+				return nil
+			}
+			if pbft.authentic(msg.TreeNode, msg.Sender) {
+				if msg.Request.Client != nil && msg.Request.Client.Equal(pbft.Root().ServerIdentity.Public) {
+					pbft.adoptTimeout(msg.TreeNode, msg.Request.Timeout)
+				}
+				err = pbft.handleRequest(&msg.Request)
+			}
+		case msg, channelOpen := <-pbft.ChannelPrePrepare:
+			if !channelOpen {
+				return nil
+			}
+			if pbft.authentic(msg.TreeNode, msg.Sender) {
+				pbft.adoptTimeout(msg.TreeNode, msg.PrePrepare.Timeout)
+				err = pbft.handlePrePrepare(&msg.PrePrepare)
+			}
+		case msg, channelOpen := <-pbft.ChannelPrepare:
+			if !channelOpen {
+				return nil
+			}
+			if pbft.authentic(msg.TreeNode, msg.Sender) {
+				err = pbft.handlePrepare(&msg.Prepare)
+			}
+		case msg, channelOpen := <-pbft.ChannelCommit:
+			if !channelOpen {
+				return nil
+			}
+			if pbft.authentic(msg.TreeNode, msg.Sender) {
+				err = pbft.handleCommit(&msg.Commit)
+			}
+		case msg, channelOpen := <-pbft.ChannelReply:
+			if !channelOpen {
+				return nil
+			}
+			if pbft.authentic(msg.TreeNode, msg.Sender) {
+				pbft.handleReply(&msg.Reply)
+			}
+		case msg, channelOpen := <-pbft.ChannelCheckpoint:
+			if !channelOpen {
+				return nil
+			}
+			if pbft.authentic(msg.TreeNode, msg.Sender) {
+				err = pbft.handleCheckpoint(&msg.Checkpoint)
+			}
+		case msg, channelOpen := <-pbft.ChannelViewChange:
+			if !channelOpen {
+				return nil
+			}
+			if pbft.authentic(msg.TreeNode, msg.Sender) {
+				err = pbft.handleViewChange(&msg.ViewChange)
+			}
+		case msg, channelOpen := <-pbft.ChannelNewView:
+			if !channelOpen {
+				return nil
+			}
+			if pbft.authentic(msg.TreeNode, msg.Sender) {
+				err = pbft.handleNewView(&msg.NewView)
+			}
+		case msg, channelOpen := <-pbft.ChannelAggregate:
+			if !channelOpen {
+				return nil
+			}
+			err = pbft.handleAggregate(&msg.AggregateCert)
+		case msg, channelOpen := <-pbft.ChannelStateRequest:
+			if !channelOpen {
+				return nil
+			}
+			if pbft.authentic(msg.TreeNode, msg.Sender) {
+				pbft.handleStateRequest(msg.TreeNode, &msg.StateRequest)
+			}
+		case msg, channelOpen := <-pbft.ChannelStateReply:
+			if !channelOpen {
+				return nil
+			}
+			if pbft.authentic(msg.TreeNode, msg.Sender) {
+				err = pbft.handleStateReply(&msg.StateReply)
+			}
+		case v := <-pbft.verifyChan:
+			err = pbft.handleVerification(v)
+		case <-pbft.batchTimer:
+			pbft.batchTimer = nil
+			pbft.batchDue = true
+			if pbft.isPrimary(pbft.view) && !pbft.viewChanging {
+				err = pbft.proposePending()
+			}
+		case <-pbft.viewTimer:
+			log.Lvl2(pbft.ServerIdentity(), "timed out in view", pbft.view, "starting a view change")
+			pbft.viewTimer = nil
+			err = pbft.startViewChange(pbft.view + 1)
+		}
 		if err != nil {
 			return err
 		}
 
+		// in single request mode, the root stops everybody once the
+		// request has been answered
+		if pbft.IsRoot() && pbft.Msg != nil && len(pbft.FinalReply) > 0 {
+			pbft.stop()
+			pbft.discardWAL()
+			return nil
+		}
+	}
+}
+
+// stop makes every replica stop its protocol.
+func (pbft *PbftProtocol) stop() {
+	if errs := pbft.broadcast(&Stop{}); len(errs) > 0 {
+		log.Lvl3(pbft.ServerIdentity(), "failed to stop all replicas")
+	}
+}
+
+// submit is run by the client to send a request to the replicas. If the
+// client is itself the primary, the request is directly ordered and the
+// backups learn about it through the pre-prepare.
+func (pbft *PbftProtocol) submit(req *Request) error {
+	// timestamps of a client must increase
+	timestamp := time.Now().UnixNano()
+	if timestamp <= pbft.timestamp {
+		timestamp = pbft.timestamp + 1
+	}
+	pbft.timestamp = timestamp
+
+	req.Timestamp = timestamp
+	req.Client = pbft.Public()
+	req.Timeout = pbft.Timeout
+	req.Sender = pbft.id()
+	var err error
+	req.Sig, err = pbft.sign(req.Digest())
+	if err != nil {
+		return err
+	}
+	d := string(req.Digest())
+	pbft.submitted[d] = true
+	if pbft.Msg != nil && pbft.msgDigest == "" {
+		pbft.msgDigest = d
+	}
+
+	if !pbft.isPrimary(pbft.view) || pbft.viewChanging {
+		previous, sent := pbft.sent, make(chan bool)
+		pbft.sent = sent
 		go func() {
-			if errs := pbft.SendToChildrenInParallel(&PrePrepare{Msg:pbft.Msg, Digest:digest[:], Sig:sig, Sender:pbft.ServerIdentity().ID.String()}); len(errs) > 0 {
-				log.Lvl3(pbft.ServerIdentity(), "failed to send pre-prepare to all children")
+			defer close(sent)
+			if previous != nil {
+				<-previous
+			}
+			if errs := pbft.broadcast(req); len(errs) > 0 {
+				log.Lvl3(pbft.ServerIdentity(), "failed to send request to all replicas")
 			}
 		}()
+	}
+	return pbft.handleRequest(req)
+}
 
-		futureDigest = digest[:]
+// handleRequest stores the request of the client. The primary orders it,
+// while the backups start the view timer so that a silent primary is
+// eventually replaced.
+func (pbft *PbftProtocol) handleRequest(req *Request) error {
+	if req.Client == nil {
+		log.Lvl2(pbft.ServerIdentity(), "received request without client")
+		return nil
+	}
+	d := string(req.Digest())
+	if pbft.executed[d] || req.Timestamp <= pbft.lastTimestamp[req.Client.String()] {
+		return nil
+	}
+	if pbft.requests[d] == nil {
+		if err := pbft.verifyRequest(req); err != nil {
+			log.Lvl2(pbft.ServerIdentity(), "received request with invalid signature:", err)
+			return nil
+		}
+		pbft.requests[d] = req
+	}
 
-	} else {
-		// wait for pre-prepare message from leader
-		log.Lvl3(pbft.ServerIdentity(), "Waiting for preprepare")
-		preprepare, channelOpen := <-pbft.ChannelPrePrepare
-		if !channelOpen {
+	if pbft.isPrimary(pbft.view) && !pbft.viewChanging {
+		if !pbft.assigned[d] {
+			pbft.assigned[d] = true
+			pbft.pending = append(pbft.pending, d)
+		}
+		return pbft.proposePending()
+	}
+	pbft.outstanding[d] = true
+	pbft.startViewTimer()
+	return nil
+}
+
+// proposePending groups the pending requests in batches and assigns them
+// sequence numbers, as long as they are below the high watermark. A batch
+// that isn't full waits for more requests until the batch timer fires.
+func (pbft *PbftProtocol) proposePending() error {
+	pbft.sortPending()
+	for len(pbft.pending) > 0 && pbft.nextSeq <= pbft.highWatermark() {
+		if len(pbft.pending) < pbft.BatchSize && !pbft.batchDue {
+			if pbft.batchTimer == nil {
+				pbft.batchTimer = time.After(pbft.BatchTimeout)
+			}
 			return nil
 		}
-		log.Lvl3(pbft.ServerIdentity(), "Received PrePrepare. Verifying...")
-		go func() {
-			verifyChan <- pbft.verificationFn(preprepare.Msg, pbft.Data)
-		}()
+		var batch []Request
+		for len(pbft.pending) > 0 && len(batch) < pbft.BatchSize {
+			d := pbft.pending[0]
+			pbft.pending = pbft.pending[1:]
+			if !pbft.executed[d] {
+				batch = append(batch, *pbft.requests[d])
+			}
+		}
+		pbft.batchDue = false
+		pbft.batchTimer = nil
+		if len(batch) == 0 {
+			continue
+		}
+		if err := pbft.propose(pbft.nextSeq, batch); err != nil {
+			return err
+		}
+		pbft.nextSeq++
+	}
 
-		// Verify the signature for authentication
-		err := schnorr.Verify(pbft.Suite(), pbft.PubKeysMap[preprepare.Sender], preprepare.Msg, preprepare.Sig)
-		if err != nil {
+	// a pending reconfiguration switches at a checkpoint, which is only
+	// reached if the slots up to it are filled with null requests
+	for pbft.config.Next != nil && len(pbft.pending) == 0 && pbft.nextSeq <= pbft.highWatermark() {
+		seq := pbft.nextSeq
+		pbft.nextSeq++
+		if err := pbft.propose(seq, nil); err != nil {
 			return err
 		}
+	}
+	return nil
+}
 
-		// verify message digest
-		digest := sha512.Sum512(preprepare.Msg)
-		if !bytes.Equal(digest[:], preprepare.Digest) {
-			log.Lvl3(pbft.ServerIdentity(), "received pre-prepare digest is not correct")
+// sortPending orders the pending requests by client and timestamp, so that the
+// requests pipelined by a client are executed in the order it sent them, even
+// if they reached the primary out of order.
+func (pbft *PbftProtocol) sortPending() {
+	sort.SliceStable(pbft.pending, func(i, j int) bool {
+		a, b := pbft.requests[pbft.pending[i]], pbft.requests[pbft.pending[j]]
+		if ca, cb := a.Client.String(), b.Client.String(); ca != cb {
+			return ca < cb
 		}
+		return a.Timestamp < b.Timestamp
+	})
+}
 
-		futureDigest = preprepare.Digest
+// propose makes the primary order the given batch of requests with the given
+// sequence number in the current view.
+func (pbft *PbftProtocol) propose(seq int, batch []Request) error {
+	pp, err := pbft.newPrePrepare(pbft.view, seq, batch)
+	if err != nil {
+		return err
+	}
+	pbft.proposedAt[seq] = time.Now()
+	// a primary restarted after a crash must not assign the sequence
+	// number to another request
+	if err := pbft.persistPrePrepare(pp); err != nil {
+		return err
+	}
 
-		ok := <-verifyChan
-		if !ok {
-			return fmt.Errorf("verification failed on node")
+	go func() {
+		if errs := pbft.broadcast(pp); len(errs) > 0 {
+			log.Lvl3(pbft.ServerIdentity(), "failed to send pre-prepare to all replicas")
 		}
-	}
+	}()
+
+	return pbft.acceptPrePrepare(pp)
+}
 
-	// Sign message and broadcast
-	signedDigest, err := schnorr.Sign(pbft.Suite(), pbft.Private(), futureDigest)
+// newPrePrepare returns a signed pre-prepare of the given batch, or of a null
+// request if the batch is empty.
+func (pbft *PbftProtocol) newPrePrepare(view, seq int, batch []Request) (*PrePrepare, error) {
+	pp := &PrePrepare{
+		View: view,
+		Seq: seq,
+		Requests: batch,
+		Digest: batchDigest(batch),
+		Timeout: pbft.Timeout,
+		Sender: pbft.id(),
+	}
+	var err error
+	pp.Sig, err = pbft.sign(payload("preprepare", pp.View, pp.Seq, pp.Digest))
 	if err != nil {
+		return nil, err
+	}
+	return pp, nil
+}
+
+// handlePrePrepare checks a pre-prepare of the primary of the current view
+// and starts the verification of the request.
+func (pbft *PbftProtocol) handlePrePrepare(pp *PrePrepare) error {
+	if pp.View != pbft.view || pbft.viewChanging || !pbft.inWindow(pp.Seq) {
+		log.Lvl3(pbft.ServerIdentity(), "ignoring pre-prepare for view", pp.View, "and sequence number", pp.Seq)
+		return nil
+	}
+	if e := pbft.entry(pp.View, pp.Seq); e.prePrepare != nil {
+		if !bytes.Equal(e.prePrepare.Digest, pp.Digest) {
+			log.Lvl2(pbft.ServerIdentity(), "primary sent conflicting pre-prepares for sequence number", pp.Seq)
+		}
+		return nil
+	}
+	if err := pbft.verifyPrePrepare(pp); err != nil {
+		log.Lvl2(pbft.ServerIdentity(), "received invalid pre-prepare:", err)
+		return nil
+	}
+	return pbft.acceptPrePrepare(pp)
+}
+
+// acceptPrePrepare stores a valid pre-prepare in the log and sends the
+// prepare once the requests of its batch have been verified.
+func (pbft *PbftProtocol) acceptPrePrepare(pp *PrePrepare) error {
+	if err := pbft.persistPrePrepare(pp); err != nil {
 		return err
 	}
-	
-	// broadcast Prepare message to all nodes
-	if errs := pbft.Broadcast(&Prepare{Digest:futureDigest, Sig:signedDigest, Sender:pbft.ServerIdentity().ID.String()}); len(errs) > 0 {
-		log.Lvl3(pbft.ServerIdentity(), "error while broadcasting prepare message")
+	d := string(pp.Digest)
+	pbft.addBatch(pp.Digest, pp.Requests)
+
+	// the primary doesn't verify its own proposals, and null requests
+	// don't need to be verified
+	if pbft.isPrimary(pp.View) || len(pp.Requests) == 0 {
+		pbft.verified[d] = true
+	} else {
+		for _, rd := range pbft.batches[d] {
+			if !pbft.executed[rd] {
+				pbft.outstanding[rd] = true
+			}
+		}
+		pbft.startViewTimer()
+	}
+	if pbft.verified[d] {
+		return pbft.sendPrepare(pp.View, pp.Seq)
+	}
+	if pbft.verifying[d] {
+		return nil
 	}
 
-	t := time.After(defaultTimeout * 2)
-	nReceivedPrepareMessages := 0
-	
-loop:
-	for  i := 0; i <= nRepliesThreshold - 1; i++  {
-		select {
-		case prepare, channelOpen := <-pbft.ChannelPrepare:
-			if !channelOpen {
-				return nil
+	log.Lvl3(pbft.ServerIdentity(), "Received PrePrepare. Verifying...")
+	pbft.verifying[d] = true
+	go func(batch []Request) {
+		v := verification{digest: d, ok: true}
+		for i := range batch {
+			if !pbft.verificationFn(batch[i].Msg, pbft.Data) {
+				v.ok = false
+				break
 			}
-			// Verify the signature for authentication
-			err := schnorr.Verify(pbft.Suite(), pbft.PubKeysMap[prepare.Sender], prepare.Digest, prepare.Sig)
-			if err != nil {
+		}
+		select {
+		case pbft.verifyChan <- v:
+		case <-pbft.doneChan:
+		}
+	}(pp.Requests)
+	return nil
+}
+
+// addBatch stores the requests of a batch, and the digests of the requests
+// under the digest of the batch.
+func (pbft *PbftProtocol) addBatch(digest []byte, batch []Request) {
+	if _, ok := pbft.batches[string(digest)]; ok {
+		return
+	}
+	digests := make([]string, len(batch))
+	for i := range batch {
+		d := string(batch[i].Digest())
+		digests[i] = d
+		if pbft.requests[d] == nil {
+			req := batch[i]
+			pbft.requests[d] = &req
+		}
+	}
+	pbft.batches[string(digest)] = digests
+}
+
+// handleVerification sends the prepares of the entries waiting on the
+// verification of the request.
+func (pbft *PbftProtocol) handleVerification(v verification) error {
+	delete(pbft.verifying, v.digest)
+	if !v.ok {
+		// don't prepare it: if the primary insists, it will be replaced
+		log.Lvl1(pbft.ServerIdentity(), "verification failed on node")
+		return nil
+	}
+	pbft.verified[v.digest] = true
+	if pbft.viewChanging {
+		return nil
+	}
+	for id, e := range pbft.log {
+		if id.view == pbft.view && e.prePrepare != nil && string(e.prePrepare.Digest) == v.digest {
+			if err := pbft.sendPrepare(id.view, id.seq); err != nil {
 				return err
 			}
+		}
+	}
+	return nil
+}
 
-			nReceivedPrepareMessages++
-		case <-t:
-			// TODO
-			break loop
-		}	
+// sendPrepare signs and broadcasts the prepare for the pre-prepare of the
+// given slot.
+func (pbft *PbftProtocol) sendPrepare(view, seq int) error {
+	e := pbft.entry(view, seq)
+	// a replica removed by a reconfiguration doesn't vote anymore
+	if e.sentPrepare || !pbft.isMember() {
+		return nil
 	}
+	digest := e.prePrepare.Digest
+	if err := pbft.persist(&Record{Type: recordPrepare, View: view, Seq: seq, Digest: digest}); err != nil {
+		return err
+	}
+	e.sentPrepare = true
 
-	if !(nReceivedPrepareMessages >= nRepliesThreshold) {
-		errors.New("node didn't receive enough prepare messages. Stopping.")
-	} else {
-		log.Lvl1(pbft.ServerIdentity(), "Received enough prepare messages (> 2/3 + 1):", nReceivedPrepareMessages, "/", pbft.nNodes)
+	if pbft.Linear {
+		return pbft.sendLinearPrepare(view, seq, digest)
+	}
+	sig, err := pbft.sign(payload("prepare", view, seq, digest))
+	if err != nil {
+		return err
 	}
+	prepare := &Prepare{View: view, Seq: seq, Digest: digest, Sig: sig, Sender: pbft.id()}
 
-	//digest := sha512.Sum512(pbft.Msg)
+	// broadcast Prepare message to all nodes
+	if errs := pbft.broadcast(prepare); len(errs) > 0 {
+		log.Lvl3(pbft.ServerIdentity(), "error while broadcasting prepare message")
+	}
+	return pbft.handlePrepare(prepare)
+}
 
-	// Sign message and broadcast
-	signedDigest2, err := schnorr.Sign(pbft.Suite(), pbft.Private(), futureDigest)
+func (pbft *PbftProtocol) handlePrepare(prepare *Prepare) error {
+	if prepare.View < pbft.view || !pbft.inWindow(prepare.Seq) {
+		return nil
+	}
+	if pbft.Linear {
+		return pbft.handleLinearPrepare(prepare)
+	}
+	// Verify the signature for authentication
+	err := pbft.verifySig(prepare.Sender, payload("prepare", prepare.View, prepare.Seq, prepare.Digest), prepare.Sig)
+	if err != nil {
+		log.Lvl2(pbft.ServerIdentity(), "received prepare with invalid signature:", err)
+		return nil
+	}
+	pbft.entry(prepare.View, prepare.Seq).prepares[prepare.Sender] = prepare
+	return pbft.checkPrepared(prepare.View, prepare.Seq)
+}
+
+// checkPrepared broadcasts the commit once a quorum of replicas prepared the
+// pre-prepare of the slot.
+func (pbft *PbftProtocol) checkPrepared(view, seq int) error {
+	if pbft.Linear {
+		return pbft.checkLinearPrepared(view, seq)
+	}
+	e := pbft.entry(view, seq)
+	if e.prePrepare == nil || view != pbft.view || pbft.viewChanging || e.sentCommit || !e.sentPrepare {
+		return nil
+	}
+
+	sigs := make(map[string][]byte)
+	for sender, prepare := range e.prepares {
+		if bytes.Equal(prepare.Digest, e.prePrepare.Digest) {
+			sigs[sender] = prepare.Sig
+		}
+	}
+	cert := pbft.quorumCert("prepare", view, seq, e.prePrepare.Digest, sigs)
+	if cert == nil {
+		return nil
+	}
+	log.Lvl2(pbft.ServerIdentity(), "Received enough prepare messages for", seq, ":", len(cert.Sigs), "/", pbft.nNodes)
+
+	prepared := &PreparedCert{PrePrepare: *e.prePrepare, Prepares: *cert}
+	if err := pbft.persist(&Record{Type: recordCommit, View: view, Seq: seq, Prepared: prepared}); err != nil {
+		return err
+	}
+	pbft.prepared[seq] = prepared
+	e.sentCommit = true
+
+	commit := &Commit{View: view, Seq: seq, Digest: e.prePrepare.Digest, Sender: pbft.id()}
+	var err error
+	if pbft.MACs {
+		commit.Auth, err = pbft.authenticator(payload("commit", view, seq, commit.Digest))
+	} else {
+		commit.Sig, err = pbft.sign(payload("commit", view, seq, commit.Digest))
+	}
 	if err != nil {
 		return err
 	}
 
 	// Broadcast commit message
-	if errs := pbft.Broadcast(&Commit{Digest:futureDigest, Sender:pbft.ServerIdentity().ID.String(), Sig:signedDigest2}); len(errs) > 0 {
+	if errs := pbft.broadcast(commit); len(errs) > 0 {
 		log.Lvl1(pbft.ServerIdentity(), "error while broadcasting commit message")
 	}
+	return pbft.handleCommit(commit)
+}
 
-	nReceivedCommitMessages := 0
-
-commitLoop:
-	for  i := 0; i <= nRepliesThreshold - 1; i++  {
-		select {
-		case commit, channelOpen := <-pbft.ChannelCommit:
-			if !channelOpen {
-				return nil
-			}
+func (pbft *PbftProtocol) handleCommit(commit *Commit) error {
+	if commit.View < pbft.view || !pbft.inWindow(commit.Seq) {
+		return nil
+	}
+	if pbft.Linear {
+		return pbft.handleLinearCommit(commit)
+	}
+	// Verify the signature or the MAC for authentication
+	var err error
+	if pbft.MACs {
+		err = pbft.verifyAuthenticator(commit.Sender, payload("commit", commit.View, commit.Seq, commit.Digest), commit.Auth)
+	} else {
+		err = pbft.verifySig(commit.Sender, payload("commit", commit.View, commit.Seq, commit.Digest), commit.Sig)
+	}
+	if err != nil {
+		log.Lvl2(pbft.ServerIdentity(), "received commit with invalid authentication:", err)
+		return nil
+	}
+	pbft.entry(commit.View, commit.Seq).commits[commit.Sender] = commit
+	return pbft.checkCommitted(commit.View, commit.Seq)
+}
 
-			// Verify the signature for authentication
-			err := schnorr.Verify(pbft.Suite(), pbft.PubKeysMap[commit.Sender], commit.Digest, commit.Sig)
-			if err != nil {
-				return err
-			}
-			nReceivedCommitMessages++
-		case <-t:
-			// TODO
-			break commitLoop
+// checkCommitted executes the request once a quorum of replicas committed
+// it.
+func (pbft *PbftProtocol) checkCommitted(view, seq int) error {
+	if pbft.Linear {
+		return pbft.checkLinearCommitted(view, seq)
+	}
+	e := pbft.entry(view, seq)
+	if e.committed || !e.sentCommit {
+		return nil
+	}
+	sigs := make(map[string][]byte)
+	for sender, commit := range e.commits {
+		if bytes.Equal(commit.Digest, e.prePrepare.Digest) {
+			sigs[sender] = commit.Sig
 		}
 	}
+	cert := pbft.quorumCert("commit", view, seq, e.prePrepare.Digest, sigs)
+	if cert == nil {
+		return nil
+	}
+	log.Lvl2(pbft.ServerIdentity(), "Received enough commit messages for", seq, ":", len(cert.Sigs), "/", pbft.nNodes)
 
-	if !(nReceivedCommitMessages >= nRepliesThreshold) {
-		log.Lvl1(pbft.ServerIdentity(), "node didn't receive enough commit messages. Stopping.", nReceivedCommitMessages, " / ", nRepliesThreshold)
-		return errors.New("node didn't receive enough commit messages. Stopping.")
-	} else {
-		log.Lvl1(pbft.ServerIdentity(), "Received enough commit messages (> 2/3 + 1):", nReceivedCommitMessages, "/", pbft.nNodes)
+	if err := pbft.persist(&Record{Type: recordCommitted, View: view, Seq: seq, Digest: e.prePrepare.Digest}); err != nil {
+		return err
+	}
+	e.committed = true
+	pbft.committed[seq] = e.prePrepare.Digest
+	// MACs don't make a transferable certificate
+	if pbft.certifiedReplies() {
+		pbft.commitCerts[seq] = cert
 	}
+	return pbft.execute()
+}
 
-	receivedReplies := 0
+// execute runs the committed batches on the state machine, in the order of
+// their sequence numbers, and replies to the clients.
+func (pbft *PbftProtocol) execute() error {
+	for {
+		seq := pbft.lastExecuted + 1
+		digest, ok := pbft.committed[seq]
+		if !ok {
+			break
+		}
+		batch := pbft.batches[string(digest)]
+		digests := make([][]byte, len(batch))
+		for i, d := range batch {
+			digests[i] = []byte(d)
+		}
+		for _, d := range batch {
+			req := pbft.requests[d]
 
-	if pbft.IsRoot() {
-replyLoop:
-		for  i := 0; i <= nRepliesThreshold - 1; i++  {
-			select {
-			case reply, channelOpen := <-pbft.ChannelReply:
-				if !channelOpen {
-					return nil
-				}
+			// requests committed twice are not executed
+			if req == nil || pbft.executed[d] {
+				continue
+			}
+			pbft.executed[d] = true
+			delete(pbft.outstanding, d)
 
-				// Verify the signature for authentication
-				err := schnorr.Verify(pbft.Suite(), pbft.PubKeysMap[reply.Sender], reply.Result, reply.Sig)
+			// nor are requests older than the last one of their client:
+			// they are rejected, so that the client doesn't wait for them
+			client := req.Client.String()
+			if req.Timestamp <= pbft.lastTimestamp[client] {
+				reply, err := pbft.newReply(seq, []byte(d), digests, nil, true, req.Client)
 				if err != nil {
 					return err
 				}
+				pbft.deliver(req, reply)
+				continue
+			}
+			var result []byte
+			if req.Members != nil {
+				result = pbft.reconfigure(seq, req)
+			} else {
+				result = pbft.stateMachine.Execute(seq, req.Msg)
+			}
+			reply, err := pbft.newReply(seq, []byte(d), digests, result, false, req.Client)
+			if err != nil {
+				return err
+			}
+			pbft.lastTimestamp[client] = req.Timestamp
+			pbft.lastReply[client] = reply
+			pbft.deliver(req, reply)
+		}
+		pbft.lastExecuted = seq
+		pbft.measureBatch(seq, len(batch))
 
-				receivedReplies++
-				log.Lvl1("Leader got one reply, total received is now", receivedReplies, "out of", nRepliesThreshold, "needed.")
-				
-			case <-time.After(defaultTimeout * 2):
-				// wait a bit longer than the protocol timeout
-				log.Lvl3("didn't get reply in time")
-				break replyLoop
+		if seq%checkpointInterval == 0 {
+			if err := pbft.sendCheckpoint(seq); err != nil {
+				return err
 			}
 		}
+	}
 
-		pbft.FinalReply <- futureDigest[:]
+	// the primary made progress, give it some more time
+	if !pbft.viewChanging {
+		pbft.viewTimer = nil
+		pbft.startViewTimer()
+	}
+	if pbft.config.Next != nil && pbft.isPrimary(pbft.view) && !pbft.viewChanging && !pbft.replaying {
+		return pbft.proposePending()
+	}
+	return nil
+}
 
+// newReply returns the authenticated reply to the client of an executed or a
+// rejected request, given the digests of the requests of its batch.
+func (pbft *PbftProtocol) newReply(seq int, digest []byte, batch [][]byte, result []byte, rejected bool, client kyber.Point) (*Reply, error) {
+	reply := &Reply{View: pbft.view, Seq: seq, Digest: digest, Result: result, Rejected: rejected, Batch: batch, Sender: pbft.id()}
+	if cert, ok := pbft.commitCerts[seq]; ok {
+		reply.Cert = *cert
+	}
+	msg := reply.payload()
+	if !pbft.MACs {
+		var err error
+		reply.Sig, err = pbft.sign(msg)
+		return reply, err
+	}
+	defer pbft.measureAuthentication(time.Now())
+	key, err := pbft.sessionKey(client)
+	if err != nil {
+		return nil, err
+	}
+	reply.MAC = mac(key, msg)
+	return reply, nil
+}
+
+// handleReply is run by the client to collect the replies of the replicas.
+func (pbft *PbftProtocol) handleReply(reply *Reply) {
+	d := string(reply.Digest)
+	if !pbft.submitted[d] {
+		return
+	}
+	// Verify the signature or the MAC for authentication
+	var err error
+	if pbft.MACs {
+		err = pbft.verifyMAC(reply.Sender, reply.payload(), reply.MAC)
 	} else {
-		err := pbft.SendToParent(&Reply{Result:futureDigest, Sender:pbft.ServerIdentity().ID.String(), Sig:signedDigest})
-		if err != nil {
-			return err
+		err = pbft.verifySig(reply.Sender, reply.payload(), reply.Sig)
+	}
+	if err != nil {
+		log.Lvl2(pbft.ServerIdentity(), "received reply with invalid authentication:", err)
+		return
+	}
+	if !pbft.certifiedReplies() {
+		// there is no commit certificate to check
+	} else if err := reply.Cert.Matches("commit", reply.Cert.View, reply.Seq, hashDigests(reply.Batch)); err != nil {
+		log.Lvl2(pbft.ServerIdentity(), "received reply with invalid commit certificate:", err)
+		return
+	} else if !inBatch(reply.Digest, reply.Batch) {
+		log.Lvl2(pbft.ServerIdentity(), "received reply for a request outside of the batch")
+		return
+	}
+	if pbft.replies[d] == nil {
+		pbft.replies[d] = make(map[string]*Reply)
+	}
+	pbft.replies[d][reply.Sender] = reply
+	log.Lvl3("Leader got one reply, total received is now", len(pbft.replies[d]))
+
+	n := 0
+	for _, r := range pbft.replies[d] {
+		if r.matches(reply) {
+			n++
 		}
 	}
+	if n < pbft.faulty()+1 {
+		return
+	}
+
+	log.Lvl2("Leader got enough replies for request", reply.Seq)
+	// at least one of the replies comes from a correct replica, whose
+	// certificate is valid
+	var cert *QuorumCert
+	for _, r := range pbft.replies[d] {
+		if !pbft.certifiedReplies() {
+			break
+		}
+		if r.matches(reply) && r.Cert.Verify(pbft.Suite(), pbft.membersRoster()) == nil {
+			cert = &r.Cert
+			break
+		}
+	}
+	delete(pbft.submitted, d)
+	delete(pbft.replies, d)
+	if pbft.onResult != nil {
+		pbft.onResult(&Result{Seq: reply.Seq, Digest: reply.Digest, Result: reply.Result, Rejected: reply.Rejected, Batch: reply.Batch, Cert: cert})
+	}
+	if pbft.Msg != nil && d == pbft.msgDigest {
+		digest := sha512.Sum512(pbft.Msg)
+		pbft.FinalReply <- digest[:]
+	}
+}
+
+// adoptTimeout makes the replica use the timeout of the root, sent along its
+// own requests and pre-prepares. The root is configured by its server, while
+// the timeouts of the clients and of the other replicas are ignored, as well
+// as the ones out of bounds.
+func (pbft *PbftProtocol) adoptTimeout(from *onet.TreeNode, timeout time.Duration) {
+	if from.ID.Equal(pbft.Root().ID) && CheckTimeout(timeout) == nil {
+		pbft.Timeout = timeout
+	}
+}
 
+// CheckTimeout returns an error if the timeout is out of the bounds
+// MinTimeout and MaxTimeout.
+func CheckTimeout(timeout time.Duration) error {
+	if timeout < MinTimeout || timeout > MaxTimeout {
+		return fmt.Errorf("timeout %s out of bounds [%s, %s]", timeout, MinTimeout, MaxTimeout)
+	}
 	return nil
 }
 
+// startViewTimer starts the timer after which the primary is suspected to be
+// faulty, unless it is already running or no request is waiting.
+func (pbft *PbftProtocol) startViewTimer() {
+	if pbft.viewTimer != nil || len(pbft.outstanding) == 0 || !pbft.isMember() {
+		return
+	}
+	if pbft.viewTimeout == 0 {
+		pbft.viewTimeout = pbft.Timeout
+	}
+	pbft.viewTimer = time.After(pbft.viewTimeout)
+}
+
 // Shutdown stops the protocol
 func (pbft *PbftProtocol) Shutdown() error {
 	pbft.stoppedOnce.Do(func() {
+		close(pbft.ChannelRequest)
 		close(pbft.ChannelPrePrepare)
 		close(pbft.ChannelPrepare)
 		close(pbft.ChannelCommit)
 		close(pbft.ChannelReply)
+		close(pbft.ChannelCheckpoint)
+		close(pbft.ChannelViewChange)
+		close(pbft.ChannelNewView)
+		close(pbft.ChannelAggregate)
+		close(pbft.ChannelStateRequest)
+		close(pbft.ChannelStateReply)
+		close(pbft.ChannelStop)
 	})
 	return nil
 }
 
+// entry returns the slot of the log for the given view and sequence number,
+// creating it if needed.
+func (pbft *PbftProtocol) entry(view, seq int) *entry {
+	id := entryID{view, seq}
+	e, ok := pbft.log[id]
+	if !ok {
+		e = &entry{
+			prepares: make(map[string]*Prepare),
+			commits: make(map[string]*Commit),
+		}
+		pbft.log[id] = e
+	}
+	return e
+}
+
+// inWindow returns whether the sequence number is between the low and high
+// watermarks.
+func (pbft *PbftProtocol) inWindow(seq int) bool {
+	return seq > pbft.stableSeq && seq <= pbft.highWatermark()
+}
+
+// id returns the identifier used as Sender in the messages of this node.
+func (pbft *PbftProtocol) id() string {
+	return pbft.ServerIdentity().ID.String()
+}
+
+// primary returns the primary replica of the given view.
+func (pbft *PbftProtocol) primary(view int) *onet.TreeNode {
+	return pbft.replicas[view%len(pbft.replicas)]
+}
+
+func (pbft *PbftProtocol) isPrimary(view int) bool {
+	return pbft.primary(view).ServerIdentity.ID.Equal(pbft.ServerIdentity().ID)
+}
+
+// certifiedReplies returns whether the replies carry a transferable commit
+// certificate.
+func (pbft *PbftProtocol) certifiedReplies() bool {
+	return !pbft.MACs && !pbft.Linear
+}
 
-func min(a, b int) int {
-    if a < b {
-        return a
-    }
-    return b
-}
\ No newline at end of file
+// faulty returns the number of faulty replicas tolerated.
+func (pbft *PbftProtocol) faulty() int {
+	return (len(pbft.replicas) - 1) / 3
+}
+
+// quorum returns the number of matching messages from distinct replicas
+// needed for any two quorums to intersect in at least one correct replica.
+func (pbft *PbftProtocol) quorum() int {
+	return quorumSize(len(pbft.replicas))
+}
+
+// payload returns the bytes signed by a replica for a phase of a slot, so
+// that signatures cannot be replayed in another phase, view or slot.
+func payload(phase string, view, seq int, digest []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(phase)
+	binary.Write(&buf, binary.LittleEndian, int64(view))
+	binary.Write(&buf, binary.LittleEndian, int64(seq))
+	buf.Write(digest)
+	return buf.Bytes()
+}
+
+// payload returns the bytes signed by a replica in a reply.
+func (r *Reply) payload() []byte {
+	h := sha512.New()
+	h.Write(r.Digest)
+	h.Write(r.Result)
+	if r.Rejected {
+		h.Write([]byte("rejected"))
+	}
+	return payload("reply", r.View, r.Seq, h.Sum(nil))
+}
+
+// matches returns whether the replies agree on the outcome of the request.
+func (r *Reply) matches(other *Reply) bool {
+	return r.Seq == other.Seq && r.Rejected == other.Rejected && bytes.Equal(r.Result, other.Result)
+}
@@ -2,12 +2,18 @@ package protocol
 
 
 import (
+	"bytes"
+	"crypto/sha512"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/dedis/onet"
 	"github.com/dedis/onet/log"
 	"github.com/dedis/kyber/group/edwards25519"
+	"github.com/dedis/kyber/pairing/bn256"
+	"github.com/dedis/kyber/util/key"
 )
 
 var tSuite = edwards25519.NewBlakeSHA256Ed25519()
@@ -51,3 +57,394 @@ func TestNode(t *testing.T) {
 	}
 }
 
+
+func TestViewChange(t *testing.T) {
+
+	proposal := []byte("dedis")
+	timeout := 2 * time.Second
+	nodes := []int{4, 7}
+
+	for _, nbrNodes := range nodes {
+		local := onet.NewLocalTest(tSuite)
+		local.Check = onet.CheckNone
+		servers, roster, _ := local.GenTree(nbrNodes, true)
+
+		// the primary of view 0 is the first replica of the roster, the
+		// client is the last one: GenerateNaryTreeWithRoot would move the
+		// client first and make it the primary, so the tree is built here
+		root := onet.NewTreeNode(nbrNodes-1, roster.List[nbrNodes-1])
+		for i := 0; i < nbrNodes-1; i++ {
+			root.AddChild(onet.NewTreeNode(i, roster.List[i]))
+		}
+		tree := onet.NewTree(roster, root)
+		log.Lvl3(tree.Dump())
+
+		pi, err := local.CreateProtocol(DefaultProtocolName, tree)
+		if err != nil {
+			local.CloseAll()
+			t.Fatal("Error in creation of protocol:", err)
+		}
+
+		protocol := pi.(*PbftProtocol)
+		protocol.Msg = proposal
+		protocol.Timeout = timeout
+
+		// kill the primary
+		if !protocol.primary(0).ServerIdentity.ID.Equal(servers[0].ServerIdentity.ID) {
+			local.CloseAll()
+			t.Fatal("the first server isn't the primary of view 0")
+		}
+		if err := servers[0].Close(); err != nil {
+			local.CloseAll()
+			t.Fatal(err)
+		}
+
+		err = protocol.Start()
+		if err != nil {
+			local.CloseAll()
+			t.Fatal(err)
+		}
+
+		select {
+		case finalReply := <-protocol.FinalReply:
+			log.Lvl3("Leader sent final reply")
+			digest := sha512.Sum512(proposal)
+			if !bytes.Equal(finalReply, digest[:]) {
+				local.CloseAll()
+				t.Fatal("committed the wrong request")
+			}
+			// the client is a backup as well, which suspected the primary
+			// before the others since it sent the request first
+			if protocol.view == 0 {
+				local.CloseAll()
+				t.Fatal("committed without a view change")
+			}
+		case <-time.After(timeout * 10):
+			local.CloseAll()
+			t.Fatal("Replicas didn't elect a new primary in time")
+		}
+
+		local.CloseAll()
+	}
+}
+
+
+// counter is a state machine counting the executed requests
+type counter struct {
+	sync.Mutex
+	n int
+}
+
+func (c *counter) Execute(seq int, request []byte) []byte {
+	c.Lock()
+	defer c.Unlock()
+	c.n++
+	return []byte(strconv.Itoa(c.n))
+}
+
+func (c *counter) Snapshot() []byte {
+	c.Lock()
+	defer c.Unlock()
+	return []byte(strconv.Itoa(c.n))
+}
+
+func (c *counter) Restore(snapshot []byte) error {
+	n, err := strconv.Atoi(string(snapshot))
+	if err != nil {
+		return err
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.n = n
+	return nil
+}
+
+const logTestProtocolName = "PBFTLogTest"
+
+func init() {
+	onet.GlobalProtocolRegister(logTestProtocolName, func(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+		vf := func(msg, data []byte) bool { return true }
+		return NewPbftProtocol(n, vf, &counter{}, NewMemoryWAL())
+	})
+}
+
+func TestLog(t *testing.T) {
+
+	timeout := 5 * time.Second
+	nbrRequests := 50
+
+	// make the requests go through a few checkpoints and a full log
+	oldInterval, oldSize := checkpointInterval, logSize
+	checkpointInterval, logSize = 4, 8
+	defer func() {
+		checkpointInterval, logSize = oldInterval, oldSize
+	}()
+
+	local := onet.NewLocalTest(tSuite)
+	defer local.CloseAll()
+	_, _, tree := local.GenTree(4, true)
+
+	pi, err := local.CreateProtocol(logTestProtocolName, tree)
+	if err != nil {
+		t.Fatal("Error in creation of protocol:", err)
+	}
+	protocol := pi.(*PbftProtocol)
+	protocol.Timeout = timeout
+
+	results := make(chan *Result, nbrRequests)
+	protocol.RegisterOnResult(func(r *Result) {
+		results <- r
+	})
+
+	if err := protocol.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer protocol.Stop()
+
+	for i := 0; i < nbrRequests; i++ {
+		if err := protocol.Submit([]byte("request " + strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 1; i <= nbrRequests; i++ {
+		select {
+		case r := <-results:
+			if r.Seq != i {
+				t.Fatal("request executed with sequence number", r.Seq, "instead of", i)
+			}
+			if string(r.Result) != strconv.Itoa(i) {
+				t.Fatal("wrong result for request", i, ":", string(r.Result))
+			}
+			if r.Cert == nil {
+				t.Fatal("no commit certificate for request", i)
+			}
+			if err := r.Cert.Verify(tSuite, tree.Roster); err != nil {
+				t.Fatal("invalid commit certificate:", err)
+			}
+		case <-time.After(timeout):
+			t.Fatal("request", i, "never got enough replies")
+		}
+	}
+
+	// the primary proposed every request, so its stable checkpoint is at
+	// most logSize behind, and it forgot about the requests before it
+	protocol.Stop()
+	<-protocol.doneChan
+	for name, m := range map[string]map[string]bool{
+		"executed": protocol.executed,
+		"verified": protocol.verified,
+		"assigned": protocol.assigned,
+	} {
+		if len(m) > logSize {
+			t.Fatal(len(m), "requests still", name, "with a log of", logSize)
+		}
+	}
+}
+
+func TestBatch(t *testing.T) {
+
+	timeout := 5 * time.Second
+	nbrRequests := 20
+
+	local := onet.NewLocalTest(tSuite)
+	defer local.CloseAll()
+	_, _, tree := local.GenTree(4, true)
+
+	pi, err := local.CreateProtocol(logTestProtocolName, tree)
+	if err != nil {
+		t.Fatal("Error in creation of protocol:", err)
+	}
+	protocol := pi.(*PbftProtocol)
+	protocol.Timeout = timeout
+	protocol.BatchSize = 5
+	protocol.BatchTimeout = time.Second
+
+	results := make(chan *Result, nbrRequests)
+	protocol.RegisterOnResult(func(r *Result) {
+		results <- r
+	})
+
+	if err := protocol.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer protocol.Stop()
+
+	for i := 0; i < nbrRequests; i++ {
+		if err := protocol.Submit([]byte("request " + strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	executed := make(map[string]bool)
+	for i := 1; i <= nbrRequests; i++ {
+		select {
+		case r := <-results:
+			if r.Rejected {
+				t.Fatal("pipelined request rejected as older than another one")
+			}
+			if r.Seq > nbrRequests/protocol.BatchSize {
+				t.Fatal("request executed with sequence number", r.Seq, "in batches of", protocol.BatchSize)
+			}
+			if executed[string(r.Result)] {
+				t.Fatal("two requests got the result", string(r.Result))
+			}
+			executed[string(r.Result)] = true
+			if !inBatch(r.Digest, r.Batch) {
+				t.Fatal("request isn't part of its batch")
+			}
+			if err := r.Cert.Matches("commit", r.Cert.View, r.Seq, hashDigests(r.Batch)); err != nil {
+				t.Fatal(err)
+			}
+			if err := r.Cert.Verify(tSuite, tree.Roster); err != nil {
+				t.Fatal("invalid commit certificate:", err)
+			}
+		case <-time.After(timeout):
+			t.Fatal("request", i, "never got enough replies")
+		}
+	}
+}
+
+func TestSortPending(t *testing.T) {
+	a, b := key.NewKeyPair(tSuite).Public, key.NewKeyPair(tSuite).Public
+	reqs := []*Request{
+		{Client: a, Timestamp: 3},
+		{Client: b, Timestamp: 2},
+		{Client: a, Timestamp: 1},
+		{Client: b, Timestamp: 1},
+		{Client: a, Timestamp: 2},
+	}
+	pbft := &PbftProtocol{requests: make(map[string]*Request)}
+	for _, req := range reqs {
+		d := string(req.Digest())
+		pbft.requests[d] = req
+		pbft.pending = append(pbft.pending, d)
+	}
+	pbft.sortPending()
+
+	// the requests of each client are in the order of their timestamps
+	last := make(map[string]int64)
+	for _, d := range pbft.pending {
+		req := pbft.requests[d]
+		if req.Timestamp <= last[req.Client.String()] {
+			t.Fatal("request of timestamp", req.Timestamp, "after the one of", last[req.Client.String()])
+		}
+		last[req.Client.String()] = req.Timestamp
+	}
+}
+
+func TestMACs(t *testing.T) {
+
+	proposal := []byte("dedis")
+	timeout := 5 * time.Second
+	nodes := []int{4, 7}
+
+	for _, nbrNodes := range nodes {
+		local := onet.NewLocalTest(tSuite)
+		_, _, tree := local.GenTree(nbrNodes, true)
+
+		pi, err := local.CreateProtocol(MACProtocolName, tree)
+		if err != nil {
+			local.CloseAll()
+			t.Fatal("Error in creation of protocol:", err)
+		}
+
+		protocol := pi.(*PbftProtocol)
+		protocol.Msg = proposal
+		protocol.Timeout = timeout
+		if !protocol.MACs {
+			local.CloseAll()
+			t.Fatal("protocol doesn't use MACs")
+		}
+
+		err = protocol.Start()
+		if err != nil {
+			local.CloseAll()
+			t.Fatal(err)
+		}
+
+		select {
+		case finalReply := <-protocol.FinalReply:
+			digest := sha512.Sum512(proposal)
+			if !bytes.Equal(finalReply, digest[:]) {
+				local.CloseAll()
+				t.Fatal("committed the wrong request")
+			}
+		case <-time.After(timeout * 2):
+			local.CloseAll()
+			t.Fatal("Leader never got enough final replies, timed out")
+		}
+
+		local.CloseAll()
+	}
+}
+
+func TestLinear(t *testing.T) {
+
+	proposal := []byte("dedis")
+	timeout := 5 * time.Second
+	nodes := []int{4, 7}
+
+	for _, nbrNodes := range nodes {
+		local := onet.NewLocalTest(bn256.NewSuiteG2())
+		_, _, tree := local.GenTree(nbrNodes, true)
+
+		pi, err := local.CreateProtocol(LinearProtocolName, tree)
+		if err != nil {
+			local.CloseAll()
+			t.Fatal("Error in creation of protocol:", err)
+		}
+
+		protocol := pi.(*PbftProtocol)
+		protocol.Msg = proposal
+		protocol.Timeout = timeout
+		if !protocol.Linear {
+			local.CloseAll()
+			t.Fatal("protocol isn't linear")
+		}
+
+		err = protocol.Start()
+		if err != nil {
+			local.CloseAll()
+			t.Fatal(err)
+		}
+
+		select {
+		case finalReply := <-protocol.FinalReply:
+			digest := sha512.Sum512(proposal)
+			if !bytes.Equal(finalReply, digest[:]) {
+				local.CloseAll()
+				t.Fatal("committed the wrong request")
+			}
+		case <-time.After(timeout * 2):
+			local.CloseAll()
+			t.Fatal("Leader never got enough final replies, timed out")
+		}
+
+		local.CloseAll()
+	}
+}
+
+func TestSessionKey(t *testing.T) {
+	a := key.NewKeyPair(tSuite)
+	b := key.NewKeyPair(tSuite)
+	ab, err := sessionKey(tSuite, a.Private, b.Public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ba, err := sessionKey(tSuite, b.Private, a.Public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ab, ba) {
+		t.Fatal("session keys don't match")
+	}
+	c := key.NewKeyPair(tSuite)
+	ac, err := sessionKey(tSuite, a.Private, c.Public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(ab, ac) {
+		t.Fatal("same session key with different replicas")
+	}
+}
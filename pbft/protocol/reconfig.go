@@ -0,0 +1,201 @@
+package protocol
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/dedis/kyber"
+	"github.com/dedis/onet"
+	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/network"
+)
+
+// Reconfigure submits a reconfiguration making the given servers, in this
+// order, the replicas. Once the reconfiguration is committed, the replicas
+// keep ordering the requests with the current replica set until the next
+// checkpoint past the high watermark, and switch to the new one when this
+// checkpoint becomes stable. The new replicas fetch the state through a state
+// transfer. It can only be called on the root, after Start.
+//
+// The replicas can only be chosen among the nodes of the tree of the
+// protocol: a node outside of it has no instance of the protocol to join. To
+// add such a node, start a new instance over a tree including it.
+func (pbft *PbftProtocol) Reconfigure(members []*network.ServerIdentity) error {
+	if len(members) == 0 {
+		return errors.New("cannot reconfigure to an empty replica set")
+	}
+	ids := make([]string, len(members))
+	for i, si := range members {
+		ids[i] = si.ID.String()
+	}
+	if err := pbft.checkMembers(ids); err != nil {
+		return err
+	}
+	select {
+	case pbft.submitChan <- &Request{Members: ids}:
+		return nil
+	case <-pbft.doneChan:
+		return errors.New("protocol is stopped")
+	}
+}
+
+// reconfigure executes a committed reconfiguration with the given sequence
+// number, and returns its result for the client. The switch happens at the
+// first checkpoint from which the primary cannot have ordered requests with
+// the current replica set yet.
+func (pbft *PbftProtocol) reconfigure(seq int, req *Request) []byte {
+	if !req.Client.Equal(pbft.Root().ServerIdentity.Public) {
+		return []byte("reconfiguration not submitted by the root")
+	}
+	if pbft.config.Next != nil {
+		return []byte("reconfiguration already in progress")
+	}
+	if err := pbft.checkMembers(req.Members); err != nil {
+		return []byte(err.Error())
+	}
+	at := seq + logSize - 1
+	if r := at % checkpointInterval; r != 0 {
+		at += checkpointInterval - r
+	}
+	pbft.config.Next = req.Members
+	pbft.config.Seq = at
+	log.Lvl2(pbft.ServerIdentity(), "switching to", len(req.Members), "replicas at checkpoint", at)
+	return []byte("reconfiguration at " + strconv.Itoa(at))
+}
+
+// checkMembers returns an error unless the identifiers are distinct nodes of
+// the tree.
+func (pbft *PbftProtocol) checkMembers(ids []string) error {
+	if len(ids) == 0 {
+		return errors.New("empty replica set")
+	}
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		if seen[id] {
+			return fmt.Errorf("replica %s listed twice", id)
+		}
+		if pbft.treeNode(id) == nil {
+			return fmt.Errorf("replica %s is not part of the tree", id)
+		}
+		seen[id] = true
+	}
+	return nil
+}
+
+// applyConfig makes the members of the configuration the replicas. The
+// primary losing its role hands the requests it didn't order over to the new
+// one, which orders them along with the requests waiting at it.
+func (pbft *PbftProtocol) applyConfig(config Configuration) {
+	wasPrimary := len(pbft.replicas) > 0 && pbft.isPrimary(pbft.view)
+	pbft.config = config
+	pbft.replicas = make([]*onet.TreeNode, 0, len(config.Members))
+	pbft.PubKeysMap = make(map[string]kyber.Point)
+	for _, id := range config.Members {
+		if tn := pbft.treeNode(id); tn != nil {
+			pbft.replicas = append(pbft.replicas, tn)
+			pbft.PubKeysMap[id] = tn.ServerIdentity.Public
+		}
+	}
+	log.Lvl2(pbft.ServerIdentity(), "now with", len(pbft.replicas), "replicas, member:", pbft.isMember())
+	if pbft.viewChanging {
+		return
+	}
+
+	isPrimary := pbft.isPrimary(pbft.view)
+	switch {
+	case isPrimary && !wasPrimary:
+		for d := range pbft.outstanding {
+			if !pbft.assigned[d] && !pbft.executed[d] && pbft.requests[d] != nil {
+				pbft.assigned[d] = true
+				pbft.pending = append(pbft.pending, d)
+			}
+		}
+		pbft.outstanding = make(map[string]bool)
+	case wasPrimary && !isPrimary:
+		primary := pbft.primary(pbft.view)
+		for _, d := range pbft.pending {
+			if pbft.executed[d] || pbft.requests[d] == nil {
+				continue
+			}
+			pbft.outstanding[d] = true
+			req := *pbft.requests[d]
+			req.Sender = pbft.id()
+			go func() {
+				if err := pbft.sendTo(primary, &req); err != nil {
+					log.Lvl3(pbft.ServerIdentity(), "failed to hand the request over to the primary:", err)
+				}
+			}()
+		}
+		pbft.pending = nil
+		pbft.assigned = make(map[string]bool)
+		pbft.viewTimer = nil
+		pbft.startViewTimer()
+	}
+}
+
+// configAfter returns the configuration of the replicas once the given
+// sequence number has been executed.
+func (pbft *PbftProtocol) configAfter(seq int) *Configuration {
+	if pbft.config.Next != nil && seq >= pbft.config.Seq {
+		return &Configuration{Members: pbft.config.Next}
+	}
+	config := pbft.config
+	return &config
+}
+
+// highWatermark returns the highest sequence number that can be ordered. A
+// pending reconfiguration stops the current replica set at the checkpoint of
+// the switch.
+func (pbft *PbftProtocol) highWatermark() int {
+	high := pbft.stableSeq + logSize
+	if pbft.config.Next != nil && pbft.config.Seq < high {
+		return pbft.config.Seq
+	}
+	return high
+}
+
+// isMember returns whether this node is one of the replicas.
+func (pbft *PbftProtocol) isMember() bool {
+	_, ok := pbft.PubKeysMap[pbft.id()]
+	return ok
+}
+
+// treeNode returns the node of the tree with the given identifier, or nil.
+func (pbft *PbftProtocol) treeNode(id string) *onet.TreeNode {
+	for _, tn := range pbft.List() {
+		if tn.ServerIdentity.ID.String() == id {
+			return tn
+		}
+	}
+	return nil
+}
+
+// membersRoster returns the roster of the replicas, against which their
+// certificates are verified.
+func (pbft *PbftProtocol) membersRoster() *onet.Roster {
+	ids := make([]*network.ServerIdentity, len(pbft.replicas))
+	for i, r := range pbft.replicas {
+		ids[i] = r.ServerIdentity
+	}
+	return onet.NewRoster(ids)
+}
+
+// stateDigest returns the digest signed in the checkpoints: the state of the
+// state machine along with the configuration of the replicas, so that a
+// replica fetching the state learns the replica set as well.
+func stateDigest(snapshot []byte, config *Configuration) []byte {
+	h := sha512.New()
+	h.Write(snapshot)
+	for _, id := range config.Members {
+		h.Write([]byte(id))
+	}
+	h.Write([]byte("next"))
+	for _, id := range config.Next {
+		h.Write([]byte(id))
+	}
+	binary.Write(h, binary.LittleEndian, int64(config.Seq))
+	return h.Sum(nil)
+}
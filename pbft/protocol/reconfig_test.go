@@ -0,0 +1,168 @@
+package protocol
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/dedis/kyber/util/key"
+	"github.com/dedis/onet"
+	"github.com/dedis/onet/network"
+)
+
+func TestReconfiguration(t *testing.T) {
+
+	timeout := 5 * time.Second
+	maxRequests := 100
+
+	oldInterval, oldSize := checkpointInterval, logSize
+	checkpointInterval, logSize = 4, 8
+	defer func() {
+		checkpointInterval, logSize = oldInterval, oldSize
+	}()
+
+	local := onet.NewLocalTest(tSuite)
+	defer local.CloseAll()
+	local.Check = onet.CheckNone
+	_, roster, tree := local.GenTree(5, true)
+	last := roster.List[4].ID.String()
+
+	pi, err := local.CreateProtocol(logTestProtocolName, tree)
+	if err != nil {
+		t.Fatal("Error in creation of protocol:", err)
+	}
+	protocol := pi.(*PbftProtocol)
+	protocol.Timeout = timeout
+
+	results := make(chan *Result, 1)
+	protocol.RegisterOnResult(func(r *Result) {
+		results <- r
+	})
+
+	if err := protocol.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer protocol.Stop()
+
+	nbrRequests := 0
+	request := func() *Result {
+		nbrRequests++
+		if err := protocol.Submit([]byte("request " + strconv.Itoa(nbrRequests))); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case r := <-results:
+			return r
+		case <-time.After(timeout):
+			t.Fatal("request", nbrRequests, "never got enough replies")
+		}
+		return nil
+	}
+	reconfigure := func(members int) int {
+		if err := protocol.Reconfigure(roster.List[:members]); err != nil {
+			t.Fatal(err)
+		}
+		var at int
+		select {
+		case r := <-results:
+			if _, err := fmt.Sscanf(string(r.Result), "reconfiguration at %d", &at); err != nil {
+				t.Fatal("reconfiguration failed:", string(r.Result))
+			}
+		case <-time.After(timeout):
+			t.Fatal("the reconfiguration never got enough replies")
+		}
+		return at
+	}
+	signed := func(r *Result, id string) bool {
+		for _, s := range r.Cert.Sigs {
+			if s.Sender == id {
+				return true
+			}
+		}
+		return false
+	}
+
+	for i := 0; i < 5; i++ {
+		request()
+	}
+
+	// once the replicas switched, the last one doesn't take part in the
+	// quorums anymore
+	at := reconfigure(4)
+	members := onet.NewRoster(roster.List[:4])
+	for {
+		r := request()
+		if r.Seq <= at {
+			continue
+		}
+		if r.Cert == nil {
+			t.Fatal("no valid commit certificate after the reconfiguration")
+		}
+		if err := r.Cert.Verify(tSuite, members); err != nil {
+			t.Fatal("commit certificate not signed by the new replicas:", err)
+		}
+		if signed(r, last) {
+			t.Fatal("the removed replica still signs commits")
+		}
+		break
+	}
+
+	// added back, the last replica fetches the state it missed and signs
+	// commits again
+	at = reconfigure(5)
+	for {
+		r := request()
+		if r.Seq > at && r.Cert != nil && signed(r, last) {
+			if err := r.Cert.Verify(tSuite, roster); err != nil {
+				t.Fatal(err)
+			}
+			break
+		}
+		if nbrRequests > maxRequests {
+			t.Fatal("the added replica never signed a commit")
+		}
+	}
+}
+
+func TestReconfigurationRejected(t *testing.T) {
+	local := onet.NewLocalTest(tSuite)
+	defer local.CloseAll()
+	_, roster, tree := local.GenTree(4, true)
+
+	n, err := local.NewTreeNodeInstance(tree.Root, logTestProtocolName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pbft, err := NewPbftProtocol(n, func(msg, data []byte) bool { return true }, &counter{}, NewMemoryWAL())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := roster.List[1].ID.String()
+	for _, members := range [][]string{nil, {id, id}, {id, "unknown"}} {
+		if err := pbft.checkMembers(members); err == nil {
+			t.Fatal("accepted replica set", members)
+		}
+	}
+
+	// a node outside of the tree can't join the replicas
+	outsider := network.NewServerIdentity(key.NewKeyPair(tSuite).Public, network.NewLocalAddress("outsider"))
+	if err := pbft.Reconfigure([]*network.ServerIdentity{roster.List[0], outsider}); err == nil {
+		t.Fatal("accepted a replica outside of the tree")
+	}
+
+	// only the root can reconfigure the replicas
+	other := &Request{Members: []string{id}, Client: roster.List[1].Public}
+	pbft.reconfigure(1, other)
+	if pbft.config.Next != nil {
+		t.Fatal("reconfiguration of another client executed")
+	}
+	pbft.reconfigure(1, &Request{Members: []string{id}, Client: pbft.Public()})
+	if pbft.config.Seq != logSize || len(pbft.config.Next) != 1 {
+		t.Fatal("reconfiguration switching at", pbft.config.Seq, "to", pbft.config.Next)
+	}
+	if pbft.highWatermark() != logSize {
+		t.Fatal("high watermark", pbft.highWatermark(), "instead of", logSize)
+	}
+}
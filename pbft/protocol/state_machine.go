@@ -0,0 +1,63 @@
+package protocol
+
+import (
+	"crypto/sha512"
+	"errors"
+	"sync"
+)
+
+// StateMachine is the service replicated by the pbft replicas. The committed
+// requests are executed on every replica in the order of their sequence
+// numbers, so a deterministic state machine ends up in the same state on every
+// correct replica.
+type StateMachine interface {
+	// Execute applies the request committed with the given sequence number
+	// and returns the result sent back to the client.
+	Execute(seq int, request []byte) []byte
+	// Snapshot returns the current state. Its digest is signed in the
+	// checkpoints, so it must be identical on all the correct replicas.
+	Snapshot() []byte
+	// Restore replaces the current state with a snapshot, taken by
+	// another replica whose checkpoint has been verified.
+	Restore(snapshot []byte) error
+}
+
+// HashChain is the default state machine: its state is a hash chain of all the
+// executed requests, and the result of a request is its digest.
+type HashChain struct {
+	sync.Mutex
+	state []byte
+}
+
+// NewHashChain returns an empty hash chain.
+func NewHashChain() *HashChain {
+	return &HashChain{state: make([]byte, sha512.Size)}
+}
+
+// Execute implements StateMachine.
+func (h *HashChain) Execute(seq int, request []byte) []byte {
+	h.Lock()
+	defer h.Unlock()
+	digest := sha512.Sum512(request)
+	state := sha512.Sum512(append(h.state, digest[:]...))
+	h.state = state[:]
+	return digest[:]
+}
+
+// Snapshot implements StateMachine.
+func (h *HashChain) Snapshot() []byte {
+	h.Lock()
+	defer h.Unlock()
+	return append([]byte{}, h.state...)
+}
+
+// Restore implements StateMachine.
+func (h *HashChain) Restore(snapshot []byte) error {
+	if len(snapshot) != sha512.Size {
+		return errors.New("invalid hash chain snapshot")
+	}
+	h.Lock()
+	defer h.Unlock()
+	h.state = append([]byte{}, snapshot...)
+	return nil
+}
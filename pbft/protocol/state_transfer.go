@@ -0,0 +1,221 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/dedis/onet"
+	"github.com/dedis/onet/log"
+)
+
+// lagging returns whether f+1 replicas, so at least one correct replica,
+// reached the checkpoint while this replica is a whole checkpoint interval
+// behind it: it missed messages, and would never catch up on its own.
+func (pbft *PbftProtocol) lagging(cp *Checkpoint) bool {
+	if cp.Seq < pbft.lastExecuted+checkpointInterval || cp.Seq <= pbft.fetching {
+		return false
+	}
+	matching := 0
+	for _, c := range pbft.checkpoints[cp.Seq] {
+		if bytes.Equal(c.State, cp.State) {
+			matching++
+		}
+	}
+	return matching > pbft.faulty()
+}
+
+// fetchState asks the other replicas for their stable checkpoint and the
+// requests they committed after it.
+func (pbft *PbftProtocol) fetchState(seq int) error {
+	log.Lvl2(pbft.ServerIdentity(), "fell behind checkpoint", seq, "fetching the state")
+	pbft.fetching = seq
+	pbft.transfer = make(map[string]*StateReply)
+
+	req := &StateRequest{Seq: seq, Sender: pbft.id()}
+	go func() {
+		if errs := pbft.broadcast(req); len(errs) > 0 {
+			log.Lvl3(pbft.ServerIdentity(), "failed to send state request to all replicas")
+		}
+	}()
+	return nil
+}
+
+// handleStateRequest sends the stable checkpoint of this replica and the
+// requests it executed after it to the replica fetching the state.
+func (pbft *PbftProtocol) handleStateRequest(tn *onet.TreeNode, req *StateRequest) {
+	reply := &StateReply{
+		View:     pbft.view,
+		Seq:      pbft.stableSeq,
+		Snapshot: pbft.snapshots[pbft.stableSeq],
+		Proof:    pbft.stableProof,
+		Sender:   pbft.id(),
+	}
+	if config, ok := pbft.configs[pbft.stableSeq]; ok {
+		reply.Config = *config
+	}
+	for seq := pbft.stableSeq + 1; seq <= pbft.lastExecuted; seq++ {
+		digest, ok := pbft.committed[seq]
+		if !ok {
+			break
+		}
+		entry := LogEntry{Seq: seq, Digest: digest}
+		for _, d := range pbft.batches[string(digest)] {
+			if r, ok := pbft.requests[d]; ok {
+				entry.Requests = append(entry.Requests, *r)
+			}
+		}
+		reply.Log = append(reply.Log, entry)
+	}
+	go func() {
+		if err := pbft.sendTo(tn, reply); err != nil {
+			log.Lvl2(pbft.ServerIdentity(), "couldn't send state:", err)
+		}
+	}()
+}
+
+// handleStateReply collects the states sent by the other replicas, and
+// applies them as soon as they can be trusted.
+func (pbft *PbftProtocol) handleStateReply(reply *StateReply) error {
+	if pbft.transfer == nil {
+		return nil
+	}
+	if reply.Seq > pbft.lastExecuted {
+		if err := pbft.verifyState(reply); err != nil {
+			log.Lvl2(pbft.ServerIdentity(), "received invalid state:", err)
+			return nil
+		}
+	}
+	pbft.transfer[reply.Sender] = reply
+	return pbft.applyTransfer()
+}
+
+// verifyState checks that the snapshot and the configuration match the state
+// signed by f+1 distinct replicas in the checkpoints of the proof.
+func (pbft *PbftProtocol) verifyState(reply *StateReply) error {
+	state := stateDigest(reply.Snapshot, &reply.Config)
+	senders := make(map[string]bool)
+	for i := range reply.Proof {
+		cp := &reply.Proof[i]
+		if cp.Seq != reply.Seq || !bytes.Equal(cp.State, state) {
+			return errors.New("snapshot doesn't match the checkpoints")
+		}
+		if err := pbft.verifyCheckpoint(cp); err != nil {
+			return err
+		}
+		senders[cp.Sender] = true
+	}
+	if len(senders) <= pbft.faulty() {
+		return fmt.Errorf("only %d checkpoints in the proof", len(senders))
+	}
+	return nil
+}
+
+// applyTransfer restores the most recent checkpoint received, then commits
+// the following requests on which f+1 replicas agree, and executes them.
+func (pbft *PbftProtocol) applyTransfer() error {
+	var latest *StateReply
+	for _, r := range pbft.transfer {
+		if r.Seq > pbft.lastExecuted && (latest == nil || r.Seq > latest.Seq) {
+			latest = r
+		}
+	}
+	if latest != nil {
+		if err := pbft.restore(latest); err != nil {
+			return err
+		}
+	}
+
+	for seq := pbft.lastExecuted + 1; ; seq++ {
+		if _, ok := pbft.committed[seq]; ok {
+			continue
+		}
+		entry := pbft.agreedEntry(seq)
+		if entry == nil {
+			break
+		}
+		r := &Record{Type: recordCommitted, View: pbft.view, Seq: seq, Digest: entry.Digest, Requests: entry.Requests}
+		if err := pbft.persist(r); err != nil {
+			return err
+		}
+		pbft.committed[seq] = entry.Digest
+		pbft.addBatch(entry.Digest, entry.Requests)
+	}
+	if err := pbft.execute(); err != nil {
+		return err
+	}
+	if pbft.nextSeq <= pbft.lastExecuted {
+		pbft.nextSeq = pbft.lastExecuted + 1
+	}
+
+	// follow the replicas if they moved to another view in the meantime
+	var views []int
+	for _, r := range pbft.transfer {
+		views = append(views, r.View)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(views)))
+	if len(views) > pbft.faulty() && views[pbft.faulty()] > pbft.view && !pbft.viewChanging {
+		pbft.view = views[pbft.faulty()]
+		if err := pbft.persistView(); err != nil {
+			return err
+		}
+	}
+
+	if pbft.lastExecuted >= pbft.fetching {
+		log.Lvl2(pbft.ServerIdentity(), "caught up at sequence number", pbft.lastExecuted)
+		pbft.transfer = nil
+	}
+	return nil
+}
+
+// restore replaces the state of the state machine and the configuration of
+// the replicas with a verified snapshot.
+func (pbft *PbftProtocol) restore(r *StateReply) error {
+	if err := pbft.stateMachine.Restore(r.Snapshot); err != nil {
+		return err
+	}
+	log.Lvl2(pbft.ServerIdentity(), "restored checkpoint", r.Seq)
+	pbft.lastExecuted = r.Seq
+	pbft.snapshots[r.Seq] = r.Snapshot
+	config := r.Config
+	pbft.configs[r.Seq] = &config
+	pbft.applyConfig(config)
+
+	// the requests waiting here might have been executed in the snapshot:
+	// their clients retransmit them if they were not
+	pbft.outstanding = make(map[string]bool)
+	pbft.viewTimer = nil
+
+	if r.Seq > pbft.stableSeq {
+		return pbft.stabilize(r.Seq, r.Proof)
+	}
+	return nil
+}
+
+// agreedEntry returns the batch committed with the sequence number according
+// to f+1 replicas, or nil if they don't agree yet.
+func (pbft *PbftProtocol) agreedEntry(seq int) *LogEntry {
+	entries := make(map[string][]*LogEntry)
+	for _, r := range pbft.transfer {
+		for i := range r.Log {
+			entry := &r.Log[i]
+			if entry.Seq == seq && bytes.Equal(entry.Digest, batchDigest(entry.Requests)) {
+				d := string(entry.Digest)
+				entries[d] = append(entries[d], entry)
+			}
+		}
+	}
+	for _, candidates := range entries {
+		if len(candidates) <= pbft.faulty() {
+			continue
+		}
+		// the signatures of the clients aren't covered by the digest
+		for _, entry := range candidates {
+			if pbft.verifyBatch(entry.Requests) == nil {
+				return entry
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package protocol
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/dedis/onet"
+)
+
+const restartTestProtocolName = "PBFTRestartTest"
+
+// restartedReplica is a replica that is down, losing all its messages, until
+// it is restarted with an empty state.
+type restartedReplica struct {
+	*PbftProtocol
+	state   *counter
+	restart chan bool
+}
+
+var restarted = make(chan *restartedReplica, 1)
+
+func init() {
+	onet.GlobalProtocolRegister(restartTestProtocolName, func(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+		vf := func(msg, data []byte) bool { return true }
+		sm := &counter{}
+		pbft, err := NewPbftProtocol(n, vf, sm, NewMemoryWAL())
+		if err != nil {
+			return nil, err
+		}
+		// the last replica of the roster is neither the client nor the
+		// primary
+		if n.TreeNode().RosterIndex != len(n.Roster().List)-1 {
+			return pbft, nil
+		}
+		r := &restartedReplica{PbftProtocol: pbft, state: sm, restart: make(chan bool)}
+		restarted <- r
+		return r, nil
+	})
+}
+
+// Dispatch drops the messages until the replica is restarted.
+func (r *restartedReplica) Dispatch() error {
+	cases := []reflect.SelectCase{{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(r.restart)}}
+	for _, c := range []interface{}{
+		r.ChannelRequest,
+		r.ChannelPrePrepare,
+		r.ChannelPrepare,
+		r.ChannelCommit,
+		r.ChannelReply,
+		r.ChannelCheckpoint,
+		r.ChannelViewChange,
+		r.ChannelNewView,
+		r.ChannelAggregate,
+		r.ChannelStateRequest,
+		r.ChannelStateReply,
+		r.ChannelStop,
+	} {
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(c)})
+	}
+	for {
+		i, _, ok := reflect.Select(cases)
+		if i == 0 {
+			return r.PbftProtocol.Dispatch()
+		}
+		if !ok {
+			r.Done()
+			return nil
+		}
+	}
+}
+
+func TestStateTransfer(t *testing.T) {
+
+	timeout := 5 * time.Second
+	nbrRequests := 40
+
+	// make the replicas go through many checkpoints while one is down
+	oldInterval, oldSize := checkpointInterval, logSize
+	checkpointInterval, logSize = 4, 8
+	defer func() {
+		checkpointInterval, logSize = oldInterval, oldSize
+	}()
+
+	local := onet.NewLocalTest(tSuite)
+	defer local.CloseAll()
+	_, _, tree := local.GenTree(4, true)
+
+	pi, err := local.CreateProtocol(restartTestProtocolName, tree)
+	if err != nil {
+		t.Fatal("Error in creation of protocol:", err)
+	}
+	protocol := pi.(*PbftProtocol)
+	protocol.Timeout = timeout
+
+	results := make(chan *Result, nbrRequests)
+	protocol.RegisterOnResult(func(r *Result) {
+		results <- r
+	})
+
+	if err := protocol.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer protocol.Stop()
+
+	var replica *restartedReplica
+	select {
+	case replica = <-restarted:
+	case <-time.After(timeout):
+		t.Fatal("the replica never started")
+	}
+
+	for i := 0; i < nbrRequests; i++ {
+		if err := protocol.Submit([]byte("request " + strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 1; i <= nbrRequests; i++ {
+		select {
+		case <-results:
+		case <-time.After(timeout):
+			t.Fatal("request", i, "never got enough replies")
+		}
+		// restart the replica in the middle of the requests
+		if i == nbrRequests/2 {
+			close(replica.restart)
+		}
+	}
+
+	// the replica fetches the state it missed from the others
+	deadline := time.After(timeout)
+	for string(replica.state.Snapshot()) != strconv.Itoa(nbrRequests) {
+		select {
+		case <-deadline:
+			t.Fatal("the restarted replica only executed", string(replica.state.Snapshot()), "requests")
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
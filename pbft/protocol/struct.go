@@ -1,15 +1,53 @@
 package protocol
 
 
-import "github.com/dedis/onet"
+import (
+	"time"
+
+	"github.com/dedis/kyber"
+	"github.com/dedis/onet"
+)
 
 // Name can be used from other packages to refer to this protocol.
 const DefaultProtocolName = "PBFT"
 
 
-type PrePrepare struct {
+// Request is signed by a client with the public key Client. Timestamp orders
+// the requests of a client: each one is executed at most once, and older ones
+// are ignored. The replica receiving it forwards it to every replica, so that
+// the primary orders it and the backups can detect a faulty primary.
+//
+// A request with Members is a reconfiguration: once executed, the replicas
+// with these identities become the replica set. Only the root can
+// reconfigure the replicas.
+//
+// Timeout is how long the client waits for the reply. The replicas only
+// adopt the one of the requests of the root, see PbftProtocol.Timeout.
+type Request struct {
 	Msg []byte
+	Members []string
+	Timestamp int64
+	Client kyber.Point
+	Timeout time.Duration
+	Sig []byte
+	Sender string
+}
+
+type StructRequest struct {
+	*onet.TreeNode
+	Request
+}
+
+
+// PrePrepare assigns the sequence number Seq to a batch of requests in a view,
+// which are executed in order. A pre-prepare of an empty batch is a null
+// request, used by a new primary to fill the holes in the sequence numbers.
+type PrePrepare struct {
+	View int
+	Seq int
+	Requests []Request
 	Digest []byte
+	Timeout time.Duration
 	Sig []byte
 	Sender string
 }
@@ -21,6 +59,8 @@ type StructPrePrepare struct {
 
 
 type Prepare struct {
+	View int
+	Seq int
 	Digest []byte
 	Sig []byte
 	Sender string
@@ -32,9 +72,14 @@ type StructPrepare struct {
 }
 
 
+// Commit is signed, or authenticated with a vector of MACs holding one MAC
+// for every replica in the order of the roster.
 type Commit struct {
+	View int
+	Seq int
 	Digest []byte
 	Sig []byte
+	Auth [][]byte
 	Sender string
 }
 
@@ -44,9 +89,22 @@ type StructCommit struct {
 }
 
 
+// Reply is sent to the client once a replica executed the request with the
+// given Digest, or Rejected it because the client sent a newer request that
+// was executed first. Result is the output of the state machine and Cert the
+// commit certificate of the batch holding the request, whose requests have
+// the digests of Batch. It is either signed, or authenticated with a MAC for
+// the client, in which case there is no commit certificate.
 type Reply struct {
+	View int
+	Seq int
+	Digest []byte
 	Result []byte
+	Rejected bool
+	Batch [][]byte
+	Cert QuorumCert
 	Sig []byte
+	MAC []byte
 	Sender string
 }
 
@@ -54,3 +112,142 @@ type StructReply struct {
 	*onet.TreeNode
 	Reply
 }
+
+
+// Checkpoint is broadcast by a replica every checkpoint interval, with the
+// digest of the state of its state machine after executing Seq. A quorum of
+// matching checkpoints makes the checkpoint stable.
+type Checkpoint struct {
+	Seq int
+	State []byte
+	Sig []byte
+	Sender string
+}
+
+type StructCheckpoint struct {
+	*onet.TreeNode
+	Checkpoint
+}
+
+
+// PreparedCert proves that a request has been prepared in a view: it holds
+// the pre-prepare of the primary of that view and the certificate of a
+// quorum of matching prepares, aggregated in the linear variant.
+type PreparedCert struct {
+	PrePrepare PrePrepare
+	Prepares QuorumCert
+	Aggregate AggregateCert
+}
+
+
+// AggregateCert is broadcast by the primary in the linear variant, once it
+// aggregated the BLS signatures of a quorum of prepares or commits. Mask
+// tells which replicas, in the order of the roster, signed.
+type AggregateCert struct {
+	Phase string
+	View int
+	Seq int
+	Digest []byte
+	Sig []byte
+	Mask []byte
+}
+
+type StructAggregateCert struct {
+	*onet.TreeNode
+	AggregateCert
+}
+
+// ViewChange is broadcast by a replica that suspects the primary of View-1
+// to be faulty. It carries the proof of its last stable checkpoint and the
+// certificates of the requests it prepared after it.
+type ViewChange struct {
+	View int
+	StableSeq int
+	Checkpoints []Checkpoint
+	Prepared []PreparedCert
+	Sig []byte
+	Sender string
+}
+
+type StructViewChange struct {
+	*onet.TreeNode
+	ViewChange
+}
+
+
+// NewView is broadcast by the primary of View once it collected a quorum of
+// view changes. The pre-prepares re-propose, for every sequence number after
+// the latest stable checkpoint, the request of the highest prepared
+// certificate, or a null request.
+type NewView struct {
+	View int
+	ViewChanges []ViewChange
+	PrePrepares []PrePrepare
+	Sig []byte
+	Sender string
+}
+
+type StructNewView struct {
+	*onet.TreeNode
+	NewView
+}
+
+
+// StateRequest is broadcast by a replica that fell behind, asking for the
+// latest stable checkpoint of the other replicas and the requests they
+// committed after it.
+type StateRequest struct {
+	Seq int
+	Sender string
+}
+
+type StructStateRequest struct {
+	*onet.TreeNode
+	StateRequest
+}
+
+
+// StateReply answers a StateRequest with the snapshot of the state machine at
+// the stable checkpoint Seq, the configuration of the replicas at it, its
+// proof, and the committed requests executed after it.
+type StateReply struct {
+	View int
+	Seq int
+	Snapshot []byte
+	Config Configuration
+	Proof []Checkpoint
+	Log []LogEntry
+	Sender string
+}
+
+type StructStateReply struct {
+	*onet.TreeNode
+	StateReply
+}
+
+// Configuration is the replica set at a checkpoint: the identities of the
+// replicas, in order, and the replica set replacing it once checkpoint Seq is
+// stable, if a reconfiguration has been executed.
+type Configuration struct {
+	Members []string
+	Next []string
+	Seq int
+}
+
+
+// LogEntry is a batch of requests committed with sequence number Seq. An
+// empty batch is a null request.
+type LogEntry struct {
+	Seq int
+	Digest []byte
+	Requests []Request
+}
+
+
+// Stop is sent by the client to stop the replicas.
+type Stop struct{}
+
+type StructStop struct {
+	*onet.TreeNode
+	Stop
+}
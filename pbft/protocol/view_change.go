@@ -0,0 +1,393 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/dedis/onet/log"
+)
+
+// startViewChange stops accepting messages of the current view and
+// broadcasts a view change to the given view, along with the proof of the
+// last stable checkpoint and the certificates of the requests prepared
+// after it.
+func (pbft *PbftProtocol) startViewChange(view int) error {
+	if view <= pbft.view || !pbft.isMember() {
+		return nil
+	}
+	log.Lvl2(pbft.ServerIdentity(), "moving to view", view)
+
+	pbft.view = view
+	pbft.viewChanging = true
+	if err := pbft.persistView(); err != nil {
+		return err
+	}
+
+	vc := &ViewChange{View: view, StableSeq: pbft.stableSeq, Checkpoints: pbft.stableProof, Sender: pbft.id()}
+	for _, cert := range pbft.prepared {
+		vc.Prepared = append(vc.Prepared, *cert)
+	}
+	sort.Slice(vc.Prepared, func(i, j int) bool {
+		return vc.Prepared[i].PrePrepare.Seq < vc.Prepared[j].PrePrepare.Seq
+	})
+	var err error
+	vc.Sig, err = pbft.sign(vc.payload())
+	if err != nil {
+		return err
+	}
+	go func() {
+		if errs := pbft.broadcast(vc); len(errs) > 0 {
+			log.Lvl3(pbft.ServerIdentity(), "failed to send view change to all replicas")
+		}
+	}()
+
+	// if the next primary is faulty as well, we will move on to the one
+	// after it, leaving it twice as much time to make progress
+	if pbft.viewTimeout == 0 {
+		pbft.viewTimeout = pbft.Timeout
+	}
+	pbft.viewTimeout *= 2
+	pbft.viewTimer = time.After(pbft.viewTimeout)
+
+	return pbft.handleViewChange(vc)
+}
+
+func (pbft *PbftProtocol) handleViewChange(vc *ViewChange) error {
+	if vc.View < pbft.view {
+		return nil
+	}
+	if err := pbft.verifyViewChange(vc); err != nil {
+		log.Lvl2(pbft.ServerIdentity(), "received invalid view change:", err)
+		return nil
+	}
+	if pbft.viewChanges[vc.View] == nil {
+		pbft.viewChanges[vc.View] = make(map[string]*ViewChange)
+	}
+	pbft.viewChanges[vc.View][vc.Sender] = vc
+
+	// if f+1 replicas want to leave our view, at least one of them is
+	// correct: join the smallest view they are moving to
+	next := -1
+	senders := make(map[string]bool)
+	for view, vcs := range pbft.viewChanges {
+		if view <= pbft.view {
+			continue
+		}
+		for sender := range vcs {
+			senders[sender] = true
+		}
+		if next < 0 || view < next {
+			next = view
+		}
+	}
+	if len(senders) >= pbft.faulty()+1 {
+		return pbft.startViewChange(next)
+	}
+
+	if pbft.isPrimary(pbft.view) && pbft.viewChanging && !pbft.sentNewView[pbft.view] &&
+		len(pbft.viewChanges[pbft.view]) >= pbft.quorum() {
+		return pbft.sendNewView(pbft.view)
+	}
+	return nil
+}
+
+// sendNewView is run by the new primary once it has a quorum of view
+// changes. For every sequence number after the latest stable checkpoint, it
+// re-proposes the request with the highest prepared certificate, or a null
+// request if none has been prepared.
+func (pbft *PbftProtocol) sendNewView(view int) error {
+	var vcs []ViewChange
+	for _, vc := range pbft.viewChanges[view] {
+		vcs = append(vcs, *vc)
+	}
+	pbft.sentNewView[view] = true
+
+	minS, batches := reproposals(vcs)
+	var pps []PrePrepare
+	for i, batch := range batches {
+		pp, err := pbft.newPrePrepare(view, minS+1+i, batch)
+		if err != nil {
+			return err
+		}
+		pps = append(pps, *pp)
+	}
+	for i := range pps {
+		if err := pbft.persistPrePrepare(&pps[i]); err != nil {
+			return err
+		}
+	}
+
+	nv := &NewView{View: view, ViewChanges: vcs, PrePrepares: pps, Sender: pbft.id()}
+	var err error
+	nv.Sig, err = pbft.sign(nv.payload())
+	if err != nil {
+		return err
+	}
+	log.Lvl2(pbft.ServerIdentity(), "is the new primary of view", view)
+	go func() {
+		if errs := pbft.broadcast(nv); len(errs) > 0 {
+			log.Lvl3(pbft.ServerIdentity(), "failed to send new view to all replicas")
+		}
+	}()
+
+	return pbft.enterView(nv, minS)
+}
+
+func (pbft *PbftProtocol) handleNewView(nv *NewView) error {
+	if nv.View < pbft.view || (nv.View == pbft.view && !pbft.viewChanging) {
+		return nil
+	}
+	minS, err := pbft.verifyNewView(nv)
+	if err != nil {
+		log.Lvl2(pbft.ServerIdentity(), "received invalid new view:", err)
+		return nil
+	}
+	pbft.view = nv.View
+	return pbft.enterView(nv, minS)
+}
+
+// enterView starts the normal operation in the view of the new view, whose
+// latest stable checkpoint is minS.
+func (pbft *PbftProtocol) enterView(nv *NewView, minS int) error {
+	log.Lvl2(pbft.ServerIdentity(), "entering view", nv.View)
+	pbft.viewChanging = false
+	pbft.viewTimer = nil
+	pbft.discardViews()
+	if err := pbft.persistView(); err != nil {
+		return err
+	}
+
+	if minS > pbft.stableSeq {
+		if pbft.lastExecuted < minS {
+			log.Lvl1(pbft.ServerIdentity(), "is behind stable checkpoint", minS)
+		} else {
+			for _, vc := range nv.ViewChanges {
+				if vc.StableSeq == minS {
+					if err := pbft.stabilize(minS, vc.Checkpoints); err != nil {
+						return err
+					}
+					break
+				}
+			}
+		}
+	}
+
+	proposed := make(map[string]bool)
+	pbft.nextSeq = minS + 1
+	for i := range nv.PrePrepares {
+		pp := &nv.PrePrepares[i]
+		for j := range pp.Requests {
+			proposed[string(pp.Requests[j].Digest())] = true
+		}
+		if err := pbft.acceptPrePrepare(pp); err != nil {
+			return err
+		}
+		// prepares of the new view might have arrived before the new view
+		if err := pbft.checkPrepared(pp.View, pp.Seq); err != nil {
+			return err
+		}
+		pbft.nextSeq = pp.Seq + 1
+	}
+
+	if pbft.isPrimary(nv.View) {
+		// order the requests the previous primary left behind
+		pbft.pending = nil
+		pbft.assigned = make(map[string]bool)
+		for d := range pbft.outstanding {
+			if !proposed[d] && !pbft.executed[d] && pbft.requests[d] != nil {
+				pbft.assigned[d] = true
+				pbft.pending = append(pbft.pending, d)
+			}
+		}
+		pbft.outstanding = make(map[string]bool)
+		return pbft.proposePending()
+	}
+	pbft.startViewTimer()
+	return nil
+}
+
+// verifyPrePrepare checks that a pre-prepare has been sent by the primary of
+// its view and that its digest matches the batch of signed requests.
+func (pbft *PbftProtocol) verifyPrePrepare(pp *PrePrepare) error {
+	if pp.Sender != pbft.primary(pp.View).ServerIdentity.ID.String() {
+		return fmt.Errorf("pre-prepare of view %d not sent by the primary", pp.View)
+	}
+	// Verify the signature for authentication
+	err := pbft.verifySig(pp.Sender, payload("preprepare", pp.View, pp.Seq, pp.Digest), pp.Sig)
+	if err != nil {
+		return err
+	}
+	// verify message digest
+	if !bytes.Equal(batchDigest(pp.Requests), pp.Digest) {
+		return errors.New("pre-prepare digest is not correct")
+	}
+	return pbft.verifyBatch(pp.Requests)
+}
+
+// verifyPreparedCert checks that a prepared certificate holds a valid
+// pre-prepare and a valid certificate of its prepares.
+func (pbft *PbftProtocol) verifyPreparedCert(cert *PreparedCert) error {
+	pp := &cert.PrePrepare
+	if err := pbft.verifyPrePrepare(pp); err != nil {
+		return err
+	}
+	if pbft.Linear {
+		if err := cert.Aggregate.Matches("prepare", pp.View, pp.Seq, pp.Digest); err != nil {
+			return err
+		}
+		return pbft.verifyAggregate(&cert.Aggregate)
+	}
+	if err := cert.Prepares.Matches("prepare", pp.View, pp.Seq, pp.Digest); err != nil {
+		return err
+	}
+	return cert.Prepares.Verify(pbft.Suite(), pbft.membersRoster())
+}
+
+func (pbft *PbftProtocol) verifyViewChange(vc *ViewChange) error {
+	err := pbft.verifySig(vc.Sender, vc.payload(), vc.Sig)
+	if err != nil {
+		return err
+	}
+	if err := pbft.verifyStableProof(vc.StableSeq, vc.Checkpoints); err != nil {
+		return err
+	}
+	for i := range vc.Prepared {
+		cert := &vc.Prepared[i]
+		if cert.PrePrepare.View >= vc.View {
+			return errors.New("prepared certificate from a future view")
+		}
+		if cert.PrePrepare.Seq <= vc.StableSeq || cert.PrePrepare.Seq > vc.StableSeq+logSize {
+			return errors.New("prepared certificate outside of the watermarks")
+		}
+		if err := pbft.verifyPreparedCert(cert); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyNewView checks that a new view has been sent by the primary of the
+// view, is justified by a quorum of view changes, and re-proposes the
+// requests with the highest prepared certificates. It returns the sequence
+// number of the latest stable checkpoint of the view changes.
+func (pbft *PbftProtocol) verifyNewView(nv *NewView) (int, error) {
+	if nv.Sender != pbft.primary(nv.View).ServerIdentity.ID.String() {
+		return 0, fmt.Errorf("new view %d not sent by the primary", nv.View)
+	}
+	err := pbft.verifySig(nv.Sender, nv.payload(), nv.Sig)
+	if err != nil {
+		return 0, err
+	}
+
+	senders := make(map[string]bool)
+	for i := range nv.ViewChanges {
+		vc := &nv.ViewChanges[i]
+		if vc.View != nv.View {
+			return 0, errors.New("view change for another view")
+		}
+		if err := pbft.verifyViewChange(vc); err != nil {
+			return 0, err
+		}
+		senders[vc.Sender] = true
+	}
+	if len(senders) < pbft.quorum() {
+		return 0, fmt.Errorf("only %d view changes in the new view", len(senders))
+	}
+
+	minS, batches := reproposals(nv.ViewChanges)
+	if len(batches) != len(nv.PrePrepares) {
+		return 0, errors.New("new view doesn't re-propose all the sequence numbers")
+	}
+	for i, batch := range batches {
+		pp := &nv.PrePrepares[i]
+		if pp.View != nv.View || pp.Seq != minS+1+i {
+			return 0, errors.New("pre-prepare for another slot")
+		}
+		if err := pbft.verifyPrePrepare(pp); err != nil {
+			return 0, err
+		}
+		if !bytes.Equal(batchDigest(batch), pp.Digest) {
+			return 0, errors.New("new view doesn't re-propose the prepared batch")
+		}
+	}
+	return minS, nil
+}
+
+// reproposals returns the latest stable checkpoint among the view changes
+// and, for every following sequence number up to the highest prepared one,
+// the batch of the prepared certificate with the highest view, or nil for a
+// null request.
+func reproposals(vcs []ViewChange) (int, [][]Request) {
+	minS, maxS := 0, 0
+	for _, vc := range vcs {
+		if vc.StableSeq > minS {
+			minS = vc.StableSeq
+		}
+	}
+	certs := make(map[int]*PreparedCert)
+	for _, vc := range vcs {
+		for i := range vc.Prepared {
+			cert := &vc.Prepared[i]
+			seq := cert.PrePrepare.Seq
+			if seq <= minS {
+				continue
+			}
+			if c, ok := certs[seq]; !ok || cert.PrePrepare.View > c.PrePrepare.View {
+				certs[seq] = cert
+			}
+			if seq > maxS {
+				maxS = seq
+			}
+		}
+	}
+	var batches [][]Request
+	for seq := minS + 1; seq <= maxS; seq++ {
+		var batch []Request
+		if cert, ok := certs[seq]; ok {
+			batch = cert.PrePrepare.Requests
+		}
+		batches = append(batches, batch)
+	}
+	return minS, batches
+}
+
+// payload returns the bytes signed by the sender of the view change.
+func (vc *ViewChange) payload() []byte {
+	h := sha512.New()
+	for _, cert := range vc.Prepared {
+		binary.Write(h, binary.LittleEndian, int64(cert.PrePrepare.View))
+		binary.Write(h, binary.LittleEndian, int64(cert.PrePrepare.Seq))
+		h.Write(cert.PrePrepare.Digest)
+	}
+	return payload("viewchange", vc.View, vc.StableSeq, h.Sum(nil))
+}
+
+// payload returns the bytes signed by the sender of the new view.
+func (nv *NewView) payload() []byte {
+	h := sha512.New()
+	for _, pp := range nv.PrePrepares {
+		binary.Write(h, binary.LittleEndian, int64(pp.Seq))
+		h.Write(pp.Digest)
+	}
+	return payload("newview", nv.View, 0, h.Sum(nil))
+}
+
+// discardViews forgets the view changes of the views before the current one,
+// which can't lead to a new view anymore.
+func (pbft *PbftProtocol) discardViews() {
+	for view := range pbft.viewChanges {
+		if view < pbft.view {
+			delete(pbft.viewChanges, view)
+		}
+	}
+	for view := range pbft.sentNewView {
+		if view < pbft.view {
+			delete(pbft.sentNewView, view)
+		}
+	}
+}
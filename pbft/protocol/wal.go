@@ -0,0 +1,425 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/network"
+)
+
+// Types of the records of the write-ahead log.
+const (
+	// recordPrePrepare is written once a pre-prepare has been accepted,
+	// before the primary sends it.
+	recordPrePrepare = "preprepare"
+	// recordPrepare is written before the prepare of a slot is sent.
+	recordPrepare = "prepare"
+	// recordCommit holds the prepared certificate, written before the
+	// commit of a slot is sent.
+	recordCommit = "commit"
+	// recordCommitted is written before a committed request is executed.
+	recordCommitted = "committed"
+	// recordCheckpoint holds the own checkpoint of the replica and the
+	// snapshot and configuration it signs, written before the checkpoint
+	// is sent.
+	recordCheckpoint = "checkpoint"
+	// recordStable holds the last stable checkpoint, its proof, its
+	// snapshot and its configuration. It replaces all the records up to it
+	// at compaction.
+	recordStable = "stable"
+	// recordView is written whenever the replica moves to another view.
+	recordView = "view"
+)
+
+// WALDir is the directory of the file-backed logs of the replicas created by
+// NewProtocol.
+var WALDir = filepath.Join(os.TempDir(), "pbft")
+
+// Record is an entry of the write-ahead log of a replica. Only the fields
+// used by its Type are set.
+type Record struct {
+	Type         string
+	View         int
+	ViewChanging bool
+	Seq          int
+	Digest       []byte
+	PrePrepare   *PrePrepare
+	Requests     []Request
+	Prepared     *PreparedCert
+	Checkpoint   *Checkpoint
+	Snapshot     []byte
+	Config       *Configuration
+	Proof        []Checkpoint
+}
+
+// WAL is the write-ahead log of a replica. The replica appends its decisions
+// to it before sending the messages that depend on them, so that after a
+// crash it replays the log and never contradicts the votes it already sent.
+type WAL interface {
+	// Append durably appends the record to the log.
+	Append(r *Record) error
+	// Records returns the records of the log, in the order they were
+	// appended.
+	Records() ([]*Record, error)
+	// Compact atomically replaces the records of the log.
+	Compact(records []*Record) error
+	// Discard deletes the log once the replica stopped cleanly.
+	Discard() error
+	// Close releases the log, keeping its records.
+	Close() error
+}
+
+// MemoryWAL keeps the records in memory. It survives a replica as long as it
+// is handed over to the next one, which is enough for tests.
+type MemoryWAL struct {
+	sync.Mutex
+	records []*Record
+}
+
+// NewMemoryWAL returns an empty in-memory log.
+func NewMemoryWAL() *MemoryWAL {
+	return &MemoryWAL{}
+}
+
+// Append implements WAL.
+func (w *MemoryWAL) Append(r *Record) error {
+	w.Lock()
+	defer w.Unlock()
+	w.records = append(w.records, r)
+	return nil
+}
+
+// Records implements WAL.
+func (w *MemoryWAL) Records() ([]*Record, error) {
+	w.Lock()
+	defer w.Unlock()
+	return append([]*Record{}, w.records...), nil
+}
+
+// Compact implements WAL.
+func (w *MemoryWAL) Compact(records []*Record) error {
+	w.Lock()
+	defer w.Unlock()
+	w.records = append([]*Record{}, records...)
+	return nil
+}
+
+// Discard implements WAL.
+func (w *MemoryWAL) Discard() error {
+	return w.Compact(nil)
+}
+
+// Close implements WAL.
+func (w *MemoryWAL) Close() error {
+	return nil
+}
+
+// FileWAL appends the records to a file, each one prefixed by its length, and
+// syncs the file before returning.
+type FileWAL struct {
+	sync.Mutex
+	path  string
+	suite network.Suite
+	file  *os.File
+}
+
+// NewFileWAL opens the log stored at path, creating it if needed. The suite
+// is used to decode the public keys of the records.
+func NewFileWAL(path string, suite network.Suite) (*FileWAL, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &FileWAL{path: path, suite: suite, file: file}, nil
+}
+
+// Append implements WAL.
+func (w *FileWAL) Append(r *Record) error {
+	w.Lock()
+	defer w.Unlock()
+	if w.file == nil {
+		return errors.New("log is closed")
+	}
+	buf, err := encodeRecord(r)
+	if err != nil {
+		return err
+	}
+	if _, err := w.file.Write(buf); err != nil {
+		return err
+	}
+	return w.file.Sync()
+}
+
+// Records implements WAL. A record only partially written when the replica
+// crashed is ignored, and cut off the file so that the next records are
+// appended after the last complete one.
+func (w *FileWAL) Records() ([]*Record, error) {
+	w.Lock()
+	defer w.Unlock()
+	buf, err := ioutil.ReadFile(w.path)
+	if err != nil {
+		return nil, err
+	}
+	var records []*Record
+	r := bytes.NewReader(buf)
+	end := 0
+	for {
+		var size uint32
+		if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+			break
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			break
+		}
+		_, msg, err := network.Unmarshal(data, w.suite)
+		if err != nil {
+			return nil, err
+		}
+		record, ok := msg.(*Record)
+		if !ok {
+			return nil, fmt.Errorf("unexpected %T in the log", msg)
+		}
+		records = append(records, record)
+		end = len(buf) - r.Len()
+	}
+	if end < len(buf) && w.file != nil {
+		if err := w.file.Truncate(int64(end)); err != nil {
+			return nil, err
+		}
+		if err := w.file.Sync(); err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+// Compact implements WAL. The records are written to a temporary file which
+// then replaces the log, so that a crash leaves either the old or the new
+// records.
+func (w *FileWAL) Compact(records []*Record) error {
+	w.Lock()
+	defer w.Unlock()
+	if w.file == nil {
+		return errors.New("log is closed")
+	}
+	var buf bytes.Buffer
+	for _, r := range records {
+		b, err := encodeRecord(r)
+		if err != nil {
+			return err
+		}
+		buf.Write(b)
+	}
+
+	tmp := w.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(buf.Bytes()); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, w.path); err != nil {
+		return err
+	}
+
+	w.file.Close()
+	w.file, err = os.OpenFile(w.path, os.O_RDWR|os.O_APPEND, 0600)
+	return err
+}
+
+// Discard implements WAL.
+func (w *FileWAL) Discard() error {
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return os.Remove(w.path)
+}
+
+// Close implements WAL.
+func (w *FileWAL) Close() error {
+	w.Lock()
+	defer w.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// encodeRecord returns the record prefixed by its length.
+func encodeRecord(r *Record) ([]byte, error) {
+	data, err := network.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, uint32(len(data)))
+	buf.Write(data)
+	return buf.Bytes(), nil
+}
+
+// persist durably appends the record to the log of the replica. The records
+// replayed after a crash are not appended again.
+func (pbft *PbftProtocol) persist(r *Record) error {
+	if pbft.replaying {
+		return nil
+	}
+	if err := pbft.wal.Append(r); err != nil {
+		return fmt.Errorf("couldn't write to the log: %v", err)
+	}
+	pbft.walRecords = append(pbft.walRecords, r)
+	return nil
+}
+
+// persistView records the current view of the replica.
+func (pbft *PbftProtocol) persistView() error {
+	return pbft.persist(&Record{Type: recordView, View: pbft.view, ViewChanging: pbft.viewChanging})
+}
+
+// persistPrePrepare stores the pre-prepare in its slot of the log and
+// records it, unless the slot already holds it.
+func (pbft *PbftProtocol) persistPrePrepare(pp *PrePrepare) error {
+	e := pbft.entry(pp.View, pp.Seq)
+	if e.prePrepare != nil {
+		return nil
+	}
+	if err := pbft.persist(&Record{Type: recordPrePrepare, View: pp.View, Seq: pp.Seq, PrePrepare: pp}); err != nil {
+		return err
+	}
+	e.prePrepare = pp
+	return nil
+}
+
+// compact replaces the records up to the stable checkpoint seq with a single
+// record holding its proof and its snapshot.
+func (pbft *PbftProtocol) compact(seq int) error {
+	records := []*Record{
+		{Type: recordStable, Seq: seq, Proof: pbft.stableProof, Snapshot: pbft.snapshots[seq], Config: pbft.configs[seq]},
+		{Type: recordView, View: pbft.view, ViewChanging: pbft.viewChanging},
+	}
+	for _, r := range pbft.walRecords {
+		if r.Seq > seq && r.Type != recordStable && r.Type != recordView {
+			records = append(records, r)
+		}
+	}
+	if err := pbft.wal.Compact(records); err != nil {
+		return fmt.Errorf("couldn't compact the log: %v", err)
+	}
+	pbft.walRecords = records
+	return nil
+}
+
+// replay restores the state of the replica from its log after a crash: the
+// last stable checkpoint, the view, and the messages it sent after the
+// checkpoint. The committed requests are then executed again on top of the
+// snapshot.
+func (pbft *PbftProtocol) replay() error {
+	records, err := pbft.wal.Records()
+	if err != nil {
+		return fmt.Errorf("couldn't read the log: %v", err)
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	log.Lvl2(pbft.ServerIdentity(), "replaying", len(records), "records of the log")
+	pbft.walRecords = records
+	pbft.replaying = true
+	defer func() { pbft.replaying = false }()
+
+	for _, r := range records {
+		switch r.Type {
+		case recordStable:
+			if err := pbft.stateMachine.Restore(r.Snapshot); err != nil {
+				return err
+			}
+			pbft.stableSeq = r.Seq
+			pbft.stableProof = r.Proof
+			pbft.lastExecuted = r.Seq
+			pbft.snapshots[r.Seq] = r.Snapshot
+			if r.Config != nil {
+				pbft.configs[r.Seq] = r.Config
+				pbft.applyConfig(*r.Config)
+			}
+		case recordView:
+			pbft.view = r.View
+			pbft.viewChanging = r.ViewChanging
+		case recordPrePrepare:
+			pp := r.PrePrepare
+			pbft.entry(pp.View, pp.Seq).prePrepare = pp
+			pbft.addBatch(pp.Digest, pp.Requests)
+			if pp.Seq >= pbft.nextSeq {
+				pbft.nextSeq = pp.Seq + 1
+			}
+		case recordPrepare:
+			pbft.entry(r.View, r.Seq).sentPrepare = true
+			pbft.verified[string(r.Digest)] = true
+		case recordCommit:
+			pbft.entry(r.View, r.Seq).sentCommit = true
+			pbft.prepared[r.Seq] = r.Prepared
+		case recordCommitted:
+			pbft.entry(r.View, r.Seq).committed = true
+			pbft.committed[r.Seq] = r.Digest
+			if r.Requests != nil {
+				pbft.addBatch(r.Digest, r.Requests)
+			}
+		case recordCheckpoint:
+			cp := r.Checkpoint
+			if pbft.checkpoints[cp.Seq] == nil {
+				pbft.checkpoints[cp.Seq] = make(map[string]*Checkpoint)
+			}
+			pbft.checkpoints[cp.Seq][cp.Sender] = cp
+			pbft.snapshots[cp.Seq] = r.Snapshot
+			if r.Config != nil {
+				pbft.configs[cp.Seq] = r.Config
+			}
+		default:
+			return fmt.Errorf("unknown record %q in the log", r.Type)
+		}
+	}
+	if pbft.nextSeq <= pbft.lastExecuted {
+		pbft.nextSeq = pbft.lastExecuted + 1
+	}
+	if pbft.viewChanging {
+		// the view change might have been lost in the crash: the timer
+		// moves on to the next view if the new primary doesn't show up
+		pbft.viewTimer = time.After(pbft.Timeout)
+	}
+	return pbft.execute()
+}
+
+// closeWAL closes the log of the replica, keeping its records for the replay.
+func (pbft *PbftProtocol) closeWAL() {
+	if err := pbft.wal.Close(); err != nil {
+		log.Error(pbft.ServerIdentity(), "couldn't close the log:", err)
+	}
+}
+
+// discardWAL deletes the log of a replica that stopped cleanly.
+func (pbft *PbftProtocol) discardWAL() {
+	if err := pbft.wal.Discard(); err != nil {
+		log.Error(pbft.ServerIdentity(), "couldn't delete the log:", err)
+	}
+}
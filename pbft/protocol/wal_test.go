@@ -0,0 +1,215 @@
+package protocol
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/dedis/kyber/util/key"
+	"github.com/dedis/onet"
+)
+
+func TestWAL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pbft")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "replica.wal")
+
+	client := key.NewKeyPair(tSuite)
+	req := Request{Msg: []byte("request"), Timestamp: 1, Client: client.Public}
+	records := []*Record{
+		{Type: recordView, View: 1, ViewChanging: true},
+		{Type: recordPrePrepare, View: 1, Seq: 1, PrePrepare: &PrePrepare{View: 1, Seq: 1, Requests: []Request{req}, Digest: batchDigest([]Request{req})}},
+		{Type: recordPrepare, View: 1, Seq: 1, Digest: req.Digest()},
+		{Type: recordCheckpoint, Seq: 4, Checkpoint: &Checkpoint{Seq: 4, State: []byte("state")}, Snapshot: []byte("snapshot")},
+	}
+
+	check := func(w WAL, want []*Record) {
+		got, err := w.Records()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(want) {
+			t.Fatal("got", len(got), "records instead of", len(want))
+		}
+		for i := range want {
+			if got[i].Type != want[i].Type || got[i].View != want[i].View || got[i].Seq != want[i].Seq ||
+				got[i].ViewChanging != want[i].ViewChanging || !bytes.Equal(got[i].Snapshot, want[i].Snapshot) {
+				t.Fatal("record", i, "differs:", got[i], "instead of", want[i])
+			}
+			if want[i].PrePrepare != nil && !got[i].PrePrepare.Requests[0].Client.Equal(client.Public) {
+				t.Fatal("request of record", i, "has the wrong client")
+			}
+		}
+	}
+
+	file, err := NewFileWAL(path, tSuite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range []WAL{NewMemoryWAL(), file} {
+		for _, r := range records {
+			if err := w.Append(r); err != nil {
+				t.Fatal(err)
+			}
+		}
+		check(w, records)
+		if err := w.Compact(records[2:]); err != nil {
+			t.Fatal(err)
+		}
+		check(w, records[2:])
+		if err := w.Append(records[0]); err != nil {
+			t.Fatal(err)
+		}
+		check(w, append(records[2:], records[0]))
+	}
+
+	// the records survive the replica, except for a record that was only
+	// partially written when it crashed
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte{42, 0, 0, 0, 1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	file, err = NewFileWAL(path, tSuite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(file, append(records[2:], records[0]))
+
+	// the records appended after the crash follow the complete ones, and
+	// survive the next crash
+	if err := file.Append(records[1]); err != nil {
+		t.Fatal(err)
+	}
+	check(file, append(records[2:], records[0], records[1]))
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+	file, err = NewFileWAL(path, tSuite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(file, append(records[2:], records[0], records[1]))
+
+	if err := file.Discard(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("the log wasn't deleted")
+	}
+}
+
+func TestReplay(t *testing.T) {
+
+	timeout := 5 * time.Second
+	nbrRequests := 10
+
+	oldInterval, oldSize := checkpointInterval, logSize
+	checkpointInterval, logSize = 4, 8
+	defer func() {
+		checkpointInterval, logSize = oldInterval, oldSize
+	}()
+
+	local := onet.NewLocalTest(tSuite)
+	defer local.CloseAll()
+	local.Check = onet.CheckNone
+	_, _, tree := local.GenTree(4, true)
+
+	pi, err := local.CreateProtocol(logTestProtocolName, tree)
+	if err != nil {
+		t.Fatal("Error in creation of protocol:", err)
+	}
+	protocol := pi.(*PbftProtocol)
+	protocol.Timeout = timeout
+
+	results := make(chan *Result, nbrRequests)
+	protocol.RegisterOnResult(func(r *Result) {
+		results <- r
+	})
+
+	if err := protocol.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < nbrRequests; i++ {
+		if err := protocol.Submit([]byte("request " + strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 1; i <= nbrRequests; i++ {
+		select {
+		case <-results:
+		case <-time.After(timeout):
+			t.Fatal("request", i, "never got enough replies")
+		}
+	}
+
+	// the root, which is the primary, crashes once it executed every
+	// request and made a checkpoint stable
+	deadline := time.After(timeout)
+	var records []*Record
+	for {
+		records, err = protocol.wal.Records()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(protocol.stateMachine.Snapshot()) == strconv.Itoa(nbrRequests) &&
+			len(records) > 0 && records[0].Type == recordStable {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatal("the root never made a checkpoint stable")
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	protocol.Stop()
+
+	stable := records[0].Seq
+	for _, r := range records[1:] {
+		if r.Type != recordView && r.Seq <= stable {
+			t.Fatal("record", r.Type, "for sequence number", r.Seq, "kept after the stable checkpoint", stable)
+		}
+	}
+
+	// a new replica recovers the state from the log
+	wal := NewMemoryWAL()
+	if err := wal.Compact(records); err != nil {
+		t.Fatal(err)
+	}
+	n, err := local.NewTreeNodeInstance(tree.Root, logTestProtocolName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm := &counter{}
+	recovered, err := NewPbftProtocol(n, func(msg, data []byte) bool { return true }, sm, wal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := recovered.replay(); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(sm.Snapshot()) != strconv.Itoa(nbrRequests) {
+		t.Fatal("replayed", string(sm.Snapshot()), "requests instead of", nbrRequests)
+	}
+	if recovered.stableSeq != stable || recovered.lastExecuted != nbrRequests {
+		t.Fatal("recovered at stable checkpoint", recovered.stableSeq, "and sequence number", recovered.lastExecuted)
+	}
+	// the primary doesn't reuse the sequence numbers it assigned
+	if recovered.nextSeq <= nbrRequests {
+		t.Fatal("the primary would assign sequence number", recovered.nextSeq, "again")
+	}
+}
@@ -0,0 +1,151 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"time"
+
+	"bls-ftcosi/pbft/protocol"
+	"github.com/dedis/kyber"
+	"github.com/dedis/kyber/sign/schnorr"
+	"github.com/dedis/kyber/util/key"
+	"github.com/dedis/onet"
+	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/network"
+)
+
+// Client submits requests to the pbft replicas of a roster. Its requests are
+// signed with its key pair and ordered by their timestamps.
+type Client struct {
+	*onet.Client
+	suite network.Suite
+	keys *key.Pair
+
+	sync.Mutex
+	timestamp int64
+}
+
+// NewClient returns a client signing its requests with the given keys.
+func NewClient(suite network.Suite, keys *key.Pair) *Client {
+	return &Client{
+		Client: onet.NewClient(suite, ServiceName),
+		suite: suite,
+		keys: keys,
+	}
+}
+
+// Setup starts the replicas of the roster. It is signed with the private key
+// of the first node of the roster, which runs the root.
+func (c *Client) Setup(roster *onet.Roster, timeout time.Duration, private kyber.Scalar) error {
+	req := &Setup{Roster: roster, Timeout: timeout, Timestamp: time.Now().UnixNano()}
+	var err error
+	req.Sig, err = schnorr.Sign(c.suite, private, req.payload())
+	if err != nil {
+		return err
+	}
+	return c.SendProtobuf(roster.List[0], req, &SetupReply{})
+}
+
+// Request submits the message to the replicas of the roster and returns the
+// reply agreed on by f+1 of them. The request is sent to every replica: the
+// backups relay it to the primary, and elect a new one if it is not ordered
+// in time. If not enough replicas answer within the timeout, the request is
+// sent again, so that the replicas which missed it reply as well.
+func (c *Client) Request(roster *onet.Roster, msg []byte, timeout time.Duration) (*protocol.Reply, error) {
+	req, err := c.newRequest(msg, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return c.request(roster, req)
+}
+
+// newRequest returns a signed request with a new timestamp.
+func (c *Client) newRequest(msg []byte, timeout time.Duration) (*protocol.Request, error) {
+	c.Lock()
+	timestamp := time.Now().UnixNano()
+	if timestamp <= c.timestamp {
+		timestamp = c.timestamp + 1
+	}
+	c.timestamp = timestamp
+	c.Unlock()
+
+	req := &protocol.Request{Msg: msg, Timestamp: timestamp, Client: c.keys.Public, Timeout: timeout}
+	var err error
+	req.Sig, err = schnorr.Sign(c.suite, c.keys.Private, req.Digest())
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func (c *Client) request(roster *onet.Roster, req *protocol.Request) (*protocol.Reply, error) {
+	n := len(roster.List)
+	replies := make(chan *indexedReply, 2*n)
+	send := func(i int) {
+		go func() {
+			reply := &ClientReply{}
+			if err := c.SendProtobuf(roster.List[i], &ClientRequest{Request: *req}, reply); err != nil {
+				log.Lvl2("replica", i, "didn't reply:", err)
+				return
+			}
+			replies <- &indexedReply{i, &reply.Reply}
+		}()
+	}
+
+	sendAll := func() {
+		for i := range roster.List {
+			send(i)
+		}
+	}
+	sendAll()
+	retry := time.After(req.Timeout)
+	timeout := time.After(2 * req.Timeout)
+
+	digest := req.Digest()
+	received := make(map[int]*protocol.Reply)
+	for {
+		select {
+		case r := <-replies:
+			i, reply := r.index, r.reply
+			if !bytes.Equal(reply.Digest, digest) {
+				continue
+			}
+			var err error
+			if reply.MAC != nil {
+				err = reply.VerifyMAC(c.suite, c.keys.Private, roster.List[i].Public)
+			} else {
+				err = reply.Verify(c.suite, roster.List[i].Public)
+			}
+			if err != nil {
+				log.Lvl2("invalid reply of replica", i, ":", err)
+				continue
+			}
+			received[i] = reply
+
+			matching := 0
+			for _, other := range received {
+				if other.Rejected == reply.Rejected && bytes.Equal(other.Result, reply.Result) {
+					matching++
+				}
+			}
+			if matching >= (n-1)/3+1 {
+				if reply.Rejected {
+					return nil, errors.New("request older than the last one of the client")
+				}
+				return reply, nil
+			}
+		case <-retry:
+			log.Lvl2("not enough replies in time, sending the request again")
+			sendAll()
+		case <-timeout:
+			return nil, errors.New("didn't get enough matching replies")
+		}
+	}
+}
+
+// indexedReply is the reply of the replica at the given index of the roster.
+type indexedReply struct {
+	index int
+	reply *protocol.Reply
+}
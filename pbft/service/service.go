@@ -0,0 +1,137 @@
+package service
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	"bls-ftcosi/pbft/protocol"
+	"github.com/dedis/cothority"
+	"github.com/dedis/kyber/sign/schnorr"
+	"github.com/dedis/onet"
+	"github.com/dedis/onet/log"
+)
+
+// ServiceName is the name under which the service is registered.
+const ServiceName = "PBFTService"
+
+func init() {
+	if _, err := onet.RegisterNewService(ServiceName, newService); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Service runs the pbft replica of its node and lets external clients submit
+// requests to it.
+type Service struct {
+	*onet.ServiceProcessor
+
+	replica *protocol.PbftProtocol
+	replicaMut sync.Mutex
+	// timestamp of the last Setup, so that it can't be replayed
+	setupTimestamp int64
+}
+
+func newService(c *onet.Context) (onet.Service, error) {
+	s := &Service{
+		ServiceProcessor: onet.NewServiceProcessor(c),
+	}
+	if err := s.RegisterHandlers(s.Setup, s.ClientRequest); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Setup starts the replicas of the roster, rooted at this node. It must be
+// signed with the private key of this node. The replicas use the timeout of
+// the Setup, which the root gives them through the configuration of the
+// protocol.
+func (s *Service) Setup(req *Setup) (*SetupReply, error) {
+	if req.Roster == nil {
+		return nil, errors.New("no roster")
+	}
+	if err := schnorr.Verify(cothority.Suite, s.ServerIdentity().Public, req.payload(), req.Sig); err != nil {
+		return nil, errors.New("setup not signed by this node: " + err.Error())
+	}
+	if err := protocol.CheckTimeout(req.Timeout); err != nil {
+		return nil, err
+	}
+	s.replicaMut.Lock()
+	if req.Timestamp <= s.setupTimestamp {
+		s.replicaMut.Unlock()
+		return nil, errors.New("setup older than the last one")
+	}
+	s.setupTimestamp = req.Timestamp
+	s.replicaMut.Unlock()
+
+	tree := req.Roster.GenerateNaryTreeWithRoot(len(req.Roster.List)-1, s.ServerIdentity())
+	if tree == nil {
+		return nil, errors.New("this node is not part of the roster")
+	}
+	pi, err := s.CreateProtocol(protocol.DefaultProtocolName, tree)
+	if err != nil {
+		return nil, err
+	}
+	replica := pi.(*protocol.PbftProtocol)
+	replica.Timeout = req.Timeout
+	config := make([]byte, 8)
+	binary.LittleEndian.PutUint64(config, uint64(req.Timeout))
+	if err := replica.SetConfig(&onet.GenericConfig{Data: config}); err != nil {
+		return nil, err
+	}
+	if err := replica.Start(); err != nil {
+		return nil, err
+	}
+	s.setReplica(replica)
+	return &SetupReply{}, nil
+}
+
+// ClientRequest orders the request of a client and returns the reply of this
+// replica once it has been executed.
+func (s *Service) ClientRequest(req *ClientRequest) (*ClientReply, error) {
+	s.replicaMut.Lock()
+	replica := s.replica
+	s.replicaMut.Unlock()
+	if replica == nil {
+		return nil, errors.New("no replica running on this node")
+	}
+	reply, err := replica.HandleClientRequest(&req.Request)
+	if err != nil {
+		return nil, err
+	}
+	return &ClientReply{Reply: *reply}, nil
+}
+
+// NewProtocol keeps track of the replica started on this node by the root.
+func (s *Service) NewProtocol(tn *onet.TreeNodeInstance, conf *onet.GenericConfig) (onet.ProtocolInstance, error) {
+	if tn.ProtocolName() != protocol.DefaultProtocolName {
+		return nil, nil
+	}
+	pi, err := protocol.NewProtocol(tn)
+	if err != nil {
+		return nil, err
+	}
+	replica := pi.(*protocol.PbftProtocol)
+	if timeout, ok := configTimeout(conf); ok {
+		replica.Timeout = timeout
+	}
+	s.setReplica(replica)
+	return pi, nil
+}
+
+// configTimeout returns the timeout set by the root in the configuration of
+// the protocol, if it is valid.
+func configTimeout(conf *onet.GenericConfig) (time.Duration, bool) {
+	if conf == nil || len(conf.Data) != 8 {
+		return 0, false
+	}
+	timeout := time.Duration(binary.LittleEndian.Uint64(conf.Data))
+	return timeout, protocol.CheckTimeout(timeout) == nil
+}
+
+func (s *Service) setReplica(replica *protocol.PbftProtocol) {
+	s.replicaMut.Lock()
+	defer s.replicaMut.Unlock()
+	s.replica = replica
+}
@@ -0,0 +1,71 @@
+package service
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/dedis/kyber/group/edwards25519"
+	"github.com/dedis/kyber/util/key"
+	"github.com/dedis/onet"
+)
+
+var tSuite = edwards25519.NewBlakeSHA256Ed25519()
+
+func TestClient(t *testing.T) {
+	timeout := 5 * time.Second
+
+	local := onet.NewTCPTest(tSuite)
+	defer local.CloseAll()
+	servers, roster, _ := local.GenTree(4, true)
+
+	c := NewClient(tSuite, key.NewKeyPair(tSuite))
+	// only the operator of the root can start the replicas
+	if err := c.Setup(roster, timeout, c.keys.Private); err == nil {
+		t.Fatal("setup signed by the client accepted")
+	}
+	if err := c.Setup(roster, 0, local.GetPrivate(servers[0])); err == nil {
+		t.Fatal("setup without timeout accepted")
+	}
+	if err := c.Setup(roster, timeout, local.GetPrivate(servers[0])); err != nil {
+		t.Fatal(err)
+	}
+
+	// the replicas don't wait forever, nor never, for a request
+	req, err := c.newRequest([]byte("dedis"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SendProtobuf(roster.List[1], &ClientRequest{Request: *req}, &ClientReply{}); err == nil {
+		t.Fatal("request without timeout accepted")
+	}
+
+	var last *ClientRequest
+	for i := 1; i <= 5; i++ {
+		req, err := c.newRequest([]byte("dedis"), timeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply, err := c.request(roster, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply.Seq != i {
+			t.Fatal("request executed with sequence number", reply.Seq, "instead of", i)
+		}
+		if !bytes.Equal(reply.Digest, req.Digest()) {
+			t.Fatal("reply for another request")
+		}
+		last = &ClientRequest{Request: *req}
+	}
+
+	// sending the last request again returns the same reply without
+	// executing it twice
+	reply, err := c.request(roster, &last.Request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Seq != 5 {
+		t.Fatal("request executed twice")
+	}
+}
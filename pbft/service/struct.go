@@ -0,0 +1,52 @@
+package service
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+	"time"
+
+	"bls-ftcosi/pbft/protocol"
+	"github.com/dedis/onet"
+	"github.com/dedis/onet/network"
+)
+
+func init() {
+	network.RegisterMessages(Setup{}, SetupReply{}, ClientRequest{}, ClientReply{})
+}
+
+// Setup asks the first node of the roster to start the replicas, with the
+// given timeout. It is signed with the private key of that node, so that only
+// the operator of the node starts and configures the replicas, and Timestamp
+// must increase from one Setup to the next.
+type Setup struct {
+	Roster *onet.Roster
+	Timeout time.Duration
+	Timestamp int64
+	Sig []byte
+}
+
+// payload returns the bytes signed in a Setup.
+func (s *Setup) payload() []byte {
+	h := sha512.New()
+	h.Write([]byte("setup"))
+	for _, si := range s.Roster.List {
+		si.Public.MarshalTo(h)
+		h.Write([]byte(si.Address))
+	}
+	binary.Write(h, binary.LittleEndian, int64(s.Timeout))
+	binary.Write(h, binary.LittleEndian, s.Timestamp)
+	return h.Sum(nil)
+}
+
+// SetupReply is returned once the replicas are started.
+type SetupReply struct{}
+
+// ClientRequest holds a signed request of a client.
+type ClientRequest struct {
+	Request protocol.Request
+}
+
+// ClientReply holds the reply of one replica, once it executed the request.
+type ClientReply struct {
+	Reply protocol.Reply
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"bls-ftcosi/pbft/protocol"
+	"github.com/dedis/onet"
+	"github.com/dedis/onet/log"
+	"github.com/dedis/onet/network"
+)
+
+// simulationProtocols maps the pbft protocols to the names under which the
+// simulation runs them, so that it can make some replicas Byzantine.
+var simulationProtocols = map[string]string{
+	protocol.DefaultProtocolName: "PBFTSimulation",
+	protocol.MACProtocolName:     "PBFTMACSimulation",
+	protocol.LinearProtocolName:  "PBFTLinearSimulation",
+}
+
+// byzantine holds the faults of the Byzantine servers of this process.
+var byzantine = struct {
+	sync.Mutex
+	faults map[network.ServerIdentityID]protocol.Fault
+}{faults: make(map[network.ServerIdentityID]protocol.Fault)}
+
+func init() {
+	constructors := map[string]onet.NewProtocol{
+		protocol.DefaultProtocolName: protocol.NewProtocol,
+		protocol.MACProtocolName:     protocol.NewMACProtocol,
+		protocol.LinearProtocolName:  protocol.NewLinearProtocol,
+	}
+	for name, simulationName := range simulationProtocols {
+		onet.GlobalProtocolRegister(simulationName, withFault(constructors[name]))
+	}
+}
+
+// withFault returns a constructor of replicas that are Byzantine on the
+// servers configured so.
+func withFault(newProtocol onet.NewProtocol) onet.NewProtocol {
+	return func(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+		pi, err := newProtocol(n)
+		if err != nil {
+			return nil, err
+		}
+		byzantine.Lock()
+		defer byzantine.Unlock()
+		pi.(*protocol.PbftProtocol).Fault = byzantine.faults[n.ServerIdentity().ID]
+		return pi, nil
+	}
+}
+
+// checkFaults returns an error if the faults of the simulation can't be
+// injected: pbft tolerates up to f crashed or Byzantine replicas out of
+// 3f+1, and the root, client of the replicas, must be correct, except as a
+// replica with CrashPrimary.
+func (s *SimulationProtocol) checkFaults() error {
+	if s.Byzantine > 0 {
+		if fault, err := protocol.ParseFault(s.ByzantineFault); err != nil {
+			return err
+		} else if fault == protocol.Correct {
+			return fmt.Errorf("ByzantineFault must be set for %d Byzantine replicas", s.Byzantine)
+		}
+	}
+	if faulty, f := s.faulty(), (s.Hosts-1)/3; faulty > f {
+		return fmt.Errorf("%d faulty replicas but pbft tolerates only %d out of %d", faulty, f, s.Hosts)
+	}
+	if s.Crashed+s.Byzantine+s.Slow >= s.Hosts {
+		return fmt.Errorf("the root must be correct")
+	}
+	return nil
+}
+
+// faulty returns the number of crashed and Byzantine replicas.
+func (s *SimulationProtocol) faulty() int {
+	faulty := s.Crashed + s.Byzantine
+	if s.CrashPrimary {
+		faulty++
+	}
+	return faulty
+}
+
+// injectFaults makes the replica at the given index of the roster faulty. The
+// root crashes as a replica with CrashPrimary, the last Crashed replicas of
+// the roster drop all their messages, the Byzantine replicas before them run
+// with ByzantineFault, and the Slow replicas before them process every
+// message SlowDelay milliseconds late.
+func (s *SimulationProtocol) injectFaults(config *onet.SimulationConfig, index int) error {
+	server := config.Server
+	switch fromEnd := len(config.Roster.List) - index; {
+	case index == 0 && s.CrashPrimary:
+		log.Lvl2("primary", index, "crashed")
+		byzantine.Lock()
+		byzantine.faults[server.ServerIdentity.ID] = protocol.Crash
+		byzantine.Unlock()
+	case fromEnd <= s.Crashed:
+		log.Lvl2("replica", index, "crashed")
+		server.RegisterProcessorFunc(onet.ProtocolMsgID, func(e *network.Envelope) {})
+	case fromEnd <= s.Crashed+s.Byzantine:
+		fault, err := protocol.ParseFault(s.ByzantineFault)
+		if err != nil {
+			return err
+		}
+		log.Lvl2("replica", index, "is Byzantine:", s.ByzantineFault)
+		byzantine.Lock()
+		byzantine.faults[server.ServerIdentity.ID] = fault
+		byzantine.Unlock()
+	case fromEnd <= s.Crashed+s.Byzantine+s.Slow:
+		log.Lvl2("replica", index, "is slow")
+		delay := time.Duration(s.SlowDelay) * time.Millisecond
+		// every message is delayed on its own, without holding up the
+		// messages received in the meantime
+		server.RegisterProcessorFunc(onet.ProtocolMsgID, func(e *network.Envelope) {
+			time.AfterFunc(delay, func() {
+				config.Overlay.Process(e)
+			})
+		})
+	}
+	return nil
+}
@@ -22,14 +22,13 @@ In the Node-method you can read the files that have been created by the
 import (
 	"fmt"
 	"time"
-	"errors"
 
 	"github.com/BurntSushi/toml"
 	"github.com/dedis/onet"
 	"github.com/dedis/onet/log"
 	"github.com/dedis/onet/simul/monitor"
 	"bls-ftcosi/pbft/protocol"
-	"bls-ftcosi/cothority/protocols/byzcoin/blockchain"
+	"bls-ftcosi/blocks"
 	"bls-ftcosi/cothority/protocols/byzcoin/blockchain/blkparser"
 )
 
@@ -40,9 +39,35 @@ func init() {
 // SimulationProtocol implements onet.Simulation.
 type SimulationProtocol struct {
 	onet.SimulationBFTree
+	// Config selects the transactions of the blocks, see blocks.Config
+	blocks.Config
 	NNodes				int
-	FailingSubleaders	int
-	FailingLeafs		int
+	// Crashed replicas drop all their messages, Byzantine ones send
+	// conflicting digests ("digest") or invalid signatures ("signature")
+	// depending on ByzantineFault, and Slow ones process every message
+	// SlowDelay milliseconds late.
+	Crashed				int
+	// CrashPrimary crashes the primary of the first view, the root, as a
+	// replica, so that the rounds go through a view change. The root still
+	// submits the requests as the client.
+	CrashPrimary		bool
+	Byzantine			int
+	ByzantineFault		string
+	Slow				int
+	SlowDelay			int
+	// MACs authenticates the commits and the replies with MACs instead
+	// of signatures
+	MACs				bool
+	// Linear collects the prepares and the commits at the primary, which
+	// broadcasts their BLS aggregate. The suite must be bn256.g2.
+	Linear				bool
+	// Requests is the number of transactions submitted in every round. If
+	// it is 0, every round orders a single block.
+	Requests			int
+	// BatchSize and BatchTimeout, in milliseconds, configure the batches
+	// of the primary
+	BatchSize			int
+	BatchTimeout		int
 }
 
 // NewSimulationProtocol is used internally to register the simulation (see the init()
@@ -56,14 +81,12 @@ func NewSimulationProtocol(config string) (onet.Simulation, error) {
 	return es, nil
 }
 
-var magicNum = [4]byte{0xF9, 0xBE, 0xB4, 0xD9}
-var blocksPath = "/users/csbenz/blocks" // "/home/christo/.bitcoin/blocks"
-const ReadFirstNBlocks = 66000
-var wantednTxs = 10000
-
 // Setup implements onet.Simulation.
 func (s *SimulationProtocol) Setup(dir string, hosts []string) (
 	*onet.SimulationConfig, error) {
+	if err := s.checkFaults(); err != nil {
+		return nil, err
+	}
 	sc := &onet.SimulationConfig{}
 	s.CreateRoster(sc, hosts, 2000)
 	err := s.CreateTree(sc)
@@ -73,32 +96,6 @@ func (s *SimulationProtocol) Setup(dir string, hosts []string) (
 	return sc, nil
 }
 
-func loadBlocks() ([]blkparser.Tx, error) {
-	// Initialize blockchain parser
-	parser, err := blockchain.NewParser(blocksPath, magicNum)
-	_ = parser
-	if err != nil {
-		return nil, err
-	}
-
-	transactions, err := parser.Parse(0, ReadFirstNBlocks)
-	if len(transactions) == 0 {
-		return nil, errors.New("Couldn't read any transactions.")
-	}
-	if err != nil {
-		log.Error("Error: Couldn't parse blocks in", blocksPath,
-			".\nPlease download bitcoin blocks as .dat files first and place them in",
-			blocksPath, "Either run a bitcoin node (recommended) or using a torrent.")
-		return nil, err
-	}
-	log.Lvl1("Got", len(transactions), "transactions")
-	if len(transactions) < wantednTxs {
-		log.Errorf("Read only %v but wanted %v", len(transactions), wantednTxs)
-	}
-
-	return transactions, nil
-}
-
 // Node can be used to initialize each node before it will be run
 // by the server. Here we call the 'Node'-method of the
 // SimulationBFTree structure which will load the roster- and the
@@ -108,6 +105,9 @@ func (s *SimulationProtocol) Node(config *onet.SimulationConfig) error {
 	if index < 0 {
 		log.Fatal("Didn't find this node in roster")
 	}
+	if err := s.injectFaults(config, index); err != nil {
+		return err
+	}
 	log.Lvl3("Initializing node-index", index)
 	return s.SimulationBFTree.Node(config)
 }
@@ -119,14 +119,14 @@ var defaultTimeout = 120 * time.Second
 func (s *SimulationProtocol) Run(config *onet.SimulationConfig) error {
 	log.SetDebugVisible(1)
 
-	transactions, err := loadBlocks()
+	transactions, err := s.Load()
 	if err != nil {
 		return err
 	}
 
 	log.Lvl1("Run got", len(transactions), "transactions")
 	
-	block, err := GetBlock(3000, transactions, "0", "0", 0)
+	block, err := blocks.GetBlock(3000, transactions, "0", "0", 0)
 	if err != nil {
 		return err
 	}
@@ -142,15 +142,38 @@ func (s *SimulationProtocol) Run(config *onet.SimulationConfig) error {
 	for round := 0; round < s.Rounds; round++ {
 		log.Lvl1("Starting round", round)
 		fullRound := monitor.NewTimeMeasure("fullRound")
+		// to plot the latency as a function of the faulty replicas
+		monitor.RecordSingleMeasure("faulty", float64(s.faulty()))
 
-		pi, err := config.Overlay.CreateProtocol(protocol.DefaultProtocolName, config.Tree, onet.NilServiceID)
+		protocolName := protocol.DefaultProtocolName
+		if s.MACs {
+			protocolName = protocol.MACProtocolName
+		}
+		if s.Linear {
+			protocolName = protocol.LinearProtocolName
+		}
+		pi, err := config.Overlay.CreateProtocol(simulationProtocols[protocolName], config.Tree, onet.NilServiceID)
 		if err != nil {
 			return err
 		}
 
 		pbftPprotocol := pi.(*protocol.PbftProtocol)
-		pbftPprotocol.Msg = binaryBlock
 		pbftPprotocol.Timeout = defaultTimeout
+		if s.BatchSize > 0 {
+			pbftPprotocol.BatchSize = s.BatchSize
+		}
+		if s.BatchTimeout > 0 {
+			pbftPprotocol.BatchTimeout = time.Duration(s.BatchTimeout) * time.Millisecond
+		}
+		if s.Requests > 0 {
+			err = runRequests(pbftPprotocol, transactions, s.Requests)
+			if err != nil {
+				return err
+			}
+			fullRound.Record()
+			continue
+		}
+		pbftPprotocol.Msg = binaryBlock
 
 		err = pbftPprotocol.Start()
 		if err != nil {
@@ -163,6 +186,8 @@ func (s *SimulationProtocol) Run(config *onet.SimulationConfig) error {
 			_ = finalReply
 		case <-time.After(defaultTimeout * 2):
 			fmt.Errorf("Leader never got enough final replies, timed out")
+			// don't leave the replicas running into the next round
+			pbftPprotocol.Stop()
 		}
 
 		fullRound.Record()
@@ -171,14 +196,32 @@ func (s *SimulationProtocol) Run(config *onet.SimulationConfig) error {
 }
 
 
-// GetBlock returns the next block available from the transaction pool.
-func GetBlock(size int, transactions []blkparser.Tx, lastBlock string, lastKeyBlock string, priority int) (*blockchain.TrBlock, error) {
-	if len(transactions) < 1 {
-		return nil, errors.New("no transaction available")
+// runRequests submits the given number of transactions to the replicas, and
+// waits for all of them to be executed before stopping the replicas.
+func runRequests(pbft *protocol.PbftProtocol, transactions []blkparser.Tx, n int) error {
+	results := make(chan *protocol.Result, n)
+	pbft.RegisterOnResult(func(r *protocol.Result) {
+		results <- r
+	})
+	if err := pbft.Start(); err != nil {
+		return err
 	}
+	defer pbft.Stop()
 
-	trlist := blockchain.NewTransactionList(transactions, size)
-	header := blockchain.NewHeader(trlist, lastBlock, lastKeyBlock)
-	trblock := blockchain.NewTrBlock(trlist, header)
-	return trblock, nil
+	for i := 0; i < n; i++ {
+		tx := transactions[i%len(transactions)]
+		if err := pbft.Submit([]byte(tx.Hash)); err != nil {
+			return err
+		}
+	}
+	timeout := time.After(defaultTimeout * 2)
+	for i := 0; i < n; i++ {
+		select {
+		case <-results:
+		case <-timeout:
+			return fmt.Errorf("only %d of the %d transactions executed, timed out", i, n)
+		}
+	}
+	log.Lvl1("Leader got the replies of", n, "transactions")
+	return nil
 }